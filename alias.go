@@ -0,0 +1,121 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Alias files define abbreviations for commands. Each line has the form
+//
+//	name = command[; command...]
+//
+// e.g. "n = go north" or "coins = take red coin; take blue coin". When the
+// first word of an input line is an alias, the line is replaced by the
+// alias's commands, with any remaining words appended to the last command.
+// Input lines starting with literalPrefix are sent without expansion.
+// Blank lines and lines starting with '#' are ignored.
+
+// aliasMap maps alias names to the commands that they expand to.
+type aliasMap map[string][]string
+
+// readAliases reads an alias file from r.
+func readAliases(r io.Reader) (aliasMap, error) {
+	m := make(aliasMap)
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		if err := m.define(s); err != nil {
+			return nil, fmt.Errorf("line %d: %v", ln, err)
+		}
+	}
+	return m, sc.Err()
+}
+
+// readAliasFile is a wrapper around readAliases that reads the named file.
+// An empty map is returned if the file doesn't exist.
+func readAliasFile(p string) (aliasMap, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return make(aliasMap), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readAliases(f)
+}
+
+// defaultAliasPath returns the default location of the alias file.
+func defaultAliasPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "synacor-challenge", "aliases"), nil
+}
+
+// define adds or replaces an alias using a definition like "n = go north".
+func (m aliasMap) define(def string) error {
+	parts := strings.SplitN(def, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad alias %q", def)
+	}
+	name := strings.TrimSpace(parts[0])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("bad alias name %q", name)
+	}
+	var cmds []string
+	for _, c := range strings.Split(parts[1], ";") {
+		if c = strings.TrimSpace(c); c != "" {
+			cmds = append(cmds, c)
+		}
+	}
+	if len(cmds) == 0 {
+		return fmt.Errorf("empty alias %q", name)
+	}
+	m[name] = cmds
+	return nil
+}
+
+// expand returns the lines that ln (ending in a newline) expands to.
+// If ln doesn't start with an alias, it's returned unchanged.
+func (m aliasMap) expand(ln string) []string {
+	fields := strings.Fields(ln)
+	if len(fields) == 0 {
+		return []string{ln}
+	}
+	cmds, ok := m[fields[0]]
+	if !ok {
+		return []string{ln}
+	}
+	lines := make([]string, len(cmds))
+	for i, c := range cmds {
+		if i == len(cmds)-1 && len(fields) > 1 {
+			c += " " + strings.Join(fields[1:], " ")
+		}
+		lines[i] = c + "\n"
+	}
+	return lines
+}
+
+// write lists the aliases in m to w.
+func (m aliasMap) write(w io.Writer) {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s = %s\n", n, strings.Join(m[n], "; "))
+	}
+}
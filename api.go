@@ -0,0 +1,812 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiHelp = `REST API (responses other than snapshots are JSON):
+  GET    /api/sessions               list WebSocket and API sessions
+  POST   /api/sessions               create session (body: optional snapshot; ?save=x for user's save)
+  GET    /api/sessions/<id>          get state ("running", "input", "paused", or "halted")
+  DELETE /api/sessions/<id>          halt program and delete session
+  POST   /api/sessions/<id>/input    send body to program
+  GET    /api/sessions/<id>/output   read and clear buffered output (?wait=1s to wait for input)
+  GET    /api/sessions/<id>/regs     get registers, stack, ip, and instruction count
+  GET    /api/sessions/<id>/mem      get memory words (?addr=0&n=16)
+  POST   /api/sessions/<id>/step     execute instructions and pause (?n=1)
+  POST   /api/sessions/<id>/continue resume paused program
+  GET    /api/sessions/<id>/breaks   list breakpoints
+  POST   /api/sessions/<id>/breaks   add breakpoint (?addr=x)
+  DELETE /api/sessions/<id>/breaks   delete breakpoint (?addr=x)
+  GET    /api/sessions/<id>/snapshot download state (?format=gob, json, or text)
+  GET    /api/sessions/<id>/saves    list states saved in memory
+  POST   /api/sessions/<id>/saves    save state in memory (?name=x)
+  DELETE /api/sessions/<id>/saves    delete saved state (?name=x)
+  POST   /api/sessions/<id>/load     load saved state (?name=x)
+  GET    /api/user/saves             list the user's saved states and quota
+  GET    /api/user/saves/<name>      download user's saved state
+  PUT    /api/user/saves/<name>      upload user's saved state (body: snapshot)
+  POST   /api/user/saves/<name>      save state of user's session (?session=id)
+  DELETE /api/user/saves/<name>      delete user's saved state
+
+Users are identified by "Authorization: Bearer <token>" headers or "token"
+query parameters, which are required under /api/sessions. Any token is
+accepted unless -user-tokens is passed. Users can only see and control
+their own sessions. With -user-saves, WebSocket connections to /ws with a
+token resume from the user's "autosave" state (or ?save=x), which is
+updated when they disconnect.
+`
+
+const (
+	apiStopTimeout = time.Second // default time to wait for the program to stop
+	apiMaxOutput   = 1 << 20     // maximum buffered output per session
+	apiMaxMemWords = 1 << 12     // maximum words returned by mem
+	apiMaxBody     = 1 << 20     // maximum bytes in uploaded snapshots
+)
+
+// apiMethods lists the methods accepted for each session operation.
+var apiMethods = map[string][]string{
+	"":         {http.MethodGet, http.MethodDelete},
+	"input":    {http.MethodPost},
+	"output":   {http.MethodGet},
+	"regs":     {http.MethodGet},
+	"mem":      {http.MethodGet},
+	"step":     {http.MethodPost},
+	"continue": {http.MethodPost},
+	"breaks":   {http.MethodGet, http.MethodPost, http.MethodDelete},
+	"snapshot": {http.MethodGet},
+	"saves":    {http.MethodGet, http.MethodPost, http.MethodDelete},
+	"load":     {http.MethodPost},
+}
+
+// serveAPI serves the REST API for controlling VMs at paths under "/api/".
+func (srv *server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/"), "/")
+	if parts[0] == "user" {
+		srv.serveUserSaves(w, r, parts[1:])
+		return
+	}
+	if parts[0] != "sessions" || len(parts) > 3 {
+		if r.URL.Path == "/api/" || r.URL.Path == "/api" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, apiHelp)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	user, err := srv.user(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			srv.list(w, user)
+		case http.MethodPost:
+			srv.create(w, r, user)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// Other users' sessions are reported as missing so their IDs can't be probed.
+	ss := srv.get(parts[1])
+	if ss == nil || ss.user != user {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	var op string
+	if len(parts) == 3 {
+		op = parts[2]
+	}
+	methods, ok := apiMethods[op]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !containsString(methods, r.Method) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if op == "" && r.Method == http.MethodDelete {
+		srv.remove(ss, "deleted")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if ss.api == nil {
+		http.Error(w, "Not an API session", http.StatusBadRequest)
+		return
+	}
+	if err := ss.api.handle(w, r, op); err != nil {
+		code := http.StatusBadRequest
+		switch err {
+		case errRunning:
+			code = http.StatusConflict
+		case errSaveMem:
+			code = http.StatusInsufficientStorage
+		}
+		http.Error(w, err.Error(), code)
+	}
+}
+
+// apiSessionInfo describes a session in the list returned by the API.
+type apiSessionInfo struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"` // "ws" or "api"
+	Remote  string    `json:"remote"`
+	Created time.Time `json:"created"`
+	Active  time.Time `json:"active"` // time of last activity
+	Halted  bool      `json:"halted"`
+	User    string    `json:"user,omitempty"`
+}
+
+// list handles a request from user to list their sessions.
+func (srv *server) list(w http.ResponseWriter, user string) {
+	writeJSON(w, srv.sessionInfos(user))
+}
+
+// sessionInfos describes user's sessions, oldest first.
+func (srv *server) sessionInfos(user string) []apiSessionInfo {
+	srv.mu.Lock()
+	infos := make([]apiSessionInfo, 0)
+	for _, ss := range srv.sessions {
+		if ss.user != user {
+			continue
+		}
+		infos = append(infos, ss.info())
+	}
+	srv.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+	return infos
+}
+
+// info describes ss. The server's mu must be held.
+func (ss *serverSession) info() apiSessionInfo {
+	return apiSessionInfo{
+		ID:      ss.id,
+		Type:    ss.kind,
+		Remote:  ss.remote,
+		Created: ss.created,
+		Active:  ss.used,
+		Halted:  isClosed(ss.vm.stopped),
+		User:    ss.user,
+	}
+}
+
+// snapshotStatus returns the HTTP status code for an error returned by
+// readSnapshot when reading an uploaded snapshot.
+func snapshotStatus(err error) int {
+	if err == errSnapshotTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// create handles a request from user to create a new session.
+// The request body may contain a snapshot to use instead of srv.snap,
+// or the "save" parameter may name one of the user's saves.
+func (srv *server) create(w http.ResponseWriter, r *http.Request, user string) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	vm := srv.newVM()
+	if name := r.URL.Query().Get("save"); name != "" {
+		if srv.users == nil {
+			http.Error(w, "User saves not enabled", http.StatusNotFound)
+			return
+		}
+		snap, err := srv.users.load(user, name)
+		if err != nil {
+			http.Error(w, err.Error(), userSaveStatus(err))
+			return
+		}
+		vm.restore(snap)
+	} else if len(body) > 0 {
+		snap, err := readSnapshot(bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, "Bad snapshot: "+err.Error(), snapshotStatus(err))
+			return
+		}
+		vm.restore(snap)
+	}
+	ss, err := srv.addAPISession(vm, r.RemoteAddr, user)
+	if err == errTooManySessions {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/sessions/"+ss.id)
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, struct {
+		ID string `json:"id"`
+	}{ss.id})
+}
+
+// addAPISession starts vm in a new API session for user, who connected
+// from remote. errTooManySessions is returned if srv.maxSessions is reached.
+func (srv *server) addAPISession(vm *vm, remote, user string) (*serverSession, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	ss := &serverSession{
+		id:     id,
+		kind:   "api",
+		remote: remote,
+		vm:     vm,
+		user:   user,
+		api:    newAPISession(id, vm, srv.saveMem),
+		end:    vm.halt,
+	}
+	if err := srv.add(ss); err != nil {
+		vm.halt()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// serveUserSaves serves the API for users' saves at "/api/user/".
+// parts contains the path's remaining components.
+func (srv *server) serveUserSaves(w http.ResponseWriter, r *http.Request, parts []string) {
+	if srv.users == nil {
+		http.Error(w, "User saves not enabled", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 0 || parts[0] != "saves" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	user, err := srv.users.user(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		infos, err := srv.users.list(user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var used int64
+		for _, info := range infos {
+			used += info.Bytes
+		}
+		writeJSON(w, struct {
+			Quota int64          `json:"quota"`
+			Used  int64          `json:"used"`
+			Saves []userSaveInfo `json:"saves"`
+		}{srv.users.quota, used, infos})
+		return
+	}
+
+	name := parts[1]
+	switch r.Method {
+	case http.MethodGet:
+		b, err := srv.users.read(user, name)
+		if err != nil {
+			http.Error(w, err.Error(), userSaveStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	case http.MethodPut, http.MethodPost:
+		var snap *snapshot
+		if r.Method == http.MethodPut {
+			if snap, err = readSnapshot(http.MaxBytesReader(w, r.Body, apiMaxBody)); err != nil {
+				http.Error(w, "Bad snapshot: "+err.Error(), snapshotStatus(err))
+				return
+			}
+		} else {
+			ss := srv.get(r.URL.Query().Get("session"))
+			if ss == nil || ss.user != user {
+				http.Error(w, "No such session", http.StatusNotFound)
+				return
+			}
+			if snap, err = ss.snapshot(apiStopTimeout); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		if err := srv.users.save(user, name, snap); err != nil {
+			http.Error(w, err.Error(), userSaveStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := srv.users.remove(user, name); err != nil {
+			http.Error(w, err.Error(), userSaveStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// userSaveStatus returns the HTTP status code for an error from userStore.
+func userSaveStatus(err error) int {
+	switch err {
+	case errNoSave:
+		return http.StatusNotFound
+	case errUserQuota:
+		return http.StatusInsufficientStorage
+	case errBadSaveName:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// errRunning is returned when an operation requires the program to stop.
+var errRunning = errors.New("program is running")
+
+// apiSession is a VM controlled through the REST API. A debugger is attached
+// (without output) so the program can be paused and stepped.
+type apiSession struct {
+	id    string
+	vm    *vm
+	dbg   *debugger
+	ctlMu sync.Mutex // serializes requests
+
+	mu      sync.Mutex
+	outCond *sync.Cond // signaled when nout changes or output ends
+	out     []byte     // output not yet read, guarded by mu
+	nout    uint64     // number of output bytes received, guarded by mu
+	outDone bool       // true when the program has stopped, guarded by mu
+
+	waited chan struct{} // closed after err is set
+	err    error         // error returned by vm.wait
+
+	saves     map[string]*snapshot // states saved in memory, guarded by ctlMu
+	saveBytes int                  // approximate size of saves, guarded by ctlMu
+	maxSave   int                  // maximum saveBytes
+}
+
+// newAPISession attaches a debugger to vm (unless it already has one) and
+// starts it. Up to maxSave bytes of states may be saved in memory.
+func newAPISession(id string, vm *vm, maxSave int) *apiSession {
+	if vm.dbg == nil {
+		newDebugger(vm, ioutil.Discard, false)
+	}
+	s := &apiSession{
+		id:      id,
+		vm:      vm,
+		dbg:     vm.dbg,
+		waited:  make(chan struct{}),
+		saves:   make(map[string]*snapshot),
+		maxSave: maxSave,
+	}
+	s.outCond = sync.NewCond(&s.mu)
+	vm.output = func(p []byte) {
+		s.mu.Lock()
+		s.out = append(s.out, p...)
+		if len(s.out) > apiMaxOutput {
+			s.out = s.out[len(s.out)-apiMaxOutput:]
+		}
+		s.nout += uint64(len(p))
+		s.outCond.Broadcast()
+		s.mu.Unlock()
+	}
+	vm.start()
+	go func() {
+		s.err = vm.wait()
+		s.mu.Lock()
+		s.outDone = true
+		s.outCond.Broadcast()
+		s.mu.Unlock()
+		close(s.waited)
+	}()
+	return s
+}
+
+// do runs f on the VM's goroutine the next time that the program waits for
+// input or is paused by the debugger. If the program has halted, f is run
+// immediately. False is returned if timeout elapses first.
+func (s *apiSession) do(f func(), timeout time.Duration) bool {
+	fin := make(chan struct{})
+	g := func() { f(); close(fin) }
+	// Check without the timer first so a zero timeout doesn't race with a
+	// stopped program.
+	select {
+	case s.vm.ctl <- g:
+	case s.dbg.ctl <- g:
+	case <-s.vm.stopped:
+		f() // the state won't change anymore
+		return true
+	default:
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case s.vm.ctl <- g:
+		case s.dbg.ctl <- g:
+		case <-s.vm.stopped:
+			f()
+			return true
+		case <-t.C:
+			return false
+		}
+	}
+	<-fin
+	return true
+}
+
+// apiState describes a session's state.
+type apiState struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`            // "running", "input", "paused", or "halted"
+	Reason string `json:"reason,omitempty"` // why the program halted
+	Error  string `json:"error,omitempty"`  // run-time error
+	Steps  uint64 `json:"steps"`            // instructions executed, if not running
+	Output int    `json:"output"`           // bytes of buffered output
+}
+
+// state waits up to timeout for the program to stop and returns its state.
+// If the program stopped, it also waits for its output to be buffered.
+func (s *apiSession) state(timeout time.Duration) apiState {
+	st := apiState{ID: s.id, State: "running"}
+	var nout uint64
+	s.do(func() {
+		switch {
+		case isClosed(s.vm.stopped):
+			st.State, st.Reason = "halted", s.vm.reason.String()
+		case s.dbg.paused():
+			st.State = "paused"
+		default:
+			st.State = "input"
+		}
+		st.Steps, nout = s.vm.steps, s.vm.nout
+	}, timeout)
+
+	if st.State == "halted" {
+		<-s.waited
+		if s.err != nil {
+			st.Error = s.err.Error()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.State != "running" {
+		for s.nout < nout && !s.outDone {
+			s.outCond.Wait()
+		}
+	}
+	st.Output = len(s.out)
+	return st
+}
+
+// handle handles the operation op.
+func (s *apiSession) handle(w http.ResponseWriter, r *http.Request, op string) error {
+	s.ctlMu.Lock()
+	defer s.ctlMu.Unlock()
+
+	q := r.URL.Query()
+	wait := apiStopTimeout
+	if v := q.Get("wait"); v != "" {
+		var err error
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			return fmt.Errorf("bad wait %q", v)
+		}
+	}
+	// intArg parses the query parameter name, returning def if it's missing.
+	intArg := func(name string, def, max int) (int, error) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > max {
+			return 0, fmt.Errorf("bad %s %q", name, v)
+		}
+		return n, nil
+	}
+
+	switch op {
+	case "":
+		writeJSON(w, s.state(wait))
+	case "input":
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err != nil {
+			return err
+		}
+		writeJSON(w, struct {
+			Pending int `json:"pending"`
+		}{s.vm.in.write(b)})
+	case "output":
+		if q.Get("wait") == "" {
+			wait = 0
+		}
+		st := s.state(wait)
+		s.mu.Lock()
+		out := string(s.out)
+		s.out = nil
+		s.mu.Unlock()
+		st.Output = 0
+		writeJSON(w, struct {
+			apiState
+			Text string `json:"text"`
+		}{st, out})
+	case "regs":
+		regs, err := s.regs(wait)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, regs)
+	case "mem":
+		addr, err := intArg("addr", 0, vmax)
+		if err != nil {
+			return err
+		}
+		n, err := intArg("n", 16, apiMaxMemWords)
+		if err != nil {
+			return err
+		}
+		words, err := s.mem(addr, n, wait)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, struct {
+			Addr  int      `json:"addr"`
+			Words []uint16 `json:"words"`
+		}{addr, words})
+	case "step":
+		n, err := intArg("n", 1, 1<<30)
+		if err != nil || n == 0 {
+			return fmt.Errorf("bad n %q", q.Get("n"))
+		}
+		if err := s.step(n, wait); err != nil {
+			return err
+		}
+		writeJSON(w, s.state(wait))
+	case "continue":
+		s.cont()
+		writeJSON(w, s.state(0))
+	case "breaks":
+		var addr int
+		if r.Method != http.MethodGet {
+			if q.Get("addr") == "" {
+				return errors.New("missing addr")
+			}
+			var err error
+			if addr, err = intArg("addr", 0, vmax); err != nil {
+				return err
+			}
+		}
+		addrs, err := s.breaks(addr, r.Method == http.MethodPost, r.Method == http.MethodDelete, wait)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, addrs)
+	case "saves":
+		if r.Method == http.MethodGet {
+			writeJSON(w, s.saveInfos())
+			return nil
+		}
+		if err := s.save(q.Get("name"), r.Method == http.MethodDelete, wait); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "load":
+		if err := s.load(q.Get("name"), wait); err != nil {
+			return err
+		}
+		writeJSON(w, s.state(wait))
+	case "snapshot":
+		enc := gobSnapshot
+		switch f := q.Get("format"); f {
+		case "", "gob":
+		case "json":
+			enc = jsonSnapshot
+		case "text":
+			enc = textSnapshot
+		default:
+			return fmt.Errorf("bad format %q", f)
+		}
+		snap, err := s.snapshot(wait)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err := writeSnapshot(&b, snap, enc); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b.Bytes())
+	}
+	return nil
+}
+
+// apiRegs describes the VM's registers.
+type apiRegs struct {
+	Reg   [nregs]uint16 `json:"reg"`
+	Stack []uint16      `json:"stack"`
+	IP    uint16        `json:"ip"`
+	Steps uint64        `json:"steps"`
+}
+
+// The following methods wait up to the supplied timeout for the program to
+// stop and return errRunning if it doesn't. Callers should hold ctlMu.
+
+// regs returns the VM's registers.
+func (s *apiSession) regs(wait time.Duration) (apiRegs, error) {
+	var regs apiRegs
+	if !s.do(func() {
+		regs.Reg, regs.IP, regs.Steps = s.vm.reg, s.vm.ip, s.vm.steps
+		regs.Stack = append([]uint16{}, s.vm.stack...)
+	}, wait) {
+		return regs, errRunning
+	}
+	return regs, nil
+}
+
+// mem returns up to n words of memory starting at addr.
+func (s *apiSession) mem(addr, n int, wait time.Duration) ([]uint16, error) {
+	if addr+n > msize {
+		n = msize - addr
+	}
+	words := make([]uint16, n)
+	if !s.do(func() { copy(words, s.vm.mem[addr:]) }, wait) {
+		return nil, errRunning
+	}
+	return words, nil
+}
+
+// step executes n instructions and pauses.
+func (s *apiSession) step(n int, wait time.Duration) error {
+	if s.dbg.paused() {
+		s.dbg.feed(fmt.Sprintf("step %d", n))
+	} else if !s.do(func() {
+		// The "in" instruction at ip hasn't been checked for
+		// pausing yet, so it counts against the steps.
+		s.dbg.steps = n + 1
+	}, wait) {
+		return errRunning
+	}
+	return nil
+}
+
+// cont resumes the program if it's paused.
+func (s *apiSession) cont() { s.dbg.feed("continue") }
+
+// breaks adds a breakpoint at addr if add is true or deletes it if del is
+// true, and then returns the sorted addresses of all breakpoints.
+func (s *apiSession) breaks(addr int, add, del bool, wait time.Duration) ([]int, error) {
+	addrs := make([]int, 0)
+	if !s.do(func() {
+		if add {
+			s.dbg.breaks[uint16(addr)] = struct{}{}
+		} else if del {
+			delete(s.dbg.breaks, uint16(addr))
+		}
+		for a := range s.dbg.breaks {
+			addrs = append(addrs, int(a))
+		}
+	}, wait) {
+		return nil, errRunning
+	}
+	sort.Ints(addrs)
+	return addrs, nil
+}
+
+// snapshot returns the VM's state.
+func (s *apiSession) snapshot(wait time.Duration) (*snapshot, error) {
+	var snap *snapshot
+	if !s.do(func() { snap = s.vm.snapshot() }, wait) {
+		return nil, errRunning
+	}
+	return snap, nil
+}
+
+// restore restores the VM's state from snap.
+func (s *apiSession) restore(snap *snapshot, wait time.Duration) error {
+	if !s.do(func() { s.vm.restore(snap) }, wait) {
+		return errRunning
+	}
+	return nil
+}
+
+// apiSaveInfo describes a state saved in a session's memory.
+type apiSaveInfo struct {
+	Name  string `json:"name"`
+	Bytes int    `json:"bytes"`
+	Steps uint64 `json:"steps"`
+}
+
+// saveInfos describes the states saved in memory, sorted by name.
+func (s *apiSession) saveInfos() []apiSaveInfo {
+	infos := make([]apiSaveInfo, 0, len(s.saves))
+	for name, snap := range s.saves {
+		infos = append(infos, apiSaveInfo{name, snapshotBytes(snap), snap.Meta.Steps})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// save saves the VM's state in memory as name, or deletes the saved
+// state if del is true.
+func (s *apiSession) save(name string, del bool, wait time.Duration) error {
+	if name == "" {
+		return errors.New("missing name")
+	}
+	var snap *snapshot
+	if !del {
+		var err error
+		if snap, err = s.snapshot(wait); err != nil {
+			return err
+		}
+	}
+	old, ok := s.saves[name]
+	if !ok && snap == nil {
+		return fmt.Errorf("no save %q", name)
+	}
+	n := s.saveBytes
+	if ok {
+		n -= snapshotBytes(old)
+	}
+	if snap != nil {
+		if n += snapshotBytes(snap); n > s.maxSave {
+			return errSaveMem
+		}
+		s.saves[name] = snap
+	} else {
+		delete(s.saves, name)
+	}
+	s.saveBytes = n
+	return nil
+}
+
+// load restores the state saved in memory as name.
+func (s *apiSession) load(name string, wait time.Duration) error {
+	snap, ok := s.saves[name]
+	if !ok {
+		return fmt.Errorf("no save %q", name)
+	}
+	return s.restore(snap, wait)
+}
+
+// errSaveMem is returned when saving a state would exceed the session's limit.
+var errSaveMem = errors.New("not enough memory for saved state")
+
+// snapshotBytes returns the approximate number of bytes of memory used by snap.
+func snapshotBytes(snap *snapshot) int {
+	return 2 * (len(snap.Mem) + len(snap.Stack))
+}
+
+// isClosed returns true if ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
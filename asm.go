@@ -0,0 +1,282 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// assemble assembles source code read from r and returns the resulting words.
+//
+// Each line contains an optional label followed by a colon, and then an
+// optional instruction or directive, with comments starting with ';'.
+// Operands are separated by whitespace or commas and may be decimal or
+// "0x"-prefixed hexadecimal numbers, registers ("r0" through "r7"),
+// character literals ('a' or '\n'), or labels. Numeric labels (as printed by
+// the disassembler) set the current address, padding with zeros if needed.
+//
+// The "data" directive emits its operands directly, and "str" emits a quoted
+// string with one character per word.
+//
+// If listing is non-nil, a listing of addresses, encoded words, and source
+// lines followed by a symbol table is written to it.
+func assemble(r io.Reader, listing io.Writer) ([]uint16, error) {
+	type item struct {
+		line int
+		addr int
+		name string   // mnemonic or directive
+		args []string // unparsed operands
+		pad  bool     // padding inserted by a numeric label
+	}
+	var items []item
+	var src []string // source lines
+	labels := make(map[string]uint16)
+	names := make(map[string]uint16)
+	for op, info := range ops {
+		names[info.name] = uint16(op)
+	}
+
+	// First pass: assign addresses to labels.
+	var addr int
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		src = append(src, sc.Text())
+		s := stripComment(sc.Text())
+		for {
+			i := strings.IndexByte(s, ':')
+			if i < 0 || strings.ContainsAny(s[:i], " \t'\"") {
+				break
+			}
+			label := strings.TrimSpace(s[:i])
+			s = strings.TrimSpace(s[i+1:])
+			if n, err := strconv.ParseUint(label, 0, 16); err == nil {
+				if int(n) < addr {
+					return nil, fmt.Errorf("line %d: address %d precedes current address %d", ln, n, addr)
+				}
+				items = append(items, item{ln, addr, "data", make([]string, int(n)-addr), true})
+				for i := range items[len(items)-1].args {
+					items[len(items)-1].args[i] = "0"
+				}
+				addr = int(n)
+				continue
+			}
+			if !validLabel(label) {
+				return nil, fmt.Errorf("line %d: invalid label %q", ln, label)
+			} else if _, ok := labels[label]; ok {
+				return nil, fmt.Errorf("line %d: duplicate label %q", ln, label)
+			}
+			labels[label] = uint16(addr)
+		}
+		if s == "" {
+			continue
+		}
+
+		name, rest := s, ""
+		if i := strings.IndexAny(s, " \t"); i >= 0 {
+			name, rest = s[:i], strings.TrimSpace(s[i+1:])
+		}
+		it := item{line: ln, addr: addr, name: strings.ToLower(name)}
+		switch it.name {
+		case "str":
+			str, err := strconv.Unquote(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad string %s", ln, rest)
+			}
+			it.name = "data"
+			for _, ch := range str {
+				it.args = append(it.args, strconv.Itoa(int(ch)))
+			}
+		default:
+			var err error
+			if it.args, err = splitOperands(rest); err != nil {
+				return nil, fmt.Errorf("line %d: %v", ln, err)
+			}
+			if it.name != "data" {
+				op, ok := names[it.name]
+				if !ok {
+					return nil, fmt.Errorf("line %d: unknown instruction %q", ln, it.name)
+				} else if len(it.args) != ops[op].nargs {
+					return nil, fmt.Errorf("line %d: %s takes %d operand(s)", ln, it.name, ops[op].nargs)
+				}
+				addr++
+			}
+		}
+		addr += len(it.args)
+		if addr > msize {
+			return nil, fmt.Errorf("line %d: program too large", ln)
+		}
+		items = append(items, it)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	// Second pass: emit words.
+	words := make([]uint16, 0, addr)
+	itemWords := make([][]uint16, len(items))
+	for i, it := range items {
+		start := len(words)
+		if it.name != "data" {
+			words = append(words, names[it.name])
+		}
+		for _, a := range it.args {
+			v, err := parseOperand(a, labels)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", it.line, err)
+			}
+			words = append(words, v)
+		}
+		itemWords[i] = words[start:]
+	}
+	if listing == nil {
+		return words, nil
+	}
+
+	// Write the listing, with the words emitted for each source line.
+	var b strings.Builder
+	next := 0 // index into items
+	for i, s := range src {
+		ln := i + 1
+		addr := -1
+		var lw []uint16
+		for ; next < len(items) && items[next].line == ln; next++ {
+			if it := items[next]; !it.pad {
+				addr = it.addr
+				lw = append(lw, itemWords[next]...)
+			}
+		}
+		writeListingLine(&b, addr, lw, ln, s)
+	}
+	if len(labels) > 0 {
+		b.WriteString("\nSymbols:\n")
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			ai, aj := labels[names[i]], labels[names[j]]
+			return ai < aj || (ai == aj && names[i] < names[j])
+		})
+		for _, name := range names {
+			fmt.Fprintf(&b, "%5d  %s\n", labels[name], name)
+		}
+	}
+	if _, err := io.WriteString(listing, b.String()); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
+
+// listingWords is the maximum number of words written on each listing line.
+const listingWords = 4
+
+// writeListingLine writes a listing line for source line number ln
+// containing s, which was assembled to words at addr (-1 if none).
+// Words that don't fit are written to continuation lines.
+func writeListingLine(b *strings.Builder, addr int, words []uint16, ln int, s string) {
+	for i := 0; i == 0 || i < len(words); i += listingWords {
+		var as, ws string
+		if addr >= 0 {
+			as = fmt.Sprintf("%5d:", addr+i)
+		}
+		end := i + listingWords
+		if end > len(words) {
+			end = len(words)
+		}
+		for _, w := range words[i:end] {
+			ws += fmt.Sprintf(" %5d", w)
+		}
+		if i == 0 {
+			fmt.Fprintf(b, "%-6s%-24s %5d  %s\n", as, ws, ln, s)
+		} else {
+			fmt.Fprintf(b, "%-6s%s\n", as, ws)
+		}
+	}
+}
+
+// stripComment removes a trailing ';' comment (outside of quotes) from s and trims whitespace.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == 0 && c == ';':
+			return strings.TrimSpace(s[:i])
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// splitOperands splits s on whitespace and commas, keeping character literals intact.
+func splitOperands(s string) ([]string, error) {
+	var args []string
+	for s = strings.TrimLeft(s, " \t,"); s != ""; s = strings.TrimLeft(s, " \t,") {
+		end := strings.IndexAny(s, " \t,")
+		if s[0] == '\'' {
+			end = -1
+			for i := 1; i < len(s); i++ {
+				if s[i] == '\\' {
+					i++
+				} else if s[i] == '\'' {
+					end = i + 1
+					break
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character literal %s", s)
+			}
+		}
+		if end < 0 {
+			end = len(s)
+		}
+		args = append(args, s[:end])
+		s = s[end:]
+	}
+	return args, nil
+}
+
+// parseOperand parses an assembler operand.
+func parseOperand(s string, labels map[string]uint16) (uint16, error) {
+	if strings.HasPrefix(s, "'") {
+		v, _, tail, err := strconv.UnquoteChar(s[1:len(s)-1], '\'')
+		if err != nil || tail != "" || v > vmax {
+			return 0, fmt.Errorf("bad character literal %s", s)
+		}
+		return uint16(v), nil
+	}
+	if v, ok := labels[s]; ok {
+		return v, nil
+	}
+	if validLabel(s) {
+		return 0, fmt.Errorf("undefined label %q", s)
+	}
+	return parseWord(s)
+}
+
+// validLabel returns true if s can be used as a label.
+// Numbers and register names are not valid labels.
+func validLabel(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	if len(s) == 2 && s[0] == 'r' && s[1] >= '0' && s[1] < '0'+nregs {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// batchWriter is an io.Writer that coalesces small writes (e.g. the program's
+// byte-at-a-time output) and passes them to a send function after a delay.
+type batchWriter struct {
+	send  func([]byte) error
+	delay time.Duration
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer // non-nil if a flush is scheduled
+	err   error       // first send error
+}
+
+// newBatchWriter returns a writer that passes data to send delay after
+// the first write following a flush.
+func newBatchWriter(delay time.Duration, send func([]byte) error) *batchWriter {
+	return &batchWriter{send: send, delay: delay}
+}
+
+func (w *batchWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, func() { w.flush() })
+	}
+	return len(p), nil
+}
+
+// flush sends buffered data immediately.
+func (w *batchWriter) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.buf) > 0 && w.err == nil {
+		w.err = w.send(w.buf)
+		w.buf = nil
+	}
+	return w.err
+}
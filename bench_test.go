@@ -0,0 +1,213 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchProgram is a program used to measure the interpreter's speed.
+type benchProgram struct {
+	name  string
+	src   string   // assembly source; see assemble
+	words []uint16 // used instead of src if non-nil
+}
+
+// benchPrograms are synthetic programs exercising different parts of the
+// interpreter. Each executes tens of millions of instructions.
+var benchPrograms = []benchProgram{
+	{
+		name: "arith", // tight arithmetic loop
+		src: `
+			set r7 2000
+		outer:	set r0 0
+		inner:	add r1 r1 r0
+			mult r2 r1 7
+			mod r3 r2 1000
+			and r4 r3 r1
+			or r5 r4 r2
+			not r6 r5
+			add r0 r0 1
+			eq r3 r0 1000
+			jf r3 inner
+			add r7 r7 32767
+			jt r7 outer
+			halt`,
+	},
+	{
+		name: "call", // call/ret storm
+		src: `
+			set r7 2000
+		outer:	set r0 1000
+		loop:	call fn
+			add r0 r0 32767
+			jt r0 loop
+			add r7 r7 32767
+			jt r7 outer
+			halt
+		fn:	push r0
+			call leaf
+			pop r0
+			ret
+		leaf:	add r1 r1 1
+			ret`,
+	},
+	{
+		name: "memory", // memory churn
+		src: `
+			set r7 200
+		outer:	set r0 0
+		loop:	add r1 r0 buf
+			rmem r2 r1
+			add r2 r2 r0
+			wmem r1 r2
+			add r0 r0 1
+			eq r3 r0 10000
+			jf r3 loop
+			add r7 r7 32767
+			jt r7 outer
+			halt
+		buf:	data 0`,
+	},
+	{
+		name: "output", // output flood
+		src: `
+			set r7 2000
+		outer:	set r0 1000
+		loop:	out 'x'
+			add r0 r0 32767
+			jt r0 loop
+			out '\n'
+			add r7 r7 32767
+			jt r7 outer
+			halt`,
+	},
+}
+
+// benchProg is the path of a program measured by BenchmarkProgram.
+var benchProg = flag.String("prog", "", "Program run by BenchmarkProgram until it reads input")
+
+// run runs p b.N times and reports the instructions executed per second.
+// Programs are stopped before reading input, and output is discarded.
+func (p *benchProgram) run(b *testing.B, jit bool) {
+	words := p.words
+	if words == nil {
+		var err error
+		if words, err = assemble(strings.NewReader(p.src), nil); err != nil {
+			b.Fatal("Assembling failed: ", err)
+		}
+	}
+	var steps uint64
+	var elapsed time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		vm, err := newVM(strings.NewReader(""))
+		if err != nil {
+			b.Fatal(err)
+		}
+		vm.size = copy(vm.mem[:], words)
+		vm.jit = jit
+		vm.breakIn = true
+		vm.output = func([]byte) {}
+		b.StartTimer()
+
+		start := time.Now()
+		vm.start()
+		if err := vm.wait(); err != nil {
+			b.Fatal("Program failed: ", err)
+		}
+		elapsed += time.Since(start)
+		steps += vm.steps
+	}
+	b.ReportMetric(float64(steps)/float64(b.N), "instrs/op")
+	b.ReportMetric(float64(steps)/elapsed.Seconds()/1e6, "MIPS")
+}
+
+// benchModes runs p with and without vm.jit as sub-benchmarks of b.
+func benchModes(b *testing.B, p *benchProgram) {
+	b.Run("interp", func(b *testing.B) { p.run(b, false) })
+	b.Run("jit", func(b *testing.B) { p.run(b, true) })
+}
+
+// BenchmarkSynthetic measures each of benchPrograms.
+func BenchmarkSynthetic(b *testing.B) {
+	for i := range benchPrograms {
+		p := &benchPrograms[i]
+		b.Run(p.name, func(b *testing.B) { benchModes(b, p) })
+	}
+}
+
+// BenchmarkProgram measures the program passed via -prog (e.g.
+// "go test -bench Program -prog challenge.bin") up to its first input.
+func BenchmarkProgram(b *testing.B) {
+	if *benchProg == "" {
+		b.Skip("no program supplied via -prog")
+	}
+	f, err := os.Open(*benchProg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	vm, err := newVM(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchModes(b, &benchProgram{name: filepath.Base(*benchProg), words: vm.mem[:vm.size]})
+}
+
+// loadImageWords is loadImage as it was implemented before reading the
+// whole file at once, calling binary.Read for each word.
+func loadImageWords(r io.Reader, mem []uint16) (int, error) {
+	var nr int
+	for {
+		if nr == len(mem) {
+			return nr, errors.New("program too large")
+		}
+		if err := binary.Read(r, binary.LittleEndian, &mem[nr]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nr, err
+		}
+		nr++
+	}
+	return nr, nil
+}
+
+// BenchmarkLoad compares loading a program one word at a time and all at once.
+func BenchmarkLoad(b *testing.B) {
+	// The per-word loader rejects programs that fill memory.
+	img := make([]byte, 2*(msize-1))
+	for i := range img {
+		img[i] = byte(i * 7)
+	}
+	for _, tc := range []struct {
+		name string
+		load func(io.Reader, []uint16) (int, error)
+	}{
+		{"words", loadImageWords},
+		{"bulk", loadImage},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			var mem [msize]uint16
+			b.SetBytes(int64(len(img)))
+			for i := 0; i < b.N; i++ {
+				if n, err := tc.load(bytes.NewReader(img), mem[:]); err != nil {
+					b.Fatal(err)
+				} else if n != msize-1 {
+					b.Fatalf("Loaded %d words; want %d", n, msize-1)
+				}
+			}
+		})
+	}
+}
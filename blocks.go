@@ -0,0 +1,315 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+// This file implements an optional tier (enabled by vm.jit) that translates
+// frequently-executed basic blocks into chains of Go closures. Each closure
+// is specialized for its instruction's operands, which are resolved to
+// pointers to registers or constants when the block is compiled, so the
+// block runs without decoding or dispatching individual instructions.
+//
+// Control transfers count entries to their destinations, and a block is
+// compiled at an address after it has been entered hotBlockEntries times.
+// Its cached instruction's fn is then set to fnBlock. A block contains a run
+// of non-branching instructions followed by an optional jump, call, or
+// return. Instructions that write memory, perform I/O, or stop the VM end the
+// block before them. When a block transfers control to another block, the
+// second block is run directly.
+//
+// Blocks are discarded (deoptimized) when memory that they cover is written
+// and whenever the VM's state is changed from outside run. If an instruction
+// within a block would fail, the block returns its address and the
+// interpreter executes it instead so that the error is reported there.
+
+// hotBlockEntries is the number of times an address must be entered before a
+// block is compiled there.
+const hotBlockEntries = 50
+
+// maxBlockInstrs is the maximum number of instructions in a block.
+const maxBlockInstrs = 64
+
+// maxBlockChain is the maximum number of additional blocks run by execBlock
+// before returning to the interpreter.
+const maxBlockChain = 1024
+
+// maxBlockSize is the maximum number of words in a block.
+const maxBlockSize = 4 * maxBlockInstrs
+
+// hotBlock is a compiled basic block.
+type hotBlock struct {
+	ops   []func() bool         // non-branching instructions; false if unable to execute
+	term  func() (uint16, bool) // final control transfer, or nil to fall through
+	addrs []uint16              // addresses of ops and then of term or end
+	end   uint16                // address after the block
+	first predecoded            // first instruction
+	fn    opFunc                // interpreter handler for first
+}
+
+// jitOpFuncs is used instead of opFuncs when vm.jit is set. Handlers that
+// may transfer control record entries to their destinations.
+var jitOpFuncs = func() [len(opFuncs)]opFunc {
+	funcs := opFuncs
+	for _, fn := range []uint16{opJmp, opJt, opJf, opCall, opRet,
+		fnEqJt, fnEqJf, fnGtJt, fnGtJf, fnAddJt, fnAddJf, fnBlock, fnNative} {
+		f := funcs[fn]
+		funcs[fn] = func(vm *vm, d *predecoded, ip uint16) uint16 {
+			next := f(vm, d, ip)
+			vm.enter(next)
+			return next
+		}
+	}
+	return funcs
+}()
+
+// execBlock runs the block starting at ip. If the block transfers control to
+// another block, it's run as well, up to maxBlockChain blocks or until
+// vm.slowPath needs to be called.
+func execBlock(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.steps-- // counted below instead
+	for n := 0; ; n++ {
+		b := vm.blocks[ip]
+		for i, f := range b.ops {
+			if !f() {
+				vm.stepAll(b.addrs[:i])
+				return b.bail(vm, ip, i, n)
+			}
+		}
+		vm.stepAll(b.addrs[:len(b.ops)])
+		next := b.end
+		if b.term != nil {
+			var ok bool
+			if next, ok = b.term(); !ok {
+				return b.bail(vm, ip, len(b.ops), n)
+			}
+			vm.step(b.addrs[len(b.ops)])
+		}
+		if ip = next; n == maxBlockChain || vm.steps >= vm.slowAt || vm.blocks[ip] == nil {
+			return ip
+		}
+	}
+}
+
+// bail is called when b's i-th instruction can't be executed. ip is b's
+// address, and n is the number of blocks that were already run by execBlock.
+// The address of the instruction is returned so the interpreter can execute
+// it, unless the instruction starts the block that was dispatched by run, in
+// which case it's executed here to report the error at the right address.
+func (b *hotBlock) bail(vm *vm, ip uint16, i, n int) uint16 {
+	if i > 0 || n > 0 {
+		return b.addrs[i]
+	}
+	vm.step(ip)
+	return b.fn(vm, &b.first, ip)
+}
+
+// stepAll calls vm.step for each of addrs.
+func (vm *vm) stepAll(addrs []uint16) {
+	if vm.hist == nil {
+		vm.steps += uint64(len(addrs))
+		return
+	}
+	for _, a := range addrs {
+		vm.step(a)
+	}
+}
+
+// enter records that control was transferred to addr, compiling a block
+// there if it's hot.
+func (vm *vm) enter(addr uint16) {
+	if vm.heat == nil {
+		return
+	}
+	if h := vm.heat[addr]; h < hotBlockEntries {
+		vm.heat[addr] = h + 1
+	} else if h == hotBlockEntries {
+		vm.heat[addr]++ // don't try again if compilation fails
+		vm.compileBlock(addr)
+	}
+}
+
+// compileBlock compiles a block starting at ip if possible.
+func (vm *vm) compileBlock(ip uint16) {
+	d := vm.decoded(ip)
+	if d.size == 0 || d.fn == fnNative {
+		return
+	}
+	b := &hotBlock{first: *d, fn: opFuncs[d.op]}
+	addr := int(ip)
+	for len(b.ops) < maxBlockInstrs-1 && addr < msize {
+		d := vm.decoded(uint16(addr))
+		if d.size == 0 {
+			break
+		}
+		if f := vm.compileInstr(d); f != nil {
+			b.ops = append(b.ops, f)
+			b.addrs = append(b.addrs, uint16(addr))
+			addr += int(d.size)
+			continue
+		}
+		if b.term = vm.compileTerm(d, uint16(addr)); b.term != nil {
+			b.addrs = append(b.addrs, uint16(addr))
+			addr += int(d.size)
+		}
+		break
+	}
+	if addr == int(ip) {
+		return // starts with an unsupported instruction
+	}
+	if b.term == nil {
+		b.addrs = append(b.addrs, uint16(addr))
+	}
+	b.end = uint16(addr)
+
+	vm.blocks[ip] = b
+	for a := int(ip); a < addr; a++ {
+		vm.cover[a]++
+	}
+	d.fn = fnBlock
+}
+
+// ref returns a pointer to the value of operand a.
+func (vm *vm) ref(a uint16) *uint16 {
+	if a >= vreg {
+		return &vm.reg[a-vreg]
+	}
+	return &a
+}
+
+// compileInstr returns a closure executing d if it's a non-branching
+// instruction that doesn't write memory, perform I/O, or stop the VM.
+func (vm *vm) compileInstr(d *predecoded) func() bool {
+	a := &d.args
+	switch d.op {
+	case opSet:
+		dst, b := vm.ref(a[0]), vm.ref(a[1])
+		return func() bool { *dst = *b; return true }
+	case opPush:
+		b := vm.ref(a[0])
+		return func() bool { vm.push(*b); return true }
+	case opPop:
+		dst := vm.ref(a[0])
+		return func() bool {
+			if len(vm.stack) == 0 {
+				return false
+			}
+			*dst = vm.pop()
+			return true
+		}
+	case opEq:
+		dst, b, c := vm.ref(a[0]), vm.ref(a[1]), vm.ref(a[2])
+		return func() bool { *dst = cond(*b == *c, 1, 0); return true }
+	case opGt:
+		dst, b, c := vm.ref(a[0]), vm.ref(a[1]), vm.ref(a[2])
+		return func() bool { *dst = cond(*b > *c, 1, 0); return true }
+	case opAdd:
+		dst, b, c := vm.ref(a[0]), vm.ref(a[1]), vm.ref(a[2])
+		return func() bool { *dst = (*b + *c) % vmod; return true }
+	case opMult:
+		dst, b, c := vm.ref(a[0]), vm.ref(a[1]), vm.ref(a[2])
+		return func() bool { *dst = uint16((int(*b) * int(*c)) % vmod); return true }
+	case opMod:
+		dst, b, c := vm.ref(a[0]), vm.ref(a[1]), vm.ref(a[2])
+		return func() bool {
+			if *c == 0 {
+				return false
+			}
+			*dst = *b % *c
+			return true
+		}
+	case opAnd:
+		dst, b, c := vm.ref(a[0]), vm.ref(a[1]), vm.ref(a[2])
+		return func() bool { *dst = *b & *c; return true }
+	case opOr:
+		dst, b, c := vm.ref(a[0]), vm.ref(a[1]), vm.ref(a[2])
+		return func() bool { *dst = *b | *c; return true }
+	case opNot:
+		dst, b := vm.ref(a[0]), vm.ref(a[1])
+		return func() bool { *dst = ^*b & vmax; return true }
+	case opRmem:
+		dst, b := vm.ref(a[0]), vm.ref(a[1])
+		return func() bool { *dst = vm.mem[*b&vmax]; return true }
+	case opNoop:
+		return func() bool { return true }
+	}
+	return nil
+}
+
+// compileTerm returns a closure executing d, at ip, if it's a jump, call, or
+// return. The closure returns the address of the next instruction.
+func (vm *vm) compileTerm(d *predecoded, ip uint16) func() (uint16, bool) {
+	a := &d.args
+	next := ip + d.size
+	switch d.op {
+	case opJmp:
+		t := vm.ref(a[0])
+		return func() (uint16, bool) { return *t, true }
+	case opJt:
+		c, t := vm.ref(a[0]), vm.ref(a[1])
+		return func() (uint16, bool) {
+			if *c != 0 {
+				return *t, true
+			}
+			return next, true
+		}
+	case opJf:
+		c, t := vm.ref(a[0]), vm.ref(a[1])
+		return func() (uint16, bool) {
+			if *c == 0 {
+				return *t, true
+			}
+			return next, true
+		}
+	case opCall:
+		t := vm.ref(a[0])
+		return func() (uint16, bool) { vm.push(next); return *t, true }
+	case opRet:
+		return func() (uint16, bool) {
+			if len(vm.stack) == 0 {
+				return 0, false
+			}
+			return vm.pop(), true
+		}
+	}
+	return nil
+}
+
+// dropBlocksAt discards blocks covering addr, which has been written.
+func (vm *vm) dropBlocksAt(addr uint16) {
+	for h := int(addr); h >= 0 && h > int(addr)-maxBlockSize; h-- {
+		if b := vm.blocks[h]; b != nil && int(addr) < int(b.end) {
+			vm.dropBlock(uint16(h))
+		}
+	}
+}
+
+// dropBlock discards the block at ip.
+func (vm *vm) dropBlock(ip uint16) {
+	b := vm.blocks[ip]
+	for a := int(ip); a < int(b.end); a++ {
+		vm.cover[a]--
+	}
+	vm.blocks[ip] = nil
+	vm.heat[ip] = 0
+	vm.code[ip].gen = 0
+}
+
+// resetBlocks discards all blocks and entry counts. Blocks skip
+// per-instruction instrumentation, so they're only used if vm.fuse is set.
+func (vm *vm) resetBlocks() {
+	if !vm.jit || !vm.fuse {
+		vm.blocks, vm.heat, vm.cover = nil, nil, nil
+		return
+	}
+	if vm.blocks == nil {
+		vm.blocks = make([]*hotBlock, msize)
+		vm.heat = make([]uint16, msize)
+		vm.cover = make([]uint16, msize)
+		return
+	}
+	for i := range vm.blocks {
+		vm.blocks[i] = nil
+		vm.heat[i] = 0
+		vm.cover[i] = 0
+	}
+}
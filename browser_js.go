@@ -0,0 +1,179 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// This file lets the VM run entirely within a web browser. Build it with:
+//
+//	GOOS=js GOARCH=wasm go build -o synacor.wasm
+//	cp "$(go env GOROOT)/misc/wasm/wasm_exec.js" .
+//
+// After the module is started with wasm_exec.js, it defines a global
+// "synacor" object with these members:
+//
+//	load(bytes)      start a program image or snapshot passed as a Uint8Array,
+//	                 returning an error message or null
+//	sendInput(text)  send text (e.g. "look\n") to the program, returning
+//	                 false if it can't currently be queued
+//	halt()           halt the program
+//	onOutput         function to call with the program's output
+//	onExit           function to call with a message when the program stops
+
+// browserFlushDelay is how long output waits for more data before it's passed to onOutput.
+const browserFlushDelay = 10 * time.Millisecond
+
+// browserMaxInput is the maximum number of queued sendInput calls.
+const browserMaxInput = 256
+
+// browserRunner runs programs on behalf of JavaScript code.
+type browserRunner struct {
+	obj js.Value // global "synacor" object
+
+	mu sync.Mutex
+	vm *vm         // running VM, or nil
+	in chan string // input for vm; closed when it stops
+}
+
+// runBrowser defines the global "synacor" object and handles calls to it.
+// It never returns.
+func runBrowser() {
+	br := &browserRunner{obj: js.Global().Get("Object").New()}
+	br.obj.Set("load", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) != 1 || args[0].Type() != js.TypeObject {
+			return "load requires a Uint8Array"
+		}
+		b := make([]byte, args[0].Get("length").Int())
+		js.CopyBytesToGo(b, args[0])
+		if err := br.load(b); err != nil {
+			return err.Error()
+		}
+		return nil
+	}))
+	br.obj.Set("sendInput", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) != 1 || args[0].Type() != js.TypeString {
+			return false
+		}
+		return br.sendInput(args[0].String())
+	}))
+	br.obj.Set("halt", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		br.mu.Lock()
+		vm := br.vm
+		br.mu.Unlock()
+		if vm != nil {
+			vm.halt()
+		}
+		return nil
+	}))
+	js.Global().Set("synacor", br.obj)
+	select {}
+}
+
+// load halts the current program (if any) and starts a new one from b,
+// which may contain a program image or snapshot.
+func (br *browserRunner) load(b []byte) error {
+	r := bufio.NewReader(bytes.NewReader(b))
+	var prog io.Reader = r
+	var snap *snapshot
+	if isSnapshot(r) {
+		var err error
+		if snap, err = readSnapshot(r); err != nil {
+			return err
+		}
+		prog = strings.NewReader("")
+	}
+	vm, err := newVM(prog)
+	if err != nil {
+		return err
+	}
+	if snap != nil {
+		vm.restore(snap)
+	}
+
+	in := make(chan string, browserMaxInput)
+	br.mu.Lock()
+	old := br.vm
+	br.vm, br.in = vm, in
+	br.mu.Unlock()
+	if old != nil {
+		old.halt()
+	}
+	go br.run(vm, in)
+	return nil
+}
+
+// sendInput queues s to be sent to the running program.
+// False is returned if no program is running or too much input is queued.
+func (br *browserRunner) sendInput(s string) bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.in == nil {
+		return false
+	}
+	select {
+	case br.in <- s:
+		return true
+	default:
+		return false
+	}
+}
+
+// run runs vm until it halts, passing it text from in and sending its output
+// to onOutput. JS callbacks can't block, so input is written to the session
+// from a separate goroutine.
+func (br *browserRunner) run(vm *vm, in chan string) {
+	w := newBatchWriter(browserFlushDelay, func(b []byte) error {
+		br.call("onOutput", string(b))
+		return nil
+	})
+	pr, pw := io.Pipe()
+	go func() {
+		for s := range in {
+			if _, err := io.WriteString(pw, s); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Meta-commands are disabled since there's no filesystem.
+	sess := &session{vm: vm, onEOF: eofHalt, msg: w}
+	runErr := sess.run(pr, w)
+	if runErr != nil {
+		fmt.Fprintf(w, "\n%v\n", runErr)
+	}
+	pw.Close() // end input if the program halted on its own
+
+	br.mu.Lock()
+	if br.vm == vm {
+		br.vm, br.in = nil, nil
+	}
+	close(in)
+	br.mu.Unlock()
+
+	w.flush()
+	reason := vm.reason.String()
+	if runErr != nil {
+		reason = runErr.Error()
+	}
+	br.call("onExit", reason)
+}
+
+// call calls the JS function stored in the named property of br.obj, if any.
+func (br *browserRunner) call(name string, args ...interface{}) {
+	if f := br.obj.Get(name); f.Type() == js.TypeFunction {
+		f.Invoke(args...)
+	}
+}
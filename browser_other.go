@@ -0,0 +1,9 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+//go:build !js || !wasm
+// +build !js !wasm
+
+package main
+
+func runBrowser() { panic("not built for browsers") }
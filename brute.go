@@ -0,0 +1,145 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resetFrom replaces vm's state with ps and base's configuration so that vm
+// can be started again. vm must be stopped (or not yet started).
+func (vm *vm) resetFrom(base *vm, ps *pagedSnapshot) {
+	vm.restorePaged(ps)
+	vm.jit = base.jit
+	vm.maxIPS = base.maxIPS
+	vm.natives = base.natives
+
+	vm.obuf = vm.obuf[:0]
+	vm.done = nil
+	vm.qonce = sync.Once{}
+	vm.quitReq = 0
+	vm.reason = haltNone
+	vm.initChans()
+}
+
+// bruteResult describes a run of the program performed by bruteForce.
+type bruteResult struct {
+	input  string     // input sent to the program
+	output string     // output written by the program
+	steps  uint64     // instructions executed
+	reason haltReason // why the program stopped
+	err    error      // run-time error, if any
+}
+
+// bruteForce runs the program in base once for each of inputs, using up to
+// workers VMs in parallel. Each run starts from base's state and receives its
+// input followed by end-of-input (halting the program if it's read). Runs
+// are halted if they take longer than timeout. Results are returned in the
+// same order as inputs.
+func bruteForce(base *vm, inputs []string, workers int, timeout time.Duration) []bruteResult {
+	results := make([]bruteResult, len(inputs))
+	ps := base.pagedSnapshot()
+	if workers < 1 {
+		workers = 1
+	}
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(inputs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vm := &vm{}
+			var out strings.Builder
+			vm.output = func(p []byte) { out.Write(p) }
+			for i := range idx {
+				out.Reset()
+				vm.resetFrom(base, ps)
+				vm.in.write([]byte(inputs[i]))
+				vm.in.close()
+
+				timer := time.AfterFunc(timeout, vm.halt)
+				vm.start()
+				err := vm.wait()
+				timer.Stop()
+
+				results[i] = bruteResult{
+					input:  inputs[i],
+					output: out.String(),
+					steps:  vm.steps - base.steps,
+					reason: vm.reason,
+					err:    err,
+				}
+			}
+		}()
+	}
+	for i := range inputs {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	return results
+}
+
+// readBruteInputs reads inputs for bruteForce from the file at p. Each
+// non-empty line contains one input's commands separated by sep.
+func readBruteInputs(p, sep string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var inputs []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		cmds := []string{line}
+		if sep != "" {
+			cmds = strings.Split(line, sep)
+		}
+		var b strings.Builder
+		for _, c := range cmds {
+			b.WriteString(strings.TrimSpace(c))
+			b.WriteByte('\n')
+		}
+		inputs = append(inputs, b.String())
+	}
+	return inputs, sc.Err()
+}
+
+// writeBruteResults writes results to w, skipping ones whose output doesn't
+// match re if it's non-nil. Each result's output is preceded by a line
+// describing its input and how the program stopped.
+func writeBruteResults(w io.Writer, results []bruteResult, re *regexp.Regexp) error {
+	bw := bufio.NewWriter(w)
+	for _, res := range results {
+		if re != nil && !re.MatchString(res.output) {
+			continue
+		}
+		cmds := strings.Split(strings.TrimSuffix(res.input, "\n"), "\n")
+		stop := res.reason.String()
+		switch {
+		case res.err != nil:
+			stop = res.err.Error()
+		case res.reason == haltQuit:
+			stop = "timed out"
+		}
+		fmt.Fprintf(bw, "== %s (%d steps, %s)\n", strings.Join(cmds, "; "), res.steps, stop)
+		bw.WriteString(res.output)
+		if res.output != "" && !strings.HasSuffix(res.output, "\n") {
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// busyInterval is how often the busy indicator is updated.
+const busyInterval = 250 * time.Millisecond
+
+// showBusy shows a spinner on s.busyOut while the program runs for longer than
+// s.busyDelay without writing output or waiting for input, e.g. during the
+// teleporter's confirmation check. It returns when stop is closed.
+func (s *session) showBusy(stop <-chan struct{}) {
+	t := time.NewTicker(busyInterval)
+	defer t.Stop()
+
+	var lastOut uint64
+	quiet := time.Now() // time at which the program last wrote output or read input
+	for frame := 0; ; frame++ {
+		select {
+		case <-t.C:
+		case <-stop:
+			s.clearBusy()
+			return
+		}
+		s.outMu.Lock()
+		if s.nout != lastOut || s.inputWait || s.paused || (s.dbg != nil && s.dbg.paused()) {
+			lastOut = s.nout
+			quiet = time.Now()
+		} else if d := time.Since(quiet); d >= s.busyDelay {
+			fmt.Fprintf(s.busyOut, "\r%c running for %v without output\x1b[K",
+				`|/-\`[frame%4], d.Round(time.Second))
+			s.busyShown = true
+		}
+		s.outMu.Unlock()
+	}
+}
+
+// clearBusy erases the busy indicator if it's visible.
+func (s *session) clearBusy() {
+	s.outMu.Lock()
+	if s.busyShown {
+		fmt.Fprint(s.busyOut, "\r\x1b[K")
+		s.busyShown = false
+	}
+	s.outMu.Unlock()
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeCallGraphDOT writes p's static call graph to w in Graphviz DOT format.
+// Edges are labeled with the addresses of the corresponding call instructions.
+func (p *program) writeCallGraphDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph calls {\n")
+	b.WriteString("\tnode [shape=box fontname=monospace];\n")
+	var indirect bool
+	for _, fn := range p.sortedFuncs() {
+		fmt.Fprintf(&b, "\t%s;\n", funcName(fn.entry))
+		for _, c := range fn.calls {
+			if c.direct {
+				fmt.Fprintf(&b, "\t%s -> %s [label=\"%d\"];\n",
+					funcName(fn.entry), funcName(c.target), c.addr)
+			} else {
+				fmt.Fprintf(&b, "\t%s -> indirect [label=\"%d (%s)\"];\n",
+					funcName(fn.entry), c.addr, fmtArg(c.target, false))
+				indirect = true
+			}
+		}
+	}
+	if indirect {
+		b.WriteString("\tindirect [shape=ellipse label=\"?\"];\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// callGraphFunc is used to serialize a function in writeCallGraphJSON.
+type callGraphFunc struct {
+	Name  string          `json:"name"`
+	Entry uint16          `json:"entry"`
+	Calls []callGraphCall `json:"calls"`
+}
+
+// callGraphCall is used to serialize a callSite in writeCallGraphJSON.
+type callGraphCall struct {
+	Addr       uint16  `json:"addr"`
+	Target     string  `json:"target"`               // function name or register, e.g. "r1"
+	TargetAddr *uint16 `json:"targetAddr,omitempty"` // nil for indirect calls
+}
+
+// writeCallGraphJSON writes p's static call graph to w as a JSON array of functions.
+func (p *program) writeCallGraphJSON(w io.Writer) error {
+	fns := make([]callGraphFunc, 0, len(p.funcs))
+	for _, fn := range p.sortedFuncs() {
+		cf := callGraphFunc{Name: funcName(fn.entry), Entry: fn.entry, Calls: []callGraphCall{}}
+		for _, c := range fn.calls {
+			cc := callGraphCall{Addr: c.addr, Target: fmtArg(c.target, false)}
+			if c.direct {
+				t := c.target
+				cc.Target = funcName(t)
+				cc.TargetAddr = &t
+			}
+			cf.Calls = append(cf.Calls, cc)
+		}
+		fns = append(fns, cf)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(fns)
+}
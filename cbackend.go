@@ -0,0 +1,201 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cBackend emits a standalone C99 program.
+type cBackend struct{}
+
+func (cBackend) prologue(b *strings.Builder, t *translation) {
+	b.WriteString(`/* Code generated by synacor-challenge -recompile; DO NOT EDIT. */
+
+#include <stdarg.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+`)
+	fmt.Fprintf(b, "#define START_PC %d\n\n", t.pc)
+	fmt.Fprintf(b, "static uint16_t r[8] = {%s};\n\n", joinWords(t.regs[:]))
+	// C doesn't permit empty arrays, so the initial stack is terminated by a
+	// sentinel that isn't copied.
+	fmt.Fprintf(b, "static const uint16_t stack_init[] = {%s};\n", joinWords(append(t.stack[:len(t.stack):len(t.stack)], 0)))
+	fmt.Fprintf(b, "static const size_t stack_init_len = %d;\n\n", len(t.stack))
+	b.WriteString("static uint16_t mem[32768] = {\n")
+	writeWords(b, t.p.mem[:t.memEnd], "    ")
+	b.WriteString("};\n\n")
+	b.WriteString("/* [start, end) ranges of translated blocks, terminated by an empty range. */\n")
+	b.WriteString("static const uint16_t blocks[][2] = {\n")
+	for _, blk := range t.blocks {
+		fmt.Fprintf(b, "    {%d, %d},\n", blk[0], blk[1])
+	}
+	b.WriteString("    {0, 0},\n};\n")
+	b.WriteString(cRuntime)
+}
+
+func (cBackend) format(src []byte) ([]byte, error) { return src, nil }
+
+func (cBackend) funcHeader(b *strings.Builder, name string) {
+	fmt.Fprintf(b, "\nstatic uint16_t %s(uint16_t pc) {\n", name)
+}
+
+func (cBackend) funcFooter(b *strings.Builder) {
+	b.WriteString("}\n")
+}
+
+func (cBackend) epilogue(b *strings.Builder, t *translation) {
+	b.WriteString(`
+int main(void) {
+    size_t i;
+    uint16_t pc = START_PC;
+    for (i = 0; blocks[i][1] != 0; i++) {
+        uint16_t a;
+        for (a = blocks[i][0]; a < blocks[i][1]; a++) owner[a] = blocks[i][0] + 1;
+    }
+    for (i = 0; i < stack_init_len; i++) push(stack_init[i]);
+
+    while (pc != 0xffff) {
+        if (pc > 32767) fail("bad address %u", pc);
+        if (dirty[pc]) {
+            pc = step(pc);
+            continue;
+        }
+        switch (pc) {
+`)
+	for _, tf := range t.fns {
+		for _, e := range tf.entries {
+			fmt.Fprintf(b, "        case %d:\n", e)
+		}
+		if len(tf.entries) > 0 {
+			fmt.Fprintf(b, "            pc = %s(pc);\n            break;\n", funcName(tf.fn.entry))
+		}
+	}
+	b.WriteString(`        default:
+            pc = step(pc);
+        }
+    }
+    fflush(stdout);
+    return 0;
+}
+`)
+}
+
+// cRuntime contains helpers used by translated C code.
+const cRuntime = `
+static unsigned char dirty[32768]; /* overwritten translated blocks, keyed by start */
+static uint16_t owner[32768];      /* 1 + start of translated block containing each word, or 0 */
+static uint16_t *stack;
+static size_t stack_len, stack_cap;
+
+static void fail(const char *format, ...) {
+    va_list ap;
+    fflush(stdout);
+    va_start(ap, format);
+    vfprintf(stderr, format, ap);
+    va_end(ap);
+    fputc('\n', stderr);
+    exit(1);
+}
+
+static uint16_t bad(uint16_t v, uint16_t addr) {
+    fail("bad value %u at %u", v, addr);
+    return 0;
+}
+
+static void push(uint16_t v) {
+    if (stack_len == stack_cap) {
+        stack_cap = stack_cap ? 2 * stack_cap : 256;
+        stack = realloc(stack, stack_cap * sizeof(uint16_t));
+        if (!stack) fail("out of memory");
+    }
+    stack[stack_len++] = v;
+}
+
+static uint16_t pop(void) {
+    if (stack_len == 0) fail("pop with empty stack");
+    return stack[--stack_len];
+}
+
+static uint16_t popRet(void) { return stack_len ? pop() : 0xffff; }
+static uint16_t eq(uint16_t a, uint16_t b) { return a == b; }
+static uint16_t gt(uint16_t a, uint16_t b) { return a > b; }
+static uint16_t add(uint16_t a, uint16_t b) { return (uint16_t)((a + b) % 32768); }
+static uint16_t mul(uint16_t a, uint16_t b) { return (uint16_t)(((uint32_t)a * b) % 32768); }
+static uint16_t and(uint16_t a, uint16_t b) { return a & b; }
+static uint16_t or(uint16_t a, uint16_t b) { return a | b; }
+static uint16_t inv(uint16_t a) { return (uint16_t)(~a & 32767); }
+
+static uint16_t mod(uint16_t a, uint16_t b) {
+    if (b == 0) fail("mod by zero");
+    return a % b;
+}
+
+static uint16_t rd(uint16_t a) {
+    if (a > 32767) fail("bad address %u", a);
+    return mem[a];
+}
+
+static void wr(uint16_t a, uint16_t v) {
+    if (a > 32767) fail("bad address %u", a);
+    mem[a] = v;
+    if (owner[a]) dirty[owner[a] - 1] = 1;
+}
+
+static void out(uint16_t v) { putchar(v & 0xff); }
+
+static uint16_t in(void) {
+    int c;
+    fflush(stdout);
+    if ((c = getchar()) == EOF) exit(0);
+    return (uint16_t)c;
+}
+
+static uint16_t get(uint16_t pc, uint16_t i) {
+    uint16_t v = rd(pc + i);
+    if (v < 32768) return v;
+    if (v < 32776) return r[v - 32768];
+    return bad(v, pc + i);
+}
+
+static void set(uint16_t pc, uint16_t i, uint16_t v) {
+    uint16_t d = rd(pc + i);
+    if (d < 32768 || d >= 32776) bad(d, pc + i);
+    r[d - 32768] = v;
+}
+
+/* Interprets the instruction at pc and returns the next address. */
+static uint16_t step(uint16_t pc) {
+    uint16_t op = rd(pc);
+    switch (op) {
+    case 0: return 0xffff;
+    case 1: set(pc, 1, get(pc, 2)); return pc + 3;
+    case 2: push(get(pc, 1)); return pc + 2;
+    case 3: set(pc, 1, pop()); return pc + 2;
+    case 4: set(pc, 1, eq(get(pc, 2), get(pc, 3))); return pc + 4;
+    case 5: set(pc, 1, gt(get(pc, 2), get(pc, 3))); return pc + 4;
+    case 6: return get(pc, 1);
+    case 7: return get(pc, 1) != 0 ? get(pc, 2) : pc + 3;
+    case 8: return get(pc, 1) == 0 ? get(pc, 2) : pc + 3;
+    case 9: set(pc, 1, add(get(pc, 2), get(pc, 3))); return pc + 4;
+    case 10: set(pc, 1, mul(get(pc, 2), get(pc, 3))); return pc + 4;
+    case 11: set(pc, 1, mod(get(pc, 2), get(pc, 3))); return pc + 4;
+    case 12: set(pc, 1, and(get(pc, 2), get(pc, 3))); return pc + 4;
+    case 13: set(pc, 1, or(get(pc, 2), get(pc, 3))); return pc + 4;
+    case 14: set(pc, 1, inv(get(pc, 2))); return pc + 3;
+    case 15: set(pc, 1, rd(get(pc, 2))); return pc + 3;
+    case 16: wr(get(pc, 1), get(pc, 2)); return pc + 3;
+    case 17: push(pc + 2); return get(pc, 1);
+    case 18: return popRet();
+    case 19: out(get(pc, 1)); return pc + 2;
+    case 20: set(pc, 1, in()); return pc + 2;
+    case 21: case 22: return pc + 1; /* noop, trap */
+    }
+    fail("invalid op %u at %u", op, pc);
+    return 0xffff;
+}
+`
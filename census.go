@@ -0,0 +1,49 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// staticOpCounts returns the number of reachable instructions in p using each opcode.
+func (p *program) staticOpCounts() []uint64 {
+	counts := make([]uint64, len(ops))
+	for _, in := range p.instrs {
+		counts[in.op]++
+	}
+	return counts
+}
+
+// writeCensus writes a table of per-opcode counts to w.
+// dynamic contains execution counts and may be nil.
+func writeCensus(w io.Writer, static, dynamic []uint64) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-3s %-5s %8s", "op", "name", "static")
+	if dynamic != nil {
+		fmt.Fprintf(&b, " %14s", "dynamic")
+	}
+	b.WriteString("\n")
+
+	var stot, dtot uint64
+	for op, info := range ops {
+		fmt.Fprintf(&b, "%-3d %-5s %8d", op, info.name, static[op])
+		stot += static[op]
+		if dynamic != nil {
+			fmt.Fprintf(&b, " %14d", dynamic[op])
+			dtot += dynamic[op]
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%-9s %8d", "total", stot)
+	if dynamic != nil {
+		fmt.Fprintf(&b, " %14d", dtot)
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
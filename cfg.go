@@ -0,0 +1,155 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import "sort"
+
+// block is a basic block within a function.
+type block struct {
+	start  uint16
+	instrs []instr
+	succs  []uint16 // start addresses of successor blocks within the function
+}
+
+// last returns the final instruction in b.
+func (b *block) last() instr { return b.instrs[len(b.instrs)-1] }
+
+// end returns the address immediately after b.
+func (b *block) end() uint16 { return b.last().next() }
+
+// blocks splits fn into basic blocks sorted by start address.
+// Calls do not end blocks.
+func (p *program) blocks(fn *function) []*block {
+	in := make(map[uint16]struct{}, len(fn.addrs))
+	for _, addr := range fn.addrs {
+		in[addr] = struct{}{}
+	}
+
+	leaders := map[uint16]struct{}{fn.entry: {}}
+	for i, addr := range fn.addrs {
+		ins := p.instrs[addr]
+		if t, ok := ins.target(); ok && ins.op != opCall {
+			leaders[t] = struct{}{}
+		}
+		if endsBlock(ins) {
+			leaders[ins.next()] = struct{}{}
+		}
+		if i == 0 || p.instrs[fn.addrs[i-1]].next() != addr {
+			leaders[addr] = struct{}{}
+		}
+	}
+
+	var blocks []*block
+	var cur *block
+	for _, addr := range fn.addrs {
+		if _, ok := leaders[addr]; ok || cur == nil {
+			cur = &block{start: addr}
+			blocks = append(blocks, cur)
+		}
+		cur.instrs = append(cur.instrs, p.instrs[addr])
+	}
+
+	for _, b := range blocks {
+		last := b.last()
+		var succs []uint16
+		switch last.op {
+		case opHalt, opRet:
+		case opJmp:
+			if t, ok := last.target(); ok {
+				succs = append(succs, t)
+			}
+		case opJt, opJf:
+			if t, ok := last.target(); ok {
+				succs = append(succs, t)
+			}
+			succs = append(succs, last.next())
+		default:
+			succs = append(succs, last.next())
+		}
+		for _, s := range succs {
+			if _, ok := in[s]; ok {
+				b.succs = append(b.succs, s)
+			}
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].start < blocks[j].start })
+	return blocks
+}
+
+// endsBlock returns true if in transfers control somewhere other than the next instruction.
+func endsBlock(in instr) bool {
+	switch in.op {
+	case opHalt, opJmp, opJt, opJf, opRet:
+		return true
+	}
+	return false
+}
+
+// loop describes a natural loop as a range of indexes into a function's sorted blocks.
+type loop struct {
+	head, tail int
+}
+
+// findLoops returns properly-nested loops formed by back-edges in blocks,
+// sorted by head index and then by decreasing size.
+// Back-edges that would produce overlapping loops are ignored.
+func findLoops(blocks []*block) []loop {
+	idx := make(map[uint16]int, len(blocks))
+	for i, b := range blocks {
+		idx[b.start] = i
+	}
+	contiguous := func(h, t int) bool {
+		for i := h; i < t; i++ {
+			if blocks[i].end() != blocks[i+1].start {
+				return false
+			}
+		}
+		return true
+	}
+
+	tails := make(map[int]int) // head index to largest tail index
+	for t, b := range blocks {
+		for _, s := range b.succs {
+			if h, ok := idx[s]; ok && h <= t && contiguous(h, t) {
+				if old, ok := tails[h]; !ok || t > old {
+					tails[h] = t
+				}
+			}
+		}
+	}
+	var cands []loop
+	for h, t := range tails {
+		cands = append(cands, loop{h, t})
+	}
+	// Accept larger loops first and reject any that cross them.
+	sort.Slice(cands, func(i, j int) bool {
+		si, sj := cands[i].tail-cands[i].head, cands[j].tail-cands[j].head
+		if si != sj {
+			return si > sj
+		}
+		return cands[i].head < cands[j].head
+	})
+	var loops []loop
+	for _, c := range cands {
+		ok := true
+		for _, l := range loops {
+			disjoint := c.tail < l.head || c.head > l.tail
+			inside := c.head >= l.head && c.tail <= l.tail
+			if !disjoint && !inside {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			loops = append(loops, c)
+		}
+	}
+	sort.Slice(loops, func(i, j int) bool {
+		if loops[i].head != loops[j].head {
+			return loops[i].head < loops[j].head
+		}
+		return loops[i].tail > loops[j].tail
+	})
+	return loops
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// chromeTrace writes a timeline of function calls, input waits, debugger
+// pauses, and discovered codes in the Chrome trace event format, which can be
+// loaded by chrome://tracing or https://ui.perfetto.dev. The JSON array form
+// is used since it may be truncated if the program is killed.
+// It is safe for concurrent use.
+type chromeTrace struct {
+	start time.Time
+	f     *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+
+	mu   sync.Mutex
+	n    int      // events written
+	open []string // names of unfinished duration events
+	err  error    // first write error
+}
+
+// chromeEvent is a single trace event.
+type chromeEvent struct {
+	Name  string                 `json:"name"`
+	Cat   string                 `json:"cat,omitempty"`
+	Phase string                 `json:"ph"`
+	TS    float64                `json:"ts"` // microseconds
+	PID   int                    `json:"pid"`
+	TID   int                    `json:"tid"`
+	Scope string                 `json:"s,omitempty"` // for instant events
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// newChromeTrace creates a trace at path p for the named program.
+func newChromeTrace(p, name string) (*chromeTrace, error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	ct := &chromeTrace{start: time.Now(), f: f, w: bufio.NewWriter(f)}
+	ct.enc = json.NewEncoder(ct.w)
+	ct.w.WriteString("[\n")
+	ct.write(chromeEvent{Name: "process_name", Phase: "M", Args: map[string]interface{}{"name": name}})
+	ct.write(chromeEvent{Name: "thread_name", Phase: "M", Args: map[string]interface{}{"name": "vm"}})
+	return ct, nil
+}
+
+// write writes ev, filling in its timestamp and IDs. ct.mu must be held.
+func (ct *chromeTrace) write(ev chromeEvent) {
+	if ct.err != nil {
+		return
+	}
+	if ev.Phase != "M" {
+		ev.TS = float64(time.Since(ct.start).Nanoseconds()) / 1000
+	}
+	ev.PID, ev.TID = 1, 1
+	if ct.n > 0 {
+		ct.w.WriteString(",")
+	}
+	ct.err = ct.enc.Encode(ev)
+	ct.n++
+}
+
+// begin starts a duration event.
+func (ct *chromeTrace) begin(name, cat string, args map[string]interface{}) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.write(chromeEvent{Name: name, Cat: cat, Phase: "B", Args: args})
+	ct.open = append(ct.open, name)
+}
+
+// end finishes the most-recently-started duration event, if any.
+func (ct *chromeTrace) end() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.endLocked()
+}
+
+func (ct *chromeTrace) endLocked() {
+	if len(ct.open) == 0 {
+		return // e.g. "ret" from the initial frame
+	}
+	name := ct.open[len(ct.open)-1]
+	ct.open = ct.open[:len(ct.open)-1]
+	ct.write(chromeEvent{Name: name, Phase: "E"})
+}
+
+// instant records a momentary event.
+func (ct *chromeTrace) instant(name, cat string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.write(chromeEvent{Name: name, Cat: cat, Phase: "i", Scope: "g"})
+}
+
+// call records a call to the function at addr.
+func (ct *chromeTrace) call(addr uint16) { ct.begin(funcName(addr), "call", nil) }
+
+// close finishes any unfinished events and closes the file.
+func (ct *chromeTrace) close() error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for len(ct.open) > 0 {
+		ct.endLocked()
+	}
+	if ct.err == nil {
+		_, ct.err = ct.w.WriteString("]\n")
+	}
+	if ct.err == nil {
+		ct.err = ct.w.Flush()
+	}
+	if err := ct.f.Close(); ct.err == nil {
+		ct.err = err
+	}
+	return ct.err
+}
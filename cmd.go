@@ -0,0 +1,219 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subcommand describes a command like "synacor-challenge disasm prog.bin".
+//
+// Each subcommand parses its own flag set, containing a subset of the
+// top-level flags, into an options struct and then runs its mode directly.
+type subcommand struct {
+	name string
+	args string // positional arguments, e.g. "<prog.bin>" ("[...]" if optional)
+	desc string
+
+	// flags lists the top-level flags accepted by the command. An entry
+	// like "o=asm" accepts the top-level "asm" flag as "o".
+	// If all is true, all top-level flags not in exclude are accepted.
+	flags   []string
+	all     bool
+	exclude []string
+
+	// defaults contains default values for the command's flags (keyed by
+	// the command's names for them) that differ from the top-level defaults.
+	defaults map[string]string
+
+	// run runs the command with its parsed flags and positional arguments.
+	// stopProfiler is called before exiting after running the program.
+	run func(o *options, args []string, stopProfiler func())
+}
+
+// analysisFlags are top-level flags that select non-interactive modes.
+// They aren't accepted by subcommands that run the program.
+var analysisFlags = []string{
+	"annotate", "asm", "asm-list", "brute", "brute-grep", "brute-timeout",
+	"brute-workers", "callgraph", "control-stdio", "core-info", "dap",
+	"decompile", "diff", "diff-code", "diff-state", "disasm", "entropy",
+	"entropy-thresh", "export", "grpc", "grpc-cert", "grpc-key", "http",
+	"http-pprof", "json", "lint", "lockstep", "lockstep-ref", "make-patch",
+	"max-sessions", "recompile", "session-idle", "session-ips",
+	"session-save-mem", "strings", "strings-min", "teleporter-search",
+	"transcript-html", "user-quota", "user-saves", "user-tokens",
+	"write-image",
+}
+
+// subcommands lists the available subcommands. The top-level flags are
+// still accepted without a subcommand.
+var subcommands = []*subcommand{
+	{
+		name:    "run",
+		args:    "<prog.bin|state.sav>",
+		desc:    "Run the program interactively",
+		all:     true,
+		exclude: analysisFlags,
+		run:     runFlags,
+	},
+	{
+		name:    "debug",
+		args:    "<prog.bin|state.sav>",
+		desc:    "Run the program under the debugger",
+		all:     true,
+		exclude: append([]string{"debug"}, analysisFlags...),
+		run: func(o *options, args []string, stopProfiler func()) {
+			o.debug = true
+			runFlags(o, args, stopProfiler)
+		},
+	},
+	{
+		name:     "trace",
+		args:     "<prog.bin|state.sav>",
+		desc:     "Run the program, writing executed instructions to stderr or -trace",
+		all:      true,
+		exclude:  analysisFlags,
+		defaults: map[string]string{"trace": stdioPath},
+		run:      runFlags,
+	},
+	{
+		name:     "dap",
+		args:     "<prog.bin|state.sav>",
+		desc:     "Debug the program from an editor using the Debug Adapter Protocol",
+		flags:    []string{"dap", "load-from", "patch", "skip-intro"},
+		defaults: map[string]string{"dap": stdioPath},
+		run: func(o *options, args []string, stopProfiler func()) {
+			vm, _ := loadProgram(o, args)
+			cmdDAP(o, prepareVM(o, vm), firstArg(args))
+		},
+	},
+	{
+		name:  "disasm",
+		args:  "<prog.bin|state.sav>",
+		desc:  "Print disassembly of reachable code",
+		flags: []string{"annotate", "decrypt", "json", "load-from", "patch"},
+		run: func(o *options, args []string, stopProfiler func()) {
+			o.disasm = true
+			vm, _ := loadProgram(o, args)
+			cmdAnalyze(o, vm, firstArg(args))
+		},
+	},
+	{
+		name: "serve",
+		args: "<prog.bin|state.sav>",
+		desc: "Serve the program to web browsers and REST and gRPC API clients",
+		flags: []string{"grpc", "grpc-cert", "grpc-key", "http", "load-from", "max-ips",
+			"max-sessions", "patch", "session-idle", "session-ips", "session-save-mem",
+			"skip-intro", "turbo", "user-quota", "user-saves", "user-tokens"},
+		defaults: map[string]string{"http": ":8080"},
+		run: func(o *options, args []string, stopProfiler func()) {
+			vm, _ := loadProgram(o, args)
+			cmdServe(o, prepareVM(o, vm))
+		},
+	},
+	{
+		name: "solve",
+		args: "[<prog.bin|state.sav>]",
+		desc: "Print teleporter eighth-register values, or -brute results",
+		flags: []string{"brute", "brute-grep", "brute-timeout", "brute-workers", "cmd-sep",
+			"jit", "load-from", "max-ips", "patch", "skip-intro", "teleporter", "turbo"},
+		run: func(o *options, args []string, stopProfiler func()) {
+			if len(args) == 0 && o.loadFrom == "" {
+				cmdSolve(o, nil)
+				return
+			}
+			vm, _ := loadProgram(o, args)
+			cmdSolve(o, prepareVM(o, vm))
+		},
+	},
+	{
+		name:     "asm",
+		args:     "<src.s>",
+		desc:     "Assemble a source file",
+		flags:    []string{"o=asm", "list=asm-list"},
+		defaults: map[string]string{"o": stdioPath},
+		run: func(o *options, args []string, stopProfiler func()) {
+			cmdAsm(args[0], o.asmOut, o.asmList)
+		},
+	},
+}
+
+// findSubcommand returns the subcommand named name, or nil if there isn't one.
+func findSubcommand(name string) *subcommand {
+	for _, c := range subcommands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// parse parses the command's flags from args into o and returns the
+// remaining positional arguments. The process exits if the flags or the
+// number of arguments are invalid.
+func (c *subcommand) parse(o *options, args []string) []string {
+	fs := c.flagSet(o, flag.ExitOnError)
+	fs.Parse(args)
+
+	optional := strings.HasPrefix(c.args, "[") || o.loadFrom != ""
+	if n := fs.NArg(); n > 1 || (n == 0 && !optional) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+// flagSet returns a flag set containing the command's flags, which are
+// stored in o. The command's default values are applied to o.
+func (c *subcommand) flagSet(o *options, eh flag.ErrorHandling) *flag.FlagSet {
+	prog := os.Args[0] + " " + c.name
+	fs := flag.NewFlagSet(prog, eh)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s %s\n\n%s.\n\n", prog, c.args, c.desc)
+		fs.PrintDefaults()
+	}
+	top := flag.NewFlagSet(os.Args[0], flag.PanicOnError)
+	o.register(top)
+
+	names := make(map[string]string) // local name to top-level name
+	for _, n := range c.flags {
+		local, tn := n, n
+		if i := strings.IndexByte(n, '='); i >= 0 {
+			local, tn = n[:i], n[i+1:]
+		}
+		names[local] = tn
+	}
+	if c.all {
+		top.VisitAll(func(f *flag.Flag) { names[f.Name] = f.Name })
+		for _, n := range c.exclude {
+			delete(names, n)
+		}
+	}
+	for local, tn := range names {
+		f := top.Lookup(tn)
+		assertf(f != nil, "no flag %q", tn)
+		if def, ok := c.defaults[local]; ok {
+			if err := f.Value.Set(def); err != nil {
+				panic(fmt.Sprintf("setting -%s: %v", local, err))
+			}
+		}
+		fs.Var(f.Value, local, f.Usage)
+	}
+	return fs
+}
+
+// writeSubcommands lists the subcommands for the top-level usage message.
+func writeSubcommands(w io.Writer) {
+	cmds := append([]*subcommand(nil), subcommands...)
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	fmt.Fprintln(w, "Commands (run with -h for flags):")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-7s %-23s %s\n", c.name, c.args, c.desc)
+	}
+}
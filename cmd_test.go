@@ -0,0 +1,64 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestSubcommandFlags(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		args []string
+		get  func(o *options) interface{} // nil if parsing should fail
+		want interface{}
+	}{
+		{"asm", []string{"a.s"}, func(o *options) interface{} { return [2]string{o.asmOut, o.asmList} },
+			[2]string{stdioPath, ""}},
+		{"asm", []string{"-o", "a.bin", "-list", "a.lst", "a.s"},
+			func(o *options) interface{} { return [2]string{o.asmOut, o.asmList} },
+			[2]string{"a.bin", "a.lst"}},
+		{"asm", []string{"-asm", "a.bin", "a.s"}, nil, nil},
+		{"serve", []string{"p.bin"}, func(o *options) interface{} { return o.httpAddr }, ":8080"},
+		{"serve", []string{"-http", ":9000", "p.bin"}, func(o *options) interface{} { return o.httpAddr }, ":9000"},
+		{"serve", []string{"-debug", "p.bin"}, nil, nil},
+		{"trace", []string{"p.bin"}, func(o *options) interface{} { return o.tracePath }, stdioPath},
+		{"run", []string{"-undo", "5", "p.bin"}, func(o *options) interface{} { return o.undo }, 5},
+		{"run", []string{"-http", ":8080", "p.bin"}, nil, nil},
+		{"run", []string{"-disasm", "p.bin"}, nil, nil},
+		{"solve", []string{"-brute", "in.txt", "p.bin"}, func(o *options) interface{} { return o.brute }, "in.txt"},
+		{"solve", []string{"-turbo", "p.bin"}, func(o *options) interface{} { return o.turbo }, true},
+		{"serve", []string{"-turbo", "p.bin"}, func(o *options) interface{} { return o.turbo }, true},
+	} {
+		c := findSubcommand(tc.cmd)
+		if c == nil {
+			t.Fatalf("No %q subcommand", tc.cmd)
+		}
+		var o options
+		fs := c.flagSet(&o, flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		if err := fs.Parse(tc.args); err != nil {
+			if tc.get != nil {
+				t.Errorf("%v %q failed: %v", tc.cmd, tc.args, err)
+			}
+		} else if tc.get == nil {
+			t.Errorf("%v %q unexpectedly succeeded", tc.cmd, tc.args)
+		} else if got := tc.get(&o); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v %q set %v; want %v", tc.cmd, tc.args, got, tc.want)
+		} else if args := fs.Args(); len(args) != 1 || args[0] != tc.args[len(tc.args)-1] {
+			t.Errorf("%v %q left args %q", tc.cmd, tc.args, args)
+		}
+	}
+}
+
+func TestSubcommandFlagNames(t *testing.T) {
+	// flagSet panics if a command lists an unknown top-level flag.
+	for _, c := range subcommands {
+		var o options
+		c.flagSet(&o, flag.ContinueOnError)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ANSI escape sequences for colorizing text.
+const (
+	ansiHost  = "\x1b[36m" // cyan, used for host messages
+	ansiReset = "\x1b[0m"
+)
+
+// colorWriter wraps each write to w in an ANSI color sequence.
+type colorWriter struct {
+	w     io.Writer
+	color string
+}
+
+func (cw colorWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(cw.w, cw.color+string(p)+ansiReset); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// useColor returns true if output to f should be colorized according to
+// mode: "always", "never", or "auto" (if f is a terminal).
+func useColor(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return isTerminal(int(f.Fd())) && os.Getenv("TERM") != "dumb", nil
+	default:
+		return false, fmt.Errorf("bad color mode %q", mode)
+	}
+}
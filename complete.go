@@ -0,0 +1,93 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// gameVerbs lists commands understood by the challenge's adventure game.
+var gameVerbs = []string{"drop", "go", "help", "inv", "look", "take", "use"}
+
+// complete returns completions for the input line head, which ends at the
+// cursor. cands contains replacements for head[start:].
+//
+// Meta-command names are completed after s.prefix. Otherwise, the first word
+// is completed to a verb, exit, or alias, and the remainder of the line is
+// completed to an exit (after "go"), an item in the room (after "take"), or an
+// item in the room or inventory.
+func (s *session) complete(head string) (start int, cands []string) {
+	if s.prefix != "" && strings.HasPrefix(head, s.prefix) {
+		rest := head[len(s.prefix):]
+		if strings.ContainsAny(rest, " \t") {
+			return 0, nil
+		}
+		return len(s.prefix), matchPrefix(metaCommands(), rest)
+	}
+
+	things, exits, inv := s.info.nouns()
+	i := strings.IndexByte(head, ' ')
+	if i < 0 {
+		words := append(append([]string(nil), gameVerbs...), exits...)
+		for name := range s.aliases {
+			words = append(words, name)
+		}
+		return 0, matchPrefix(words, head)
+	}
+	start = i + 1
+	for start < len(head) && head[start] == ' ' {
+		start++
+	}
+	var nouns []string
+	switch head[:i] {
+	case "go":
+		nouns = exits
+	case "take":
+		nouns = things
+	default:
+		nouns = append(things, inv...)
+	}
+	return start, matchPrefix(nouns, head[start:])
+}
+
+// matchPrefix returns the sorted, unique strings in words that start with
+// prefix.
+func matchPrefix(words []string, prefix string) []string {
+	seen := make(map[string]bool)
+	var matches []string
+	for _, w := range words {
+		if strings.HasPrefix(w, prefix) && !seen[w] {
+			matches = append(matches, w)
+			seen[w] = true
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// metaCommands returns the names of the meta-commands listed in metaHelp.
+func metaCommands() []string {
+	var cmds []string
+	for _, ln := range strings.Split(metaHelp, "\n")[1:] {
+		if f := strings.Fields(ln); len(f) > 0 {
+			cmds = append(cmds, f[0])
+		}
+	}
+	return cmds
+}
+
+// commonPrefix returns the longest common prefix of strs.
+func commonPrefix(strs []string) string {
+	if len(strs) == 0 {
+		return ""
+	}
+	p := strs[0]
+	for _, s := range strs[1:] {
+		for !strings.HasPrefix(s, p) {
+			p = p[:len(p)-1]
+		}
+	}
+	return p
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// This file implements a JSON-RPC 2.0 interface for controlling the VM over
+// stdin and stdout, so the VM can be embedded in other programs without
+// network setup. Each request and response is a single line. Methods mirror
+// the REST API (see apiHelp); params are in a JSON object:
+//
+//	input     send {"text"} to the program, returning {"pending"} byte count
+//	state     get state after waiting up to {"wait"} (e.g. "1s") for the program to stop
+//	regs      get registers, stack, ip, and instruction count
+//	mem       get {"n"} words of memory starting at {"addr"}
+//	step      execute {"n"} instructions and pause
+//	continue  resume paused program
+//	breaks    list breakpoints
+//	addBreak  add breakpoint at {"addr"}
+//	delBreak  delete breakpoint at {"addr"}
+//	snapshot  get base64-encoded state as {"data"} ({"format"} is gob, json, or text)
+//	restore   restore state from base64-encoded {"data"}
+//	halt      halt the program
+//
+// Methods that inspect the VM accept {"wait"} like state. The program's
+// output is sent in "output" notifications with {"text"}, and a "halted"
+// notification containing the final state is sent when the program stops.
+
+// JSON-RPC error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+// rpcMaxLine is the maximum length of a request.
+const rpcMaxLine = 16 << 20
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"` // nil for notifications
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// rpcParams contains the union of all methods' params.
+type rpcParams struct {
+	Text   string `json:"text"`
+	Wait   string `json:"wait"`
+	Addr   int    `json:"addr"`
+	N      int    `json:"n"`
+	Format string `json:"format"`
+	Data   []byte `json:"data"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"` // for notifications
+	Params  interface{}     `json:"params,omitempty"` // for notifications
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcServer controls a VM on behalf of a JSON-RPC client.
+type rpcServer struct {
+	s   *apiSession
+	mu  sync.Mutex // guards enc
+	enc *json.Encoder
+}
+
+// serveControl starts vm and handles JSON-RPC requests from r, writing
+// responses and notifications to w. It returns at the end of input.
+func serveControl(r io.Reader, w io.Writer, vm *vm) error {
+	rs := &rpcServer{s: newAPISession("stdio", vm, 0), enc: json.NewEncoder(w)}
+	done := make(chan struct{})
+	go func() {
+		rs.sendOutput()
+		close(done)
+	}()
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, rpcMaxLine)
+	for sc.Scan() {
+		ln := bytes.TrimSpace(sc.Bytes())
+		if len(ln) == 0 {
+			continue
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(ln, &req); err != nil {
+			rs.send(rpcMessage{ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}})
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			id := req.ID
+			if id == nil {
+				id = json.RawMessage("null")
+			}
+			rs.send(rpcMessage{ID: id, Error: &rpcError{rpcInvalidRequest, "invalid request"}})
+			continue
+		}
+		res, rerr := rs.call(req.Method, req.Params)
+		if req.ID == nil {
+			continue // notification
+		}
+		if rerr != nil {
+			rs.send(rpcMessage{ID: req.ID, Error: rerr})
+		} else {
+			rs.send(rpcMessage{ID: req.ID, Result: res})
+		}
+	}
+	vm.halt()
+	<-done
+	return sc.Err()
+}
+
+// send writes msg to the client.
+func (rs *rpcServer) send(msg rpcMessage) {
+	msg.JSONRPC = "2.0"
+	rs.mu.Lock()
+	rs.enc.Encode(msg)
+	rs.mu.Unlock()
+}
+
+// sendOutput sends "output" notifications as the program writes output and
+// a "halted" notification when it stops.
+func (rs *rpcServer) sendOutput() {
+	s := rs.s
+	for {
+		s.mu.Lock()
+		for len(s.out) == 0 && !s.outDone {
+			s.outCond.Wait()
+		}
+		out, done := string(s.out), s.outDone
+		s.out = nil
+		s.mu.Unlock()
+		if out != "" {
+			rs.send(rpcMessage{Method: "output", Params: map[string]string{"text": out}})
+		}
+		if done {
+			break
+		}
+	}
+	rs.send(rpcMessage{Method: "halted", Params: s.state(0)})
+}
+
+// call executes method with the supplied params and returns its result.
+func (rs *rpcServer) call(method string, raw json.RawMessage) (interface{}, *rpcError) {
+	var p rpcParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+	}
+	wait := apiStopTimeout
+	if p.Wait != "" {
+		var err error
+		if wait, err = time.ParseDuration(p.Wait); err != nil || wait < 0 {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("bad wait %q", p.Wait)}
+		}
+	}
+	badParams := func(format string, args ...interface{}) (interface{}, *rpcError) {
+		return nil, &rpcError{rpcInvalidParams, fmt.Sprintf(format, args...)}
+	}
+
+	s := rs.s
+	s.ctlMu.Lock()
+	defer s.ctlMu.Unlock()
+
+	var res interface{}
+	var err error
+	switch method {
+	case "input":
+		res = map[string]int{"pending": s.vm.in.write([]byte(p.Text))}
+	case "state":
+		res = s.state(wait)
+	case "regs":
+		res, err = s.regs(wait)
+	case "mem":
+		if p.Addr < 0 || p.Addr > vmax {
+			return badParams("bad addr %d", p.Addr)
+		}
+		if p.N == 0 {
+			p.N = 16
+		} else if p.N < 0 || p.N > apiMaxMemWords {
+			return badParams("bad n %d", p.N)
+		}
+		var words []uint16
+		if words, err = s.mem(p.Addr, p.N, wait); err == nil {
+			res = struct {
+				Addr  int      `json:"addr"`
+				Words []uint16 `json:"words"`
+			}{p.Addr, words}
+		}
+	case "step":
+		if p.N == 0 {
+			p.N = 1
+		} else if p.N < 0 {
+			return badParams("bad n %d", p.N)
+		}
+		if err = s.step(p.N, wait); err == nil {
+			res = s.state(wait)
+		}
+	case "continue":
+		s.cont()
+		res = s.state(0)
+	case "breaks", "addBreak", "delBreak":
+		if p.Addr < 0 || p.Addr > vmax {
+			return badParams("bad addr %d", p.Addr)
+		}
+		res, err = s.breaks(p.Addr, method == "addBreak", method == "delBreak", wait)
+	case "snapshot":
+		enc := gobSnapshot
+		switch p.Format {
+		case "", "gob":
+		case "json":
+			enc = jsonSnapshot
+		case "text":
+			enc = textSnapshot
+		default:
+			return badParams("bad format %q", p.Format)
+		}
+		var snap *snapshot
+		if snap, err = s.snapshot(wait); err == nil {
+			var b bytes.Buffer
+			if err = writeSnapshot(&b, snap, enc); err == nil {
+				res = map[string][]byte{"data": b.Bytes()}
+			}
+		}
+	case "restore":
+		snap, err := readSnapshot(bytes.NewReader(p.Data))
+		if err != nil {
+			return badParams("bad snapshot: %v", err)
+		}
+		if err = s.restore(snap, wait); err != nil {
+			return nil, &rpcError{rpcServerError, err.Error()}
+		}
+		res = s.state(wait)
+	case "halt":
+		s.vm.halt()
+		res = s.state(wait)
+	default:
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("unknown method %q", method)}
+	}
+	if err != nil {
+		return nil, &rpcError{rpcServerError, err.Error()}
+	}
+	return res, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// coreHistory is the number of recently-executed instructions recorded in core dumps.
+const coreHistory = 64
+
+// coreSnapshot returns a snapshot of vm after it failed with err, including
+// the addresses in vm.hist.
+func coreSnapshot(vm *vm, err error) *snapshot {
+	snap := vm.snapshot()
+	snap.Meta.Fault = err.Error()
+	snap.Meta.Trace = vm.history()
+	return snap
+}
+
+// writeCoreInfo writes a description of the core dump in snap to w:
+// the fault, registers, stack, and disassembly of recent instructions.
+func writeCoreInfo(w io.Writer, snap *snapshot) error {
+	var b strings.Builder
+	fault := snap.Meta.Fault
+	if fault == "" {
+		fault = "(none)"
+	}
+	fmt.Fprintf(&b, "Fault: %s\n", fault)
+	fmt.Fprintf(&b, "Steps: %d\n", snap.Meta.Steps)
+	fmt.Fprintf(&b, "IP:    %d\n", snap.IP)
+	for i, v := range snap.Reg {
+		fmt.Fprintf(&b, "r%d=%-6d", i, v)
+	}
+	fmt.Fprintf(&b, "\nStack: %v\n", snap.Stack)
+
+	// Instructions are decoded using the final memory, which may differ from
+	// what was executed if the code was modified.
+	mem := snap.memory()
+	fmt.Fprintf(&b, "Last %d instruction(s):\n", len(snap.Meta.Trace))
+	for _, addr := range snap.Meta.Trace {
+		if in, ok := decode(mem, addr); ok {
+			fmt.Fprintf(&b, "%5d: %s\n", addr, in)
+		} else {
+			fmt.Fprintf(&b, "%5d: %d\n", addr, mem[addr])
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,663 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This file implements a server for the Debug Adapter Protocol
+// (https://microsoft.github.io/debug-adapter-protocol/) so editors can debug
+// programs. The program's disassembly is served as a source with one
+// instruction per line, and the program's output is sent as output events.
+// Lines typed into the debug console that aren't expressions are sent to the
+// program as input.
+
+const (
+	dapThreadID  = 1 // the only thread
+	dapSourceRef = 1 // reference of the disassembly source
+	dapRegsRef   = 1 // variables reference for registers
+	dapStackRef  = 2 // variables reference for the stack
+	dapMaxFrames = 32
+)
+
+// dapMessage is a request, response, or event.
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"` // "request", "response", or "event"
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    bool            `json:"success,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	Body       interface{}     `json:"body,omitempty"`
+}
+
+// dapServer debugs a single VM for a client.
+type dapServer struct {
+	r   *bufio.Reader
+	w   io.Writer
+	wmu sync.Mutex // guards w and seq
+	seq int
+	msg io.Writer // receives log messages
+
+	vm  *vm
+	dbg *debugger
+	api *apiSession // nil until the program is started
+
+	name   string          // name of the disassembly source
+	source string          // disassembly of the program
+	lines  map[uint16]int  // 1-indexed source lines keyed by address
+	addrs  map[int]uint16  // addresses keyed by source line
+	outMu  sync.Mutex      // serializes output events
+	srcBP  map[uint16]bool // breakpoints set in the source
+	insBP  map[uint16]bool // instruction breakpoints
+	temp   map[uint16]bool // temporary breakpoints for stepping
+	resume chan struct{}   // signaled when the program resumes after stopping
+	mu     sync.Mutex
+	reason string // reason for the next stopped event, guarded by mu
+
+	launched, configured bool
+	stopOnEntry          bool
+}
+
+// dapLineRegexp matches instruction lines written by writeDisasm.
+var dapLineRegexp = regexp.MustCompile(`^\s*(\d+): `)
+
+// serveDAP serves the Debug Adapter Protocol on stdin and stdout (if addr
+// is stdioPath) or to the first client that connects to addr, debugging vm.
+// name identifies the program. Log messages are written to msg.
+func serveDAP(addr string, vm *vm, name string, msg io.Writer) error {
+	if addr == stdioPath {
+		return newDAPServer(os.Stdin, os.Stdout, vm, name, msg).run()
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(msg, "Waiting for debugger at %v\n", ln.Addr())
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(msg, "Debugger connected from %v\n", conn.RemoteAddr())
+	return newDAPServer(conn, conn, vm, name, msg).run()
+}
+
+func newDAPServer(r io.Reader, w io.Writer, vm *vm, name string, msg io.Writer) *dapServer {
+	ds := &dapServer{
+		r:      bufio.NewReader(r),
+		w:      w,
+		msg:    msg,
+		vm:     vm,
+		dbg:    newDebugger(vm, ioutil.Discard, false),
+		name:   name + ".dis",
+		lines:  make(map[uint16]int),
+		addrs:  make(map[int]uint16),
+		srcBP:  make(map[uint16]bool),
+		insBP:  make(map[uint16]bool),
+		resume: make(chan struct{}, 1),
+		temp:   make(map[uint16]bool),
+	}
+	var b strings.Builder
+	analyze(vm.mem[:], 0, vm.ip).writeDisasm(&b, false)
+	ds.source = b.String()
+	for i, ln := range strings.Split(ds.source, "\n") {
+		if m := dapLineRegexp.FindStringSubmatch(ln); m != nil {
+			v, _ := strconv.Atoi(m[1])
+			ds.lines[uint16(v)] = i + 1
+			ds.addrs[i+1] = uint16(v)
+		}
+	}
+	return ds
+}
+
+// run handles requests until the client disconnects.
+func (ds *dapServer) run() error {
+	defer func() {
+		if ds.api != nil {
+			ds.vm.halt()
+		}
+	}()
+	tr := textproto.NewReader(ds.r)
+	for {
+		hdr, err := tr.ReadMIMEHeader()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(hdr.Get("Content-Length"))
+		if err != nil || n < 0 || n > 1<<20 {
+			return fmt.Errorf("bad content length %q", hdr.Get("Content-Length"))
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(ds.r, b); err != nil {
+			return err
+		}
+		var req dapMessage
+		if err := json.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := ds.handle(&req)
+		res := dapMessage{
+			Type:       "response",
+			Command:    req.Command,
+			RequestSeq: req.Seq,
+			Success:    err == nil,
+			Body:       body,
+		}
+		if err != nil {
+			res.Message = err.Error()
+		}
+		if err := ds.send(&res); err != nil {
+			return err
+		}
+		switch req.Command {
+		case "initialize":
+			ds.event("initialized", nil)
+		case "disconnect", "terminate":
+			return nil
+		}
+		if ds.launched && ds.configured && ds.api == nil {
+			ds.start()
+		}
+	}
+}
+
+// send writes m to the client, assigning its sequence number.
+func (ds *dapServer) send(m *dapMessage) error {
+	ds.wmu.Lock()
+	defer ds.wmu.Unlock()
+	ds.seq++
+	m.Seq = ds.seq
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(ds.w, "Content-Length: %d\r\n\r\n", len(b)); err != nil {
+		return err
+	}
+	_, err = ds.w.Write(b)
+	return err
+}
+
+// event sends an event to the client.
+func (ds *dapServer) event(name string, body interface{}) {
+	if err := ds.send(&dapMessage{Type: "event", Event: name, Body: body}); err != nil {
+		fmt.Fprintf(ds.msg, "Failed sending %v event: %v\n", name, err)
+	}
+}
+
+// start starts the program and begins watching it.
+func (ds *dapServer) start() {
+	if ds.stopOnEntry {
+		ds.dbg.steps = 1
+		ds.reason = "entry"
+	}
+	ds.applyBreaks()
+	ds.api = newAPISession("dap", ds.vm, 0)
+	go ds.copyOutput()
+	go ds.watch()
+}
+
+// withVM runs f while the program is waiting for input, paused, or halted,
+// or immediately if the program hasn't been started yet.
+func (ds *dapServer) withVM(f func()) error {
+	if ds.api == nil {
+		f()
+		return nil
+	}
+	if !ds.api.do(f, apiStopTimeout) {
+		return errRunning
+	}
+	return nil
+}
+
+// applyBreaks updates the debugger's breakpoints.
+// It must be called within withVM.
+func (ds *dapServer) applyBreaks() {
+	ds.dbg.breaks = make(map[uint16]struct{})
+	for _, m := range []map[uint16]bool{ds.srcBP, ds.insBP, ds.temp} {
+		for a := range m {
+			ds.dbg.breaks[a] = struct{}{}
+		}
+	}
+}
+
+// copyOutput sends the program's output to the client as output events.
+func (ds *dapServer) copyOutput() {
+	s := ds.api
+	for {
+		s.mu.Lock()
+		for len(s.out) == 0 && !s.outDone {
+			s.outCond.Wait()
+		}
+		done := len(s.out) == 0
+		s.mu.Unlock()
+		if done {
+			return
+		}
+		ds.flushOutput()
+	}
+}
+
+// flushOutput sends buffered output to the client.
+func (ds *dapServer) flushOutput() {
+	s := ds.api
+	ds.outMu.Lock()
+	defer ds.outMu.Unlock()
+	s.mu.Lock()
+	out := s.out
+	s.out = nil
+	s.mu.Unlock()
+	if len(out) > 0 {
+		ds.event("output", map[string]interface{}{"category": "stdout", "output": string(out)})
+	}
+}
+
+// watch sends stopped events when the program is paused and exited and
+// terminated events when it halts.
+func (ds *dapServer) watch() {
+	for {
+		select {
+		case ds.dbg.ctl <- func() {}:
+		case <-ds.vm.stopped:
+			st := ds.api.state(0)
+			ds.flushOutput()
+			code := 0
+			if st.Error != "" {
+				ds.event("output", map[string]interface{}{"category": "stderr", "output": st.Error + "\n"})
+				code = 1
+			}
+			ds.event("exited", map[string]interface{}{"exitCode": code})
+			ds.event("terminated", nil)
+			return
+		}
+
+		ds.api.state(0) // wait for output to be buffered
+		ds.flushOutput()
+		var trap bool
+		ds.api.do(func() {
+			trap = ds.vm.mem[ds.vm.ip] == 22
+			if len(ds.temp) > 0 {
+				ds.temp = make(map[uint16]bool)
+				ds.applyBreaks()
+			}
+		}, apiStopTimeout)
+		ds.mu.Lock()
+		reason := ds.reason
+		ds.reason = ""
+		ds.mu.Unlock()
+		if reason == "" {
+			reason = "breakpoint"
+			if trap {
+				reason = "trap"
+			}
+		}
+		ds.event("stopped", map[string]interface{}{
+			"reason":            reason,
+			"threadId":          dapThreadID,
+			"allThreadsStopped": true,
+		})
+		<-ds.resume
+	}
+}
+
+// cont resumes the paused program. If steps is positive, it pauses again
+// after executing that many instructions. reason is used for the next
+// stopped event.
+func (ds *dapServer) cont(steps int, reason string) error {
+	ds.mu.Lock()
+	ds.reason = reason
+	ds.mu.Unlock()
+	cmd := "continue"
+	if steps > 0 {
+		cmd = fmt.Sprintf("step %d", steps)
+	}
+	if ds.dbg.paused() {
+		if ds.dbg.feed(cmd) {
+			ds.resume <- struct{}{}
+		}
+		return nil
+	}
+	if steps == 0 {
+		return nil // already running
+	}
+	// The program is waiting for input. The "in" instruction at ip hasn't
+	// been checked for pausing yet, so it counts against the steps.
+	return ds.withVM(func() { ds.dbg.steps = steps + 1 })
+}
+
+// runTo continues the paused program until it reaches addr.
+func (ds *dapServer) runTo(addr uint16, reason string) error {
+	if err := ds.withVM(func() {
+		ds.temp[addr] = true
+		ds.applyBreaks()
+	}); err != nil {
+		return err
+	}
+	return ds.cont(0, reason)
+}
+
+// frames returns the address of the instruction at ip followed by likely
+// return addresses found on the stack. It must be called within withVM.
+func (ds *dapServer) frames() []uint16 {
+	return append([]uint16{ds.vm.ip}, callers(ds.vm, dapMaxFrames-1)...)
+}
+
+// parseAddr parses a decimal address from a memory or instruction reference.
+func parseAddr(s string, off int) (uint16, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v+off < 0 || v+off > vmax {
+		return 0, fmt.Errorf("bad address %q", s)
+	}
+	return uint16(v + off), nil
+}
+
+// evalExpr evaluates a register ("r0"-"r7"), "ip", or memory address
+// (e.g. "123" or "[123]"). It must be called within withVM.
+func (ds *dapServer) evalExpr(expr string) (uint16, bool) {
+	expr = strings.TrimSpace(expr)
+	if expr == "ip" {
+		return ds.vm.ip, true
+	}
+	if len(expr) == 2 && expr[0] == 'r' && expr[1] >= '0' && expr[1] < '0'+nregs {
+		return ds.vm.reg[expr[1]-'0'], true
+	}
+	expr = strings.TrimSuffix(strings.TrimPrefix(expr, "["), "]")
+	if v, err := strconv.ParseUint(expr, 0, 16); err == nil && v <= vmax {
+		return ds.vm.mem[v], true
+	}
+	return 0, false
+}
+
+// disassemble returns count instructions starting off instructions from addr.
+// It must be called within withVM.
+func (ds *dapServer) disassemble(addr, off, count int) []map[string]interface{} {
+	decodeAt := func(a int) (text string, size int) {
+		if in, ok := decode(ds.vm.mem[:], uint16(a)); ok {
+			return in.String(), int(in.size())
+		}
+		return fmt.Sprintf("data %d", ds.vm.mem[a]), 1
+	}
+
+	// Instructions have different sizes, so decode from a bit before addr
+	// to find the instructions preceding it.
+	var addrs []int
+	start := addr
+	if off < 0 {
+		start += 4 * off
+	}
+	if start < 0 {
+		start = 0
+	}
+	for a := start; a < addr; {
+		addrs = append(addrs, a)
+		_, n := decodeAt(a)
+		a += n
+	}
+	before := len(addrs)
+	for a := addr; a < msize && len(addrs) < before+off+count; {
+		addrs = append(addrs, a)
+		_, n := decodeAt(a)
+		a += n
+	}
+
+	res := make([]map[string]interface{}, 0, count)
+	for i := before + off; len(res) < count; i++ {
+		if i < 0 || i >= len(addrs) {
+			a := 0
+			if i >= 0 {
+				a = vmax
+			}
+			res = append(res, map[string]interface{}{
+				"address": strconv.Itoa(a), "instruction": "", "presentationHint": "invalid",
+			})
+			continue
+		}
+		text, _ := decodeAt(addrs[i])
+		m := map[string]interface{}{"address": strconv.Itoa(addrs[i]), "instruction": text}
+		if ln, ok := ds.lines[uint16(addrs[i])]; ok {
+			m["location"] = ds.sourceRef()
+			m["line"] = ln
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// sourceRef returns a reference to the disassembly source.
+func (ds *dapServer) sourceRef() map[string]interface{} {
+	return map[string]interface{}{"name": ds.name, "sourceReference": dapSourceRef}
+}
+
+// handle handles req and returns the response body.
+func (ds *dapServer) handle(req *dapMessage) (interface{}, error) {
+	var args struct {
+		// launch
+		StopOnEntry bool `json:"stopOnEntry"`
+		// setBreakpoints
+		Breakpoints []struct {
+			Line                 int    `json:"line"`
+			InstructionReference string `json:"instructionReference"`
+			Offset               int    `json:"offset"`
+		} `json:"breakpoints"`
+		// disassemble
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int    `json:"offset"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+		// variables
+		VariablesReference int `json:"variablesReference"`
+		// evaluate
+		Expression string `json:"expression"`
+		Context    string `json:"context"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsDisassembleRequest":       true,
+			"supportsInstructionBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch", "attach":
+		ds.launched = true
+		ds.stopOnEntry = args.StopOnEntry
+		return nil, nil
+	case "configurationDone":
+		ds.configured = true
+		return nil, nil
+	case "setBreakpoints", "setInstructionBreakpoints":
+		bps := make(map[uint16]bool)
+		var res []map[string]interface{}
+		for _, bp := range args.Breakpoints {
+			var addr uint16
+			var err error
+			ok := true
+			if req.Command == "setBreakpoints" {
+				addr, ok = ds.addrs[bp.Line]
+			} else {
+				addr, err = parseAddr(bp.InstructionReference, bp.Offset)
+				ok = err == nil
+			}
+			if ok {
+				bps[addr] = true
+			}
+			m := map[string]interface{}{"verified": ok}
+			if ln, found := ds.lines[addr]; ok && found {
+				m["line"] = ln
+				m["source"] = ds.sourceRef()
+			}
+			if ok {
+				m["instructionReference"] = strconv.Itoa(int(addr))
+			}
+			res = append(res, m)
+		}
+		if err := ds.withVM(func() {
+			if req.Command == "setBreakpoints" {
+				ds.srcBP = bps
+			} else {
+				ds.insBP = bps
+			}
+			ds.applyBreaks()
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"breakpoints": res}, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThreadID, "name": "vm"}},
+		}, nil
+	case "stackTrace":
+		var res []map[string]interface{}
+		if err := ds.withVM(func() {
+			for i, addr := range ds.frames() {
+				name := strconv.Itoa(int(addr))
+				if in, ok := decode(ds.vm.mem[:], addr); ok {
+					name += ": " + in.String()
+				}
+				f := map[string]interface{}{
+					"id":                          i,
+					"name":                        name,
+					"line":                        0,
+					"column":                      0,
+					"instructionPointerReference": strconv.Itoa(int(addr)),
+				}
+				if ln, ok := ds.lines[addr]; ok {
+					f["source"] = ds.sourceRef()
+					f["line"] = ln
+				}
+				res = append(res, f)
+			}
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"stackFrames": res, "totalFrames": len(res)}, nil
+	case "scopes":
+		return map[string]interface{}{"scopes": []map[string]interface{}{
+			{"name": "Registers", "variablesReference": dapRegsRef},
+			{"name": "Stack", "variablesReference": dapStackRef},
+		}}, nil
+	case "variables":
+		res := []map[string]interface{}{}
+		add := func(name string, v uint16) {
+			res = append(res, map[string]interface{}{
+				"name": name, "value": strconv.Itoa(int(v)), "variablesReference": 0,
+			})
+		}
+		if err := ds.withVM(func() {
+			switch args.VariablesReference {
+			case dapRegsRef:
+				for i, v := range ds.vm.reg {
+					add(fmt.Sprintf("r%d", i), v)
+				}
+				add("ip", ds.vm.ip)
+			case dapStackRef:
+				for i := len(ds.vm.stack) - 1; i >= 0; i-- {
+					add(fmt.Sprintf("[%d]", len(ds.vm.stack)-1-i), ds.vm.stack[i])
+				}
+			}
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"variables": res}, nil
+	case "source":
+		return map[string]interface{}{"content": ds.source, "mimeType": "text/x-asm"}, nil
+	case "disassemble":
+		addr, err := parseAddr(args.MemoryReference, args.Offset)
+		if err != nil {
+			return nil, err
+		}
+		var res []map[string]interface{}
+		if err := ds.withVM(func() {
+			res = ds.disassemble(int(addr), args.InstructionOffset, args.InstructionCount)
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"instructions": res}, nil
+	case "evaluate":
+		var v uint16
+		var ok bool
+		if err := ds.withVM(func() { v, ok = ds.evalExpr(args.Expression) }); err != nil {
+			return nil, err
+		}
+		if ok {
+			return map[string]interface{}{"result": strconv.Itoa(int(v)), "variablesReference": 0}, nil
+		}
+		if args.Context != "repl" || ds.api == nil {
+			return nil, fmt.Errorf("can't evaluate %q", args.Expression)
+		}
+		ds.api.vm.in.write([]byte(args.Expression + "\n"))
+		return map[string]interface{}{"result": "", "variablesReference": 0}, nil
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, ds.cont(0, "")
+	case "stepIn", "stepBack":
+		if req.Command == "stepBack" {
+			return nil, errors.New("can't step back")
+		}
+		return nil, ds.cont(1, "step")
+	case "next", "stepOut":
+		var target uint16
+		var err error
+		if err = ds.withVM(func() {
+			if req.Command == "next" {
+				if in, ok := decode(ds.vm.mem[:], ds.vm.ip); ok && in.op == 17 { // call
+					target = in.next()
+				}
+			} else if frames := ds.frames(); len(frames) > 1 {
+				target = frames[1]
+			} else {
+				err = errors.New("no caller found")
+			}
+		}); err != nil {
+			return nil, err
+		}
+		if target == 0 {
+			return nil, ds.cont(1, "step")
+		}
+		return nil, ds.runTo(target, "step")
+	case "pause":
+		if ds.api == nil || ds.dbg.paused() {
+			return nil, nil
+		}
+		ds.mu.Lock()
+		ds.reason = "pause"
+		ds.mu.Unlock()
+		if !ds.vm.doWithin(func() { ds.dbg.steps = 1 }, apiStopTimeout) {
+			return nil, errRunning
+		}
+		return nil, nil
+	case "disconnect", "terminate":
+		ds.vm.halt()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported command %q", req.Command)
+}
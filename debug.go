@@ -0,0 +1,389 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const debugHelp = `Commands:
+  c, continue         resume execution
+  s, step [n]         execute n instructions (default 1)
+  r, regs             print registers, stack, and ip
+  x <addr> [n]        print n words of memory (default 8)
+  d, dis [addr] [n]   disassemble n instructions (default ip and 8)
+  b, break <addr>     set breakpoint
+  bd, delete <addr>   delete breakpoint
+  bl, breaks          list breakpoints
+  set <rN|addr> <val> set register or memory word
+  jump <addr>         continue execution at addr
+  ckpts               list checkpoints taken at breakpoints and traps
+  rewind <n>          restore checkpoint n
+  save <file>         save VM state to file
+  load <file>         load VM state from file
+  q, quit             halt the program
+  h, help             print this message
+`
+
+// debugger implements an interactive prompt that's entered before executing
+// instructions at breakpoints, after single-stepping, and when "trap"
+// instructions are executed.
+type debugger struct {
+	vm     *vm
+	lines  chan string   // commands typed by the user; see feed
+	ack    chan struct{} // signaled after each line is handled
+	ctl    chan func()   // functions to run while paused
+	w      io.Writer     // prompt and command output
+	breaks map[uint16]struct{}
+	steps  int   // instructions remaining until pause, or 0 if not stepping
+	temp   int   // address of one-shot breakpoint used by MI commands, or -1
+	active int32 // 1 while paused; accessed atomically
+
+	mi  bool    // use GDB/MI syntax; see mi.go
+	bkn miBkpts // MI breakpoint numbers
+	why string  // MI stop reason set by commands that resume execution
+
+	maxCkpts int         // maximum number of checkpoints to keep
+	ckpts    []*snapshot // taken when breakpoints and traps are hit, oldest first
+}
+
+// newDebugger attaches a new debugger to vm.
+// Output is written to w. Input should be passed to feed, and the lines
+// channel should be closed at the end of input.
+// If stop is true, the debugger pauses before the first instruction.
+func newDebugger(vm *vm, w io.Writer, stop bool) *debugger {
+	d := &debugger{
+		vm:     vm,
+		lines:  make(chan string),
+		ack:    make(chan struct{}),
+		ctl:    make(chan func()),
+		w:      w,
+		breaks: make(map[uint16]struct{}),
+		temp:   -1,
+	}
+	if stop {
+		d.steps = 1
+	}
+	vm.dbg = d
+	return d
+}
+
+// paused returns true if the debugger is waiting for commands.
+// It may be called from any goroutine.
+func (d *debugger) paused() bool { return atomic.LoadInt32(&d.active) == 1 }
+
+// feed passes ln to the debugger and returns true if it's paused.
+// False is returned if ln should instead be sent to the program.
+// feed must only be called from a single goroutine.
+func (d *debugger) feed(ln string) bool {
+	// The debugger only resumes after handling a line (which we wait for
+	// below) or when the VM is halted, so if it's paused now, it's either
+	// waiting for a line or quitting.
+	if !d.paused() {
+		return d.mi && d.miRunning(ln)
+	}
+	select {
+	case d.lines <- ln:
+		<-d.ack
+	case <-d.vm.quit:
+	}
+	return true
+}
+
+// shouldPause is called by the VM before executing the instruction at ip.
+func (d *debugger) shouldPause(ip uint16) bool {
+	if d.steps > 0 {
+		d.steps--
+		if d.steps == 0 {
+			return true
+		}
+	}
+	if int(ip) == d.temp {
+		return true
+	}
+	_, ok := d.breaks[ip]
+	return ok
+}
+
+// pause reads and executes commands until execution should resume.
+// reason is included in the message describing why execution stopped.
+// d.vm.ip may be updated to change where execution continues.
+func (d *debugger) pause(reason string) {
+	atomic.StoreInt32(&d.active, 1)
+	defer atomic.StoreInt32(&d.active, 0)
+	d.steps = 0
+
+	if _, ok := d.breaks[d.vm.ip]; ok && reason == "" {
+		reason = "breakpoint"
+	}
+	if (reason == "breakpoint" || reason == "trap") && d.maxCkpts > 0 {
+		if len(d.ckpts) == d.maxCkpts {
+			d.ckpts = d.ckpts[1:]
+		}
+		d.ckpts = append(d.ckpts, d.vm.snapshot())
+	}
+	if ct := d.vm.ctrace; ct != nil {
+		var args map[string]interface{}
+		if reason != "" {
+			args = map[string]interface{}{"reason": reason}
+		}
+		ct.begin("paused", "debug", args)
+		defer ct.end()
+	}
+	if d.mi {
+		d.miStopped(reason)
+	} else {
+		if reason != "" {
+			reason = " (" + reason + ")"
+		}
+		fmt.Fprintf(d.w, "Paused at %d%s\n", d.vm.ip, reason)
+		d.disasm(d.vm.ip, 1)
+	}
+	d.temp, d.why = -1, ""
+	for {
+		if d.mi {
+			fmt.Fprint(d.w, miPrompt)
+		} else {
+			fmt.Fprint(d.w, "dbg> ")
+		}
+		var ln string
+		var ok bool
+		select {
+		case f := <-d.ctl:
+			f() // like vm.do, but while paused
+			continue
+		case ln, ok = <-d.lines:
+			if !ok {
+				d.vm.halt() // end of input
+				fmt.Fprintln(d.w)
+				return
+			}
+		case <-d.vm.quit:
+			fmt.Fprintln(d.w)
+			return
+		}
+		resume := d.handle(ln)
+		if resume {
+			atomic.StoreInt32(&d.active, 0) // before acking; see feed
+		}
+		d.ack <- struct{}{}
+		if resume {
+			return
+		}
+	}
+}
+
+// handle executes the command line ln and returns true if execution should resume.
+func (d *debugger) handle(ln string) bool {
+	if d.mi {
+		return d.execMI(ln)
+	}
+	fields := strings.Fields(ln)
+	if len(fields) == 0 {
+		return false
+	}
+	resume, err := d.exec(fields[0], fields[1:])
+	if err != nil {
+		fmt.Fprintln(d.w, err)
+		return false
+	}
+	return resume
+}
+
+// exec executes the command cmd with arguments args.
+// It returns true if execution should resume.
+func (d *debugger) exec(cmd string, args []string) (resume bool, err error) {
+	vm := d.vm
+
+	// arg parses the i-th argument, returning def if it's missing.
+	arg := func(i int, def uint16) (uint16, error) {
+		if i >= len(args) {
+			return def, nil
+		}
+		v, err := parseWord(args[i])
+		if err != nil {
+			return 0, fmt.Errorf("bad value %q", args[i])
+		}
+		return v, nil
+	}
+	// addr parses the required i-th argument as a memory address.
+	addr := func(i int) (uint16, error) {
+		if i >= len(args) {
+			return 0, fmt.Errorf("%s requires an address", cmd)
+		}
+		v, err := arg(i, 0)
+		if err == nil && v > vmax {
+			err = fmt.Errorf("bad address %q", args[i])
+		}
+		return v, err
+	}
+
+	switch cmd {
+	case "c", "continue":
+		return true, nil
+	case "s", "step":
+		n, err := arg(0, 1)
+		if err != nil || n == 0 {
+			return false, fmt.Errorf("bad step count")
+		}
+		d.steps = int(n)
+		return true, nil
+	case "r", "regs":
+		writeRegs(d.w, vm)
+	case "x":
+		start, err := addr(0)
+		if err != nil {
+			return false, err
+		}
+		n, err := arg(1, 8)
+		if err != nil {
+			return false, err
+		}
+		for i := 0; i < int(n) && int(start)+i < msize; i++ {
+			if i%8 == 0 {
+				if i > 0 {
+					fmt.Fprintln(d.w)
+				}
+				fmt.Fprintf(d.w, "%5d:", int(start)+i)
+			}
+			fmt.Fprintf(d.w, " %5d", vm.mem[int(start)+i])
+		}
+		fmt.Fprintln(d.w)
+	case "d", "dis":
+		start, err := arg(0, vm.ip)
+		if err != nil {
+			return false, err
+		}
+		n, err := arg(1, 8)
+		if err != nil {
+			return false, err
+		}
+		d.disasm(start, int(n))
+	case "b", "break", "bd", "delete":
+		a, err := addr(0)
+		if err != nil {
+			return false, err
+		}
+		if cmd == "b" || cmd == "break" {
+			d.breaks[a] = struct{}{}
+		} else {
+			delete(d.breaks, a)
+		}
+	case "bl", "breaks":
+		addrs := make([]int, 0, len(d.breaks))
+		for a := range d.breaks {
+			addrs = append(addrs, int(a))
+		}
+		sort.Ints(addrs)
+		for _, a := range addrs {
+			fmt.Fprintln(d.w, a)
+		}
+	case "set":
+		if len(args) != 2 {
+			return false, fmt.Errorf("usage: set <rN|addr> <val>")
+		}
+		v, err := arg(1, 0)
+		if err != nil {
+			return false, fmt.Errorf("bad value %q", args[1])
+		}
+		a, err := arg(0, 0)
+		if err != nil {
+			return false, err
+		}
+		if err := vm.setWord(a, v); err != nil {
+			return false, err
+		}
+	case "jump":
+		a, err := addr(0)
+		if err != nil {
+			return false, err
+		}
+		vm.ip = a
+		return true, nil
+	case "ckpts":
+		if len(d.ckpts) == 0 {
+			fmt.Fprintln(d.w, "No checkpoints")
+		}
+		for i, c := range d.ckpts {
+			fmt.Fprintf(d.w, "%3d: ip=%-5d steps=%d\n", i, c.IP, c.Meta.Steps)
+		}
+	case "rewind":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: rewind <n>")
+		}
+		i, err := strconv.Atoi(args[0])
+		if err != nil || i < 0 || i >= len(d.ckpts) {
+			return false, fmt.Errorf("bad checkpoint %q", args[0])
+		}
+		vm.restore(d.ckpts[i])
+		fmt.Fprintf(d.w, "Rewound to checkpoint %d at %d\n", i, vm.ip)
+		d.disasm(vm.ip, 1)
+	case "save", "load":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: %s <file>", cmd)
+		}
+		if cmd == "save" {
+			return false, saveSnapshotFile(args[0], vm.snapshot())
+		}
+		s, err := loadSnapshotFile(args[0])
+		if err != nil {
+			return false, err
+		}
+		vm.restore(s)
+		fmt.Fprintf(d.w, "Loaded state at %d\n", vm.ip)
+		d.disasm(vm.ip, 1)
+	case "q", "quit":
+		vm.halt()
+		return true, nil
+	case "h", "help":
+		fmt.Fprint(d.w, debugHelp)
+	default:
+		return false, fmt.Errorf("unknown command %q (try \"help\")", cmd)
+	}
+	return false, nil
+}
+
+// disasm writes up to n instructions starting at addr.
+func (d *debugger) disasm(addr uint16, n int) {
+	for i := 0; i < n && addr <= vmax; i++ {
+		in, ok := decode(d.vm.mem[:], addr)
+		if !ok {
+			fmt.Fprintf(d.w, "%5d: %d\n", addr, d.vm.mem[addr])
+			addr++
+			continue
+		}
+		fmt.Fprintf(d.w, "%5d: %s\n", addr, in)
+		addr = in.next()
+	}
+}
+
+// writeRegs writes vm's registers, ip, and stack to w.
+// The VM must not be executing instructions.
+func writeRegs(w io.Writer, vm *vm) {
+	for i, v := range vm.reg {
+		fmt.Fprintf(w, "r%d=%-6d", i, v)
+		if i == nregs/2-1 {
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintf(w, "\nip=%d stack=%v\n", vm.ip, vm.stack)
+}
+
+// callers returns up to max likely return addresses found on vm's stack,
+// innermost first. A value is assumed to be a return address if it follows
+// a two-word call instruction. The VM must not be executing instructions.
+func callers(vm *vm, max int) []uint16 {
+	var addrs []uint16
+	for i := len(vm.stack) - 1; i >= 0 && len(addrs) < max; i-- {
+		if v := vm.stack[i]; v >= 2 && v <= vmax && vm.mem[v-2] == opCall {
+			addrs = append(addrs, v)
+		}
+	}
+	return addrs
+}
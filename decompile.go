@@ -0,0 +1,293 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// condExpr is a lifted branch condition, e.g. "r1 == 113".
+type condExpr struct {
+	l, op, r string
+}
+
+func (c condExpr) String() string { return c.l + " " + c.op + " " + c.r }
+
+// not returns the negation of c.
+func (c condExpr) not() condExpr {
+	neg := map[string]string{"==": "!=", "!=": "==", ">": "<=", "<=": ">"}
+	return condExpr{c.l, neg[c.op], c.r}
+}
+
+// decompiler lifts a function's basic blocks into C-like pseudo-code.
+type decompiler struct {
+	p      *program
+	fn     *function
+	blocks []*block
+	loops  []loop
+	lines  []dline
+	refs   map[uint16]struct{} // addresses referenced by emitted gotos
+}
+
+// dline is a line of decompiler output.
+type dline struct {
+	depth   int
+	text    string
+	label   uint16 // only used if isLabel is true
+	isLabel bool
+}
+
+// writeDecompiled writes best-effort pseudo-code for each of p's functions to w.
+func (p *program) writeDecompiled(w io.Writer) error {
+	var b strings.Builder
+	for i, fn := range p.sortedFuncs() {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		p.decompile(fn, &b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// decompile writes pseudo-code for fn to b.
+func (p *program) decompile(fn *function, b *strings.Builder) {
+	d := &decompiler{
+		p:      p,
+		fn:     fn,
+		blocks: p.blocks(fn),
+		refs:   make(map[uint16]struct{}),
+	}
+	d.loops = findLoops(d.blocks)
+	if len(d.blocks) > 0 && d.blocks[0].start != fn.entry {
+		d.gotoLine(1, "", fn.entry)
+	}
+	d.emit(0, len(d.blocks)-1, 1, nil)
+
+	fmt.Fprintf(b, "%s() {\n", funcName(fn.entry))
+	for _, ln := range d.lines {
+		if ln.isLabel {
+			if _, ok := d.refs[ln.label]; ok {
+				fmt.Fprintf(b, "%s:\n", labelName(ln.label))
+			}
+			continue
+		}
+		fmt.Fprintf(b, "%s%s\n", strings.Repeat("\t", ln.depth), ln.text)
+	}
+	b.WriteString("}\n")
+}
+
+// labelName returns the label used for jumps to addr.
+func labelName(addr uint16) string { return fmt.Sprintf("L_%d", addr) }
+
+func (d *decompiler) add(depth int, format string, args ...interface{}) {
+	d.lines = append(d.lines, dline{depth: depth, text: fmt.Sprintf(format, args...)})
+}
+
+// gotoLine adds a "goto" statement (optionally preceded by prefix) targeting addr.
+func (d *decompiler) gotoLine(depth int, prefix string, addr uint16) {
+	d.refs[addr] = struct{}{}
+	d.add(depth, "%sgoto %s;", prefix, labelName(addr))
+}
+
+// emit emits blocks with indexes in [lo, hi] inside the innermost loop lp.
+func (d *decompiler) emit(lo, hi, depth int, lp *loop) {
+	for i := lo; i <= hi; {
+		if l := d.loopAt(i, hi, lp); l != nil {
+			d.emitLoop(l, depth)
+			i = l.tail + 1
+			continue
+		}
+		d.emitBlock(i, depth, lp, false)
+		i++
+	}
+}
+
+// loopAt returns the outermost loop (other than cur) that starts at index i
+// and ends at or before hi.
+func (d *decompiler) loopAt(i, hi int, cur *loop) *loop {
+	for j := range d.loops {
+		l := &d.loops[j]
+		if l.head == i && l.tail <= hi && (cur == nil || *l != *cur) {
+			return l
+		}
+	}
+	return nil
+}
+
+// emitLoop emits l as a "while" or "do-while" statement.
+func (d *decompiler) emitLoop(l *loop, depth int) {
+	head, tail := d.blocks[l.head], d.blocks[l.tail]
+	exit := tail.end()
+	d.lines = append(d.lines, dline{label: head.start, isLabel: true})
+
+	if last := tail.last(); last.op == opJt || last.op == opJf {
+		d.add(depth, "do {")
+		d.emitBody(l, depth+1)
+		c, _ := d.branchCond(tail, len(tail.instrs)-1)
+		d.add(depth, "} while (%s);", c)
+		return
+	}
+
+	// Use "while (cond)" if the head block consists solely of a loop exit test.
+	if len(head.instrs) == 1 && l.head != l.tail {
+		if in := head.instrs[0]; in.op == opJt || in.op == opJf {
+			if t, _ := in.target(); t == exit {
+				c, _ := d.branchCond(head, 0)
+				d.add(depth, "while (%s) {", c.not())
+				d.emit(l.head+1, l.tail, depth+1, l)
+				d.add(depth, "}")
+				return
+			}
+		}
+	}
+	d.add(depth, "while (1) {")
+	d.emitBody(l, depth+1)
+	d.add(depth, "}")
+}
+
+// emitBody emits the blocks in l, with the head block's label suppressed.
+func (d *decompiler) emitBody(l *loop, depth int) {
+	d.emitBlock(l.head, depth, l, true)
+	d.emit(l.head+1, l.tail, depth, l)
+}
+
+// emitBlock emits the block at index i within the innermost loop lp.
+func (d *decompiler) emitBlock(i, depth int, lp *loop, noLabel bool) {
+	b := d.blocks[i]
+	if !noLabel {
+		d.lines = append(d.lines, dline{label: b.start, isLabel: true})
+	}
+	var next uint16 // address of the next block in output order
+	hasNext := i+1 < len(d.blocks)
+	if hasNext {
+		next = d.blocks[i+1].start
+	}
+
+	for j, in := range b.instrs {
+		switch in.op {
+		case opJmp:
+			t, ok := in.target()
+			if !ok {
+				d.add(depth, "goto *%s;", fmtArg(in.args[0], false))
+			} else if lp != nil && i == lp.tail && t == d.blocks[lp.head].start {
+				// Implicit in the enclosing "while (1)".
+			} else if s := d.jumpStmt(t, lp); s != "" {
+				d.add(depth, "%s;", s)
+			} else if !hasNext || t != next || b.end() != next {
+				d.gotoLine(depth, "", t)
+			}
+		case opJt, opJf:
+			if lp != nil && i == lp.tail && j == len(b.instrs)-1 {
+				continue // emitted as "do-while" condition
+			}
+			c, t := d.branchCond(b, j)
+			if s := d.jumpStmt(t, lp); s != "" {
+				d.add(depth, "if (%s) %s;", c, s)
+			} else {
+				d.gotoLine(depth, fmt.Sprintf("if (%s) ", c), t)
+			}
+		default:
+			if s := liftStmt(in); s != "" {
+				d.add(depth, "%s", s)
+			}
+		}
+	}
+}
+
+// jumpStmt returns "break" or "continue" if a jump to addr can be expressed
+// as one within lp, or an empty string otherwise.
+func (d *decompiler) jumpStmt(addr uint16, lp *loop) string {
+	if lp == nil {
+		return ""
+	}
+	head, tail := d.blocks[lp.head], d.blocks[lp.tail]
+	if addr == tail.end() {
+		return "break"
+	}
+	// "continue" in a do-while would skip to the condition, so only use it in "while (1)".
+	if addr == head.start && tail.last().op == opJmp {
+		return "continue"
+	}
+	return ""
+}
+
+// branchCond returns the condition and target of the jt or jf instruction at
+// index j within b. If the previous instruction computed the tested register
+// using eq or gt, the comparison is folded into the condition.
+func (d *decompiler) branchCond(b *block, j int) (condExpr, uint16) {
+	in := b.instrs[j]
+	t := in.args[1]
+	c := condExpr{fmtVal(in.args[0]), "!=", "0"}
+	if j > 0 {
+		if prev := b.instrs[j-1]; (prev.op == opEq || prev.op == opGt) && prev.args[0] == in.args[0] {
+			op := "=="
+			if prev.op == opGt {
+				op = ">"
+			}
+			c = condExpr{fmtVal(prev.args[1]), op, fmtVal(prev.args[2])}
+		}
+	}
+	if in.op == opJf {
+		c = c.not()
+	}
+	return c, t
+}
+
+// fmtVal formats an operand for use in pseudo-code.
+func fmtVal(v uint16) string { return fmtArg(v, false) }
+
+// liftStmt returns a pseudo-code statement for in, which must not be a jump.
+func liftStmt(in instr) string {
+	a := make([]string, len(in.args))
+	for i, v := range in.args {
+		a[i] = fmtVal(v)
+	}
+	switch in.op {
+	case opHalt:
+		return "halt();"
+	case opSet:
+		return fmt.Sprintf("%s = %s;", a[0], a[1])
+	case opPush:
+		return fmt.Sprintf("push(%s);", a[0])
+	case opPop:
+		return fmt.Sprintf("%s = pop();", a[0])
+	case opEq:
+		return fmt.Sprintf("%s = %s == %s;", a[0], a[1], a[2])
+	case opGt:
+		return fmt.Sprintf("%s = %s > %s;", a[0], a[1], a[2])
+	case opAdd:
+		return fmt.Sprintf("%s = (%s + %s) %% %d;", a[0], a[1], a[2], vmod)
+	case opMult:
+		return fmt.Sprintf("%s = (%s * %s) %% %d;", a[0], a[1], a[2], vmod)
+	case opMod:
+		return fmt.Sprintf("%s = %s %% %s;", a[0], a[1], a[2])
+	case opAnd:
+		return fmt.Sprintf("%s = %s & %s;", a[0], a[1], a[2])
+	case opOr:
+		return fmt.Sprintf("%s = %s | %s;", a[0], a[1], a[2])
+	case opNot:
+		return fmt.Sprintf("%s = ~%s & %d;", a[0], a[1], vmax)
+	case opRmem:
+		return fmt.Sprintf("%s = mem[%s];", a[0], a[1])
+	case opWmem:
+		return fmt.Sprintf("mem[%s] = %s;", a[0], a[1])
+	case opCall:
+		if t, ok := in.target(); ok {
+			return fmt.Sprintf("%s();", funcName(t))
+		}
+		return fmt.Sprintf("(*%s)();", a[0])
+	case opRet:
+		return "return;"
+	case opOut:
+		return fmt.Sprintf("out(%s);", fmtArg(in.args[0], true))
+	case opIn:
+		return fmt.Sprintf("%s = in();", a[0])
+	case opTrap:
+		return "trap();"
+	}
+	return "" // noop
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// analyzeSource assembles src and analyzes it starting at address 0.
+func analyzeSource(t *testing.T, src string) *program {
+	words, err := assemble(strings.NewReader(src), nil)
+	if err != nil {
+		t.Fatal("Assembling failed: ", err)
+	}
+	mem := make([]uint16, msize)
+	copy(mem, words)
+	return analyze(mem, 0)
+}
+
+func TestDecompile(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"loop and call", `
+  set r0 3
+loop:
+  add r0 r0 32767
+  jt r0 loop
+  call fn
+  halt
+fn:
+  push r1
+  pop r1
+  ret`, `fn_0000() {
+	r0 = 3;
+	do {
+		r0 = (r0 + 32767) % 32768;
+	} while (r0 != 0);
+	fn_000d();
+	halt();
+}
+
+fn_000d() {
+	push(r1);
+	r1 = pop();
+	return;
+}
+`},
+		{"comparison and forward jump", `
+  set r0 0
+loop:
+  add r0 r0 1
+  eq r1 r0 5
+  jf r1 loop
+  jt r0 skip
+  out 65
+skip:
+  halt`, `fn_0000() {
+	r0 = 0;
+	do {
+		r0 = (r0 + 1) % 32768;
+		r1 = r0 == 5;
+	} while (r0 != 5);
+	if (r0 != 0) goto L_19;
+	out('A');
+L_19:
+	halt();
+}
+`},
+	} {
+		var b strings.Builder
+		if err := analyzeSource(t, tc.src).writeDecompiled(&b); err != nil {
+			t.Errorf("%v: decompiling failed: %v", tc.desc, err)
+		} else if got := b.String(); got != tc.want {
+			t.Errorf("%v: decompiled to:\n%s\nwant:\n%s", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// owners returns a map from each of p's reachable instruction addresses to
+// the entry address of the lowest-addressed function containing it.
+func (p *program) owners() map[uint16]uint16 {
+	owners := make(map[uint16]uint16, len(p.instrs))
+	for _, fn := range p.sortedFuncs() {
+		for _, addr := range fn.addrs {
+			if _, ok := owners[addr]; !ok {
+				owners[addr] = fn.entry
+			}
+		}
+	}
+	return owners
+}
+
+// writeDisasmDiff writes a unified-diff-style comparison of the instructions
+// in a and b to w, grouped by containing function. Changed words that aren't
+// part of reachable instructions in either program are summarized as data.
+func writeDisasmDiff(w io.Writer, a, b *program) error {
+	aown, bown := a.owners(), b.owners()
+	seen := make(map[uint16]struct{})
+	var addrs []uint16
+	for _, p := range []*program{a, b} {
+		for addr := range p.instrs {
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var sb strings.Builder
+	covered := make([]bool, len(a.mem))
+	cover := func(in instr) {
+		for i := int(in.addr); i < int(in.next()); i++ {
+			covered[i] = true
+		}
+	}
+	var lastFn string
+	for _, addr := range addrs {
+		ia, aok := a.instrs[addr]
+		ib, bok := b.instrs[addr]
+		if aok {
+			cover(ia)
+		}
+		if bok {
+			cover(ib)
+		}
+		if aok && bok && ia.String() == ib.String() {
+			continue
+		}
+
+		fn := ""
+		if e, ok := bown[addr]; ok {
+			fn = funcName(e)
+		} else if e, ok := aown[addr]; ok {
+			fn = funcName(e)
+		}
+		if fn != lastFn {
+			fmt.Fprintf(&sb, "@@ %s @@\n", fn)
+			lastFn = fn
+		}
+		if aok {
+			fmt.Fprintf(&sb, "-%5d: %s\n", addr, ia)
+		}
+		if bok {
+			fmt.Fprintf(&sb, "+%5d: %s\n", addr, ib)
+		}
+	}
+
+	// Summarize changed data words as ranges.
+	var ranges []string
+	for i := 0; i < len(a.mem); i++ {
+		if covered[i] || a.mem[i] == b.mem[i] {
+			continue
+		}
+		j := i
+		for j+1 < len(a.mem) && !covered[j+1] && a.mem[j+1] != b.mem[j+1] {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(i))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", i, j))
+		}
+		i = j
+	}
+	if len(ranges) > 0 {
+		fmt.Fprintf(&sb, "@@ data @@\n changed words: %s\n", strings.Join(ranges, " "))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
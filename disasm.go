@@ -0,0 +1,498 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Opcodes, in the order listed in the spec.
+const (
+	opHalt = iota
+	opSet
+	opPush
+	opPop
+	opEq
+	opGt
+	opJmp
+	opJt
+	opJf
+	opAdd
+	opMult
+	opMod
+	opAnd
+	opOr
+	opNot
+	opRmem
+	opWmem
+	opCall
+	opRet
+	opOut
+	opIn
+	opNoop
+	opTrap // extension: pause in the debugger
+)
+
+// opInfo describes an instruction.
+type opInfo struct {
+	name  string
+	nargs int
+	dst   bool   // first argument is a register that's written
+	desc  string // description from the spec
+}
+
+// minGapString is the minimum length of strings reported in unreachable regions.
+const minGapString = 4
+
+// ops is indexed by opcode.
+var ops = [...]opInfo{
+	{"halt", 0, false, "stop execution and terminate the program"},
+	{"set", 2, true, "set register <a> to the value of <b>"},
+	{"push", 1, false, "push <a> onto the stack"},
+	{"pop", 1, true, "remove the top element from the stack and write it into <a>; empty stack = error"},
+	{"eq", 3, true, "set <a> to 1 if <b> is equal to <c>; set it to 0 otherwise"},
+	{"gt", 3, true, "set <a> to 1 if <b> is greater than <c>; set it to 0 otherwise"},
+	{"jmp", 1, false, "jump to <a>"},
+	{"jt", 2, false, "if <a> is nonzero, jump to <b>"},
+	{"jf", 2, false, "if <a> is zero, jump to <b>"},
+	{"add", 3, true, "assign into <a> the sum of <b> and <c> (modulo 32768)"},
+	{"mult", 3, true, "store into <a> the product of <b> and <c> (modulo 32768)"},
+	{"mod", 3, true, "store into <a> the remainder of <b> divided by <c>"},
+	{"and", 3, true, "stores into <a> the bitwise and of <b> and <c>"},
+	{"or", 3, true, "stores into <a> the bitwise or of <b> and <c>"},
+	{"not", 2, true, "stores 15-bit bitwise inverse of <b> in <a>"},
+	{"rmem", 2, true, "read memory at address <b> and write it to <a>"},
+	{"wmem", 2, false, "write the value from <b> into memory at address <a>"},
+	{"call", 1, false, "write the address of the next instruction to the stack and jump to <a>"},
+	{"ret", 0, false, "remove the top element from the stack and jump to it; empty stack = halt"},
+	{"out", 1, false, "write the character represented by ascii code <a> to the terminal"},
+	{"in", 1, true, "read a character from the terminal and write its ascii code to <a>"},
+	{"noop", 0, false, "no operation"},
+	{"trap", 0, false, "extension: pause and drop to the debugger prompt; no operation otherwise"},
+}
+
+// instr is a decoded instruction.
+type instr struct {
+	addr uint16
+	op   uint16
+	args []uint16
+}
+
+// decode decodes the instruction at addr in mem.
+// False is returned if the opcode is invalid or the instruction runs past the end of memory.
+func decode(mem []uint16, addr uint16) (instr, bool) {
+	op := mem[addr]
+	if int(op) >= len(ops) {
+		return instr{}, false
+	}
+	n := ops[op].nargs
+	if int(addr)+1+n > len(mem) {
+		return instr{}, false
+	}
+	return instr{addr, op, mem[addr+1 : int(addr)+1+n]}, true
+}
+
+// size returns the number of words occupied by the instruction.
+func (in instr) size() uint16 { return uint16(1 + len(in.args)) }
+
+// next returns the address of the following instruction.
+func (in instr) next() uint16 { return in.addr + in.size() }
+
+// target returns the literal address that in jumps to or calls.
+// False is returned if in does not transfer control or uses a register.
+func (in instr) target() (uint16, bool) {
+	var v uint16
+	switch in.op {
+	case opJmp, opCall:
+		v = in.args[0]
+	case opJt, opJf:
+		v = in.args[1]
+	default:
+		return 0, false
+	}
+	return v, v <= vmax
+}
+
+// String formats in as e.g. "add r1 r2 5".
+func (in instr) String() string {
+	s := ops[in.op].name
+	for _, a := range in.args {
+		s += " " + fmtArg(a, in.op == opOut)
+	}
+	return s
+}
+
+// explain describes the effect of in with its operands resolved, e.g. "r0 = 4".
+func (in instr) explain() string {
+	switch in.op {
+	case opJmp:
+		return "goto " + fmtVal(in.args[0])
+	case opJt:
+		return fmt.Sprintf("if %s != 0 goto %s", fmtVal(in.args[0]), fmtVal(in.args[1]))
+	case opJf:
+		return fmt.Sprintf("if %s == 0 goto %s", fmtVal(in.args[0]), fmtVal(in.args[1]))
+	case opNoop:
+		return "nothing"
+	}
+	return strings.TrimSuffix(liftStmt(in), ";")
+}
+
+// fmtArg formats the supplied operand.
+// If char is true, printable literals are formatted as quoted characters.
+func fmtArg(v uint16, char bool) string {
+	switch {
+	case v <= vmax && char && v >= ' ' && v < 0x7f && v != '\'' && v != '\\':
+		return fmt.Sprintf("'%c'", rune(v))
+	case v <= vmax && char && v == '\n':
+		return `'\n'`
+	case v <= vmax:
+		return fmt.Sprint(v)
+	case v < vreg+nregs:
+		return fmt.Sprintf("r%d", v-vreg)
+	default:
+		return fmt.Sprintf("?%d", v)
+	}
+}
+
+// function describes a routine discovered by static analysis.
+type function struct {
+	entry uint16
+	addrs []uint16   // sorted addresses of instructions in the function
+	calls []callSite // sorted by address
+}
+
+// callSite describes a call instruction.
+type callSite struct {
+	addr   uint16
+	target uint16
+	direct bool // false if target is held in a register
+}
+
+// program holds the results of statically analyzing a memory image.
+type program struct {
+	mem    []uint16
+	instrs map[uint16]instr     // reachable instructions keyed by address
+	funcs  map[uint16]*function // keyed by entry address
+}
+
+// analyze performs recursive-descent disassembly of mem starting at entries.
+// Functions are created for each entry point and for each literal call target.
+func analyze(mem []uint16, entries ...uint16) *program {
+	p := &program{
+		mem:    mem,
+		instrs: make(map[uint16]instr),
+		funcs:  make(map[uint16]*function),
+	}
+	todo := append([]uint16(nil), entries...)
+	for len(todo) > 0 {
+		entry := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if _, ok := p.funcs[entry]; ok {
+			continue
+		}
+		fn := p.walk(entry)
+		p.funcs[entry] = fn
+		for _, c := range fn.calls {
+			if c.direct {
+				todo = append(todo, c.target)
+			}
+		}
+	}
+	return p
+}
+
+// walk follows intraprocedural control flow from entry, recording decoded
+// instructions in p.instrs and returning the resulting function.
+func (p *program) walk(entry uint16) *function {
+	fn := &function{entry: entry}
+	seen := make(map[uint16]struct{})
+	todo := []uint16{entry}
+	for len(todo) > 0 {
+		addr := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for {
+			if _, ok := seen[addr]; ok || int(addr) >= len(p.mem) {
+				break
+			}
+			in, ok := decode(p.mem, addr)
+			if !ok {
+				break
+			}
+			seen[addr] = struct{}{}
+			p.instrs[addr] = in
+			fn.addrs = append(fn.addrs, addr)
+
+			if in.op == opCall {
+				t, ok := in.target()
+				if !ok {
+					t = in.args[0]
+				}
+				fn.calls = append(fn.calls, callSite{addr, t, ok})
+			} else if t, ok := in.target(); ok {
+				todo = append(todo, t)
+			}
+			if in.op == opHalt || in.op == opRet || in.op == opJmp {
+				break
+			}
+			addr = in.next()
+		}
+	}
+	sort.Slice(fn.addrs, func(i, j int) bool { return fn.addrs[i] < fn.addrs[j] })
+	sort.Slice(fn.calls, func(i, j int) bool { return fn.calls[i].addr < fn.calls[j].addr })
+	return fn
+}
+
+// sortedFuncs returns p's functions sorted by entry address.
+func (p *program) sortedFuncs() []*function {
+	fns := make([]*function, 0, len(p.funcs))
+	for _, fn := range p.funcs {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].entry < fns[j].entry })
+	return fns
+}
+
+// funcName returns a label for the function starting at addr.
+func funcName(addr uint16) string { return fmt.Sprintf("fn_%04x", addr) }
+
+// writeDisasm writes a listing of p's reachable instructions to w.
+// Unreachable regions are summarized in comments, with likely-encrypted data
+// and text called out. If annotate is true, each instruction is followed by a
+// comment describing its effect and the spec's description of its opcode.
+func (p *program) writeDisasm(w io.Writer, annotate bool) error {
+	addrs := p.sortedAddrs()
+	var b strings.Builder
+	gaps := p.gaps()
+	for _, addr := range addrs {
+		in := p.instrs[addr]
+		for len(gaps) > 0 && gaps[0].start < int(addr) {
+			gaps[0].writeComments(&b)
+			gaps = gaps[1:]
+		}
+		if _, ok := p.funcs[addr]; ok {
+			fmt.Fprintf(&b, "%s:\n", funcName(addr))
+		}
+		if annotate {
+			fmt.Fprintf(&b, "%5d: %-20s ; %s -- %s\n", addr, in, in.explain(), ops[in.op].desc)
+		} else {
+			fmt.Fprintf(&b, "%5d: %s\n", addr, in)
+		}
+	}
+	for _, g := range gaps {
+		g.writeComments(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sortedAddrs returns the addresses of p's reachable instructions in ascending order.
+func (p *program) sortedAddrs() []uint16 {
+	addrs := make([]uint16, 0, len(p.instrs))
+	for addr := range p.instrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+// gap describes a region of memory not covered by reachable instructions.
+type gap struct {
+	start, end int           // [start, end)
+	zero       bool          // all words are zero
+	hot        []region      // high-entropy subregions
+	text       []foundString // one-character-per-word strings outside of hot
+}
+
+// gaps returns the regions of p.mem not covered by reachable instructions,
+// omitting trailing zeros.
+func (p *program) gaps() []gap {
+	covered := make([]bool, len(p.mem))
+	for addr, in := range p.instrs {
+		for i := int(addr); i < int(in.next()); i++ {
+			covered[i] = true
+		}
+	}
+	end := len(p.mem)
+	for end > 0 && p.mem[end-1] == 0 {
+		end--
+	}
+
+	hot := highEntropyRegions(p.mem, defaultEntropyThresh)
+	inHot := func(addr int) bool {
+		for _, r := range hot {
+			if addr >= r.start && addr < r.end {
+				return true
+			}
+		}
+		return false
+	}
+
+	var gaps []gap
+	for start := 0; start < end; {
+		if covered[start] {
+			start++
+			continue
+		}
+		g := gap{start: start, end: start, zero: true}
+		for g.end < end && !covered[g.end] {
+			g.zero = g.zero && p.mem[g.end] == 0
+			g.end++
+		}
+		start = g.end
+		if g.zero {
+			gaps = append(gaps, g)
+			continue
+		}
+		for _, r := range hot {
+			if r.start < g.start {
+				r.start = g.start
+			}
+			if r.end > g.end {
+				r.end = g.end
+			}
+			if r.start < r.end {
+				g.hot = append(g.hot, r)
+			}
+		}
+		for _, f := range findStrings(p.mem[g.start:g.end], minGapString) {
+			f.addr += uint16(g.start)
+			if f.kind == "word" && !inHot(int(f.addr)) {
+				g.text = append(g.text, f)
+			}
+		}
+		gaps = append(gaps, g)
+	}
+	return gaps
+}
+
+// writeComments writes comments describing g to b.
+func (g *gap) writeComments(b *strings.Builder) {
+	if b.Len() > 0 {
+		b.WriteString("\n")
+	}
+	if g.zero {
+		fmt.Fprintf(b, "; %d-%d: zero-filled (%d words)\n", g.start, g.end-1, g.end-g.start)
+	} else {
+		fmt.Fprintf(b, "; %d-%d: unreachable (%d words)\n", g.start, g.end-1, g.end-g.start)
+	}
+	for _, r := range g.hot {
+		fmt.Fprintf(b, ";   %d-%d: high-entropy data (%.2f bits/byte), likely encrypted\n",
+			r.start, r.end-1, r.entropy)
+	}
+	for _, f := range g.text {
+		fmt.Fprintf(b, ";   %d: text %q\n", f.addr, f.s)
+	}
+	b.WriteString("\n")
+}
+
+// labels returns labels for addresses in p that are function entry points or
+// jump targets.
+func (p *program) labels() map[uint16][]string {
+	labels := make(map[uint16][]string)
+	for addr := range p.funcs {
+		labels[addr] = append(labels[addr], funcName(addr))
+	}
+	seen := make(map[uint16]struct{})
+	for _, in := range p.instrs {
+		if t, ok := in.target(); ok && in.op != opCall {
+			if _, ok := seen[t]; !ok {
+				labels[t] = append(labels[t], labelName(t))
+				seen[t] = struct{}{}
+			}
+		}
+	}
+	return labels
+}
+
+// jsonInstr is used to serialize an instruction in writeDisasmJSON.
+type jsonInstr struct {
+	Addr     uint16        `json:"addr"`
+	Op       uint16        `json:"op"`
+	Name     string        `json:"name"`
+	Operands []jsonOperand `json:"operands"`
+	Labels   []string      `json:"labels,omitempty"`
+	Words    []uint16      `json:"words"`
+	Bytes    string        `json:"bytes"` // little-endian hex
+	Text     string        `json:"text"`
+}
+
+// jsonOperand is used to serialize an instruction operand in writeDisasmJSON.
+type jsonOperand struct {
+	Kind  string `json:"kind"`            // "literal", "register", or "invalid"
+	Value uint16 `json:"value"`           // literal value, register number, or raw word
+	Label string `json:"label,omitempty"` // label of jump or call target
+}
+
+// jsonRegion is used to serialize an unreachable region in writeDisasmJSON.
+type jsonRegion struct {
+	Start   int     `json:"start"`
+	End     int     `json:"end"`  // exclusive
+	Kind    string  `json:"kind"` // "zero", "data", "encrypted", or "text"
+	Entropy float64 `json:"entropy,omitempty"`
+	Text    string  `json:"text,omitempty"`
+}
+
+// writeDisasmJSON writes p's reachable instructions and unreachable regions to w as JSON.
+func (p *program) writeDisasmJSON(w io.Writer) error {
+	labels := p.labels()
+	out := struct {
+		Instrs  []jsonInstr  `json:"instructions"`
+		Regions []jsonRegion `json:"regions"`
+	}{Instrs: []jsonInstr{}, Regions: []jsonRegion{}}
+
+	for _, addr := range p.sortedAddrs() {
+		in := p.instrs[addr]
+		ji := jsonInstr{
+			Addr:     addr,
+			Op:       in.op,
+			Name:     ops[in.op].name,
+			Operands: []jsonOperand{},
+			Labels:   labels[addr],
+			Words:    append([]uint16{in.op}, in.args...),
+			Text:     in.String(),
+		}
+		for _, v := range ji.Words {
+			ji.Bytes += fmt.Sprintf("%02x%02x", v&0xff, v>>8)
+		}
+		t, hasTarget := in.target()
+		for i, v := range in.args {
+			op := jsonOperand{Kind: "literal", Value: v}
+			if v >= vreg+nregs {
+				op.Kind = "invalid"
+			} else if v >= vreg {
+				op.Kind, op.Value = "register", v-vreg
+			} else if hasTarget && v == t && i == len(in.args)-1 {
+				if l := labels[t]; len(l) > 0 {
+					op.Label = l[0]
+				}
+			}
+			ji.Operands = append(ji.Operands, op)
+		}
+		out.Instrs = append(out.Instrs, ji)
+	}
+
+	for _, g := range p.gaps() {
+		kind := "data"
+		if g.zero {
+			kind = "zero"
+		}
+		out.Regions = append(out.Regions, jsonRegion{Start: g.start, End: g.end, Kind: kind})
+		for _, r := range g.hot {
+			out.Regions = append(out.Regions,
+				jsonRegion{Start: r.start, End: r.end, Kind: "encrypted", Entropy: r.entropy})
+		}
+		for _, f := range g.text {
+			out.Regions = append(out.Regions, jsonRegion{Start: int(f.addr),
+				End: int(f.addr) + len(f.s), Kind: "text", Text: f.s})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
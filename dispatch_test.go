@@ -0,0 +1,197 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// runSwitch is like runPlain but dispatches opcodes with a switch statement,
+// as run did before opFuncs was added. It exists to compare the two
+// approaches and stops when the program reads input.
+func (vm *vm) runSwitch() {
+	ip := vm.ip
+	defer func() { vm.ip = ip }()
+
+	for !vm.quitting() {
+		d := &vm.code[ip]
+		if d.gen != vm.gen {
+			d = vm.decoded(ip)
+		}
+		a := &d.args
+		sz := d.size
+		vm.steps++
+		if vm.steps >= vm.slowAt {
+			vm.slowPath()
+		}
+		if sz == 0 {
+			_, msg := predecode(vm.mem[:], ip)
+			panic(msg)
+		}
+
+		switch d.op {
+		case opHalt:
+			vm.reason = haltOp
+			vm.halt()
+		case opSet:
+			vm.setReg(a[0], vm.val(a[1]))
+		case opPush:
+			vm.push(vm.val(a[0]))
+		case opPop:
+			vm.setReg(a[0], vm.pop())
+		case opEq:
+			vm.setReg(a[0], cond(vm.val(a[1]) == vm.val(a[2]), 1, 0))
+		case opGt:
+			vm.setReg(a[0], cond(vm.val(a[1]) > vm.val(a[2]), 1, 0))
+		case opJmp:
+			ip, sz = vm.val(a[0]), 0
+		case opJt:
+			if vm.val(a[0]) != 0 {
+				ip, sz = vm.val(a[1]), 0
+			}
+		case opJf:
+			if vm.val(a[0]) == 0 {
+				ip, sz = vm.val(a[1]), 0
+			}
+		case opAdd:
+			vm.setReg(a[0], (vm.val(a[1])+vm.val(a[2]))%vmod)
+		case opMult:
+			vm.setReg(a[0], uint16((int(vm.val(a[1]))*int(vm.val(a[2])))%vmod))
+		case opMod:
+			vm.setReg(a[0], vm.val(a[1])%vm.val(a[2]))
+		case opAnd:
+			vm.setReg(a[0], vm.val(a[1])&vm.val(a[2]))
+		case opOr:
+			vm.setReg(a[0], vm.val(a[1])|vm.val(a[2]))
+		case opNot:
+			vm.setReg(a[0], (^vm.val(a[1]))&vmax)
+		case opRmem:
+			vm.setReg(a[0], vm.mem[vm.val(a[1])&vmax])
+		case opWmem:
+			addr := vm.val(a[0]) & vmax
+			vm.mem[addr] = vm.val(a[1])
+			vm.invalidate(addr)
+		case opCall:
+			addr := vm.val(a[0])
+			vm.push(ip + sz)
+			ip, sz = addr, 0
+		case opRet:
+			ip, sz = vm.pop(), 0
+		case opOut:
+			vm.obuf = append(vm.obuf, byte(vm.val(a[0])))
+			vm.nout++
+			if c := vm.obuf[len(vm.obuf)-1]; c == '\n' || len(vm.obuf) >= outBatchSize {
+				vm.flushOutput()
+			} else if len(vm.obuf) == 1 && vm.steps+outFlushSteps < vm.slowAt {
+				vm.slowAt = vm.steps + outFlushSteps
+			}
+		case opIn:
+			vm.reason = haltBreak
+		case opNoop, opTrap:
+		}
+		if vm.reason != haltNone {
+			return
+		}
+		ip += sz
+	}
+}
+
+// benchLoop runs the synthetic programs b.N times each using loop, which
+// executes instructions until the program stops. If fuse is false,
+// instruction fusion is disabled.
+func benchLoop(b *testing.B, fuse bool, loop func(vm *vm)) {
+	for i := range benchPrograms {
+		p := &benchPrograms[i]
+		words, err := assemble(strings.NewReader(p.src), nil)
+		if err != nil {
+			b.Fatalf("Assembling %v failed: %v", p.name, err)
+		}
+		b.Run(p.name, func(b *testing.B) {
+			var steps uint64
+			var elapsed time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				vm, err := newVM(strings.NewReader(""))
+				if err != nil {
+					b.Fatal(err)
+				}
+				vm.size = copy(vm.mem[:], words)
+				vm.output = func([]byte) {}
+				vm.code = make([]predecoded, msize)
+				vm.changed()
+				vm.fuse = fuse
+				b.StartTimer()
+
+				start := time.Now()
+				loop(vm)
+				elapsed += time.Since(start)
+				steps += vm.steps
+				if vm.reason != haltOp {
+					b.Fatalf("Program stopped with %q", vm.reason)
+				}
+			}
+			b.ReportMetric(float64(steps)/elapsed.Seconds()/1e6, "MIPS")
+		})
+	}
+}
+
+// BenchmarkDispatch compares dispatching unfused instructions with a switch
+// statement and with opFuncs.
+func BenchmarkDispatch(b *testing.B) {
+	b.Run("switch", func(b *testing.B) { benchLoop(b, false, (*vm).runSwitch) })
+	b.Run("table", func(b *testing.B) {
+		benchLoop(b, false, func(vm *vm) { vm.runPlain(&opFuncs) })
+	})
+}
+
+// BenchmarkFused compares running with and without instruction fusion.
+func BenchmarkFused(b *testing.B) {
+	b.Run("unfused", func(b *testing.B) {
+		benchLoop(b, false, func(vm *vm) { vm.runPlain(&opFuncs) })
+	})
+	b.Run("fused", func(b *testing.B) {
+		benchLoop(b, true, func(vm *vm) { vm.runPlain(&opFuncs) })
+	})
+}
+
+// quittingSelect is quitting as it was implemented before vm.quitReq was
+// added, receiving from vm.quit in a select statement.
+func (vm *vm) quittingSelect() bool {
+	select {
+	case <-vm.quit:
+		if vm.reason == haltNone {
+			vm.reason = haltQuit
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// BenchmarkQuitCheck compares the per-instruction cost of checking whether
+// halt has been called by selecting on vm.quit and by loading vm.quitReq.
+func BenchmarkQuitCheck(b *testing.B) {
+	for _, tc := range []struct {
+		name  string
+		check func(vm *vm) bool
+	}{
+		{"select", (*vm).quittingSelect},
+		{"atomic", (*vm).quitting},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			vm, err := newVM(strings.NewReader(""))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if tc.check(vm) {
+					b.Fatal("Unexpectedly quitting")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	entropyWindow        = 256 // words in sliding window used by wordEntropy
+	defaultEntropyThresh = 7.0 // bits per byte above which data is likely encrypted
+)
+
+// wordEntropy returns the Shannon entropy in bits per byte of the bytes in a
+// window of entropyWindow words centered on each word in mem.
+func wordEntropy(mem []uint16) []float64 {
+	var counts [256]int
+	var n int
+	update := func(v uint16, d int) {
+		counts[v&0xff] += d
+		counts[v>>8] += d
+		n += 2 * d
+	}
+
+	ents := make([]float64, len(mem))
+	lo, hi := 0, 0 // current window is [lo, hi)
+	for i := range mem {
+		for ; hi < len(mem) && hi < i+entropyWindow/2; hi++ {
+			update(mem[hi], 1)
+		}
+		for ; lo < i-entropyWindow/2; lo++ {
+			update(mem[lo], -1)
+		}
+		var e float64
+		for _, c := range counts {
+			if c > 0 {
+				p := float64(c) / float64(n)
+				e -= p * math.Log2(p)
+			}
+		}
+		ents[i] = e
+	}
+	return ents
+}
+
+// region describes a range of memory.
+type region struct {
+	start, end int     // [start, end)
+	entropy    float64 // mean entropy in bits per byte
+}
+
+// highEntropyRegions returns maximal runs of words in mem whose windowed
+// entropy is at least thresh.
+func highEntropyRegions(mem []uint16, thresh float64) []region {
+	var regions []region
+	var sum float64
+	start := -1
+	ents := wordEntropy(mem)
+	for i := 0; i <= len(ents); i++ {
+		if i < len(ents) && ents[i] >= thresh {
+			if start < 0 {
+				start, sum = i, 0
+			}
+			sum += ents[i]
+			continue
+		}
+		if start >= 0 {
+			regions = append(regions, region{start, i, sum / float64(i-start)})
+			start = -1
+		}
+	}
+	return regions
+}
+
+// writeEntropyRegions writes mem's high-entropy regions to w.
+func writeEntropyRegions(w io.Writer, mem []uint16, thresh float64) error {
+	var b strings.Builder
+	for _, r := range highEntropyRegions(mem, thresh) {
+		fmt.Fprintf(&b, "%5d-%5d: %5d words, %.2f bits/byte\n", r.start, r.end-1, r.end-r.start, r.entropy)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,267 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import "time"
+
+// opFunc executes the pre-decoded instruction d at ip and returns the address
+// of the next instruction. To stop the VM, it sets vm.reason.
+type opFunc func(vm *vm, d *predecoded, ip uint16) uint16
+
+// opFuncs is indexed by opcode, followed by handlers from fuse.go and blocks.go.
+// predecode rejects invalid opcodes, so every entry is non-nil.
+var opFuncs = [numOpFuncs]opFunc{
+	opHalt: execHalt,
+	opSet:  execSet,
+	opPush: execPush,
+	opPop:  execPop,
+	opEq:   execEq,
+	opGt:   execGt,
+	opJmp:  execJmp,
+	opJt:   execJt,
+	opJf:   execJf,
+	opAdd:  execAdd,
+	opMult: execMult,
+	opMod:  execMod,
+	opAnd:  execAnd,
+	opOr:   execOr,
+	opNot:  execNot,
+	opRmem: execRmem,
+	opWmem: execWmem,
+	opCall: execCall,
+	opRet:  execRet,
+	opOut:  execOut,
+	opIn:   execIn,
+	opNoop: execNoop,
+	opTrap: execTrap,
+
+	fnEqJt:    execEqJt,
+	fnEqJf:    execEqJf,
+	fnGtJt:    execGtJt,
+	fnGtJf:    execGtJf,
+	fnAddJt:   execAddJt,
+	fnAddJf:   execAddJf,
+	fnAddWmem: execAddWmem,
+	fnBlock:   execBlock,
+	fnNative:  execNative,
+}
+
+// ctraceOpFuncs is used instead of opFuncs when vm.ctrace is set so that
+// calls and returns are only checked for when needed.
+var ctraceOpFuncs = func() [len(opFuncs)]opFunc {
+	funcs := opFuncs
+	funcs[opCall] = func(vm *vm, d *predecoded, ip uint16) uint16 {
+		next := execCall(vm, d, ip)
+		vm.ctrace.call(next)
+		return next
+	}
+	funcs[opRet] = func(vm *vm, d *predecoded, ip uint16) uint16 {
+		next := execRet(vm, d, ip)
+		vm.ctrace.end()
+		return next
+	}
+	return funcs
+}()
+
+// execNative runs the Go implementation of the routine at ip.
+func execNative(vm *vm, d *predecoded, ip uint16) uint16 {
+	return vm.natives[ip](vm, d, ip)
+}
+
+// halt: stop execution and terminate the program
+func execHalt(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.reason = haltOp
+	vm.halt()
+	return ip + d.size
+}
+
+// set a b: set register <a> to the value of <b>
+func execSet(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], vm.val(d.args[1]))
+	return ip + d.size
+}
+
+// push a: push <a> onto the stack
+func execPush(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.push(vm.val(d.args[0]))
+	return ip + d.size
+}
+
+// pop a: remove the top element from the stack and write it into <a>; empty stack = error
+func execPop(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], vm.pop())
+	return ip + d.size
+}
+
+// eq a b c: set <a> to 1 if <b> is equal to <c>; set it to 0 otherwise
+func execEq(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], cond(vm.val(d.args[1]) == vm.val(d.args[2]), 1, 0))
+	return ip + d.size
+}
+
+// gt a b c: set <a> to 1 if <b> is greater than <c>; set it to 0 otherwise
+func execGt(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], cond(vm.val(d.args[1]) > vm.val(d.args[2]), 1, 0))
+	return ip + d.size
+}
+
+// jmp a: jump to <a>
+func execJmp(vm *vm, d *predecoded, ip uint16) uint16 {
+	return vm.val(d.args[0])
+}
+
+// jt a b: if <a> is nonzero, jump to <b>
+func execJt(vm *vm, d *predecoded, ip uint16) uint16 {
+	if vm.val(d.args[0]) != 0 {
+		return vm.val(d.args[1])
+	}
+	return ip + d.size
+}
+
+// jf a b: if <a> is zero, jump to <b>
+func execJf(vm *vm, d *predecoded, ip uint16) uint16 {
+	if vm.val(d.args[0]) == 0 {
+		return vm.val(d.args[1])
+	}
+	return ip + d.size
+}
+
+// add a b c: assign into <a> the sum of <b> and <c> (modulo 32768)
+func execAdd(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], (vm.val(d.args[1])+vm.val(d.args[2]))%vmod)
+	return ip + d.size
+}
+
+// mult a b c: store into <a> the product of <b> and <c> (modulo 32768)
+func execMult(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], uint16((int(vm.val(d.args[1]))*int(vm.val(d.args[2])))%vmod))
+	return ip + d.size
+}
+
+// mod a b c: store into <a> the remainder of <b> divided by <c>
+func execMod(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], vm.val(d.args[1])%vm.val(d.args[2]))
+	return ip + d.size
+}
+
+// and a b c: stores into <a> the bitwise and of <b> and <c>
+func execAnd(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], vm.val(d.args[1])&vm.val(d.args[2]))
+	return ip + d.size
+}
+
+// or a b c: stores into <a> the bitwise or of <b> and <c>
+func execOr(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], vm.val(d.args[1])|vm.val(d.args[2]))
+	return ip + d.size
+}
+
+// not a b: stores 15-bit bitwise inverse of <b> in <a>
+func execNot(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], (^vm.val(d.args[1]))&vmax)
+	return ip + d.size
+}
+
+// rmem a b: read memory at address <b> and write it to <a>
+func execRmem(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.setReg(d.args[0], vm.mem[vm.val(d.args[1])&vmax])
+	return ip + d.size
+}
+
+// wmem a b: write the value from <b> into memory at address <a>
+func execWmem(vm *vm, d *predecoded, ip uint16) uint16 {
+	addr := vm.val(d.args[0]) & vmax
+	vm.mem[addr] = vm.val(d.args[1])
+	vm.invalidate(addr)
+	return ip + d.size
+}
+
+// call a: write the address of the next instruction to the stack and jump to <a>
+func execCall(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.push(ip + d.size)
+	return vm.val(d.args[0])
+}
+
+// ret: remove the top element from the stack and jump to it; empty stack = halt
+func execRet(vm *vm, d *predecoded, ip uint16) uint16 {
+	return vm.pop()
+}
+
+// out a: write the character represented by ascii code <a> to the terminal
+func execOut(vm *vm, d *predecoded, ip uint16) uint16 {
+	vm.obuf = append(vm.obuf, byte(vm.val(d.args[0])))
+	vm.nout++
+	if c := vm.obuf[len(vm.obuf)-1]; c == '\n' || len(vm.obuf) >= outBatchSize {
+		vm.flushOutput()
+	} else if len(vm.obuf) == 1 && vm.steps+outFlushSteps < vm.slowAt {
+		vm.slowAt = vm.steps + outFlushSteps
+	}
+	return ip + d.size
+}
+
+// in a: read a character from the terminal and write its ascii code to <a>
+func execIn(vm *vm, d *predecoded, ip uint16) uint16 {
+	if vm.breakIn {
+		vm.reason = haltBreak
+		return ip
+	}
+	v, ok, closed := vm.in.read() // prefer pending input over functions from do
+	if !ok {
+		vm.flushOutput() // before the program's output is inspected
+	}
+	var f func()
+	if waiting := !ok && !closed; waiting && vm.ctrace != nil {
+		vm.ctrace.begin("input", "io", nil)
+		defer vm.ctrace.end()
+	}
+	for !ok && !closed && f == nil {
+		vm.ipsStart = time.Time{} // don't count time spent waiting
+		if vm.onBlock != nil && !vm.blocked {
+			vm.ip = ip
+			vm.onBlock()
+			vm.blocked = true
+		}
+		select {
+		case <-vm.in.notify:
+			v, ok, closed = vm.in.read()
+		case f = <-vm.ctl:
+		case <-vm.quit:
+			vm.reason = haltQuit
+			return ip // interrupt read if requested to quit
+		}
+	}
+	if f != nil {
+		vm.ip = ip
+		f()
+		vm.changed()
+		vm.steps--   // don't count the instruction at ip twice
+		return vm.ip // execute the (possibly replaced) instruction at ip
+	}
+	if !ok {
+		vm.reason = haltInput
+		return ip
+	}
+	vm.blocked = false
+	vm.setReg(d.args[0], uint16(v))
+	return ip + d.size
+}
+
+// noop: no operation
+func execNoop(vm *vm, d *predecoded, ip uint16) uint16 {
+	return ip + d.size
+}
+
+// trap: extension; pause in the debugger if attached
+func execTrap(vm *vm, d *predecoded, ip uint16) uint16 {
+	if vm.dbg != nil {
+		vm.ip = ip
+		vm.flushOutput()
+		vm.dbg.pause("trap")
+		vm.changed()
+		if vm.ip != ip {
+			return vm.ip // debugger jumped elsewhere
+		}
+	}
+	return ip + d.size
+}
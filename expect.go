@@ -0,0 +1,582 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Expect scripts drive a session by waiting for output before sending input.
+// Each line consists of a command and an argument:
+//
+//	expect <quoted-string>     wait for output containing the string
+//	expect-re <quoted-string>  wait for output matching the regular expression
+//	send <quoted-string>       send a line of input (which may be a meta-command)
+//	timeout <duration>         set the time that expect and wait-break wait (default 10s)
+//	sleep <duration>           pause before the next command
+//	set <rN|addr> <value>      set a register or memory word
+//	get <var> <rN|addr|ip>     store a register, memory word, or ip in a variable
+//	let <var> <value> [<op> <value>]
+//	                           set a variable, optionally to the result of
+//	                           +, -, *, /, or % applied to two values
+//	label <name>               mark a position in the script
+//	goto <label>               continue at label
+//	if <value> <cmp> <value> <label>
+//	                           continue at label if the comparison (==, !=, <,
+//	                           <=, >, or >=) is true
+//	if-match <quoted-string> <label>
+//	                           continue at label if the output consumed by the
+//	                           previous expect matches the regular expression
+//	break <addr>               pause the program whenever it reaches addr
+//	unbreak <addr>             remove a breakpoint
+//	wait-break                 wait for the program to pause at a breakpoint
+//	continue                   resume the program after wait-break
+//	limit <n>                  set the number of commands that may be run (default 100000)
+//
+// Values are numbers or variables written as $name, and send strings may
+// include variables as ${name}. get and set run once the program waits for
+// input or while it's paused at a breakpoint.
+//
+// Only output written after the previous match is searched. Blank lines and
+// lines starting with '#' are ignored. The script fails if it runs more
+// commands than the limit, e.g. because of a goto loop that doesn't wait.
+
+const (
+	defaultExpectTimeout = 10 * time.Second
+	defaultExpectLimit   = 100000
+)
+
+// expectCmd is a command in an expect script.
+type expectCmd struct {
+	line int    // line number in script
+	op   string // e.g. "expect" or "send"
+	str  string
+	re   *regexp.Regexp
+	dur  time.Duration
+	dst  uint16   // for "set", "get", "break", and "unbreak"
+	ip   bool     // "get" reads ip instead of dst
+	vr   string   // variable for "get" and "let"
+	args []string // values (and operators) for "set", "let", and "if"
+	n    int      // for "limit"
+	lab  string   // for "label", "goto", "if", and "if-match"
+}
+
+func (c *expectCmd) String() string {
+	switch c.op {
+	case "expect", "send":
+		return fmt.Sprintf("%s %q", c.op, c.str)
+	case "expect-re":
+		return fmt.Sprintf("%s %q", c.op, c.re)
+	case "set":
+		return fmt.Sprintf("%s %s %s", c.op, fmtArg(c.dst, false), c.args[0])
+	case "get":
+		if c.ip {
+			return fmt.Sprintf("%s %s ip", c.op, c.vr)
+		}
+		return fmt.Sprintf("%s %s %s", c.op, c.vr, fmtArg(c.dst, false))
+	case "let":
+		return fmt.Sprintf("%s %s %s", c.op, c.vr, strings.Join(c.args, " "))
+	case "label", "goto":
+		return fmt.Sprintf("%s %s", c.op, c.lab)
+	case "if":
+		return fmt.Sprintf("%s %s %s", c.op, strings.Join(c.args, " "), c.lab)
+	case "if-match":
+		return fmt.Sprintf("%s %q %s", c.op, c.re, c.lab)
+	case "break", "unbreak":
+		return fmt.Sprintf("%s %d", c.op, c.dst)
+	case "wait-break", "continue":
+		return c.op
+	case "limit":
+		return fmt.Sprintf("%s %d", c.op, c.n)
+	default:
+		return fmt.Sprintf("%s %v", c.op, c.dur)
+	}
+}
+
+// expectVarRegexp matches variable names in expect scripts.
+var expectVarRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// expectSendVarRegexp matches variables in send strings.
+var expectSendVarRegexp = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// checkExpectValue returns an error if s isn't a number or variable.
+func checkExpectValue(s string) error {
+	if strings.HasPrefix(s, "$") {
+		if !expectVarRegexp.MatchString(s[1:]) {
+			return fmt.Errorf("bad variable %q", s)
+		}
+		return nil
+	}
+	if _, err := strconv.ParseInt(s, 0, 64); err != nil {
+		return fmt.Errorf("bad value %q", s)
+	}
+	return nil
+}
+
+// expectValue returns the value of s, a number or a variable in vars.
+func expectValue(s string, vars map[string]int) (int, error) {
+	if strings.HasPrefix(s, "$") {
+		v, ok := vars[s[1:]]
+		if !ok {
+			return 0, fmt.Errorf("undefined variable %q", s[1:])
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	return int(v), err
+}
+
+// expectArith applies the let operator op to a and b.
+func expectArith(a int, op string, b int) (int, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "%":
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	}
+	return 0, fmt.Errorf("bad operator %q", op)
+}
+
+// expectCompare applies the if comparison cmp to a and b.
+func expectCompare(a int, cmp string, b int) (bool, error) {
+	switch cmp {
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	}
+	return false, fmt.Errorf("bad comparison %q", cmp)
+}
+
+// readExpectScript reads an expect script from r.
+func readExpectScript(r io.Reader) ([]*expectCmd, error) {
+	var cmds []*expectCmd
+	labels := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(s, " ", 2)
+		if len(parts) != 2 && s != "wait-break" && s != "continue" {
+			return nil, fmt.Errorf("line %d: bad line %q", ln, s)
+		}
+		cmd := &expectCmd{line: ln, op: parts[0]}
+		var arg string
+		if len(parts) == 2 {
+			arg = strings.TrimSpace(parts[1])
+		}
+		f := strings.Fields(arg)
+		var err error
+		switch cmd.op {
+		case "expect", "send":
+			cmd.str, err = strconv.Unquote(arg)
+		case "expect-re":
+			var pat string
+			if pat, err = strconv.Unquote(arg); err == nil {
+				cmd.re, err = regexp.Compile(pat)
+			}
+		case "timeout", "sleep":
+			cmd.dur, err = time.ParseDuration(arg)
+		case "set":
+			if len(f) != 2 {
+				err = errors.New("want destination and value")
+			} else if cmd.dst, err = parseWord(f[0]); err == nil {
+				cmd.args = f[1:]
+				err = checkExpectValue(f[1])
+			}
+		case "get":
+			if len(f) != 2 || !expectVarRegexp.MatchString(f[0]) {
+				err = errors.New("want variable and source")
+			} else if cmd.vr, cmd.ip = f[0], f[1] == "ip"; !cmd.ip {
+				if cmd.dst, err = parseWord(f[1]); err == nil && cmd.dst >= vreg+nregs {
+					err = fmt.Errorf("bad source %q", f[1])
+				}
+			}
+		case "let":
+			if (len(f) != 2 && len(f) != 4) || !expectVarRegexp.MatchString(f[0]) {
+				err = errors.New("want variable and value or expression")
+				break
+			}
+			cmd.vr, cmd.args = f[0], f[1:]
+			if err = checkExpectValue(f[1]); err == nil && len(f) == 4 {
+				if err = checkExpectValue(f[3]); err == nil {
+					_, err = expectArith(1, f[2], 1)
+				}
+			}
+		case "if":
+			if len(f) != 4 {
+				err = errors.New("want comparison and label")
+				break
+			}
+			cmd.args, cmd.lab = f[:3], f[3]
+			if err = checkExpectValue(f[0]); err == nil {
+				if err = checkExpectValue(f[2]); err == nil {
+					_, err = expectCompare(0, f[1], 0)
+				}
+			}
+		case "break", "unbreak":
+			if cmd.dst, err = parseWord(arg); err == nil && cmd.dst > vmax {
+				err = fmt.Errorf("bad address %q", arg)
+			}
+		case "wait-break", "continue":
+			if arg != "" {
+				err = errors.New("no arguments allowed")
+			}
+		case "limit":
+			if cmd.n, err = strconv.Atoi(arg); err == nil && cmd.n <= 0 {
+				err = errors.New("limit must be positive")
+			}
+		case "label":
+			if labels[arg] {
+				err = fmt.Errorf("duplicate label %q", arg)
+			}
+			cmd.lab, labels[arg] = arg, true
+		case "goto":
+			cmd.lab = arg
+		case "if-match":
+			// The label follows the quoted pattern.
+			i := strings.LastIndexByte(arg, ' ')
+			if i < 0 {
+				err = errors.New("want pattern and label")
+				break
+			}
+			cmd.lab = arg[i+1:]
+			var pat string
+			if pat, err = strconv.Unquote(strings.TrimSpace(arg[:i])); err == nil {
+				cmd.re, err = regexp.Compile(pat)
+			}
+		default:
+			err = fmt.Errorf("unknown command %q", cmd.op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", ln, err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		if (cmd.op == "goto" || cmd.op == "if" || cmd.op == "if-match") && !labels[cmd.lab] {
+			return nil, fmt.Errorf("line %d: unknown label %q", cmd.line, cmd.lab)
+		}
+	}
+	return cmds, sc.Err()
+}
+
+// readExpectScriptFile is a wrapper around readExpectScript that reads the
+// named file.
+func readExpectScriptFile(p string) ([]*expectCmd, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readExpectScript(f)
+}
+
+// errOutputEnded is returned by expecter.wait if the program stops writing
+// output before the pattern is seen.
+var errOutputEnded = errors.New("program stopped")
+
+// expecter searches the program's output for patterns.
+// It is safe for concurrent use.
+type expecter struct {
+	mu    sync.Mutex
+	buf   []byte // output since last match
+	ended bool   // no more output will be written
+
+	notify chan struct{} // signaled when buf or ended changes
+}
+
+func newExpecter() *expecter {
+	return &expecter{notify: make(chan struct{}, 1)}
+}
+
+// output appends a byte of output. It's ignored after end is called.
+func (e *expecter) output(b byte) {
+	e.mu.Lock()
+	if !e.ended {
+		e.buf = append(e.buf, b)
+	}
+	e.mu.Unlock()
+	e.signal()
+}
+
+// end indicates that no more output will be searched.
+func (e *expecter) end() {
+	e.mu.Lock()
+	e.ended = true
+	e.mu.Unlock()
+	e.signal()
+}
+
+func (e *expecter) signal() {
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for up to timeout for output containing str (if re is nil) or
+// matching re and discards and returns the output through the end of the match.
+func (e *expecter) wait(str string, re *regexp.Regexp, timeout time.Duration) (string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		e.mu.Lock()
+		end := -1
+		if re != nil {
+			if loc := re.FindIndex(e.buf); loc != nil {
+				end = loc[1]
+			}
+		} else if i := strings.Index(string(e.buf), str); i >= 0 {
+			end = i + len(str)
+		}
+		var matched string
+		if end >= 0 {
+			matched = string(e.buf[:end])
+			e.buf = e.buf[end:]
+		}
+		ended := e.ended
+		e.mu.Unlock()
+
+		if end >= 0 {
+			return matched, nil
+		} else if ended {
+			return "", errOutputEnded
+		}
+		select {
+		case <-e.notify:
+		case <-timer.C:
+			return "", fmt.Errorf("timed out after %v", timeout)
+		}
+	}
+}
+
+// expectBreaks pauses the program at an expect script's breakpoints.
+type expectBreaks struct {
+	hit    chan uint16     // receives address when program pauses
+	resume chan struct{}   // resumes paused program
+	done   chan struct{}   // closed when script ends
+	active map[uint16]bool // current breakpoints; VM goroutine only
+	hooked map[uint16]bool // addresses with hooks; VM goroutine only
+}
+
+func newExpectBreaks() *expectBreaks {
+	return &expectBreaks{
+		hit:    make(chan uint16),
+		resume: make(chan struct{}),
+		done:   make(chan struct{}),
+		active: make(map[uint16]bool),
+		hooked: make(map[uint16]bool),
+	}
+}
+
+// set adds or removes a breakpoint at addr. It must be run on the VM's
+// goroutine and returns true if b.hook needs to be registered for addr.
+func (b *expectBreaks) set(addr uint16, active bool) bool {
+	b.active[addr] = active
+	if !active || b.hooked[addr] {
+		return false
+	}
+	b.hooked[addr] = true
+	return true
+}
+
+// hook is called at breakpoint addresses. If the breakpoint is active, it
+// reports the hit and then runs functions passed to vm.do until the script
+// resumes the program or ends.
+func (b *expectBreaks) hook(vm *vm) {
+	if !b.active[vm.ip] {
+		return
+	}
+	vm.flushOutput() // before the script inspects the output
+	hit := b.hit
+	for {
+		select {
+		case hit <- vm.ip:
+			hit = nil
+		case f := <-vm.ctl:
+			f()
+		case <-b.resume:
+			return
+		case <-b.done:
+			return
+		case <-vm.quit:
+			return
+		}
+	}
+}
+
+// runExpect runs the expect script cmds, passing input lines to s.handleLine.
+func (s *session) runExpect(cmds []*expectCmd) error {
+	timeout := defaultExpectTimeout
+	limit := defaultExpectLimit
+	labels := make(map[string]int) // indexes of "label" commands
+	for i, cmd := range cmds {
+		if cmd.op == "label" {
+			labels[cmd.lab] = i
+		}
+	}
+	vars := make(map[string]int)
+	var matched string // output consumed by the last expect
+	var breaks *expectBreaks
+	var paused bool // program is paused at a breakpoint
+	defer func() {
+		if breaks != nil {
+			close(breaks.done)
+		}
+	}()
+
+	for i, n := 0, 0; i < len(cmds); i++ {
+		cmd := cmds[i]
+		var err error
+		if n++; n > limit {
+			return fmt.Errorf("line %d: ran more than %d commands", cmd.line, limit)
+		}
+		switch cmd.op {
+		case "expect", "expect-re":
+			matched, err = s.expect.wait(cmd.str, cmd.re, timeout)
+		case "send":
+			ln := expectSendVarRegexp.ReplaceAllStringFunc(cmd.str, func(m string) string {
+				name := m[2 : len(m)-1]
+				if v, ok := vars[name]; ok {
+					return strconv.Itoa(v)
+				}
+				err = fmt.Errorf("undefined variable %q", name)
+				return m
+			}) + "\n"
+			if err != nil {
+				break
+			}
+			s.lineMu.Lock()
+			s.echoInput(ln)
+			s.handleLine(ln)
+			s.lineMu.Unlock()
+		case "timeout":
+			timeout = cmd.dur
+		case "sleep":
+			time.Sleep(cmd.dur)
+		case "set":
+			var v int
+			if v, err = expectValue(cmd.args[0], vars); err != nil {
+				break
+			}
+			if v < 0 || v >= vreg+nregs {
+				err = fmt.Errorf("bad value %d", v)
+			} else if !s.vm.do(func() { err = s.vm.setWord(cmd.dst, uint16(v)) }) {
+				err = errOutputEnded
+			} else if err == nil {
+				s.note(fmt.Sprintf("expect script ran %q; replay will diverge", cmd.String()))
+			}
+		case "get":
+			var v uint16
+			if !s.vm.do(func() {
+				switch {
+				case cmd.ip:
+					v = s.vm.ip
+				case cmd.dst >= vreg:
+					v = s.vm.reg[cmd.dst-vreg]
+				default:
+					v = s.vm.mem[cmd.dst]
+				}
+			}) {
+				err = errOutputEnded
+			}
+			vars[cmd.vr] = int(v)
+		case "let":
+			var a, b int
+			if a, err = expectValue(cmd.args[0], vars); err == nil && len(cmd.args) == 3 {
+				if b, err = expectValue(cmd.args[2], vars); err == nil {
+					a, err = expectArith(a, cmd.args[1], b)
+				}
+			}
+			vars[cmd.vr] = a
+		case "if":
+			var a, b int
+			var ok bool
+			if a, err = expectValue(cmd.args[0], vars); err == nil {
+				if b, err = expectValue(cmd.args[2], vars); err == nil {
+					if ok, err = expectCompare(a, cmd.args[1], b); ok {
+						i = labels[cmd.lab]
+					}
+				}
+			}
+		case "goto":
+			i = labels[cmd.lab]
+		case "if-match":
+			if cmd.re.MatchString(matched) {
+				i = labels[cmd.lab]
+			}
+		case "break", "unbreak":
+			if breaks == nil {
+				breaks = newExpectBreaks()
+			}
+			active := cmd.op == "break"
+			if !s.vm.do(func() {
+				if breaks.set(cmd.dst, active) {
+					if s.vm.hooks == nil {
+						s.vm.hooks = make(map[uint16][]func(*vm))
+					}
+					s.vm.hooks[cmd.dst] = append(s.vm.hooks[cmd.dst], breaks.hook)
+				}
+			}) {
+				err = errOutputEnded
+			}
+		case "wait-break":
+			if breaks == nil {
+				err = errors.New("no breakpoints")
+				break
+			}
+			select {
+			case <-breaks.hit:
+				paused = true
+			case <-s.vm.stopped:
+				err = errOutputEnded
+			case <-time.After(timeout):
+				err = errors.New("timed out")
+			}
+		case "continue":
+			if !paused {
+				err = errors.New("not paused at breakpoint")
+				break
+			}
+			breaks.resume <- struct{}{}
+			paused = false
+		case "limit":
+			limit = cmd.n
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v: %v", cmd.line, cmd, err)
+		}
+	}
+	return nil
+}
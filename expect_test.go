@@ -0,0 +1,127 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadExpectScript(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		ok     bool
+	}{
+		{`get n r0`, true},
+		{`get n 100`, true},
+		{`get n ip`, true},
+		{`get n r8`, false},
+		{`get 1n r0`, false},
+		{`let n 5`, true},
+		{`let n $n + 0x10`, true},
+		{`let n $n ^ 2`, false},
+		{`let n $n +`, false},
+		{`let n foo`, false},
+		{"if $n < 3 done\nlabel done", true},
+		{"if $n =< 3 done\nlabel done", false},
+		{`if $n < 3 missing`, false},
+		{`set r0 $n`, true},
+		{`set r0 $`, false},
+		{`break 100`, true},
+		{`break r0`, false},
+		{`unbreak 100`, true},
+		{`wait-break`, true},
+		{`continue`, true},
+		{`continue now`, false},
+		{`limit 10`, true},
+		{`limit 0`, false},
+	} {
+		if _, err := readExpectScript(strings.NewReader(tc.script)); err != nil && tc.ok {
+			t.Errorf("Reading %q failed: %v", tc.script, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("Reading %q unexpectedly succeeded", tc.script)
+		}
+	}
+}
+
+// runExpectTest runs the expect script src against a program that reads a
+// character, counts r0 from 0 to 5, and then writes the character in a loop.
+// It returns the session's output and the script's error.
+func runExpectTest(t *testing.T, src string) (string, error) {
+	// The "out r1" instruction is at address 16.
+	words, err := assemble(strings.NewReader(`
+start: in r1
+  set r0 0
+loop:
+  add r0 r0 1
+  eq r2 r0 5
+  jf r2 loop
+  out r1
+  jmp start`), nil)
+	if err != nil {
+		t.Fatal("Assembling failed: ", err)
+	}
+	cmds, err := readExpectScript(strings.NewReader(src))
+	if err != nil {
+		t.Fatal("Reading script failed: ", err)
+	}
+	vm, err := newVM(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.size = copy(vm.mem[:], words)
+
+	var out bytes.Buffer
+	s := &session{vm: vm, onEOF: eofHalt, msg: &out, expCmds: cmds, expect: newExpecter()}
+	s.run(strings.NewReader(""), &out)
+	return out.String(), s.expErr
+}
+
+func TestRunExpect(t *testing.T) {
+	out, err := runExpectTest(t, `
+timeout 5s
+break 16
+send "a"
+wait-break
+get n r0
+get addr ip
+if $n != 5 fail
+if $addr != 16 fail
+let n $n * 3
+set r0 $n
+set r1 98
+get c r1
+continue
+expect "b"
+wait-break
+unbreak 16
+continue
+send "${c}"
+expect "98"
+goto end
+label fail
+expect "never"
+label end
+`)
+	if err != nil {
+		t.Fatal("Script failed: ", err)
+	}
+	if want := "b\n98\n"; !strings.Contains(out, want) {
+		t.Errorf("Output %q doesn't contain %q", out, want)
+	}
+}
+
+func TestRunExpectLimit(t *testing.T) {
+	_, err := runExpectTest(t, "limit 100\nlabel loop\nlet n 1\ngoto loop")
+	if err == nil || !strings.Contains(err.Error(), "more than 100 commands") {
+		t.Errorf("Looping script returned %v; want limit error", err)
+	}
+}
+
+func TestRunExpectContinueWithoutBreak(t *testing.T) {
+	if _, err := runExpectTest(t, "continue"); err == nil {
+		t.Error("continue without wait-break unexpectedly succeeded")
+	}
+}
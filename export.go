@@ -0,0 +1,138 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Files written by exportProgram.
+const (
+	exportImage   = "image.bin"
+	exportSymbols = "symbols.txt"
+	exportGhidra  = "synacor_import.py"
+)
+
+// exportSym is a symbol or region written by exportProgram.
+type exportSym struct {
+	kind string // "entry", "function", "label", "data", "encrypted", "text", or "zero"
+	addr int    // word address
+	len  int    // in words
+	name string // empty for regions
+	note string // comment for regions
+}
+
+// exportSyms returns p's symbols and unreachable regions sorted by address.
+// entries contains the program's entry points.
+func (p *program) exportSyms(entries []uint16) []exportSym {
+	isEntry := make(map[uint16]bool)
+	for _, e := range entries {
+		isEntry[e] = true
+	}
+	var syms []exportSym
+	for addr, names := range p.labels() {
+		for _, n := range names {
+			kind := "label"
+			if _, ok := p.funcs[addr]; ok && n == funcName(addr) {
+				kind = "function"
+				if isEntry[addr] {
+					kind = "entry"
+				}
+			}
+			syms = append(syms, exportSym{kind: kind, addr: int(addr), len: 1, name: n})
+		}
+	}
+	for _, g := range p.gaps() {
+		kind := "data"
+		if g.zero {
+			kind = "zero"
+		}
+		syms = append(syms, exportSym{kind: kind, addr: g.start, len: g.end - g.start,
+			note: fmt.Sprintf("unreachable %s (%d words)", kind, g.end-g.start)})
+		for _, r := range g.hot {
+			syms = append(syms, exportSym{kind: "encrypted", addr: r.start, len: r.end - r.start,
+				note: fmt.Sprintf("high-entropy data (%.2f bits/byte), likely encrypted", r.entropy)})
+		}
+		for _, f := range g.text {
+			syms = append(syms, exportSym{kind: "text", addr: int(f.addr), len: len(f.s),
+				note: fmt.Sprintf("text %q", f.s)})
+		}
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		if syms[i].addr != syms[j].addr {
+			return syms[i].addr < syms[j].addr
+		}
+		return syms[i].kind < syms[j].kind
+	})
+	return syms
+}
+
+// exportProgram writes p's memory image, a symbol sidecar file, and a Ghidra
+// script that applies the symbols to dir, which is created if needed.
+func (p *program) exportProgram(dir string, size int, entries []uint16) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeImageFile(filepath.Join(dir, exportImage), p.mem, size); err != nil {
+		return err
+	}
+	syms := p.exportSyms(entries)
+
+	var b strings.Builder
+	b.WriteString("# Symbols and regions for " + exportImage + ".\n")
+	b.WriteString("# Addresses and lengths are in 16-bit words; byte offsets are twice the address.\n")
+	b.WriteString("# kind addr len name-or-comment\n")
+	for _, s := range syms {
+		txt := s.name
+		if txt == "" {
+			txt = s.note
+		}
+		fmt.Fprintf(&b, "%s %d %d %s\n", s.kind, s.addr, s.len, txt)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, exportSymbols), []byte(b.String()), 0644); err != nil {
+		return err
+	}
+
+	b.Reset()
+	b.WriteString(`# Applies symbols discovered by synacor-challenge to a Ghidra program.
+# Import ` + exportImage + ` as a raw little-endian binary with 16-bit words
+# at address 0, then run this script.
+#@category Synacor
+
+SYMBOLS = [  # (kind, byte offset, name)
+`)
+	for _, s := range syms {
+		if s.name != "" {
+			fmt.Fprintf(&b, "    (%q, 0x%x, %q),\n", s.kind, s.addr*2, s.name)
+		}
+	}
+	b.WriteString("]\n\nREGIONS = [  # (kind, byte offset, comment)\n")
+	for _, s := range syms {
+		if s.name == "" {
+			fmt.Fprintf(&b, "    (%q, 0x%x, %q),\n", s.kind, s.addr*2, s.note)
+		}
+	}
+	b.WriteString(`]
+
+space = currentProgram.getAddressFactory().getDefaultAddressSpace()
+for kind, off, name in SYMBOLS:
+    addr = space.getAddress(off)
+    createLabel(addr, name, True)
+    if kind in ("entry", "function"):
+        createFunction(addr, name)
+    if kind == "entry":
+        addEntryPoint(addr)
+comments = {}
+for kind, off, comment in REGIONS:
+    comments.setdefault(off, []).append(comment)
+for off, lines in comments.items():
+    setPlateComment(space.getAddress(off), "\n".join(lines))
+`)
+	return ioutil.WriteFile(filepath.Join(dir, exportGhidra), []byte(b.String()), 0644)
+}
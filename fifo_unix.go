@@ -0,0 +1,14 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import "syscall"
+
+// mkfifo creates a named pipe at p.
+func mkfifo(p string) error {
+	return syscall.Mkfifo(p, 0600)
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Branches are named snapshots stored in a subdirectory of the save slot
+// directory. Each records the branch that was current when it was forked,
+// so together they form a tree of explored paths.
+
+const branchDir = "branches"
+
+// validBranch returns true if name can be used as a branch name.
+func validBranch(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '-' || c == '_' || c == '.' || (c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// branchPath returns the path of the named branch within slot directory dir.
+func branchPath(dir, name string) string {
+	return filepath.Join(dir, branchDir, name+".sav")
+}
+
+// listBranches returns metadata for all branches in slot directory dir,
+// keyed by branch name. Unreadable branches are skipped.
+func listBranches(dir string) (map[string]snapshotMeta, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(dir, branchDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	branches := make(map[string]snapshotMeta)
+	for _, fi := range fis {
+		name := strings.TrimSuffix(fi.Name(), ".sav")
+		if name == fi.Name() || !validBranch(name) {
+			continue
+		}
+		snap, err := loadSnapshotFile(filepath.Join(dir, branchDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		branches[name] = snap.Meta
+	}
+	return branches, nil
+}
+
+// writeBranchTree writes the branches as an indented tree to w, marking cur.
+// Branches whose parents no longer exist are treated as roots.
+func writeBranchTree(w io.Writer, branches map[string]snapshotMeta, cur string) error {
+	children := make(map[string][]string)
+	for name, m := range branches {
+		parent := m.Parent
+		if _, ok := branches[parent]; !ok {
+			parent = ""
+		}
+		children[parent] = append(children[parent], name)
+	}
+	for _, names := range children {
+		sort.Strings(names)
+	}
+
+	var b strings.Builder
+	var write func(name, prefix string, last bool, depth int)
+	write = func(name, prefix string, last bool, depth int) {
+		mark := " "
+		if name == cur {
+			mark = "*"
+		}
+		conn, next := "", ""
+		if depth > 0 {
+			conn, next = "├─ ", "│  "
+			if last {
+				conn, next = "└─ ", "   "
+			}
+		}
+		m := branches[name]
+		fmt.Fprintf(&b, "%s %s%s%s  (%d steps, %s)\n", mark, prefix, conn, name, m.Steps, describeState(m))
+		kids := children[name]
+		for i, k := range kids {
+			write(k, prefix+next, i == len(kids)-1, depth+1)
+		}
+	}
+	for _, r := range children[""] {
+		write(r, "", false, 0)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+// This file implements superinstructions: common pairs of instructions that
+// are executed by a single handler to avoid a trip through the main loop.
+// Pairs are detected when the first instruction is decoded, and its cached
+// entry's fn field is set to the fused handler's index in opFuncs. The
+// second instruction's entry is read from vm.code by the handler, so
+// invalidate discards the first instruction's entry whenever the second
+// instruction is written.
+//
+// Fusion skips the per-instruction work done by vm.run (debugger checks,
+// hooks, tracing, etc.), so it's only performed when no instrumentation is
+// enabled. Fused handlers call vm.step to count the second instruction.
+// The first instruction must not write memory or transfer control.
+
+// Indexes of handlers in opFuncs that don't correspond to opcodes.
+const (
+	fnEqJt = opTrap + 1 + iota
+	fnEqJf
+	fnGtJt
+	fnGtJf
+	fnAddJt
+	fnAddJf
+	fnAddWmem
+	fnBlock  // see blocks.go
+	fnNative // calls vm.natives
+
+	numOpFuncs // length of opFuncs
+)
+
+// maxFusedSize is the maximum number of words in a fused pair of instructions.
+const maxFusedSize = 7
+
+// fusions maps from pairs of opcodes to fused handlers' indexes in opFuncs.
+var fusions = map[[2]uint16]uint16{
+	{opEq, opJt}:    fnEqJt,
+	{opEq, opJf}:    fnEqJf,
+	{opGt, opJt}:    fnGtJt,
+	{opGt, opJf}:    fnGtJf,
+	{opAdd, opJt}:   fnAddJt,
+	{opAdd, opJf}:   fnAddJf,
+	{opAdd, opWmem}: fnAddWmem,
+}
+
+// canFuse returns true if instrumentation that needs to observe each
+// instruction is disabled.
+func (vm *vm) canFuse() bool {
+	return vm.dbg == nil && vm.hooks == nil && vm.trace == nil && vm.ctrace == nil &&
+		vm.opCounts == nil
+}
+
+// step records that the instruction at ip was executed by a handler
+// without passing through run.
+func (vm *vm) step(ip uint16) {
+	vm.steps++
+	if vm.hist != nil {
+		vm.hist[vm.steps%uint64(len(vm.hist))] = ip
+	}
+}
+
+// fusion returns the index in opFuncs of the handler for d, the valid
+// instruction at ip. If d can be fused with the following instruction,
+// that instruction is decoded and a fused handler is returned.
+func (vm *vm) fusion(ip uint16, d *predecoded) uint16 {
+	next := int(ip) + int(d.size)
+	if next >= msize {
+		return d.op
+	}
+	fn, ok := fusions[[2]uint16{d.op, vm.mem[next]}]
+	if !ok || vm.natives[uint16(next)] != nil || vm.decoded(uint16(next)).size == 0 {
+		return d.op
+	}
+	return fn
+}
+
+// eq followed by jt
+func execEqJt(vm *vm, d *predecoded, ip uint16) uint16 {
+	ip = execEq(vm, d, ip)
+	vm.step(ip)
+	return execJt(vm, &vm.code[ip], ip)
+}
+
+// eq followed by jf
+func execEqJf(vm *vm, d *predecoded, ip uint16) uint16 {
+	ip = execEq(vm, d, ip)
+	vm.step(ip)
+	return execJf(vm, &vm.code[ip], ip)
+}
+
+// gt followed by jt
+func execGtJt(vm *vm, d *predecoded, ip uint16) uint16 {
+	ip = execGt(vm, d, ip)
+	vm.step(ip)
+	return execJt(vm, &vm.code[ip], ip)
+}
+
+// gt followed by jf
+func execGtJf(vm *vm, d *predecoded, ip uint16) uint16 {
+	ip = execGt(vm, d, ip)
+	vm.step(ip)
+	return execJf(vm, &vm.code[ip], ip)
+}
+
+// add followed by jt
+func execAddJt(vm *vm, d *predecoded, ip uint16) uint16 {
+	ip = execAdd(vm, d, ip)
+	vm.step(ip)
+	return execJt(vm, &vm.code[ip], ip)
+}
+
+// add followed by jf
+func execAddJf(vm *vm, d *predecoded, ip uint16) uint16 {
+	ip = execAdd(vm, d, ip)
+	vm.step(ip)
+	return execJf(vm, &vm.code[ip], ip)
+}
+
+// add followed by wmem
+func execAddWmem(vm *vm, d *predecoded, ip uint16) uint16 {
+	ip = execAdd(vm, d, ip)
+	vm.step(ip)
+	return execWmem(vm, &vm.code[ip], ip)
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// codeLen is the length of the codes printed by the challenge.
+const codeLen = 12
+
+// gameInfo tracks information parsed from the program's output.
+// It is safe for concurrent use.
+type gameInfo struct {
+	mu    sync.Mutex
+	line  []byte   // current partial line
+	last  string   // last non-empty complete line
+	room  string   // most recent room title, e.g. "Foothills"
+	codes []string // codes seen so far, in order
+
+	things []string  // items listed in the current room
+	exits  []string  // exits listed for the current room
+	inv    []string  // items most recently listed in the inventory
+	list   *[]string // list receiving "- item" lines, or nil
+}
+
+// write processes a byte of output. Codes seen for the first time are
+// returned.
+func (g *gameInfo) write(b byte) (newCodes []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if b != '\n' {
+		g.line = append(g.line, b)
+		return nil
+	}
+	ln := strings.TrimSpace(string(g.line))
+	g.line = g.line[:0]
+	if ln == "" {
+		g.list = nil
+		return nil
+	}
+	g.last = ln
+	if strings.HasPrefix(ln, "== ") && strings.HasSuffix(ln, " ==") && len(ln) > 6 {
+		g.room = ln[3 : len(ln)-3]
+		g.things, g.exits = nil, nil
+	}
+	g.parseList(ln)
+	for _, c := range findCodes(ln) {
+		if !g.hasCode(c) {
+			g.codes = append(g.codes, c)
+			newCodes = append(newCodes, c)
+		}
+	}
+	return newCodes
+}
+
+// parseList updates the lists of items and exits from ln.
+// Lists look like this:
+//
+//	Things of interest here:
+//	- tablet
+//
+//	There are 2 exits:
+//	- north
+//	- south
+//
+// g.mu must be held.
+func (g *gameInfo) parseList(ln string) {
+	switch {
+	case ln == "Things of interest here:":
+		g.things, g.list = nil, &g.things
+	case ln == "Your inventory:":
+		g.inv, g.list = nil, &g.inv
+	case strings.HasPrefix(ln, "There ") && (strings.HasSuffix(ln, " exits:") || strings.HasSuffix(ln, " exit:")):
+		g.exits, g.list = nil, &g.exits
+	case strings.HasPrefix(ln, "- ") && g.list != nil:
+		*g.list = append(*g.list, strings.TrimPrefix(ln, "- "))
+	default:
+		g.list = nil
+	}
+}
+
+// nouns returns the items in the current room, the exits, and the inventory.
+func (g *gameInfo) nouns() (things, exits, inv []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.things...), append([]string(nil), g.exits...),
+		append([]string(nil), g.inv...)
+}
+
+// hasCode returns true if c is in g.codes. g.mu must be held.
+func (g *gameInfo) hasCode(c string) bool {
+	for _, o := range g.codes {
+		if o == c {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the current room title, last output line, and codes.
+func (g *gameInfo) get() (room, last string, codes []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.room, g.last, append([]string(nil), g.codes...)
+}
+
+// set replaces the room title, last line, and codes, e.g. after loading a save.
+func (g *gameInfo) set(room, last string, codes []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.room, g.last, g.codes = room, last, append([]string(nil), codes...)
+}
+
+// findCodes returns words in ln that look like challenge codes: codeLen
+// letters and digits including lowercase letters and either digits or
+// non-initial uppercase letters (to skip capitalized English words).
+func findCodes(ln string) []string {
+	var codes []string
+	for _, w := range strings.FieldsFunc(ln, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) != codeLen {
+			continue
+		}
+		var mixed, lower bool
+		for i, r := range w {
+			mixed = mixed || unicode.IsDigit(r) || (i > 0 && unicode.IsUpper(r))
+			lower = lower || unicode.IsLower(r)
+		}
+		if mixed && lower {
+			codes = append(codes, w)
+		}
+	}
+	return codes
+}
@@ -0,0 +1,283 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+// goBackend emits a standalone Go program.
+type goBackend struct{}
+
+func (goBackend) prologue(b *strings.Builder, t *translation) {
+	b.WriteString(`// Code generated by synacor-challenge -recompile; DO NOT EDIT.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+`)
+	fmt.Fprintf(b, "const startPC = %d\n\n", t.pc)
+	fmt.Fprintf(b, "var r = [8]uint16{%s}\n\n", joinWords(t.regs[:]))
+	fmt.Fprintf(b, "var stack = []uint16{%s}\n\n", joinWords(t.stack))
+	b.WriteString("var mem = [32768]uint16{\n")
+	writeWords(b, t.p.mem[:t.memEnd], "\t")
+	b.WriteString("}\n\n")
+	b.WriteString("// blocks contains the [start, end) ranges of translated blocks.\n")
+	b.WriteString("var blocks = [][2]uint16{\n")
+	for _, blk := range t.blocks {
+		fmt.Fprintf(b, "\t{%d, %d},\n", blk[0], blk[1])
+	}
+	b.WriteString("}\n")
+	b.WriteString(goRuntime)
+}
+
+func (goBackend) format(src []byte) ([]byte, error) { return format.Source(src) }
+
+func (goBackend) funcHeader(b *strings.Builder, name string) {
+	fmt.Fprintf(b, "\nfunc %s(pc uint16) uint16 {\n", name)
+}
+
+func (goBackend) funcFooter(b *strings.Builder) {
+	b.WriteString("}\n")
+}
+
+func (goBackend) epilogue(b *strings.Builder, t *translation) {
+	b.WriteString(`
+func main() {
+	for _, b := range blocks {
+		for i := b[0]; i < b[1]; i++ {
+			owner[i] = b[0] + 1
+		}
+	}
+	pc := uint16(startPC)
+	for pc != 0xffff {
+		if pc > 32767 {
+			fail("bad address %v", pc)
+		}
+		if dirty[pc] {
+			pc = step(pc)
+			continue
+		}
+		switch pc {
+`)
+	for _, tf := range t.fns {
+		if len(tf.entries) == 0 {
+			continue
+		}
+		cases := make([]string, len(tf.entries))
+		for i, e := range tf.entries {
+			cases[i] = fmt.Sprint(e)
+		}
+		fmt.Fprintf(b, "\t\tcase %s:\n\t\t\tpc = %s(pc)\n", strings.Join(cases, ", "), funcName(tf.fn.entry))
+	}
+	b.WriteString(`		default:
+			pc = step(pc)
+		}
+	}
+	stdout.Flush()
+}
+`)
+}
+
+// joinWords formats vals as a comma-separated list.
+func joinWords(vals []uint16) string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = fmt.Sprint(v)
+	}
+	return strings.Join(s, ", ")
+}
+
+// goRuntime contains helpers used by translated Go code.
+const goRuntime = `
+var (
+	dirty [32768]bool   // translated blocks that have been overwritten, keyed by start
+	owner [32768]uint16 // 1 + start of the translated block containing each word, or 0
+
+	stdin  = bufio.NewReader(os.Stdin)
+	stdout = bufio.NewWriter(os.Stdout)
+)
+
+func fail(format string, args ...interface{}) {
+	stdout.Flush()
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func bad(v, addr uint16) uint16 {
+	fail("bad value %v at %v", v, addr)
+	return 0
+}
+
+func push(v uint16) { stack = append(stack, v) }
+
+func pop() uint16 {
+	if len(stack) == 0 {
+		fail("pop with empty stack")
+	}
+	v := stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+	return v
+}
+
+func popRet() uint16 {
+	if len(stack) == 0 {
+		return 0xffff
+	}
+	return pop()
+}
+
+func eq(a, b uint16) uint16 {
+	if a == b {
+		return 1
+	}
+	return 0
+}
+
+func gt(a, b uint16) uint16 {
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func add(a, b uint16) uint16 { return (a + b) % 32768 }
+func mul(a, b uint16) uint16 { return uint16(uint32(a) * uint32(b) % 32768) }
+func and(a, b uint16) uint16 { return a & b }
+func or(a, b uint16) uint16  { return a | b }
+func inv(a uint16) uint16    { return ^a & 32767 }
+
+func mod(a, b uint16) uint16 {
+	if b == 0 {
+		fail("mod by zero")
+	}
+	return a % b
+}
+
+func rd(a uint16) uint16 {
+	if a > 32767 {
+		fail("bad address %v", a)
+	}
+	return mem[a]
+}
+
+func wr(a, v uint16) {
+	if a > 32767 {
+		fail("bad address %v", a)
+	}
+	mem[a] = v
+	if o := owner[a]; o != 0 {
+		dirty[o-1] = true
+	}
+}
+
+func out(v uint16) { stdout.WriteByte(byte(v)) }
+
+func in() uint16 {
+	stdout.Flush()
+	c, err := stdin.ReadByte()
+	if err != nil {
+		os.Exit(0)
+	}
+	return uint16(c)
+}
+
+// step interprets the instruction at pc and returns the next address.
+func step(pc uint16) uint16 {
+	get := func(i uint16) uint16 {
+		v := rd(pc + i)
+		if v < 32768 {
+			return v
+		} else if v < 32776 {
+			return r[v-32768]
+		}
+		return bad(v, pc+i)
+	}
+	set := func(i, v uint16) {
+		d := rd(pc + i)
+		if d < 32768 || d >= 32776 {
+			bad(d, pc+i)
+		}
+		r[d-32768] = v
+	}
+	switch op := rd(pc); op {
+	case 0:
+		return 0xffff
+	case 1:
+		set(1, get(2))
+		return pc + 3
+	case 2:
+		push(get(1))
+		return pc + 2
+	case 3:
+		set(1, pop())
+		return pc + 2
+	case 4:
+		set(1, eq(get(2), get(3)))
+		return pc + 4
+	case 5:
+		set(1, gt(get(2), get(3)))
+		return pc + 4
+	case 6:
+		return get(1)
+	case 7:
+		if get(1) != 0 {
+			return get(2)
+		}
+		return pc + 3
+	case 8:
+		if get(1) == 0 {
+			return get(2)
+		}
+		return pc + 3
+	case 9:
+		set(1, add(get(2), get(3)))
+		return pc + 4
+	case 10:
+		set(1, mul(get(2), get(3)))
+		return pc + 4
+	case 11:
+		set(1, mod(get(2), get(3)))
+		return pc + 4
+	case 12:
+		set(1, and(get(2), get(3)))
+		return pc + 4
+	case 13:
+		set(1, or(get(2), get(3)))
+		return pc + 4
+	case 14:
+		set(1, inv(get(2)))
+		return pc + 3
+	case 15:
+		set(1, rd(get(2)))
+		return pc + 3
+	case 16:
+		wr(get(1), get(2))
+		return pc + 3
+	case 17:
+		push(pc + 2)
+		return get(1)
+	case 18:
+		return popRet()
+	case 19:
+		out(get(1))
+		return pc + 2
+	case 20:
+		set(1, in())
+		return pc + 2
+	case 21, 22: // noop, trap
+		return pc + 1
+	default:
+		fail("invalid op %v at %v", op, pc)
+	}
+	return 0xffff
+}
+`
@@ -0,0 +1,527 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcService is the full name of the service described by synacor.proto.
+const grpcService = "synacor.Synacor"
+
+// grpcMaxMessage is the maximum size of a request message.
+const grpcMaxMessage = 1<<20 + 1<<10
+
+// gRPC status codes.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is an error with a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcStatus returns the status code and message for err, which may have
+// been returned by an API session, a userStore, or the server. def is used
+// for errors without a more specific code.
+func grpcStatus(err error, def int) *grpcError {
+	code := def
+	switch err {
+	case nil:
+		return &grpcError{grpcOK, ""}
+	case errRunning:
+		code = grpcFailedPrecondition
+	case errSaveMem, errUserQuota, errTooManySessions:
+		code = grpcResourceExhausted
+	case errNoSave:
+		code = grpcNotFound
+	case errBadSaveName:
+		code = grpcInvalidArgument
+	}
+	if ge, ok := err.(*grpcError); ok {
+		return ge
+	}
+	return &grpcError{code, err.Error()}
+}
+
+// serveGRPC listens at addr and serves the gRPC API described by
+// synacor.proto. gRPC requires HTTP/2, which net/http only supports over TLS,
+// so certFile and keyFile must contain a certificate and its private key.
+func (srv *server) serveGRPC(addr, certFile, keyFile string) error {
+	hs := &http.Server{Addr: addr, Handler: http.HandlerFunc(srv.handleGRPC)}
+	fmt.Fprintf(srv.msg, "Serving gRPC at %v\n", addr)
+	return hs.ListenAndServeTLS(certFile, keyFile)
+}
+
+// handleGRPC handles a gRPC call.
+func (srv *server) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Only gRPC requests are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	var err error
+	method := strings.TrimPrefix(r.URL.Path, "/"+grpcService+"/")
+	if user, uerr := srv.user(r); uerr != nil {
+		err = grpcErrorf(grpcUnauthenticated, "%v", uerr)
+	} else if method == "Attach" {
+		err = srv.grpcAttach(w, r, user)
+	} else if req, rerr := readGRPCMessage(r.Body); rerr != nil {
+		err = grpcStatus(rerr, grpcInvalidArgument)
+	} else {
+		var resp *pbEncoder
+		if resp, err = srv.grpcCall(r, method, user, req); err == nil {
+			err = writeGRPCMessage(w, resp)
+		}
+	}
+	st := grpcStatus(err, grpcInternal)
+	w.Header().Set("Grpc-Status", strconv.Itoa(st.code))
+	if st.msg != "" {
+		w.Header().Set("Grpc-Message", grpcEncodeMessage(st.msg))
+	}
+}
+
+// readGRPCMessage reads a length-prefixed message from r.
+// io.EOF is returned if r ends before the message starts.
+func readGRPCMessage(r io.Reader) (pbMessage, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err == io.ErrUnexpectedEOF {
+		return nil, errBadProto
+	} else if err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compression not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message too large")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errBadProto
+	}
+	return decodeProto(b)
+}
+
+// writeGRPCMessage writes the message in e to w and flushes it.
+func writeGRPCMessage(w http.ResponseWriter, e *pbEncoder) error {
+	b := make([]byte, 5, 5+len(e.b))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(e.b)))
+	if _, err := w.Write(append(b, e.b...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// grpcEncodeMessage percent-encodes msg for the grpc-message trailer.
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcWait returns the duration in milliseconds in req's field,
+// or apiStopTimeout if it's unset.
+func grpcWait(req pbMessage, field int) (time.Duration, error) {
+	ms := req.int(field)
+	if ms < 0 {
+		return 0, grpcErrorf(grpcInvalidArgument, "bad wait_ms %d", ms)
+	} else if ms == 0 {
+		return apiStopTimeout, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// grpcSession returns user's session with the supplied ID.
+// If api is true, the session must be an API session.
+func (srv *server) grpcSession(id, user string, api bool) (*serverSession, error) {
+	ss := srv.get(id)
+	if ss == nil || ss.user != user {
+		return nil, grpcErrorf(grpcNotFound, "no such session")
+	}
+	if api && ss.api == nil {
+		return nil, grpcErrorf(grpcFailedPrecondition, "not an API session")
+	}
+	return ss, nil
+}
+
+// grpcCall runs the unary method with the request req from user.
+func (srv *server) grpcCall(r *http.Request, method, user string, req pbMessage) (*pbEncoder, error) {
+	resp := &pbEncoder{}
+
+	switch method {
+	case "CreateSession":
+		vm := srv.newVM()
+		if name := req.str(2); name != "" {
+			if srv.users == nil {
+				return nil, grpcErrorf(grpcFailedPrecondition, "user saves not enabled")
+			}
+			snap, err := srv.users.load(user, name)
+			if err != nil {
+				return nil, grpcStatus(err, grpcInternal)
+			}
+			vm.restore(snap)
+		} else if b := req.bytes(1); len(b) > 0 {
+			snap, err := readSnapshot(bytes.NewReader(b))
+			if err != nil {
+				return nil, grpcErrorf(grpcInvalidArgument, "bad snapshot: %v", err)
+			}
+			vm.restore(snap)
+		}
+		ss, err := srv.addAPISession(vm, r.RemoteAddr, user)
+		if err != nil {
+			return nil, grpcStatus(err, grpcInternal)
+		}
+		srv.mu.Lock()
+		info := ss.info()
+		srv.mu.Unlock()
+		return encodeGRPCSession(info), nil
+	case "ListSessions":
+		for _, info := range srv.sessionInfos(user) {
+			resp.msg(1, encodeGRPCSession(info))
+		}
+		return resp, nil
+	case "DeleteSession":
+		ss, err := srv.grpcSession(req.str(1), user, false)
+		if err != nil {
+			return nil, err
+		}
+		srv.remove(ss, "deleted")
+		return resp, nil
+	case "ListUserSaves", "GetUserSave", "PutUserSave", "DeleteUserSave":
+		return srv.grpcUserSaves(method, user, req)
+	case "GetState", "GetRegisters", "ReadMemory", "Step", "Continue",
+		"SetBreakpoint", "ClearBreakpoint", "ListBreakpoints",
+		"GetSnapshot", "Save", "Load", "DeleteSave":
+		ss, err := srv.grpcSession(req.str(1), user, true)
+		if err != nil {
+			return nil, err
+		}
+		s := ss.api
+		s.ctlMu.Lock()
+		defer s.ctlMu.Unlock()
+		if resp, err = s.grpcCall(method, req); err != nil {
+			return nil, grpcStatus(err, grpcInvalidArgument)
+		}
+		return resp, nil
+	}
+	return nil, grpcErrorf(grpcUnimplemented, "unknown method %q", method)
+}
+
+// grpcCall runs a unary method that operates on the session.
+// The caller must hold ctlMu.
+func (s *apiSession) grpcCall(method string, req pbMessage) (*pbEncoder, error) {
+	resp := &pbEncoder{}
+
+	var wait time.Duration
+	var err error
+	switch method {
+	case "GetState", "GetRegisters":
+		wait, err = grpcWait(req, 2)
+	case "ReadMemory":
+		wait, err = grpcWait(req, 4)
+	case "Step":
+		wait, err = grpcWait(req, 3)
+	default:
+		wait = apiStopTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case "GetState":
+		return encodeGRPCState(s.state(wait)), nil
+	case "GetRegisters":
+		regs, err := s.regs(wait)
+		if err != nil {
+			return nil, err
+		}
+		reg := make([]uint64, len(regs.Reg))
+		for i, v := range regs.Reg {
+			reg[i] = uint64(v)
+		}
+		stack := make([]uint64, len(regs.Stack))
+		for i, v := range regs.Stack {
+			stack[i] = uint64(v)
+		}
+		resp.packed(1, reg)
+		resp.packed(2, stack)
+		resp.uint(3, uint64(regs.IP))
+		resp.uint(4, regs.Steps)
+	case "ReadMemory":
+		addr, n := req.uint(2), req.uint(3)
+		if n == 0 {
+			n = 16
+		}
+		if addr > vmax {
+			return nil, fmt.Errorf("bad addr %d", addr)
+		} else if n > apiMaxMemWords {
+			return nil, fmt.Errorf("bad n %d", n)
+		}
+		words, err := s.mem(int(addr), int(n), wait)
+		if err != nil {
+			return nil, err
+		}
+		vals := make([]uint64, len(words))
+		for i, v := range words {
+			vals[i] = uint64(v)
+		}
+		resp.uint(1, addr)
+		resp.packed(2, vals)
+	case "Step":
+		n := req.uint(2)
+		if n == 0 {
+			n = 1
+		} else if n > 1<<30 {
+			return nil, fmt.Errorf("bad n %d", n)
+		}
+		if err := s.step(int(n), wait); err != nil {
+			return nil, err
+		}
+		return encodeGRPCState(s.state(wait)), nil
+	case "Continue":
+		s.cont()
+		return encodeGRPCState(s.state(0)), nil
+	case "SetBreakpoint", "ClearBreakpoint", "ListBreakpoints":
+		addr := req.uint(2)
+		if addr > vmax {
+			return nil, fmt.Errorf("bad addr %d", addr)
+		}
+		addrs, err := s.breaks(int(addr), method == "SetBreakpoint", method == "ClearBreakpoint", wait)
+		if err != nil {
+			return nil, err
+		}
+		if method == "ListBreakpoints" {
+			vals := make([]uint64, len(addrs))
+			for i, a := range addrs {
+				vals[i] = uint64(a)
+			}
+			resp.packed(1, vals)
+		}
+	case "GetSnapshot":
+		encs := []snapshotEncoding{gobSnapshot, jsonSnapshot, textSnapshot}
+		f := req.uint(2)
+		if f >= uint64(len(encs)) {
+			return nil, fmt.Errorf("bad format %d", f)
+		}
+		snap, err := s.snapshot(wait)
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		if err := writeSnapshot(&b, snap, encs[f]); err != nil {
+			return nil, err
+		}
+		resp.bytes(1, b.Bytes())
+	case "Save", "DeleteSave":
+		if err := s.save(req.str(2), method == "DeleteSave", wait); err != nil {
+			return nil, err
+		}
+	case "Load":
+		if err := s.load(req.str(2), wait); err != nil {
+			return nil, err
+		}
+		return encodeGRPCState(s.state(wait)), nil
+	}
+	return resp, nil
+}
+
+// grpcUserSaves runs a unary method that manages user's saves.
+func (srv *server) grpcUserSaves(method, user string, req pbMessage) (*pbEncoder, error) {
+	if srv.users == nil {
+		return nil, grpcErrorf(grpcFailedPrecondition, "user saves not enabled")
+	}
+	resp := &pbEncoder{}
+	name := req.str(1)
+	var err error
+	switch method {
+	case "ListUserSaves":
+		var infos []userSaveInfo
+		if infos, err = srv.users.list(user); err != nil {
+			break
+		}
+		var used int64
+		for _, info := range infos {
+			used += info.Bytes
+			var m pbEncoder
+			m.str(1, info.Name)
+			m.int(2, info.Bytes)
+			m.int(3, unixMillis(info.Modified))
+			resp.msg(3, &m)
+		}
+		resp.int(1, srv.users.quota)
+		resp.int(2, used)
+	case "GetUserSave":
+		var b []byte
+		if b, err = srv.users.read(user, name); err == nil {
+			resp.bytes(1, b)
+		}
+	case "PutUserSave":
+		var snap *snapshot
+		if b := req.bytes(2); len(b) > 0 {
+			if snap, err = readSnapshot(bytes.NewReader(b)); err != nil {
+				return nil, grpcErrorf(grpcInvalidArgument, "bad snapshot: %v", err)
+			}
+		} else {
+			ss, err := srv.grpcSession(req.str(3), user, false)
+			if err != nil {
+				return nil, err
+			}
+			if snap, err = ss.snapshot(apiStopTimeout); err != nil {
+				return nil, grpcStatus(err, grpcInternal)
+			}
+		}
+		err = srv.users.save(user, name, snap)
+	case "DeleteUserSave":
+		err = srv.users.remove(user, name)
+	}
+	if err != nil {
+		return nil, grpcStatus(err, grpcInternal)
+	}
+	return resp, nil
+}
+
+// grpcAttach handles a call to the Attach method from user, which streams
+// input to an API session's program and its output back to the client.
+func (srv *server) grpcAttach(w http.ResponseWriter, r *http.Request, user string) error {
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return grpcStatus(err, grpcInvalidArgument)
+	}
+	ss, err := srv.grpcSession(req.str(1), user, true)
+	if err != nil {
+		return err
+	}
+	s := ss.api
+	s.vm.in.write(req.bytes(2))
+
+	go func() {
+		for {
+			req, err := readGRPCMessage(r.Body)
+			if err != nil {
+				return // client closed its side or the call ended
+			}
+			s.vm.in.write(req.bytes(2))
+			srv.touch(ss)
+		}
+	}()
+
+	// Wake the loop below if the client goes away.
+	ctx := r.Context()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		s.mu.Lock()
+		s.outCond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	for {
+		s.mu.Lock()
+		for len(s.out) == 0 && !s.outDone && ctx.Err() == nil {
+			s.outCond.Wait()
+		}
+		out, ended := s.out, s.outDone
+		s.out = nil
+		s.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		if len(out) > 0 {
+			var m pbEncoder
+			m.bytes(1, out)
+			if err := writeGRPCMessage(w, &m); err != nil {
+				return nil
+			}
+			srv.touch(ss)
+		}
+		if ended {
+			s.ctlMu.Lock()
+			st := s.state(0)
+			s.ctlMu.Unlock()
+			var m pbEncoder
+			m.msg(2, encodeGRPCState(st))
+			writeGRPCMessage(w, &m)
+			return nil
+		}
+	}
+}
+
+// encodeGRPCSession encodes info as a Session message.
+func encodeGRPCSession(info apiSessionInfo) *pbEncoder {
+	var e pbEncoder
+	e.str(1, info.ID)
+	e.str(2, info.Type)
+	e.str(3, info.Remote)
+	e.int(4, unixMillis(info.Created))
+	e.int(5, unixMillis(info.Active))
+	e.bool(6, info.Halted)
+	e.str(7, info.User)
+	return &e
+}
+
+// grpcStates lists apiState.State values in the order of the State message's
+// Kind enum.
+var grpcStates = []string{"running", "input", "paused", "halted"}
+
+// encodeGRPCState encodes st as a State message.
+func encodeGRPCState(st apiState) *pbEncoder {
+	var e pbEncoder
+	e.str(1, st.ID)
+	for i, s := range grpcStates {
+		if s == st.State {
+			e.uint(2, uint64(i))
+		}
+	}
+	e.str(3, st.Reason)
+	e.str(4, st.Error)
+	e.uint(5, st.Steps)
+	return &e
+}
+
+// unixMillis returns t as milliseconds since the Unix epoch.
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestProtobuf(t *testing.T) {
+	var sub pbEncoder
+	sub.str(1, "inner")
+	var e pbEncoder
+	e.uint(1, 300)
+	e.str(2, "hello")
+	e.bytes(3, []byte{0, 1, 2})
+	e.packed(4, []uint64{1, 200, 30000})
+	e.msg(5, &sub)
+	e.msg(5, &pbEncoder{})
+	e.int(6, -1)
+	e.uint(7, 0) // omitted
+
+	m, err := decodeProto(e.b)
+	if err != nil {
+		t.Fatal("Decoding failed: ", err)
+	}
+	if got := m.uint(1); got != 300 {
+		t.Errorf("Field 1 is %d; want 300", got)
+	}
+	if got := m.str(2); got != "hello" {
+		t.Errorf("Field 2 is %q; want %q", got, "hello")
+	}
+	if got := m.bytes(3); !bytes.Equal(got, []byte{0, 1, 2}) {
+		t.Errorf("Field 3 is %v; want [0 1 2]", got)
+	}
+	if got, err := m.uints(4); err != nil || !reflect.DeepEqual(got, []uint64{1, 200, 30000}) {
+		t.Errorf("Field 4 is %v (%v); want [1 200 30000]", got, err)
+	}
+	if msgs, err := m.msgs(5); err != nil || len(msgs) != 2 || msgs[0].str(1) != "inner" {
+		t.Errorf("Field 5 is %v (%v); want inner message and empty message", msgs, err)
+	}
+	if got := m.int(6); got != -1 {
+		t.Errorf("Field 6 is %d; want -1", got)
+	}
+	if _, ok := m[7]; ok {
+		t.Error("Zero-valued field 7 was encoded")
+	}
+
+	for _, b := range [][]byte{
+		{0x08},             // missing varint
+		{0x12, 0x05, 'a'},  // truncated bytes
+		{0x0b},             // group
+		{0x00, 0x01},       // field 0
+		{0x0d, 0x01, 0x02}, // truncated fixed32
+	} {
+		if _, err := decodeProto(b); err == nil {
+			t.Errorf("Decoding %v unexpectedly succeeded", b)
+		}
+	}
+}
+
+// grpcTestClient calls srv's gRPC methods over HTTP/2.
+type grpcTestClient struct {
+	t      *testing.T
+	ts     *httptest.Server
+	client *http.Client
+}
+
+func newGRPCTestClient(t *testing.T, srv *server) *grpcTestClient {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(srv.handleGRPC))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return &grpcTestClient{t, ts, ts.Client()}
+}
+
+// grpcFrame returns req as a length-prefixed gRPC message.
+func grpcFrame(req *pbEncoder) []byte {
+	b := make([]byte, 5, 5+len(req.b))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(req.b)))
+	return append(b, req.b...)
+}
+
+// start starts a call to method as the user identified by token (if
+// non-empty), with the request body read from body.
+func (c *grpcTestClient) start(method, token string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, c.ts.URL+"/"+grpcService+"/"+method, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatalf("Calling %v failed: %v", method, err)
+	}
+	if resp.ProtoMajor != 2 {
+		c.t.Fatalf("%v response used %v", method, resp.Proto)
+	}
+	return resp
+}
+
+// status reads the rest of resp and returns its gRPC status code and message.
+func (c *grpcTestClient) status(resp *http.Response) (int, string) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		c.t.Fatalf("Bad status trailer %q", resp.Trailer.Get("Grpc-Status"))
+	}
+	return code, resp.Trailer.Get("Grpc-Message")
+}
+
+// call calls a unary method and returns the response and status code.
+func (c *grpcTestClient) call(method, token string, req *pbEncoder) (pbMessage, int) {
+	resp := c.start(method, token, bytes.NewReader(grpcFrame(req)))
+	var m pbMessage
+	if resp.ContentLength != 0 {
+		var err error
+		if m, err = readGRPCMessage(resp.Body); err != nil && err != io.EOF {
+			c.t.Fatalf("Reading %v response failed: %v", method, err)
+		}
+	}
+	code, msg := c.status(resp)
+	if code != grpcOK {
+		c.t.Logf("%v returned %d: %v", method, code, msg)
+	}
+	return m, code
+}
+
+// mustCall is like call but fails the test if the call fails.
+func (c *grpcTestClient) mustCall(method, token string, req *pbEncoder) pbMessage {
+	m, code := c.call(method, token, req)
+	if code != grpcOK {
+		c.t.Fatalf("%v returned %d", method, code)
+	}
+	return m
+}
+
+func TestGRPC(t *testing.T) {
+	srv := newTestServer(t)
+	srv.saveMem = 1 << 20
+	c := newGRPCTestClient(t, srv)
+
+	if _, code := c.call("ListSessions", "", &pbEncoder{}); code != grpcUnauthenticated {
+		t.Errorf("ListSessions without token returned %d; want %d", code, grpcUnauthenticated)
+	}
+	if _, code := c.call("NoSuchMethod", "alice", &pbEncoder{}); code != grpcUnimplemented {
+		t.Errorf("Unknown method returned %d; want %d", code, grpcUnimplemented)
+	}
+
+	sess := c.mustCall("CreateSession", "alice", &pbEncoder{})
+	id := sess.str(1)
+	if id == "" || sess.str(2) != "api" || sess.str(7) == "" {
+		t.Fatalf("CreateSession returned ID %q, type %q, and user %q", id, sess.str(2), sess.str(7))
+	}
+	var idReq pbEncoder
+	idReq.str(1, id)
+
+	for _, tc := range []struct {
+		token string
+		n     int
+	}{{"alice", 1}, {"bob", 0}} {
+		m := c.mustCall("ListSessions", tc.token, &pbEncoder{})
+		if msgs, err := m.msgs(1); err != nil || len(msgs) != tc.n {
+			t.Errorf("ListSessions as %v returned %d session(s) (%v); want %d", tc.token, len(msgs), err, tc.n)
+		}
+	}
+	if _, code := c.call("GetState", "bob", &idReq); code != grpcNotFound {
+		t.Errorf("GetState as other user returned %d; want %d", code, grpcNotFound)
+	}
+
+	if st := c.mustCall("GetState", "alice", &idReq); st.uint(2) != 1 {
+		t.Errorf("GetState returned state %d; want 1 (input)", st.uint(2))
+	}
+	regs := c.mustCall("GetRegisters", "alice", &idReq)
+	if reg, err := regs.uints(1); err != nil || len(reg) != nregs {
+		t.Errorf("GetRegisters returned registers %v (%v)", reg, err)
+	}
+
+	var memReq pbEncoder
+	memReq.str(1, id)
+	memReq.uint(3, 2)
+	mem := c.mustCall("ReadMemory", "alice", &memReq)
+	if words, err := mem.uints(2); err != nil || !reflect.DeepEqual(words, []uint64{opIn, vreg}) {
+		t.Errorf("ReadMemory returned %v (%v); want [%d %d]", words, err, opIn, vreg)
+	}
+
+	var brkReq pbEncoder
+	brkReq.str(1, id)
+	brkReq.uint(2, 2)
+	c.mustCall("SetBreakpoint", "alice", &brkReq)
+	brks := c.mustCall("ListBreakpoints", "alice", &idReq)
+	if addrs, err := brks.uints(1); err != nil || !reflect.DeepEqual(addrs, []uint64{2}) {
+		t.Errorf("ListBreakpoints returned %v (%v); want [2]", addrs, err)
+	}
+	c.mustCall("ClearBreakpoint", "alice", &brkReq)
+
+	var saveReq pbEncoder
+	saveReq.str(1, id)
+	saveReq.str(2, "start")
+	c.mustCall("Save", "alice", &saveReq)
+	if _, code := c.call("Load", "alice", &saveReq); code != grpcOK {
+		t.Errorf("Load returned %d", code)
+	}
+	snap := c.mustCall("GetSnapshot", "alice", &idReq)
+	if _, err := readSnapshot(bytes.NewReader(snap.bytes(1))); err != nil {
+		t.Error("GetSnapshot returned bad snapshot: ", err)
+	}
+
+	// Attach to the session and check that input is echoed. Deleting the
+	// session halts the program, which ends the call.
+	pr, pw := io.Pipe()
+	var attachReq pbEncoder
+	attachReq.str(1, id)
+	attachReq.bytes(2, []byte("hi\n"))
+	go pw.Write(grpcFrame(&attachReq))
+	resp := c.start("Attach", "alice", pr)
+	out, err := readGRPCMessage(resp.Body)
+	if err != nil {
+		t.Fatal("Reading Attach output failed: ", err)
+	}
+	if got := out.str(1); got != "hi\n" {
+		t.Errorf("Attach returned output %q; want %q", got, "hi\n")
+	}
+	c.mustCall("DeleteSession", "alice", &idReq)
+	out, err = readGRPCMessage(resp.Body)
+	if err != nil {
+		t.Fatal("Reading Attach state failed: ", err)
+	}
+	if sts, err := out.msgs(2); err != nil || len(sts) != 1 || sts[0].uint(2) != 3 {
+		t.Errorf("Attach returned final message %v (%v); want halted state", out, err)
+	}
+	pw.Close()
+	if code, msg := c.status(resp); code != grpcOK {
+		t.Errorf("Attach returned %d: %v", code, msg)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// startIdleTimer arranges for idle to be called if the program is still
+// waiting for input after s.idleDelay.
+func (s *session) startIdleTimer() {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.idleTimer = time.AfterFunc(s.idleDelay, s.idle)
+}
+
+// stopIdleTimer cancels the timer started by startIdleTimer, if any.
+func (s *session) stopIdleTimer() {
+	s.idleMu.Lock()
+	defer s.idleMu.Unlock()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
+
+// idle reports that the program has been waiting for input for s.idleDelay
+// and runs s.idleCmd. The current room and the time spent waiting are passed
+// to the command in the SYNACOR_ROOM and SYNACOR_IDLE environment variables.
+func (s *session) idle() {
+	s.idleMu.Lock()
+	s.idleTimer = nil
+	s.idleMu.Unlock()
+
+	fmt.Fprintf(s.msg, "Program has been waiting for input for %v\n", s.idleDelay)
+	if len(s.idleCmd) == 0 {
+		return
+	}
+	room, _, _ := s.info.get()
+	cmd := exec.Command(s.idleCmd[0], s.idleCmd[1:]...)
+	cmd.Env = append(os.Environ(), "SYNACOR_ROOM="+room, "SYNACOR_IDLE="+s.idleDelay.String())
+	cmd.Stdout, cmd.Stderr = s.msg, s.msg
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(s.msg, "Idle command %q failed: %v\n", strings.Join(s.idleCmd, " "), err)
+	}
+}
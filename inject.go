@@ -0,0 +1,92 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// Other programs can send input to a running session through a named pipe
+// (see -input-fifo) or a Unix domain socket (see -input-unix). Each line
+// that they write is echoed and handled as if it had been typed, so
+// meta-commands can also be used. Lines are passed to run via s.injected.
+
+// injectFIFO reads input lines from the named pipe at p, creating it if it
+// doesn't exist. Lines are handled until the session ends.
+func (s *session) injectFIFO(p string) error {
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		if err := mkfifo(p); err != nil {
+			return err
+		}
+	}
+	// Open the pipe for writing too so that it doesn't report EOF whenever
+	// a writer closes it.
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if fi, err := f.Stat(); err != nil {
+		f.Close()
+		return err
+	} else if fi.Mode()&os.ModeNamedPipe == 0 {
+		f.Close()
+		return fmt.Errorf("%v isn't a named pipe", p)
+	}
+	s.initInjected()
+	go s.injectLines(f)
+	return nil
+}
+
+// injectUnix listens for connections on a Unix domain socket at p and reads
+// input lines from them. The returned listener should be closed when the
+// session ends, which also removes the socket.
+func (s *session) injectUnix(p string) (io.Closer, error) {
+	if fi, err := os.Stat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(p) // left over from an earlier session
+	}
+	ln, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, err
+	}
+	s.initInjected()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // closed
+			}
+			go s.injectLines(conn)
+		}
+	}()
+	return ln, nil
+}
+
+// initInjected creates s.injected if needed. It must be called before run.
+func (s *session) initInjected() {
+	if s.injected == nil {
+		s.injected = make(chan string)
+	}
+}
+
+// injectLines sends lines read from r to s.injected until EOF and closes r.
+func (s *session) injectLines(r io.ReadCloser) {
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		ln, err := br.ReadString('\n')
+		if err == io.EOF && ln != "" {
+			ln += "\n"
+		} else if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(s.msg, "Failed reading injected input: %v\n", err)
+			}
+			return
+		}
+		s.injected <- ln
+	}
+}
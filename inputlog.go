@@ -0,0 +1,142 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Input logs are text files that start with inputLogHeader. Each following
+// line consists of a keyword and arguments:
+//
+//	start <hash>              VM state hash before execution
+//	in <quoted-string>        input line sent to the program
+//	end <steps> <hash>        instruction count and state hash after execution
+//
+// Lines starting with '#' are ignored.
+
+const inputLogHeader = "synacor-input-log 1"
+
+// stateHash returns a hash of vm's memory, registers, stack, and ip.
+// The VM must not be executing instructions.
+func stateHash(vm *vm) string {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, vm.mem[:])
+	binary.Write(h, binary.LittleEndian, vm.reg[:])
+	binary.Write(h, binary.LittleEndian, vm.stack)
+	binary.Write(h, binary.LittleEndian, vm.ip)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// inputRecorder writes an input log.
+type inputRecorder struct {
+	f *os.File
+}
+
+// newInputRecorder creates an input log at p for a run starting from vm's
+// current state.
+func newInputRecorder(p string, vm *vm) (*inputRecorder, error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%s\nstart %s\n", inputLogHeader, stateHash(vm)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &inputRecorder{f}, nil
+}
+
+// input records a line of input sent to the program.
+func (r *inputRecorder) input(ln string) error {
+	_, err := fmt.Fprintf(r.f, "in %q\n", ln)
+	return err
+}
+
+// note records a comment.
+func (r *inputRecorder) note(s string) error {
+	_, err := fmt.Fprintf(r.f, "# %s\n", s)
+	return err
+}
+
+// finish records vm's final state and closes the file.
+// The VM must not be executing instructions.
+func (r *inputRecorder) finish(vm *vm) error {
+	if _, err := fmt.Fprintf(r.f, "end %d %s\n", vm.steps, stateHash(vm)); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// inputLog is a parsed input log.
+type inputLog struct {
+	start string   // initial state hash
+	input []string // lines sent to the program
+	steps uint64   // final instruction count
+	end   string   // final state hash, or empty if the log is incomplete
+}
+
+// readInputLog reads an input log written by inputRecorder.
+func readInputLog(r io.Reader) (*inputLog, error) {
+	var log inputLog
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		s := sc.Text()
+		if ln == 1 {
+			if s != inputLogHeader {
+				return nil, fmt.Errorf("bad header %q", s)
+			}
+			continue
+		}
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(s, " ", 2)
+		var err error
+		switch kw := parts[0]; {
+		case kw == "start" && len(parts) == 2:
+			log.start = parts[1]
+		case kw == "in" && len(parts) == 2:
+			var in string
+			if in, err = strconv.Unquote(parts[1]); err == nil {
+				log.input = append(log.input, in)
+			}
+		case kw == "end" && len(parts) == 2:
+			var steps string
+			if _, err = fmt.Sscan(parts[1], &steps, &log.end); err == nil {
+				log.steps, err = strconv.ParseUint(steps, 10, 64)
+			}
+		default:
+			err = fmt.Errorf("bad line %q", s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", ln, err)
+		}
+	}
+	return &log, sc.Err()
+}
+
+// readInputLogFile is a wrapper around readInputLog that reads the named file.
+func readInputLogFile(p string) (*inputLog, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readInputLog(f)
+}
+
+// reader returns a reader that supplies the log's input.
+func (log *inputLog) reader() io.Reader {
+	return strings.NewReader(strings.Join(log.input, ""))
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import "sync"
+
+// inputQueue holds input that hasn't yet been read by the program.
+// Writes never block, so pasted or scripted input can't deadlock against a
+// program that isn't reading (e.g. because it's paused in the debugger).
+// It is safe for concurrent use.
+type inputQueue struct {
+	mu     sync.Mutex
+	buf    []byte
+	closed bool // no more input will be written
+
+	notify chan struct{} // signaled when buf or closed changes
+}
+
+func newInputQueue() *inputQueue {
+	return &inputQueue{notify: make(chan struct{}, 1)}
+}
+
+// write appends p to the queue and returns the number of bytes that are
+// waiting to be read. It's ignored after close is called.
+func (q *inputQueue) write(p []byte) int {
+	q.mu.Lock()
+	if !q.closed {
+		q.buf = append(q.buf, p...)
+	}
+	n := len(q.buf)
+	q.mu.Unlock()
+	q.signal()
+	return n
+}
+
+// close indicates that no more input will be written. Bytes that were
+// already written can still be read.
+func (q *inputQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// read returns the next byte without blocking. ok is false if the queue is
+// empty, in which case closed reports whether more input may be written.
+func (q *inputQueue) read() (b byte, ok, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.buf) == 0 {
+		return 0, false, q.closed
+	}
+	b = q.buf[0]
+	q.buf = q.buf[1:]
+	if len(q.buf) == 0 {
+		q.buf = nil // release the backing array after large pastes
+	}
+	return b, true, q.closed
+}
+
+func (q *inputQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
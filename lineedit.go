@@ -0,0 +1,493 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// lineEditor reads lines from a terminal in raw mode, supporting
+// readline-style editing and history:
+//
+//	Left, Right, Ctrl-B, Ctrl-F  move by character
+//	Alt-B, Alt-F                 move by word
+//	Home, End, Ctrl-A, Ctrl-E    move to start or end of line
+//	Backspace, Delete, Ctrl-D    delete character (Ctrl-D on an empty line is EOF)
+//	Ctrl-K, Ctrl-U, Ctrl-W       delete to end of line, to start, or previous word
+//	Up, Down, Ctrl-P, Ctrl-N     recall history
+//	Tab                          complete word (twice to list completions)
+//	Ctrl-L                       redraw line
+//	Ctrl-S, Ctrl-Q               pause or resume the program's output
+//	Ctrl-C                       end input and interrupt the program
+//	Ctrl-Z, Ctrl-\               suspend or quit the process
+//
+// The prompt is written by the program, so the editor only redraws the text
+// following the cursor's position when the line was started.
+//
+// The terminal is put into raw mode when input is first read. If that fails,
+// input is passed through unedited.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	fd      int          // terminal's file descriptor
+	started bool         // Read has been called
+	plain   bool         // raw mode is unavailable, so pass input through
+	mu      sync.Mutex   // guards restore
+	restore func() error // restores the terminal's original mode, or nil
+
+	// complete returns completions for head, the portion of the line
+	// preceding the cursor. Each candidate replaces head[start:].
+	complete func(head string) (start int, cands []string)
+	lastTab  bool // previous key was Tab
+
+	// pause is called with true or false to pause or resume output.
+	pause func(paused bool)
+	// intercept is called with each key before it's handled and returns
+	// true if it consumed the key (e.g. to dismiss a pager).
+	intercept func(r rune) bool
+	// interrupt is called when Ctrl-C is pressed, possibly while a line
+	// isn't being read (e.g. while the program is computing).
+	interrupt func()
+
+	hist     []string // previous lines, oldest first
+	maxHist  int      // maximum length of hist
+	histPath string   // if non-empty, file that lines are appended to
+
+	buf     []rune // current line
+	pos     int    // cursor position within buf
+	histIdx int    // index into hist of line being edited, or len(hist)
+	saved   []rune // line being edited before history was recalled
+
+	pending string // data to be returned by Read
+	eof     bool
+}
+
+// newLineEditor returns a lineEditor that reads keys from in (connected to
+// terminal fd) and echoes them to out.
+func newLineEditor(in *bufio.Reader, fd int, out io.Writer) *lineEditor {
+	return &lineEditor{in: in, fd: fd, out: out, maxHist: 1000}
+}
+
+// Read implements io.Reader, returning complete lines (including newlines)
+// as they're entered.
+func (e *lineEditor) Read(p []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		restore, err := makeRaw(e.fd)
+		e.mu.Lock()
+		e.restore, e.plain = restore, err != nil
+		e.mu.Unlock()
+		if !e.plain {
+			go e.handleSignals()
+		}
+	}
+	if e.plain {
+		return e.in.Read(p)
+	}
+	for e.pending == "" {
+		if e.eof {
+			return 0, io.EOF
+		}
+		ln, err := e.readLine()
+		if err != nil {
+			e.eof = true
+			e.close()
+			if ln == "" {
+				continue
+			}
+		}
+		e.pending = ln + "\n"
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// close restores the terminal's mode. It's safe to call multiple times and
+// from multiple goroutines.
+func (e *lineEditor) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.restore == nil {
+		return nil
+	}
+	err := e.restore()
+	e.restore = nil
+	return err
+}
+
+// handleSignals handles signals generated by keys: Ctrl-C interrupts the
+// program, and the terminal's original mode is restored while Ctrl-Z stops
+// the process or Ctrl-\ kills it.
+func (e *lineEditor) handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, append([]os.Signal{os.Interrupt}, stopSignals...)...)
+	for sig := range ch {
+		if sig == os.Interrupt {
+			e.interrupted()
+			continue
+		}
+		e.mu.Lock()
+		raw := e.restore != nil
+		if raw {
+			e.restore()
+		}
+		raiseDefault(ch, sig)
+		if raw {
+			e.restore, _ = makeRaw(e.fd)
+		}
+		e.mu.Unlock()
+	}
+}
+
+// interrupted handles Ctrl-C.
+func (e *lineEditor) interrupted() {
+	fmt.Fprint(e.out, "^C\n")
+	if e.interrupt != nil {
+		e.interrupt()
+	}
+}
+
+// readLine reads and returns a line without a trailing newline.
+// io.EOF is returned if input ends or the user ends it.
+func (e *lineEditor) readLine() (string, error) {
+	e.buf, e.pos, e.saved = nil, 0, nil
+	e.histIdx = len(e.hist)
+	for {
+		r, err := e.readRune()
+		if err != nil {
+			return string(e.buf), err
+		}
+		if e.intercept != nil && e.intercept(r) {
+			continue
+		}
+		tab := e.lastTab
+		e.lastTab = r == '\t'
+		switch r {
+		case '\t':
+			e.completeWord(tab)
+		case '\r', '\n':
+			e.moveTo(len(e.buf))
+			fmt.Fprint(e.out, "\n")
+			ln := string(e.buf)
+			e.addHistory(ln)
+			return ln, nil
+		case ctrl('a'):
+			e.moveTo(0)
+		case ctrl('b'):
+			e.moveTo(e.pos - 1)
+		case ctrl('c'): // only reported as a key on some platforms
+			e.interrupted()
+			return "", io.EOF
+		case ctrl('d'):
+			if len(e.buf) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+		case ctrl('e'):
+			e.moveTo(len(e.buf))
+		case ctrl('f'):
+			e.moveTo(e.pos + 1)
+		case ctrl('h'), 0x7f:
+			e.delete(e.pos-1, e.pos)
+		case ctrl('k'):
+			e.delete(e.pos, len(e.buf))
+		case ctrl('l'):
+			e.redraw(0)
+		case ctrl('n'):
+			e.recall(e.histIdx + 1)
+		case ctrl('p'):
+			e.recall(e.histIdx - 1)
+		case ctrl('q'), ctrl('s'):
+			if e.pause != nil {
+				e.pause(r == ctrl('s'))
+			}
+		case ctrl('u'):
+			e.delete(0, e.pos)
+		case ctrl('w'):
+			e.delete(e.wordStart(), e.pos)
+		case 0x1b:
+			if err := e.escape(); err != nil {
+				return string(e.buf), err
+			}
+		default:
+			if unicode.IsPrint(r) {
+				e.insert(r)
+			}
+		}
+	}
+}
+
+// completeWord completes the word before the cursor using e.complete.
+// If the word can't be extended and list is true, candidates are listed.
+func (e *lineEditor) completeWord(list bool) {
+	if e.complete == nil {
+		return
+	}
+	head := string(e.buf[:e.pos])
+	start, cands := e.complete(head)
+	if len(cands) == 0 {
+		return
+	}
+	word := head[start:]
+	prefix := commonPrefix(cands)
+	if len(cands) == 1 {
+		prefix += " "
+	}
+	if len(prefix) > len(word) && strings.HasPrefix(prefix, word) {
+		for _, r := range prefix[len(word):] {
+			e.insert(r)
+		}
+		return
+	}
+	if list {
+		e.moveTo(len(e.buf))
+		fmt.Fprint(e.out, "\n"+strings.Join(cands, "  ")+"\n"+string(e.buf))
+		e.pos = len(e.buf)
+	}
+}
+
+// ctrl returns the control character produced by Ctrl and ch.
+func ctrl(ch rune) rune { return ch & 0x1f }
+
+// readRune reads a UTF-8-encoded rune.
+func (e *lineEditor) readRune() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	return r, err
+}
+
+// escape handles an escape sequence following ESC.
+func (e *lineEditor) escape() error {
+	r, err := e.readRune()
+	if err != nil {
+		return err
+	}
+	switch r {
+	case 'b':
+		e.moveTo(e.wordStart())
+		return nil
+	case 'f':
+		e.moveTo(e.wordEnd())
+		return nil
+	case '[', 'O':
+	default:
+		return nil
+	}
+
+	// Read a CSI or SS3 sequence: optional numeric parameters followed by
+	// a final character.
+	var param strings.Builder
+	for {
+		if r, err = e.readRune(); err != nil {
+			return err
+		}
+		if (r < '0' || r > '9') && r != ';' {
+			break
+		}
+		param.WriteRune(r)
+	}
+	switch {
+	case r == 'A':
+		e.recall(e.histIdx - 1)
+	case r == 'B':
+		e.recall(e.histIdx + 1)
+	case r == 'C':
+		e.moveTo(e.pos + 1)
+	case r == 'D':
+		e.moveTo(e.pos - 1)
+	case r == 'H', r == '~' && (param.String() == "1" || param.String() == "7"):
+		e.moveTo(0)
+	case r == 'F', r == '~' && (param.String() == "4" || param.String() == "8"):
+		e.moveTo(len(e.buf))
+	case r == '~' && param.String() == "3":
+		e.delete(e.pos, e.pos+1)
+	}
+	return nil
+}
+
+// insert inserts r at the cursor.
+func (e *lineEditor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	if e.pos == len(e.buf)-1 {
+		fmt.Fprint(e.out, string(r)) // common case: appending
+		e.pos++
+		return
+	}
+	e.redraw(e.pos)
+	e.moveTo(e.pos + 1)
+}
+
+// delete deletes the characters in [start, end) and moves the cursor to
+// start. Out-of-range values are clamped.
+func (e *lineEditor) delete(start, end int) {
+	start, end = clampInt(start, 0, len(e.buf)), clampInt(end, 0, len(e.buf))
+	if start >= end {
+		return
+	}
+	e.moveTo(start)
+	e.buf = append(e.buf[:start], e.buf[end:]...)
+	e.redraw(start)
+}
+
+// moveTo moves the cursor to pos, which is clamped to the line.
+func (e *lineEditor) moveTo(pos int) {
+	pos = clampInt(pos, 0, len(e.buf))
+	if pos < e.pos {
+		cursorLeft(e.out, e.pos-pos)
+	} else if pos > e.pos {
+		fmt.Fprint(e.out, string(e.buf[e.pos:pos]))
+	}
+	e.pos = pos
+}
+
+// redraw rewrites the line starting at from, which must not be after the
+// cursor, and clears the rest of the terminal line. The cursor is left at
+// e.pos.
+func (e *lineEditor) redraw(from int) {
+	cursorLeft(e.out, e.pos-from)
+	fmt.Fprint(e.out, string(e.buf[from:])+"\x1b[K")
+	cursorLeft(e.out, len(e.buf)-e.pos)
+}
+
+// cursorLeft writes an escape sequence moving the cursor n cells left.
+func cursorLeft(w io.Writer, n int) {
+	if n > 0 {
+		fmt.Fprintf(w, "\x1b[%dD", n)
+	}
+}
+
+// replace replaces the line with s and moves the cursor to the end.
+func (e *lineEditor) replace(s []rune) {
+	e.moveTo(0)
+	e.buf = append([]rune(nil), s...)
+	e.pos = len(e.buf)
+	fmt.Fprint(e.out, string(e.buf)+"\x1b[K")
+}
+
+// recall replaces the line with the history entry at idx.
+func (e *lineEditor) recall(idx int) {
+	if idx < 0 || idx > len(e.hist) || idx == e.histIdx {
+		return
+	}
+	if e.histIdx == len(e.hist) {
+		e.saved = append([]rune(nil), e.buf...)
+	}
+	e.histIdx = idx
+	if idx == len(e.hist) {
+		e.replace(e.saved)
+	} else {
+		e.replace([]rune(e.hist[idx]))
+	}
+}
+
+// addHistory appends ln to the history if it's non-empty and differs from
+// the previous line.
+func (e *lineEditor) addHistory(ln string) {
+	if strings.TrimSpace(ln) == "" || (len(e.hist) > 0 && e.hist[len(e.hist)-1] == ln) {
+		return
+	}
+	if len(e.hist) == e.maxHist {
+		e.hist = e.hist[1:]
+	}
+	e.hist = append(e.hist, ln)
+
+	if e.histPath != "" {
+		if err := appendLines(e.histPath, []string{ln}); err != nil {
+			fmt.Fprintf(e.out, "Failed saving history: %v\n", err)
+			e.histPath = "" // don't complain about every line
+		}
+	}
+}
+
+// readHistoryFile loads history from the file at p, which needn't exist,
+// and appends later lines to it. The file is rewritten if it contains more
+// than e.maxHist lines.
+func (e *lineEditor) readHistoryFile(p string) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	for _, ln := range strings.Split(string(b), "\n") {
+		if ln != "" {
+			lines = append(lines, ln)
+		}
+	}
+	if len(lines) > e.maxHist {
+		lines = lines[len(lines)-e.maxHist:]
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		if err := appendLines(p, lines); err != nil {
+			return err
+		}
+	}
+	e.hist = lines
+	e.histPath = p
+	return nil
+}
+
+// appendLines appends lines to the file at p, creating it and its parent
+// directory if needed.
+func appendLines(p string, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, strings.Join(lines, "\n")+"\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// wordStart returns the start of the word before the cursor.
+func (e *lineEditor) wordStart() int {
+	i := e.pos
+	for i > 0 && e.buf[i-1] == ' ' {
+		i--
+	}
+	for i > 0 && e.buf[i-1] != ' ' {
+		i--
+	}
+	return i
+}
+
+// wordEnd returns the end of the word after the cursor.
+func (e *lineEditor) wordEnd() int {
+	i := e.pos
+	for i < len(e.buf) && e.buf[i] == ' ' {
+		i++
+	}
+	for i < len(e.buf) && e.buf[i] != ' ' {
+		i++
+	}
+	return i
+}
+
+// clampInt returns v clamped to [min, max].
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
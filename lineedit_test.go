@@ -0,0 +1,24 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadLineInterrupt(t *testing.T) {
+	e := newLineEditor(bufio.NewReader(strings.NewReader("ab\x03cd\n")), -1, ioutil.Discard)
+	var n int
+	e.interrupt = func() { n++ }
+	if ln, err := e.readLine(); ln != "" || err != io.EOF {
+		t.Errorf("readLine() = %q, %v; want %q, %v", ln, err, "", io.EOF)
+	}
+	if n != 1 {
+		t.Errorf("interrupt called %d time(s); want 1", n)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// minDeadInstrs is the minimum number of consecutive valid instructions in an
+// unreachable region for it to be reported as dead code rather than data.
+const minDeadInstrs = 4
+
+// lintIssue describes a problem found by lint.
+type lintIssue struct {
+	addr uint16
+	msg  string
+}
+
+// lint statically checks p for problems and returns them sorted by address.
+func (p *program) lint() []lintIssue {
+	var issues []lintIssue
+	add := func(addr uint16, format string, args ...interface{}) {
+		issues = append(issues, lintIssue{addr, fmt.Sprintf(format, args...)})
+	}
+
+	// Record which words are covered by reachable instructions.
+	covered := make([]bool, len(p.mem))
+	for addr, in := range p.instrs {
+		for i := addr; i < in.next(); i++ {
+			covered[i] = true
+		}
+	}
+
+	for addr, in := range p.instrs {
+		for i, v := range in.args {
+			if v >= vreg+nregs {
+				add(addr, "%v: invalid operand %d", in, v)
+			} else if i == 0 && ops[in.op].dst && v < vreg {
+				add(addr, "%v: destination %d is not a register", in, v)
+			}
+		}
+		if t, ok := in.target(); ok {
+			verb := "jump"
+			if in.op == opCall {
+				verb = "call"
+			}
+			if _, ok := decode(p.mem, t); !ok {
+				add(addr, "%v: %s to invalid instruction at %d", in, verb, t)
+			} else if _, ok := p.instrs[t]; !ok && covered[t] {
+				add(addr, "%v: %s into middle of instruction at %d", in, verb, t)
+			}
+		}
+	}
+
+	for _, fn := range p.funcs {
+		issues = append(issues, p.checkStack(fn)...)
+	}
+
+	// Report unreachable runs of plausible instructions.
+	for start := 0; start < len(p.mem); {
+		if covered[start] || p.mem[start] == 0 {
+			start++
+			continue
+		}
+		end := start
+		for end < len(p.mem) && !covered[end] {
+			end++
+		}
+		// Linearly sweep the region, restarting after invalid data or halts.
+		n, run, addr := 0, uint16(start), uint16(start)
+		for int(addr) < end {
+			in, ok := decode(p.mem, addr)
+			if ok && int(in.next()) <= end && in.op != opHalt {
+				n++
+				addr = in.next()
+				continue
+			}
+			// Count a trailing halt as part of the run, but not zero-filled padding.
+			if ok && in.op == opHalt && n > 0 {
+				n++
+			}
+			if n >= minDeadInstrs {
+				add(run, "unreachable code (%d instructions)", n)
+			}
+			n, addr = 0, addr+1
+			run = addr
+		}
+		if n >= minDeadInstrs {
+			add(run, "unreachable code (%d instructions)", n)
+		}
+		start = end
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].addr < issues[j].addr })
+	return issues
+}
+
+// checkStack walks fn tracking the stack depth relative to the function's
+// entry and reports pops of the caller's stack, returns with unbalanced
+// stacks, and paths that reach the same instruction with different depths.
+// Calls are assumed to leave the stack balanced.
+func (p *program) checkStack(fn *function) []lintIssue {
+	var issues []lintIssue
+	name := funcName(fn.entry)
+	depths := make(map[uint16]int)
+	reported := make(map[uint16]struct{})
+	type state struct {
+		addr  uint16
+		depth int
+	}
+	todo := []state{{fn.entry, 0}}
+	for len(todo) > 0 {
+		st := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for {
+			in, ok := p.instrs[st.addr]
+			if !ok {
+				break
+			}
+			if d, ok := depths[st.addr]; ok {
+				if _, ok := reported[st.addr]; d != st.depth && !ok {
+					issues = append(issues, lintIssue{st.addr, fmt.Sprintf(
+						"%s: reached with stack depth %d and %d", name, d, st.depth)})
+					reported[st.addr] = struct{}{}
+				}
+				break
+			}
+			depths[st.addr] = st.depth
+
+			switch in.op {
+			case opPush:
+				st.depth++
+			case opPop:
+				if st.depth == 0 {
+					issues = append(issues, lintIssue{st.addr, fmt.Sprintf(
+						"%s: %v pops caller's stack", name, in)})
+				}
+				st.depth--
+			case opRet:
+				if st.depth != 0 {
+					issues = append(issues, lintIssue{st.addr, fmt.Sprintf(
+						"%s: returns with stack depth %d", name, st.depth)})
+				}
+			}
+			if in.op != opCall {
+				if t, ok := in.target(); ok {
+					todo = append(todo, state{t, st.depth})
+				}
+			}
+			if in.op == opHalt || in.op == opRet || in.op == opJmp {
+				break
+			}
+			st.addr = in.next()
+		}
+	}
+	return issues
+}
+
+// writeLint writes the issues found in p to w.
+// The number of issues is returned.
+func (p *program) writeLint(w io.Writer) (int, error) {
+	issues := p.lint()
+	var b strings.Builder
+	for _, is := range issues {
+		fmt.Fprintf(&b, "%5d: %s\n", is.addr, is.msg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return len(issues), err
+}
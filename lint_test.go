@@ -0,0 +1,75 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		src  string
+		want []string // "addr: msg" for each issue
+	}{
+		{"clean", `
+  set r0 3
+loop:
+  add r0 r0 32767
+  jt r0 loop
+  call fn
+  halt
+fn:
+  push r1
+  pop r1
+  ret`, nil},
+		{"stack", `
+  call fn
+  halt
+fn:
+  push r1
+  pop r1
+  pop r2
+  ret`, []string{
+			"7: fn_0003: pop r2 pops caller's stack",
+			"9: fn_0003: returns with stack depth -1",
+		}},
+		{"unbalanced paths", `
+  call fn
+  halt
+fn:
+  jt r0 skip
+  push r1
+skip:
+  ret`, []string{
+			"8: fn_0003: returns with stack depth 1",
+			"8: fn_0003: reached with stack depth 1 and 0",
+		}},
+		{"operands and jumps", `
+  jmp end
+  add r0 r1 r2
+  out r0
+  out r1
+  out r2
+  halt
+end:
+  set 5 r0
+  jmp 3
+  halt`, []string{
+			"2: unreachable code (5 instructions)",
+			"13: set 5 r0: destination 5 is not a register",
+			"16: jmp 3: jump to invalid instruction at 3",
+		}},
+	} {
+		var got []string
+		for _, is := range analyzeSource(t, tc.src).lint() {
+			got = append(got, fmt.Sprintf("%d: %s", is.addr, is.msg))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: lint returned %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
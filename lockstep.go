@@ -0,0 +1,404 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// This file runs the program in lockstep with a reference implementation of
+// the VM, halting at the first instruction where the two disagree. The
+// reference is started with the path of a memory image as its final argument
+// and reads commands from stdin, one per line:
+//
+//	step      execute the next instruction
+//	step <v>  execute the next instruction, an "in" that reads character code v
+//
+// After each command, it writes a line describing the result:
+//
+//	ip=<ip> reg=<r0>,<r1>,...,<r7> [sp=<n>] [write=<addr>:<val>] [out=<v>]
+//
+// "sp" is the stack depth, "write" describes the word written by "wmem", and
+// "out" is the character code written by "out". "sp" is only compared if
+// present. "halt" is written after a "halt" instruction, and "error <msg>" is
+// written if the instruction fails. -lockstep-ref makes this program act as a
+// reference, e.g. to compare a modified interpreter against an older build.
+
+// errLockstepDiverged is returned by runLockstep if the VMs disagree.
+var errLockstepDiverged = errors.New("reference VM diverged")
+
+// lockstepState describes a VM's state after executing an instruction.
+type lockstepState struct {
+	ip    uint16
+	reg   [nregs]uint16
+	sp    int    // stack depth, or -1 if unknown
+	write string // "addr:val" for "wmem"
+	out   int    // character code for "out", or -1
+	halt  bool
+	err   string // error message if the instruction failed
+}
+
+// String formats s as in the protocol.
+func (s *lockstepState) String() string {
+	if s.err != "" {
+		return "error " + s.err
+	}
+	if s.halt {
+		return "halt"
+	}
+	str := fmt.Sprintf("ip=%d reg=", s.ip)
+	for i, v := range s.reg {
+		if i > 0 {
+			str += ","
+		}
+		str += strconv.Itoa(int(v))
+	}
+	if s.sp >= 0 {
+		str += fmt.Sprintf(" sp=%d", s.sp)
+	}
+	if s.write != "" {
+		str += " write=" + s.write
+	}
+	if s.out >= 0 {
+		str += fmt.Sprintf(" out=%d", s.out)
+	}
+	return str
+}
+
+// parseLockstepState parses a line written by a reference VM.
+func parseLockstepState(ln string) (*lockstepState, error) {
+	s := &lockstepState{sp: -1, out: -1}
+	if ln == "halt" {
+		s.halt = true
+		return s, nil
+	}
+	if strings.HasPrefix(ln, "error") {
+		if s.err = strings.TrimSpace(ln[len("error"):]); s.err == "" {
+			s.err = "unknown error"
+		}
+		return s, nil
+	}
+	var sawIP, sawReg bool
+	for _, f := range strings.Fields(ln) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad field %q", f)
+		}
+		k, v := kv[0], kv[1]
+		num := func(s string, max int) (int, error) {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 || n > max {
+				return 0, fmt.Errorf("bad %v %q", k, v)
+			}
+			return n, nil
+		}
+		var err error
+		switch k {
+		case "ip":
+			var n int
+			n, err = num(v, vmax)
+			s.ip, sawIP = uint16(n), true
+		case "reg":
+			vals := strings.Split(v, ",")
+			if len(vals) != nregs {
+				return nil, fmt.Errorf("want %d registers in %q", nregs, v)
+			}
+			for i, rv := range vals {
+				var n int
+				if n, err = num(rv, vmax); err != nil {
+					break
+				}
+				s.reg[i] = uint16(n)
+			}
+			sawReg = true
+		case "sp":
+			s.sp, err = num(v, 1<<31-1)
+		case "write":
+			s.write = v
+		case "out":
+			s.out, err = num(v, 255)
+		default:
+			err = fmt.Errorf("unknown field %q", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !sawIP || !sawReg {
+		return nil, fmt.Errorf("missing ip or reg in %q", ln)
+	}
+	return s, nil
+}
+
+// diff returns descriptions of the fields where ref differs from s.
+func (s *lockstepState) diff(ref *lockstepState) []string {
+	if s.err != "" || ref.err != "" || s.halt || ref.halt {
+		if s.String() == ref.String() || (s.err != "" && ref.err != "") {
+			return nil
+		}
+		return []string{fmt.Sprintf("%q vs. %q", s.String(), ref.String())}
+	}
+	var diffs []string
+	if s.ip != ref.ip {
+		diffs = append(diffs, fmt.Sprintf("ip %d vs. %d", s.ip, ref.ip))
+	}
+	for i := range s.reg {
+		if s.reg[i] != ref.reg[i] {
+			diffs = append(diffs, fmt.Sprintf("r%d %d vs. %d", i, s.reg[i], ref.reg[i]))
+		}
+	}
+	if ref.sp >= 0 && s.sp != ref.sp {
+		diffs = append(diffs, fmt.Sprintf("sp %d vs. %d", s.sp, ref.sp))
+	}
+	if s.write != ref.write {
+		diffs = append(diffs, fmt.Sprintf("write %q vs. %q", s.write, ref.write))
+	}
+	if s.out != ref.out {
+		diffs = append(diffs, fmt.Sprintf("out %d vs. %d", s.out, ref.out))
+	}
+	return diffs
+}
+
+// lockstepVM executes a VM's instructions one at a time using a debugger.
+type lockstepVM struct {
+	vm  *vm
+	dbg *debugger
+	out []byte // output written by the VM since the last step
+}
+
+// newLockstepVM attaches a debugger to vm and starts it.
+func newLockstepVM(vm *vm) *lockstepVM {
+	l := &lockstepVM{vm: vm, dbg: newDebugger(vm, ioutil.Discard, true)}
+	vm.output = func(p []byte) { l.out = append(l.out, p...) }
+	vm.start()
+	return l
+}
+
+// paused runs f while the VM is paused before its next instruction.
+// False is returned without running f if the VM has stopped.
+func (l *lockstepVM) paused(f func()) bool {
+	fin := make(chan struct{})
+	select {
+	case l.dbg.ctl <- func() { f(); close(fin) }:
+		<-fin
+		return true
+	case <-l.vm.stopped:
+		return false
+	}
+}
+
+// next returns the instruction at ip. False is returned if the VM has
+// stopped or the instruction is invalid.
+func (l *lockstepVM) next() (in instr, ok bool) {
+	l.paused(func() { in, ok = decode(l.vm.mem[:], l.vm.ip) })
+	return in, ok
+}
+
+// step executes the next instruction, which reads input if it's "in".
+func (l *lockstepVM) step(input byte) *lockstepState {
+	st := &lockstepState{sp: -1, out: -1}
+	var op uint16
+	l.paused(func() {
+		in, ok := decode(l.vm.mem[:], l.vm.ip)
+		if !ok {
+			return
+		}
+		switch op = in.op; op {
+		case opWmem:
+			if a, b := l.resolve(in.args[0]), l.resolve(in.args[1]); a >= 0 && b >= 0 {
+				st.write = fmt.Sprintf("%d:%d", a, b)
+			}
+		case opIn:
+			l.vm.in.write([]byte{input})
+		}
+	})
+	l.dbg.feed("s")
+	if op == opTrap {
+		// The debugger pauses again within "trap".
+		l.paused(func() {})
+		l.dbg.feed("s")
+	}
+	stopped := !l.paused(func() {
+		st.ip, st.reg, st.sp = l.vm.ip, l.vm.reg, len(l.vm.stack)
+	})
+	if stopped {
+		if err := l.vm.wait(); err != nil {
+			st.err = err.Error()
+		} else {
+			st.halt = true
+		}
+	}
+	// The VM passes output to l.out before pausing or stopping, and
+	// reading it afterward is synchronized by paused or wait.
+	if len(l.out) > 0 {
+		st.out = int(l.out[0])
+		l.out = l.out[:0]
+	}
+	return st
+}
+
+// resolve returns the value of operand v, or -1 if it's invalid.
+// It must be called while the VM is paused.
+func (l *lockstepVM) resolve(v uint16) int {
+	switch {
+	case v <= vmax:
+		return int(v)
+	case v < vreg+nregs:
+		return int(l.vm.reg[v-vreg])
+	default:
+		return -1
+	}
+}
+
+// checkFresh returns an error if vm has already started executing.
+func checkFresh(vm *vm) error {
+	if vm.ip != 0 || vm.reg != [nregs]uint16{} || len(vm.stack) != 0 {
+		return errors.New("VM must start at the beginning of the program")
+	}
+	return nil
+}
+
+// runLockstep runs vm in lockstep with the reference VM started by args.
+// Input characters are read from in as needed, and output is written to out.
+// A description of any divergence is written to msg and errLockstepDiverged
+// is returned.
+func runLockstep(vm *vm, args []string, in io.Reader, out, msg io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("no reference command")
+	}
+	if err := checkFresh(vm); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "synacor-lockstep.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	img := filepath.Join(dir, "image.bin")
+	if err := writeImageFile(img, vm.mem[:], vm.size); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(args[0], append(args[1:], img)...)
+	cmd.Stderr = os.Stderr
+	refIn, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	refOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		refIn.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	refLines := bufio.NewScanner(refOut)
+
+	l := newLockstepVM(vm)
+	defer vm.halt()
+
+	br := bufio.NewReader(in)
+	for n := 1; ; n++ {
+		next, ok := l.next()
+		cmd := "step"
+		var input byte
+		if ok && next.op == opIn {
+			if input, err = br.ReadByte(); err == io.EOF {
+				fmt.Fprintf(msg, "End of input after %d instruction(s) without divergence\n", n-1)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			cmd = fmt.Sprintf("step %d", input)
+		}
+		if _, err := io.WriteString(refIn, cmd+"\n"); err != nil {
+			return fmt.Errorf("reference: %v", err)
+		}
+		ours := l.step(input)
+		if ours.out >= 0 {
+			out.Write([]byte{byte(ours.out)})
+		}
+
+		if !refLines.Scan() {
+			if err := refLines.Err(); err != nil {
+				return fmt.Errorf("reference: %v", err)
+			}
+			return errors.New("reference exited")
+		}
+		ref, err := parseLockstepState(strings.TrimSpace(refLines.Text()))
+		if err != nil {
+			return fmt.Errorf("reference: %v", err)
+		}
+		if diffs := ours.diff(ref); len(diffs) > 0 {
+			desc := fmt.Sprint(vm.mem[next.addr])
+			if ok {
+				desc = next.String()
+			}
+			fmt.Fprintf(msg, "Diverged at instruction %d (%d: %s):\n", n, next.addr, desc)
+			fmt.Fprintf(msg, "  ours:      %v\n", ours)
+			fmt.Fprintf(msg, "  reference: %v\n", ref)
+			for _, d := range diffs {
+				fmt.Fprintf(msg, "  %s\n", d)
+			}
+			return errLockstepDiverged
+		}
+		if ours.halt || ours.err != "" {
+			fmt.Fprintf(msg, "Both VMs stopped after %d instruction(s) without divergence\n", n)
+			return nil
+		}
+	}
+}
+
+// serveLockstep executes vm's instructions as requested by commands from r,
+// writing the resulting states to w. It acts as the reference VM for
+// runLockstep.
+func serveLockstep(vm *vm, r io.Reader, w io.Writer) error {
+	if err := checkFresh(vm); err != nil {
+		return err
+	}
+	l := newLockstepVM(vm)
+	defer vm.halt()
+
+	bw := bufio.NewWriter(w)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 {
+			continue
+		}
+		var input int
+		if f[0] != "step" || len(f) > 2 {
+			return fmt.Errorf("bad command %q", sc.Text())
+		} else if len(f) == 2 {
+			var err error
+			if input, err = strconv.Atoi(f[1]); err != nil || input < 0 || input > 255 {
+				return fmt.Errorf("bad input %q", f[1])
+			}
+		}
+		st := l.step(byte(input))
+		fmt.Fprintln(bw, st)
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if st.halt || st.err != "" {
+			break
+		}
+	}
+	return sc.Err()
+}
@@ -5,65 +5,939 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 )
 
 func main() {
+	if runtime.GOOS == "js" {
+		runBrowser() // see browser_js.go
+	}
+	var o options
+	o.register(flag.CommandLine)
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "%s <prog.bin>\n", os.Args[0])
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "%s [command] <prog.bin|state.sav>\n\n", os.Args[0])
+		writeSubcommands(w)
+		fmt.Fprintln(w, "\nFlags:")
 		flag.PrintDefaults()
 	}
-	flag.Parse()
+	cmd := findSubcommand(firstArg(os.Args[1:]))
+	var args []string
+	if cmd != nil {
+		args = cmd.parse(&o, os.Args[2:])
+	} else {
+		flag.Parse()
+		args = flag.Args()
+	}
+
+	prof, err := startProfiler(o.cpuProfile, o.memProfile, o.mutexProfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed starting profiler: ", err)
+		os.Exit(1)
+	}
+	stopProfiler := func() {
+		if err := prof.stop(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing profile: ", err)
+		}
+	}
+	defer stopProfiler()
 
-	if len(flag.Args()) != 1 {
+	if cmd != nil {
+		cmd.run(&o, args, stopProfiler)
+	} else {
+		runFlags(&o, args, stopProfiler)
+	}
+}
+
+// runFlags runs the mode selected by the top-level flags in o with the
+// positional arguments args. stopProfiler is called before exiting after
+// running the program.
+func runFlags(o *options, args []string, stopProfiler func()) {
+	if o.teleporterSearch {
+		cmdTeleporter(nil)
+		return
+	}
+	if len(args) > 1 || (len(args) == 0 && o.loadFrom == "") {
 		flag.Usage()
 		os.Exit(2)
 	}
+	progPath := firstArg(args)
+
+	if o.asmList != "" && o.asmOut == "" {
+		fmt.Fprintln(os.Stderr, "-asm-list requires -asm")
+		os.Exit(2)
+	}
+	if o.asmOut != "" {
+		cmdAsm(progPath, o.asmOut, o.asmList)
+		return
+	}
 
-	f, err := os.Open(flag.Arg(0))
+	if o.transcriptHTML != "" {
+		if err := writeTranscriptHTMLFile(o.transcriptHTML, progPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed converting transcript: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	vm, id := loadProgram(o, args)
+	checkFlags(o)
+	if cmdAnalyze(o, vm, progPath) {
+		return
+	}
+	vm = prepareVM(o, vm)
+	switch {
+	case o.brute != "":
+		cmdBrute(o, vm)
+	case o.httpAddr != "" || o.grpcAddr != "":
+		cmdServe(o, vm)
+	case o.dapAddr != "":
+		cmdDAP(o, vm, progPath)
+	case o.controlStdio:
+		if err := serveControl(stdin, os.Stdout, vm); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed reading requests: ", err)
+			os.Exit(1)
+		}
+	case o.lockstep != "" || o.lockstepRef:
+		cmdLockstep(o, vm)
+	default:
+		cmdRun(o, vm, id, progPath, stopProfiler)
+	}
+}
+
+// loadProgram returns a VM containing the program or state named by args
+// (which may be empty if o.loadFrom is set), with o's state and patches
+// applied. The returned ID identifies the program for save slots.
+func loadProgram(o *options, args []string) (*vm, string) {
+	progPath := firstArg(args)
+	var prog io.Reader = strings.NewReader("")
+	var progSnap *snapshot // non-nil if the program argument is a snapshot
+	if len(args) == 1 {
+		f, err := os.Open(progPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed opening program: ", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		br := bufio.NewReader(f)
+		if isSnapshot(br) {
+			if progSnap, err = readSnapshot(br); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed reading state %q: %v\n", progPath, err)
+				os.Exit(1)
+			}
+		} else {
+			prog = br
+		}
+	}
+	vm, err := newVM(prog)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed opening program: ", err)
+		fmt.Fprintf(os.Stderr, "Failed reading program %q: %v\n", progPath, err)
 		os.Exit(1)
 	}
-	defer f.Close()
+	if progSnap != nil {
+		vm.restore(progSnap)
+	} else if len(args) == 1 {
+		vm.image = imageID(vm.mem[:vm.size])
+	}
+	id := vm.image // identifies the program for save slots
+	if o.loadFrom != "" {
+		s, err := loadSnapshotFile(o.loadFrom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed loading state %q: %v\n", o.loadFrom, err)
+			os.Exit(1)
+		}
+		vm.restore(s)
+		if len(args) == 0 || progSnap != nil {
+			id = vm.image
+		}
+	}
+	if id == "" {
+		// The state was saved before snapshots recorded their program.
+		id = imageID(vm.mem[:vm.size])
+	}
+
+	for _, p := range o.patches {
+		entries, err := readPatchFile(p)
+		if err == nil {
+			err = applyPatch(vm.mem[:], entries)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed applying patch %q: %v\n", p, err)
+			os.Exit(1)
+		}
+	}
+	return vm, id
+}
+
+// checkFlags checks flags that are shared by multiple modes.
+func checkFlags(o *options) {
+	if o.census != "" && o.census != "static" && o.census != "dynamic" {
+		fmt.Fprintf(os.Stderr, "Invalid census mode %q\n", o.census)
+		os.Exit(2)
+	}
+	if o.callGraph != "" && o.callGraph != "dot" && o.callGraph != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid call graph format %q\n", o.callGraph)
+		os.Exit(2)
+	}
+	if _, ok := backends[o.recompile]; !ok && o.recompile != "" {
+		fmt.Fprintf(os.Stderr, "Invalid recompile language %q\n", o.recompile)
+		os.Exit(2)
+	}
+}
+
+// cmdAsm assembles the source file at src and writes the image to dst and
+// the listing (if requested) to list.
+func cmdAsm(src, dst, list string) {
+	if err := assembleFile(src, dst, list); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed assembling program: ", err)
+		os.Exit(1)
+	}
+}
+
+// cmdAnalyze runs the analysis mode selected by o, which prints information
+// about vm's program. False is returned if no analysis mode is selected.
+func cmdAnalyze(o *options, vm *vm, progPath string) bool {
+	// Analysis modes print information about the program and exit.
+	analyzing := o.census == "static" || o.callGraph != "" || o.decompile || o.diff != "" ||
+		o.disasm || o.entropy || o.export != "" || o.lint || o.recompile != "" || o.strs
+	entries := []uint16{0}
+	if o.decrypt {
+		if !analyzing && o.writeImg == "" && o.makePatch == "" {
+			fmt.Fprintln(os.Stderr, "-decrypt requires an analysis mode, -make-patch, or -write-image")
+			os.Exit(2)
+		}
+		if err := vm.runUntilInput(); err != nil {
+			fmt.Fprintln(os.Stderr, "Execution failed: ", err)
+			os.Exit(1)
+		}
+		entries = append(entries, vm.ip)
+	}
+	if o.coreInfo {
+		if o.loadFrom == "" {
+			fmt.Fprintln(os.Stderr, "-core-info requires -load-from")
+			os.Exit(2)
+		}
+		s, err := loadSnapshotFile(o.loadFrom)
+		if err == nil {
+			err = writeCoreInfo(os.Stdout, s)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed: ", err)
+			os.Exit(1)
+		}
+		return true
+	}
+	if o.diffState != "" {
+		other, err := loadSnapshotFile(o.diffState)
+		if err == nil {
+			err = writeStateDiff(os.Stdout, vm.snapshot(), other, o.diffCode)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed: ", err)
+			os.Exit(1)
+		}
+		return true
+	}
+	if o.makePatch != "" {
+		mem, _, err := readImageFile(o.makePatch)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reading %q: %v\n", o.makePatch, err)
+			os.Exit(1)
+		}
+		hdr := fmt.Sprintf("%s -> %s", progPath, o.makePatch)
+		if err := writePatch(os.Stdout, diffImages(vm.mem[:], mem), hdr); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing output: ", err)
+			os.Exit(1)
+		}
+		return true
+	}
+	if o.writeImg != "" {
+		if err := writeImageFile(o.writeImg, vm.mem[:], vm.size); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing image: ", err)
+			os.Exit(1)
+		}
+		return true
+	}
+	if analyzing {
+		p := analyze(vm.mem[:], entries...)
+		var err error
+		switch {
+		case o.census == "static":
+			err = writeCensus(os.Stdout, p.staticOpCounts(), nil)
+		case o.callGraph == "dot":
+			err = p.writeCallGraphDOT(os.Stdout)
+		case o.callGraph == "json":
+			err = p.writeCallGraphJSON(os.Stdout)
+		case o.decompile:
+			err = p.writeDecompiled(os.Stdout)
+		case o.diff != "":
+			var mem []uint16
+			if mem, _, err = readImageFile(o.diff); err == nil {
+				err = writeDisasmDiff(os.Stdout, p, analyze(mem, entries...))
+			}
+		case o.disasm && o.jsonOut:
+			err = p.writeDisasmJSON(os.Stdout)
+		case o.disasm:
+			err = p.writeDisasm(os.Stdout, o.annotate)
+		case o.export != "":
+			err = p.exportProgram(o.export, vm.size, entries)
+		case o.entropy:
+			err = writeEntropyRegions(os.Stdout, vm.mem[:], o.entropyThresh)
+		case o.lint:
+			var n int
+			if n, err = p.writeLint(os.Stdout); err == nil && n > 0 {
+				os.Exit(1)
+			}
+		case o.recompile != "":
+			err = cmdRecompile(p, vm, o.recompile)
+		case o.strs:
+			err = writeStrings(os.Stdout, vm.mem[:], o.strsMin)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed: ", err)
+			os.Exit(1)
+		}
+		return true
+	}
+	return false
+}
+
+// backends lists the languages accepted by -recompile.
+var backends = map[string]backend{"c": cBackend{}, "go": goBackend{}}
+
+// cmdRecompile translates the program in vm, analyzed as p, to standalone
+// source in lang and writes it to stdout.
+func cmdRecompile(p *program, vm *vm, lang string) error {
+	t := newTranslation(p, vm.reg, vm.stack, vm.ip)
+	return t.write(os.Stdout, backends[lang])
+}
+
+// applyTurbo disables features that slow down execution if -turbo was
+// passed, and reports which ones were turned off.
+func applyTurbo(o *options) {
+	if !o.turbo {
+		return
+	}
+	if o.debug {
+		fmt.Fprintln(os.Stderr, "-turbo can't be used with -debug")
+		os.Exit(2)
+	}
+	var off []string // descriptions of disabled features
+	disable := func(on bool, desc string, f func()) {
+		if on {
+			f()
+			off = append(off, desc)
+		}
+	}
+	disable(o.core != "", "core dumps (-core)", func() { o.core = "" })
+	disable(o.undo > 0, "undo (-undo)", func() { o.undo = 0 })
+	disable(o.autosave > 0 || o.autosnapshot > 0, "autosaves (-autosave, -autosnapshot)",
+		func() { o.autosave, o.autosnapshot = 0, 0 })
+	disable(o.tracePath != "", "instruction tracing (-trace)", func() { o.tracePath = "" })
+	disable(o.chromeTracePath != "", "call tracing (-chrome-trace)", func() { o.chromeTracePath = "" })
+	disable(o.census == "dynamic", "opcode counting (-census)", func() { o.census = "" })
+	disable(o.maxIPS > 0 || o.sessionIPS > 0, "instruction throttling (-max-ips, -session-ips)",
+		func() { o.maxIPS, o.sessionIPS = 0, 0 })
+	disable(o.outputDelay > 0, "output delay (-output-delay)", func() { o.outputDelay = 0 })
+	if len(off) == 0 {
+		fmt.Fprintln(os.Stderr, "Turbo mode: no features needed to be disabled")
+	} else {
+		fmt.Fprintln(os.Stderr, "Turbo mode disabled "+strings.Join(off, ", "))
+	}
+}
+
+// prepareVM applies -turbo, -skip-intro, and -teleporter to vm before the
+// program is run, returning the VM to use.
+func prepareVM(o *options, vm *vm) *vm {
+	applyTurbo(o)
+	var err error
+	if o.skipIntro {
+		if o.loadFrom != "" {
+			fmt.Fprintln(os.Stderr, "-skip-intro can't be used with -load-from")
+			os.Exit(2)
+		}
+		if vm, err = skipToInput(vm); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed skipping intro: ", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.teleporter != "" {
+		if _, err := vm.addTeleporter(o.teleporter); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed intercepting teleporter routine: ", err)
+			os.Exit(1)
+		}
+	}
+	return vm
+}
 
-	vm, err := newVM(f)
+// cmdSolve runs vm once per line of o.brute if it's set. Otherwise, it prints
+// the eighth-register values that pass the teleporter's confirmation.
+func cmdSolve(o *options, vm *vm) {
+	if o.brute == "" {
+		cmdTeleporter(vm)
+		return
+	}
+	if vm == nil {
+		fmt.Fprintln(os.Stderr, "-brute requires a program")
+		os.Exit(2)
+	}
+	cmdBrute(o, vm)
+}
+
+// cmdTeleporter prints the eighth-register values that pass the teleporter's
+// confirmation. If vm is non-nil, its program must contain the routine.
+func cmdTeleporter(vm *vm) {
+	if vm != nil {
+		if _, _, ok := findTeleporter(vm.mem[:]); !ok {
+			fmt.Fprintln(os.Stderr, "Teleporter confirmation routine not found")
+			os.Exit(1)
+		}
+	}
+	for _, k := range searchTeleporter(teleporterM, teleporterN, teleporterWant, runtime.NumCPU()) {
+		fmt.Println(k)
+	}
+}
+
+// cmdBrute runs vm once per line of o.brute and prints the results.
+func cmdBrute(o *options, vm *vm) {
+	var re *regexp.Regexp
+	if o.bruteGrep != "" {
+		var err error
+		if re, err = regexp.Compile(o.bruteGrep); err != nil {
+			fmt.Fprintln(os.Stderr, "Bad -brute-grep pattern: ", err)
+			os.Exit(2)
+		}
+	}
+	inputs, err := readBruteInputs(o.brute, o.cmdSep)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed reading program %q: %v\n", flag.Arg(0), err)
+		fmt.Fprintln(os.Stderr, "Failed reading inputs: ", err)
+		os.Exit(1)
+	}
+	vm.jit = o.jit
+	vm.maxIPS = o.maxIPS
+	results := bruteForce(vm, inputs, o.bruteWorkers, o.bruteTimeout)
+	if err := writeBruteResults(os.Stdout, results, re); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed writing output: ", err)
 		os.Exit(1)
 	}
+}
 
-	go func(stdin io.Reader) {
-		r := bufio.NewReader(stdin)
-		for {
-			ln, err := r.ReadString('\n')
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				fmt.Fprintf(os.Stderr, "Input failed: %v\n", err)
+// cmdServe serves vm's program over HTTP and gRPC.
+func cmdServe(o *options, vm *vm) {
+	var err error
+	if o.grpcAddr != "" && (o.grpcCert == "" || o.grpcKey == "") {
+		fmt.Fprintln(os.Stderr, "-grpc requires -grpc-cert and -grpc-key")
+		os.Exit(2)
+	}
+	srv := newServer(vm.snapshot(), os.Stderr)
+	srv.maxSessions = o.maxSessions
+	srv.maxIPS = o.sessionIPS
+	if srv.maxIPS == 0 {
+		srv.maxIPS = o.maxIPS
+	}
+	srv.saveMem = o.sessionSaveMem
+	srv.idle = o.sessionIdle
+	srv.pprof = o.httpPprof
+	if o.userSaves != "" {
+		if srv.users, err = newUserStore(o.userSaves, o.userQuota, o.userTokens); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed initializing user saves: ", err)
+			os.Exit(1)
+		}
+	} else if o.userTokens != "" {
+		fmt.Fprintln(os.Stderr, "-user-tokens requires -user-saves")
+		os.Exit(2)
+	}
+	if srv.idle > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go srv.expire(done)
+	}
+	errs := make(chan error, 2)
+	if o.grpcAddr != "" {
+		go func() { errs <- srv.serveGRPC(o.grpcAddr, o.grpcCert, o.grpcKey) }()
+	}
+	if o.httpAddr != "" {
+		go func() { errs <- srv.serve(o.httpAddr) }()
+	}
+	if err := <-errs; err != nil {
+		fmt.Fprintln(os.Stderr, "Failed serving: ", err)
+		os.Exit(1)
+	}
+}
+
+// cmdDAP debugs vm's program using the Debug Adapter Protocol.
+func cmdDAP(o *options, vm *vm, progPath string) {
+	name := strings.TrimSuffix(filepath.Base(progPath), filepath.Ext(progPath))
+	if progPath == "" {
+		name = "program"
+	}
+	if err := serveDAP(o.dapAddr, vm, name, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed serving debugger: ", err)
+		os.Exit(1)
+	}
+}
+
+// cmdLockstep runs vm in lockstep with a reference VM, or acts as one.
+func cmdLockstep(o *options, vm *vm) {
+	if o.lockstep != "" {
+		if err := runLockstep(vm, strings.Fields(o.lockstep), stdin, os.Stdout, os.Stderr); err == errLockstepDiverged {
+			os.Exit(1)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed running in lockstep: ", err)
+			os.Exit(1)
+		}
+	} else if o.lockstepRef {
+		if err := serveLockstep(vm, stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed serving lockstep commands: ", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// cmdRun runs vm's program interactively. id identifies the program for save
+// slots. stopProfiler is called before exiting.
+func cmdRun(o *options, vm *vm, id, progPath string, stopProfiler func()) {
+	checkRunFlags(o)
+	var err error
+	var static []uint64
+	if o.census == "dynamic" {
+		static = analyze(vm.mem[:], 0).staticOpCounts()
+		vm.opCounts = make([]uint64, len(ops))
+	}
+	vm.jit = o.jit
+	vm.maxIPS = o.maxIPS
+	// Host messages and the program's output are written to msg and out.
+	var msg, out io.Writer = os.Stderr, os.Stdout
+	if o.saveTo == stdioPath {
+		out = os.Stderr
+	}
+	term := out // terminal receiving the program's output
+	if ok, err := useColor(o.color, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid color mode %q\n", o.color)
+		os.Exit(2)
+	} else if ok {
+		msg = colorWriter{msg, ansiHost}
+	}
+	if o.logOutput != "" {
+		f, err := os.OpenFile(o.logOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed opening output log: ", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		msg, out = io.MultiWriter(msg, f), io.MultiWriter(out, f)
+	}
+
+	var dbg *debugger
+	if o.debug {
+		dbg = newDebugger(vm, msg, true)
+		dbg.maxCkpts = o.debugCkpts
+		if o.mi {
+			// Front-ends read records from stdout.
+			dbg.w, dbg.mi = os.Stdout, true
+		}
+	}
+
+	if o.saveDir == "" {
+		if o.saveDir, err = defaultSlotDir(id); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed finding save directory: ", err)
+			os.Exit(1)
+		}
+	}
+	sess := &session{
+		vm:        vm,
+		dbg:       dbg,
+		prefix:    o.metaPrefix,
+		slots:     o.saveDir,
+		autosave:  o.autosave,
+		autoKeep:  o.autosaveKeep,
+		autoEvery: o.autosnapshot,
+		undoDepth: o.undo,
+		prompt:    o.prompt,
+		onEOF:     o.onEOF,
+		eofGrace:  o.eofGrace,
+		loadCmd:   o.loadCmd,
+		cmdSep:    o.cmdSep,
+		outDelay:  o.outputDelay,
+		idleDelay: o.idle,
+		idleCmd:   strings.Fields(o.idleCmd),
+		busyDelay: o.busyAfter,
+		msg:       msg,
+	}
+	if o.busyAfter > 0 && isTerminal(int(os.Stderr.Fd())) {
+		sess.busyOut = os.Stderr
+	}
+	var in io.Reader = stdin
+	var replayLog *inputLog
+	if o.replay != "" {
+		if replayLog, err = readInputLogFile(o.replay); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reading %q: %v\n", o.replay, err)
+			os.Exit(1)
+		}
+		if h := stateHash(vm); h != replayLog.start {
+			fmt.Fprintf(os.Stderr, "Replay starts from state %s; log starts from %s\n", h, replayLog.start)
+			os.Exit(1)
+		}
+		in = replayLog.reader()
+		sess.prefix = "" // input was already filtered when recorded
+		sess.cmdSep = ""
+	}
+	if o.replay == "" {
+		p := o.aliases
+		if p == "" {
+			if p, err = defaultAliasPath(); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed finding alias file: ", err)
 				os.Exit(1)
 			}
-			for _, ch := range ln {
-				vm.in <- byte(ch)
+		}
+		if sess.aliases, err = readAliasFile(p); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reading aliases from %q: %v\n", p, err)
+			os.Exit(1)
+		}
+	}
+	var editor *lineEditor
+	if o.lineEdit && o.replay == "" && o.loadFrom != stdioPath && isTerminal(int(os.Stdin.Fd())) {
+		editor = newLineEditor(stdin, int(os.Stdin.Fd()), term)
+		editor.complete = sess.complete
+		editor.pause = sess.pauseOutput
+		editor.interrupt = sess.interrupt
+		if o.history == "" {
+			o.history = filepath.Join(o.saveDir, "history")
+		}
+		if err := editor.readHistoryFile(o.history); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reading history from %q: %v\n", o.history, err)
+			os.Exit(1)
+		}
+		if fd := int(os.Stdout.Fd()); o.pager && term == os.Stdout && isTerminal(fd) {
+			sess.pager = newPager(fd)
+			if o.status {
+				sess.pager.reserved = 1 // status line
 			}
+			editor.intercept = sess.pagerKey
 		}
-		vm.halt()
-	}(os.Stdin)
+		in = editor
+	}
+	if o.input != "" {
+		if o.replay != "" || o.vcrPlay != "" {
+			fmt.Fprintln(os.Stderr, "-input can't be used with -replay or -vcr-play")
+			os.Exit(2)
+		}
+		f, err := os.Open(o.input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed opening input: ", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		br := bufio.NewReader(f)
+		if isTranscript(br) {
+			if sess.script, err = transcriptInput(br); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed reading transcript %q: %v\n", o.input, err)
+				os.Exit(1)
+			}
+		} else {
+			sess.script = br
+		}
+	}
+	if o.expectScript != "" {
+		if o.replay != "" || o.vcrPlay != "" {
+			fmt.Fprintln(os.Stderr, "-expect can't be used with -replay or -vcr-play")
+			os.Exit(2)
+		}
+		if sess.expCmds, err = readExpectScriptFile(o.expectScript); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reading %q: %v\n", o.expectScript, err)
+			os.Exit(1)
+		}
+		sess.expect = newExpecter()
+	}
+	if o.transcriptPath != "" {
+		if sess.trans, err = newTranscript(o.transcriptPath, o.transcriptTimes); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating transcript: ", err)
+			os.Exit(1)
+		}
+	}
+	if o.vcrPlay != "" {
+		if o.replay != "" {
+			fmt.Fprintln(os.Stderr, "-vcr-play can't be used with -replay")
+			os.Exit(2)
+		}
+		rec, err := readVCRFile(o.vcrPlay)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reading %q: %v\n", o.vcrPlay, err)
+			os.Exit(1)
+		}
+		if h := stateHash(vm); h != rec.start {
+			fmt.Fprintf(os.Stderr, "Playback starts from state %s; recording starts from %s\n", h, rec.start)
+			os.Exit(1)
+		}
+		sess.vcr = newVCRPlayer(rec, o.vcrSeek, msg)
+		in = io.MultiReader(rec.reader(), in)
+	} else if o.vcrRecord != "" {
+		if sess.vcr, err = newVCRRecorder(o.vcrRecord, vm); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating recording: ", err)
+			os.Exit(1)
+		}
+	}
+	if o.recordInput != "" {
+		if sess.rec, err = newInputRecorder(o.recordInput, vm); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating input log: ", err)
+			os.Exit(1)
+		}
+	}
+	if o.core != "" {
+		vm.hist = make([]uint16, coreHistory)
+	}
+	if o.inputFIFO != "" {
+		if err := sess.injectFIFO(o.inputFIFO); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed opening input pipe: ", err)
+			os.Exit(1)
+		}
+	}
+	if o.inputUnix != "" {
+		ln, err := sess.injectUnix(o.inputUnix)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed listening for input: ", err)
+			os.Exit(1)
+		}
+		defer ln.Close()
+	}
+	switch o.tracePath {
+	case "":
+	case stdioPath:
+		vm.trace = msg
+	default:
+		if sess.traceFile, err = os.Create(o.tracePath); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating trace: ", err)
+			os.Exit(1)
+		}
+		sess.traceBuf = bufio.NewWriter(sess.traceFile)
+		vm.trace = sess.traceBuf
+	}
+	for _, cmd := range o.plugins {
+		p, err := startPlugin(cmd, msg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed starting plugin %q: %v\n", cmd, err)
+			os.Exit(1)
+		}
+		defer p.close()
+		sess.addPlugin(p)
+	}
+	if o.chromeTracePath != "" {
+		name := filepath.Base(progPath)
+		if progPath == "" {
+			name = "program"
+		}
+		if vm.ctrace, err = newChromeTrace(o.chromeTracePath, name); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating trace: ", err)
+			os.Exit(1)
+		}
+	}
+	if o.timer {
+		sess.timer = newSpeedTimer(msg)
+	}
+	if o.notifyURL != "" {
+		sess.notify = newCodeNotifier(o.notifyURL, msg)
+	}
+	if fd := int(os.Stdout.Fd()); o.status && term == os.Stdout && isTerminal(fd) {
+		sess.status = newStatusLine(term, fd)
+	}
+	runErr := sess.run(in, out)
+	if sess.status != nil {
+		sess.status.close()
+	}
+	if editor != nil {
+		editor.close()
+	}
+	if dbg != nil && dbg.mi {
+		dbg.miExited(runErr)
+	}
+	finishRun(o, sess, runErr, static, replayLog, stopProfiler)
+}
+
+// checkRunFlags checks flags used by cmdRun and applies -batch.
+func checkRunFlags(o *options) {
+	if o.mi && !o.debug {
+		fmt.Fprintln(os.Stderr, "-mi requires -debug")
+		os.Exit(2)
+	}
+	if o.onEOF != eofHalt && o.onEOF != eofWait && o.onEOF != eofNewline {
+		fmt.Fprintln(os.Stderr, `-on-eof must be "halt", "wait", or "newline"`)
+		os.Exit(2)
+	}
+	if o.batch {
+		if o.onEOF != eofHalt && o.eofGrace <= 0 {
+			fmt.Fprintln(os.Stderr, "-batch requires -eof-grace with -on-eof")
+			os.Exit(2)
+		}
+		if o.debug {
+			fmt.Fprintln(os.Stderr, "-batch can't be used with -debug")
+			os.Exit(2)
+		}
+		o.lineEdit = false
+		o.undo = 0 // avoid snapshotting before each line
+	}
+	if o.autosaveKeep < 1 {
+		fmt.Fprintln(os.Stderr, "-autosave-keep must be positive")
+		os.Exit(2)
+	}
+}
+
+// finishRun reports runErr and writes the files requested by o after sess
+// has stopped running. static holds static opcode counts for -census, and
+// replayLog is non-nil if the session replayed a -record-input log.
+func finishRun(o *options, sess *session, runErr error, static []uint64,
+	replayLog *inputLog, stopProfiler func()) {
+	vm := sess.vm // the VM may have been replaced by /load
+	if runErr != nil {
+		fmt.Fprintln(os.Stderr, "Execution failed: ", runErr)
+		if o.core != "" {
+			if err := saveSnapshotFile(o.core, coreSnapshot(vm, runErr)); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed writing core dump: ", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Wrote core dump to %s (see -core-info)\n", o.core)
+			}
+		}
+	}
+	stopProfiler() // before anything that may exit
+	if vm.ctrace != nil {
+		if err := vm.ctrace.close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing trace: ", err)
+		}
+	}
+	if sess.timer != nil {
+		sess.timer.summary(sess.msg, vm.steps)
+	}
+	if sess.notify != nil {
+		sess.notify.wait()
+	}
+	if sess.trans != nil {
+		if err := sess.trans.close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing transcript: ", err)
+		}
+	}
+	if sess.rec != nil {
+		if err := sess.rec.finish(vm); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed writing input log: ", err)
+		}
+	}
+	if sess.vcr != nil {
+		if err := sess.vcr.finish(vm); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed: ", err)
+			os.Exit(1)
+		}
+	}
+	if vm.opCounts != nil {
+		writeCensus(os.Stderr, static, vm.opCounts)
+	}
+	if o.saveTo != "" {
+		if err := saveSnapshotFile(o.saveTo, sess.snapshot()); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed saving state: ", err)
+			os.Exit(1)
+		}
+	}
+	if sess.expErr != nil {
+		os.Exit(1)
+	}
+	if replayLog != nil {
+		if replayLog.end == "" {
+			fmt.Fprintln(os.Stderr, "Replay log is incomplete; final state not verified")
+		} else if h := stateHash(vm); h != replayLog.end || vm.steps != replayLog.steps {
+			fmt.Fprintf(os.Stderr, "Replay diverged: got %d steps and state %s; want %d steps and state %s\n",
+				vm.steps, h, replayLog.steps, replayLog.end)
+			os.Exit(1)
+		} else {
+			fmt.Fprintf(os.Stderr, "Replay verified after %d steps\n", vm.steps)
+		}
+	}
+	if o.batch && runErr != nil {
+		os.Exit(1)
+	}
+}
+
+// assembleFile assembles the source file at src and writes the image to dst.
+// If list is non-empty, a listing is written to the named file.
+func assembleFile(src, dst, list string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	done := make(chan struct{}) // closed when program halts
-	go func() {
-		for v := range vm.out {
-			fmt.Print(string(rune(v)))
+	var lw io.WriteCloser
+	if list != "" {
+		if lw, err = os.Create(list); err != nil {
+			return err
+		}
+		defer lw.Close()
+	}
+	words, err := assemble(f, lw)
+	if err != nil {
+		return err
+	}
+	if lw != nil {
+		if err := lw.Close(); err != nil {
+			return err
 		}
-		close(done)
-	}()
+	}
+	if dst == "-" {
+		return writeImage(os.Stdout, words, len(words))
+	}
+	return writeImageFile(dst, words, len(words))
+}
+
+// skipToInput returns a VM in the state that vm will be in when its program
+// first reads input. The state is cached in a file keyed by vm's memory.
+func skipToInput(vm *vm) (*vm, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, "synacor-challenge", imageID(vm.mem[:])+".boot")
+	if snap, err := loadSnapshotFile(p); err == nil {
+		vm.restore(snap)
+		return vm, nil
+	}
+
+	if err := vm.runUntilInput(); err != nil {
+		return nil, err
+	} else if vm.reason != haltBreak {
+		return nil, errors.New("program stopped before reading input")
+	}
+	snap := vm.snapshot()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	if err := saveSnapshotFile(p, snap); err != nil {
+		return nil, err
+	}
+	// vm can't be restarted, so return a new one.
+	nvm, err := newVM(strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	nvm.restore(snap)
+	return nvm, nil
+}
+
+// stringList implements flag.Value for flags that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
 
-	vm.start()
-	<-done
-	if err := vm.wait(); err != nil {
-		fmt.Fprintln(os.Stderr, "Execution failed: ", err)
+// firstArg returns the first element of args, or an empty string if args is
+// empty.
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
 	}
+	return args[0]
 }
@@ -0,0 +1,488 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file implements a subset of GDB's machine interface (GDB/MI) for the
+// debugger so that front-ends that drive GDB can drive the VM too. Commands
+// look like "[token]-command args" and produce result records like
+// "[token]^done,name=value"; stops are reported via "*stopped" records.
+// See https://sourceware.org/gdb/onlinedocs/gdb/GDB_002fMI.html.
+// Other lines are executed as regular debugger commands, with their output
+// returned in console stream records.
+
+// miPrompt is written when the debugger is ready for commands.
+const miPrompt = "(gdb) \n"
+
+// miMaxFrames is the maximum number of frames listed by -stack-list-frames.
+const miMaxFrames = 32
+
+// miCommandRegexp matches an MI command with an optional numeric token.
+var miCommandRegexp = regexp.MustCompile(`^(\d*)(-[-a-z0-9]+)\s*(.*)$`)
+
+// miRunningErr is returned for most commands while the program is running.
+var miRunningErr = errors.New("Cannot execute this command while the target is running.")
+
+// miBkpts assigns GDB-style numbers to breakpoints.
+type miBkpts struct {
+	nums map[uint16]int
+	last int
+}
+
+// num returns addr's breakpoint number, assigning one if needed.
+func (b *miBkpts) num(addr uint16) int {
+	if b.nums == nil {
+		b.nums = make(map[uint16]int)
+	}
+	n, ok := b.nums[addr]
+	if !ok {
+		b.last++
+		n = b.last
+		b.nums[addr] = n
+	}
+	return n
+}
+
+// addr returns the address of the breakpoint numbered n.
+func (b *miBkpts) addr(n int) (uint16, bool) {
+	for a, num := range b.nums {
+		if num == n {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+// miRunning handles ln while the program is running and returns true if
+// it was an MI command. False is returned if ln should be sent to the program.
+func (d *debugger) miRunning(ln string) bool {
+	m := miCommandRegexp.FindStringSubmatch(strings.TrimSpace(ln))
+	if m == nil {
+		return false
+	}
+	token, cmd := m[1], m[2]
+	switch cmd {
+	case "-exec-interrupt":
+		// Like the API, this can only stop the program while it's waiting for input.
+		// The result is written on the VM's goroutine so it precedes the stop record.
+		if !d.vm.doWithin(func() {
+			d.steps = 1
+			d.why = `reason="signal-received",signal-name="SIGINT",signal-meaning="Interrupt"`
+			d.miResult(token, "done", "", nil)
+		}, apiStopTimeout) {
+			d.miResult(token, "", "", errRunning)
+		}
+	case "-gdb-exit":
+		d.miResult(token, "exit", "", nil)
+		d.vm.halt()
+	default:
+		d.miResult(token, "", "", miRunningErr)
+	}
+	return true
+}
+
+// execMI executes ln while paused and returns true if execution should resume.
+func (d *debugger) execMI(ln string) bool {
+	ln = strings.TrimSpace(ln)
+	if ln == "" {
+		return false
+	}
+	var token, class, results string
+	var resume bool
+	var err error
+	if m := miCommandRegexp.FindStringSubmatch(ln); m == nil {
+		class, resume, err = d.miConsole(ln)
+	} else {
+		token = m[1]
+		var args []string
+		if args, err = miArgs(m[3]); err == nil {
+			class, results, err = d.miExec(m[2], args)
+			resume = class == "running" || class == "exit"
+		}
+	}
+	d.miResult(token, class, results, err)
+	if class == "running" {
+		fmt.Fprintln(d.w, `*running,thread-id="all"`)
+		fmt.Fprint(d.w, miPrompt)
+	}
+	return resume
+}
+
+// miResult writes a result record. If err is non-nil, an error record
+// is written instead.
+func (d *debugger) miResult(token, class, results string, err error) {
+	if err != nil {
+		fmt.Fprintf(d.w, "%s^error,msg=%s\n", token, strconv.Quote(err.Error()))
+		return
+	}
+	if results != "" {
+		results = "," + results
+	}
+	fmt.Fprintf(d.w, "%s^%s%s\n", token, class, results)
+}
+
+// miConsole executes the regular debugger command ln, writing its output
+// as a console stream record. The result class is returned.
+func (d *debugger) miConsole(ln string) (class string, resume bool, err error) {
+	fields := strings.Fields(ln)
+	if len(fields) == 0 {
+		return "done", false, nil
+	}
+	var buf bytes.Buffer
+	w := d.w
+	d.w = &buf
+	resume, err = d.exec(fields[0], fields[1:])
+	d.w = w
+	if buf.Len() > 0 {
+		fmt.Fprintf(d.w, "~%s\n", strconv.Quote(buf.String()))
+	}
+	switch {
+	case isClosed(d.vm.quit):
+		class = "exit"
+	case resume:
+		class = "running"
+	default:
+		class = "done"
+	}
+	return class, resume, err
+}
+
+// miExec executes the MI command cmd with arguments args.
+// It returns the result class and comma-separated results.
+func (d *debugger) miExec(cmd string, args []string) (class, results string, err error) {
+	vm := d.vm
+
+	// count parses the optional i-th argument as a positive count.
+	count := func(i int) (int, error) {
+		if i >= len(args) {
+			return 1, nil
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bad count %q", args[i])
+		}
+		return n, nil
+	}
+
+	switch cmd {
+	case "-break-insert":
+		var loc string
+		for _, a := range args {
+			switch {
+			case a == "-f" || a == "-h": // pending and hardware breakpoints are just breakpoints
+			case strings.HasPrefix(a, "-"):
+				return "", "", fmt.Errorf("unsupported option %q", a)
+			default:
+				loc = a
+			}
+		}
+		a, err := miAddr(loc)
+		if err != nil {
+			return "", "", err
+		}
+		d.breaks[a] = struct{}{}
+		return "done", "bkpt=" + d.miBkpt(a), nil
+	case "-break-delete":
+		if len(args) == 0 {
+			for a := range d.breaks {
+				delete(d.breaks, a)
+				delete(d.bkn.nums, a)
+			}
+		}
+		for _, s := range args {
+			n, err := strconv.Atoi(s)
+			a, ok := d.bkn.addr(n)
+			if err != nil || !ok {
+				return "", "", fmt.Errorf("bad breakpoint number %q", s)
+			}
+			delete(d.breaks, a)
+			delete(d.bkn.nums, a)
+		}
+		return "done", "", nil
+	case "-break-list":
+		addrs := make([]int, 0, len(d.breaks))
+		for a := range d.breaks {
+			addrs = append(addrs, int(a))
+		}
+		sort.Ints(addrs)
+		body := make([]string, len(addrs))
+		for i, a := range addrs {
+			body[i] = "bkpt=" + d.miBkpt(uint16(a))
+		}
+		return "done", fmt.Sprintf(`BreakpointTable={nr_rows="%d",nr_cols="6",`+
+			`hdr=[{width="7",alignment="-1",col_name="number",colhdr="Num"},`+
+			`{width="14",alignment="-1",col_name="type",colhdr="Type"},`+
+			`{width="4",alignment="-1",col_name="disp",colhdr="Disp"},`+
+			`{width="3",alignment="-1",col_name="enabled",colhdr="Enb"},`+
+			`{width="10",alignment="-1",col_name="addr",colhdr="Address"},`+
+			`{width="40",alignment="2",col_name="what",colhdr="What"}],body=[%s]}`,
+			len(addrs), strings.Join(body, ",")), nil
+	case "-exec-continue", "-exec-run":
+		return "running", "", nil
+	case "-exec-step", "-exec-stepi":
+		n, err := count(0)
+		if err != nil {
+			return "", "", err
+		}
+		d.steps = n
+		return "running", "", nil
+	case "-exec-next", "-exec-nexti":
+		// Step over calls by stopping at the following instruction.
+		if in, ok := decode(vm.mem[:], vm.ip); ok && in.op == opCall {
+			d.temp = int(in.next())
+		} else {
+			d.steps = 1
+		}
+		return "running", "", nil
+	case "-exec-finish":
+		ret := callers(vm, 1)
+		if len(ret) == 0 {
+			return "", "", errors.New("no return address on stack")
+		}
+		d.temp = int(ret[0])
+		d.why = `reason="function-finished"`
+		return "running", "", nil
+	case "-exec-interrupt":
+		return "done", "", nil
+	case "-data-evaluate-expression":
+		if len(args) != 1 {
+			return "", "", errors.New("usage: -data-evaluate-expression EXPR")
+		}
+		v, err := d.miEval(args[0])
+		if err != nil {
+			return "", "", err
+		}
+		return "done", fmt.Sprintf(`value="%d"`, v), nil
+	case "-data-list-register-names":
+		names := make([]string, nregs+1)
+		for i := range names {
+			names[i] = strconv.Quote(miRegName(i))
+		}
+		return "done", "register-names=[" + strings.Join(names, ",") + "]", nil
+	case "-data-list-register-values":
+		if len(args) == 0 {
+			return "", "", errors.New("usage: -data-list-register-values FMT [REGNO...]")
+		}
+		var format string
+		switch args[0] {
+		case "x":
+			format = `{number="%d",value="%#x"}`
+		case "d", "N", "r":
+			format = `{number="%d",value="%d"}`
+		default:
+			return "", "", fmt.Errorf("unsupported format %q", args[0])
+		}
+		var regs []int
+		for _, s := range args[1:] {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 || n > nregs {
+				return "", "", fmt.Errorf("bad register number %q", s)
+			}
+			regs = append(regs, n)
+		}
+		if len(regs) == 0 {
+			for i := 0; i <= nregs; i++ {
+				regs = append(regs, i)
+			}
+		}
+		vals := make([]string, len(regs))
+		for i, n := range regs {
+			v := vm.ip
+			if n < nregs {
+				v = vm.reg[n]
+			}
+			vals[i] = fmt.Sprintf(format, n, v)
+		}
+		return "done", "register-values=[" + strings.Join(vals, ",") + "]", nil
+	case "-stack-info-depth":
+		return "done", fmt.Sprintf(`depth="%d"`, 1+len(callers(vm, miMaxFrames-1))), nil
+	case "-stack-list-frames":
+		addrs := append([]uint16{vm.ip}, callers(vm, miMaxFrames-1)...)
+		frames := make([]string, len(addrs))
+		for i, a := range addrs {
+			frames[i] = fmt.Sprintf(`frame={level="%d",addr="0x%04x",func="??"}`, i, a)
+		}
+		return "done", "stack=[" + strings.Join(frames, ",") + "]", nil
+	case "-data-disassemble":
+		start, end := -1, -1
+		for i := 0; i < len(args); i++ {
+			if args[i] == "--" {
+				break // the mode is ignored
+			}
+			if (args[i] != "-s" && args[i] != "-e") || i+1 == len(args) {
+				return "", "", errors.New("usage: -data-disassemble -s START -e END [-- MODE]")
+			}
+			v, err := miAddr(args[i+1])
+			if err != nil {
+				return "", "", err
+			}
+			if args[i] == "-s" {
+				start = int(v)
+			} else {
+				end = int(v)
+			}
+			i++
+		}
+		if start < 0 || end < 0 {
+			return "", "", errors.New("usage: -data-disassemble -s START -e END [-- MODE]")
+		}
+		var insns []string
+		for a := start; a < end && a <= vmax; {
+			text, size := fmt.Sprintf("data %d", vm.mem[a]), 1
+			if in, ok := decode(vm.mem[:], uint16(a)); ok {
+				text, size = in.String(), int(in.size())
+			}
+			insns = append(insns, fmt.Sprintf(`{address="0x%04x",inst=%s}`, a, strconv.Quote(text)))
+			a += size
+		}
+		return "done", "asm_insns=[" + strings.Join(insns, ",") + "]", nil
+	case "-thread-info":
+		return "done", `threads=[{id="1",target-id="vm",frame=` + miFrame(vm.ip) +
+			`,state="stopped"}],current-thread-id="1"`, nil
+	case "-list-features":
+		return "done", "features=[]", nil
+	case "-interpreter-exec":
+		if len(args) != 2 || args[0] != "console" {
+			return "", "", errors.New(`usage: -interpreter-exec console "COMMAND"`)
+		}
+		class, _, err := d.miConsole(args[1])
+		return class, "", err
+	case "-gdb-set", "-enable-pretty-printing", "-environment-cd",
+		"-file-exec-and-symbols", "-inferior-tty-set":
+		return "done", "", nil // irrelevant since the program is already loaded
+	case "-gdb-exit":
+		vm.halt()
+		return "exit", "", nil
+	}
+	return "", "", fmt.Errorf("Undefined MI command: %s", cmd[1:])
+}
+
+// miStopped writes a record reporting that execution stopped.
+// reason is the reason passed to pause.
+func (d *debugger) miStopped(reason string) {
+	var why string
+	switch {
+	case reason == "breakpoint":
+		why = fmt.Sprintf(`reason="breakpoint-hit",disp="keep",bkptno="%d"`, d.bkn.num(d.vm.ip))
+	case reason == "trap":
+		why = `reason="signal-received",signal-name="SIGTRAP",signal-meaning="Trace/breakpoint trap"`
+	case d.why != "":
+		why = d.why
+	default:
+		why = `reason="end-stepping-range"`
+	}
+	fmt.Fprintf(d.w, "*stopped,%s,frame=%s,thread-id=\"1\",stopped-threads=\"all\"\n", why, miFrame(d.vm.ip))
+}
+
+// miExited writes a record reporting that the program stopped running.
+// err is the run-time error, if any.
+func (d *debugger) miExited(err error) {
+	if err != nil {
+		fmt.Fprintf(d.w, "~%s\n", strconv.Quote(err.Error()+"\n"))
+		fmt.Fprintln(d.w, `*stopped,reason="exited",exit-code="01"`)
+	} else {
+		fmt.Fprintln(d.w, `*stopped,reason="exited-normally"`)
+	}
+}
+
+// miBkpt returns a tuple describing the breakpoint at addr.
+func (d *debugger) miBkpt(addr uint16) string {
+	return fmt.Sprintf(`{number="%d",type="breakpoint",disp="keep",enabled="y",addr="0x%04x",times="0"}`,
+		d.bkn.num(addr), addr)
+}
+
+// miEval evaluates expr, which may be a register ("$r0" or "r0"), "$pc",
+// or a number, optionally preceded by "*" to read the word at that address.
+func (d *debugger) miEval(expr string) (uint16, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "*") {
+		a, err := d.miEval(expr[1:])
+		if err != nil {
+			return 0, err
+		}
+		if a > vmax {
+			return 0, fmt.Errorf("Cannot access memory at address %#x", a)
+		}
+		return d.vm.mem[a], nil
+	}
+	s := strings.TrimPrefix(expr, "$")
+	if s == "pc" || s == "ip" {
+		return d.vm.ip, nil
+	}
+	if len(s) == 2 && s[0] == 'r' && s[1] >= '0' && s[1] < '0'+nregs {
+		return d.vm.reg[s[1]-'0'], nil
+	}
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("No symbol %q in current context.", expr)
+	}
+	return uint16(v), nil
+}
+
+// miAddr parses a location like "*0x1234", "0x1234", or "1234".
+func miAddr(loc string) (uint16, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(loc, "*"), 0, 16)
+	if err != nil || v > vmax {
+		return 0, fmt.Errorf("bad location %q", loc)
+	}
+	return uint16(v), nil
+}
+
+// miRegName returns the name of register number n as reported to front-ends.
+func miRegName(n int) string {
+	if n == nregs {
+		return "pc"
+	}
+	return fmt.Sprintf("r%d", n)
+}
+
+// miFrame returns a tuple describing a frame at addr.
+func miFrame(addr uint16) string {
+	return fmt.Sprintf(`{addr="0x%04x",func="??",args=[]}`, addr)
+}
+
+// miArgs splits s into whitespace-separated arguments.
+// Arguments may be C-style quoted strings.
+func miArgs(s string) ([]string, error) {
+	var args []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return args, nil
+		}
+		if s[0] != '"' {
+			i := strings.IndexAny(s, " \t")
+			if i < 0 {
+				i = len(s)
+			}
+			args = append(args, s[:i])
+			s = s[i:]
+			continue
+		}
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return nil, errors.New("unterminated string")
+		}
+		a, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad string %s", s[:end+1])
+		}
+		args = append(args, a)
+		s = s[end+1:]
+	}
+}
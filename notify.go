@@ -0,0 +1,74 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// notifyTimeout is the maximum time taken by each notification request.
+const notifyTimeout = 10 * time.Second
+
+// codeNotification is the JSON object posted by codeNotifier.
+type codeNotification struct {
+	Code  string    `json:"code"`
+	Time  time.Time `json:"time"`  // when the code was written
+	Steps uint64    `json:"steps"` // instructions executed when the program next read input
+}
+
+// codeNotifier posts a codeNotification to a URL whenever a code is found.
+// It is safe for concurrent use.
+type codeNotifier struct {
+	url    string
+	msg    io.Writer // receives errors
+	client http.Client
+	wg     sync.WaitGroup // tracks notify goroutines
+}
+
+func newCodeNotifier(url string, msg io.Writer) *codeNotifier {
+	return &codeNotifier{url: url, msg: msg, client: http.Client{Timeout: notifyTimeout}}
+}
+
+// notify reports the discovery of code, which was just written by vm.
+// Like speedTimer.split, it reads the instruction count once the program
+// waits for input (or stops).
+func (n *codeNotifier) notify(code string, vm *vm) {
+	cn := codeNotification{Code: code, Time: time.Now()}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if !vm.do(func() { cn.Steps = vm.steps }) {
+			cn.Steps = vm.steps // stopped
+		}
+		if err := n.post(&cn); err != nil {
+			fmt.Fprintf(n.msg, "Failed sending notification for %s: %v\n", code, err)
+		}
+	}()
+}
+
+// post posts cn to n.url.
+func (n *codeNotifier) post(cn *codeNotification) error {
+	b, err := json.Marshal(cn)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got %q", resp.Status)
+	}
+	return nil
+}
+
+// wait waits for pending notifications to be sent.
+func (n *codeNotifier) wait() { n.wg.Wait() }
@@ -0,0 +1,215 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"runtime"
+	"time"
+)
+
+// options holds the values of command-line flags.
+type options struct {
+	aliases          string
+	asmOut           string
+	asmList          string
+	annotate         bool
+	census           string
+	autosave         int
+	autosaveKeep     int
+	autosnapshot     time.Duration
+	color            string
+	cpuProfile       string
+	core             string
+	coreInfo         bool
+	batch            bool
+	cmdSep           string
+	busyAfter        time.Duration
+	brute            string
+	bruteGrep        string
+	bruteTimeout     time.Duration
+	bruteWorkers     int
+	callGraph        string
+	chromeTracePath  string
+	decrypt          bool
+	controlStdio     bool
+	dapAddr          string
+	debug            bool
+	debugCkpts       int
+	decompile        bool
+	diffState        string
+	diffCode         bool
+	diff             string
+	disasm           bool
+	entropy          bool
+	entropyThresh    float64
+	export           string
+	jit              bool
+	jsonOut          bool
+	loadFrom         string
+	expectScript     string
+	onEOF            string
+	eofGrace         time.Duration
+	history          string
+	memProfile       string
+	mutexProfile     string
+	maxIPS           int
+	maxSessions      int
+	httpAddr         string
+	httpPprof        bool
+	grpcAddr         string
+	grpcCert         string
+	grpcKey          string
+	idle             time.Duration
+	idleCmd          string
+	input            string
+	loadCmd          string
+	inputFIFO        string
+	inputUnix        string
+	logOutput        string
+	lockstep         string
+	lockstepRef      bool
+	lineEdit         bool
+	lint             bool
+	mi               bool
+	notifyURL        string
+	metaPrefix       string
+	makePatch        string
+	patches          stringList
+	plugins          stringList
+	recompile        string
+	pager            bool
+	outputDelay      time.Duration
+	prompt           string
+	recordInput      string
+	replay           string
+	teleporter       string
+	teleporterSearch bool
+	timer            bool
+	tracePath        string
+	turbo            bool
+	transcriptHTML   string
+	transcriptTimes  bool
+	transcriptPath   string
+	undo             int
+	vcrPlay          string
+	vcrRecord        string
+	vcrSeek          int
+	sessionIdle      time.Duration
+	sessionIPS       int
+	sessionSaveMem   int
+	userSaves        string
+	userQuota        int64
+	userTokens       string
+	saveDir          string
+	saveTo           string
+	skipIntro        bool
+	status           bool
+	strs             bool
+	strsMin          int
+	writeImg         string
+}
+
+// register defines flags in fs that set o's fields to their defaults
+// and to the values that are passed.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.aliases, "aliases", "", "File defining input aliases and macros (default is under user config dir)")
+	fs.StringVar(&o.asmOut, "asm", "", `Assemble the source file argument and write the image to file ("-" for stdout)`)
+	fs.StringVar(&o.asmList, "asm-list", "", "Write -asm listing and symbol table to file")
+	fs.BoolVar(&o.annotate, "annotate", false, "Append descriptions to -disasm instructions")
+	fs.StringVar(&o.census, "census", "", `Print opcode counts ("static", or "dynamic" to also count executed instructions)`)
+	fs.IntVar(&o.autosave, "autosave", 0, "Save state to a rotating autosave slot after every N commands")
+	fs.IntVar(&o.autosaveKeep, "autosave-keep", 5, "Number of autosave slots used by -autosave and -autosnapshot")
+	fs.DurationVar(&o.autosnapshot, "autosnapshot", 0, `Also save state to a rotating autosave slot at this interval (e.g. "5m")`)
+	fs.StringVar(&o.color, "color", "auto", `Show host messages in color ("auto" if stderr is a terminal, "always", or "never")`)
+	fs.StringVar(&o.cpuProfile, "cpuprofile", "", "Write a Go CPU profile of this program to file")
+	fs.StringVar(&o.core, "core", "", "Write a snapshot with recently-executed instructions to file on run-time errors")
+	fs.BoolVar(&o.coreInfo, "core-info", false, "Describe the core dump passed to -load-from and exit")
+	fs.BoolVar(&o.batch, "batch", false, "Run non-interactively, exiting with nonzero status on run-time errors")
+	fs.StringVar(&o.cmdSep, "cmd-sep", ";", "Separator for multiple commands in an input line (empty to disable)")
+	fs.DurationVar(&o.busyAfter, "busy-after", 2*time.Second, "Show a spinner on a terminal when the program runs this long without output (0 to disable)")
+	fs.StringVar(&o.brute, "brute", "", "Run the program once per line of file, sending the line's commands as input, then print each run's output and exit")
+	fs.StringVar(&o.bruteGrep, "brute-grep", "", "Only print -brute runs whose output matches this regular expression")
+	fs.DurationVar(&o.bruteTimeout, "brute-timeout", 10*time.Second, "Halt each -brute run after this long")
+	fs.IntVar(&o.bruteWorkers, "brute-workers", runtime.NumCPU(), "Number of -brute runs performed in parallel")
+	fs.StringVar(&o.callGraph, "callgraph", "", `Print static call graph ("dot" or "json") and exit`)
+	fs.StringVar(&o.chromeTracePath, "chrome-trace", "", "Write a timeline of calls, input waits, and debugger pauses for chrome://tracing or Perfetto to file")
+	fs.BoolVar(&o.decrypt, "decrypt", false, "Run until the first input instruction before analyzing memory")
+	fs.BoolVar(&o.controlStdio, "control-stdio", false, "Control the program with JSON-RPC requests on stdin, writing responses and output to stdout")
+	fs.StringVar(&o.dapAddr, "dap", "", `Serve the Debug Adapter Protocol on stdio ("-") or at an address instead of running the program`)
+	fs.BoolVar(&o.debug, "debug", false, "Run under the debugger, pausing before the first instruction")
+	fs.IntVar(&o.debugCkpts, "debug-checkpoints", 16, "Number of checkpoints kept by -debug when breakpoints and traps are hit")
+	fs.BoolVar(&o.decompile, "decompile", false, "Print pseudo-code for reachable functions and exit")
+	fs.StringVar(&o.diffState, "diff-state", "", "Print differences between the VM state (see -load-from) and the named snapshot and exit")
+	fs.BoolVar(&o.diffCode, "diff-code", false, "Also print instruction-level differences with -diff-state")
+	fs.StringVar(&o.diff, "diff", "", "Print instruction-level differences between the program and the named image and exit")
+	fs.BoolVar(&o.disasm, "disasm", false, "Print disassembly of reachable code and exit")
+	fs.BoolVar(&o.entropy, "entropy", false, "Print high-entropy (likely encrypted) memory regions and exit")
+	fs.Float64Var(&o.entropyThresh, "entropy-thresh", defaultEntropyThresh, "Bits per byte considered high-entropy by -entropy")
+	fs.StringVar(&o.export, "export", "", "Write image, symbols, and Ghidra script to directory and exit")
+	fs.BoolVar(&o.jit, "jit", false, "Compile frequently-executed code to Go closures to speed up compute-heavy sections")
+	fs.BoolVar(&o.jsonOut, "json", false, "Write -disasm output as JSON")
+	fs.StringVar(&o.loadFrom, "load-from", "", `Load VM state saved by -save-to before running ("-" for stdin; program argument is optional)`)
+	fs.StringVar(&o.expectScript, "expect", "", "Run an expect script that waits for output and sends input, then read stdin")
+	fs.StringVar(&o.onEOF, "on-eof", eofHalt, `Action at end of input: "halt" when the program next reads input, "wait" for it to halt, or send "newline"s`)
+	fs.DurationVar(&o.eofGrace, "eof-grace", 0, "Halt the program this long after end of input with -on-eof=wait or newline (0 for no limit)")
+	fs.StringVar(&o.history, "history", "", "File storing line-editing history across sessions (default is in -save-dir)")
+	fs.StringVar(&o.memProfile, "memprofile", "", "Write a Go heap profile of this program to file before exiting")
+	fs.StringVar(&o.mutexProfile, "mutexprofile", "", "Write a Go mutex contention profile of this program to file before exiting")
+	fs.IntVar(&o.maxIPS, "max-ips", 0, "Maximum instructions per second executed by the program, e.g. to slow it down for demos (0 for no limit)")
+	fs.IntVar(&o.maxSessions, "max-sessions", 100, "Maximum number of concurrent -http sessions (0 for no limit)")
+	fs.StringVar(&o.httpAddr, "http", "", `Serve the program to web browsers at this address (e.g. ":8080") instead of running it`)
+	fs.BoolVar(&o.httpPprof, "http-pprof", false, "Also serve live Go profiles of this program under /debug/pprof/ with -http")
+	fs.StringVar(&o.grpcAddr, "grpc", "", `Serve the gRPC API described by synacor.proto at this address (e.g. ":8443"), sharing sessions with -http`)
+	fs.StringVar(&o.grpcCert, "grpc-cert", "", "TLS certificate file for -grpc")
+	fs.StringVar(&o.grpcKey, "grpc-key", "", "TLS private key file for -grpc")
+	fs.DurationVar(&o.idle, "idle", 0, `Report when the program has waited this long for input (e.g. "5m")`)
+	fs.StringVar(&o.idleCmd, "idle-cmd", "", "Command and space-separated args run when -idle elapses")
+	fs.StringVar(&o.input, "input", "", "Send lines from file or -transcript input (including meta-commands) to the program before reading stdin")
+	fs.StringVar(&o.loadCmd, "load-cmd", "", `Command sent to the program after loading state with a meta-command (e.g. "look")`)
+	fs.StringVar(&o.inputFIFO, "input-fifo", "", "Also read input lines from named pipe (created if needed)")
+	fs.StringVar(&o.inputUnix, "input-unix", "", "Also read input lines from connections to Unix socket")
+	fs.StringVar(&o.logOutput, "log-output", "", "Append the program's output and host messages to file")
+	fs.StringVar(&o.lockstep, "lockstep", "", "Run in lockstep with a reference VM started by this command (plus an image path), stopping at the first divergence")
+	fs.BoolVar(&o.lockstepRef, "lockstep-ref", false, "Act as a reference VM for -lockstep, reading step commands from stdin")
+	fs.BoolVar(&o.lineEdit, "line-edit", true, "Edit input lines and recall history with arrow keys when stdin is a terminal")
+	fs.BoolVar(&o.lint, "lint", false, "Report static problems in the program and exit")
+	fs.BoolVar(&o.mi, "mi", false, "Use GDB/MI syntax for -debug commands and output so GDB front-ends can drive the debugger")
+	fs.StringVar(&o.notifyURL, "notify-url", "", "URL receiving a JSON POST with the code, time, and instruction count whenever a code is found")
+	fs.StringVar(&o.metaPrefix, "meta-prefix", "/", "Prefix for input lines handled as meta-commands (e.g. \"/save file\"); empty to disable")
+	fs.StringVar(&o.makePatch, "make-patch", "", "Print patch converting the program into the named image and exit")
+	fs.Var(&o.patches, "patch", "Patch file of \"addr: old -> new\" lines to apply at load time (repeatable)")
+	fs.Var(&o.plugins, "plugin", "Start plugin command that can add instruction hooks, meta-commands, and output filters (repeatable)")
+	fs.StringVar(&o.recompile, "recompile", "", `Translate the program to standalone source ("c" or "go") and exit`)
+	fs.BoolVar(&o.pager, "pager", true, "Pause after each screenful of output when using -line-edit")
+	fs.DurationVar(&o.outputDelay, "output-delay", 0, `Pause after writing each byte of output (e.g. "5ms")`)
+	fs.StringVar(&o.prompt, "prompt", "", `Prompt written when the program waits for input (e.g. "> ")`)
+	fs.StringVar(&o.recordInput, "record-input", "", "Record input lines and the final state to a log for -replay")
+	fs.StringVar(&o.replay, "replay", "", "Feed input from a -record-input log instead of stdin and verify the final state")
+	fs.StringVar(&o.teleporter, "teleporter", "", `Compute the teleporter's confirmation routine natively ("auto" to find it, or its address)`)
+	fs.BoolVar(&o.teleporterSearch, "teleporter-search", false, "Print eighth-register values that pass the teleporter's confirmation and exit")
+	fs.BoolVar(&o.timer, "timer", false, "Time the run, recording a split whenever a code is found")
+	fs.StringVar(&o.tracePath, "trace", "", `Write executed instructions to file ("-" for stderr)`)
+	fs.BoolVar(&o.turbo, "turbo", false, "Run as fast as possible by disabling core dumps, undo, autosaves, tracing, opcode counting, and throttling")
+	fs.StringVar(&o.transcriptHTML, "transcript-html", "", "Convert the -transcript file argument to an HTML page and exit")
+	fs.BoolVar(&o.transcriptTimes, "transcript-times", false, "Record when each line is entered in -transcript")
+	fs.StringVar(&o.transcriptPath, "transcript", "", "Write the session's output and input to file (usable with -input)")
+	fs.IntVar(&o.undo, "undo", 50, "Number of commands that can be undone with /undo (0 to disable)")
+	fs.StringVar(&o.vcrPlay, "vcr-play", "", "Play back a -vcr-record recording, then read stdin")
+	fs.StringVar(&o.vcrRecord, "vcr-record", "", "Record the session's input, output, and instruction counts to file")
+	fs.IntVar(&o.vcrSeek, "vcr-seek", 0, "Fast-forward through this many inputs without output when using -vcr-play")
+	fs.DurationVar(&o.sessionIdle, "session-idle", 30*time.Minute, "Delete -http sessions after this long without activity (0 to disable)")
+	fs.IntVar(&o.sessionIPS, "session-ips", 0, "Maximum instructions per second executed by each -http session (default is -max-ips)")
+	fs.IntVar(&o.sessionSaveMem, "session-save-mem", 8<<20, "Maximum bytes of states saved in memory by each -http API session")
+	fs.StringVar(&o.userSaves, "user-saves", "", "Directory storing saved states for -http users identified by tokens")
+	fs.Int64Var(&o.userQuota, "user-quota", 4<<20, "Maximum bytes of -user-saves states per user")
+	fs.StringVar(&o.userTokens, "user-tokens", "", `File of "user token" lines listing the tokens accepted by -user-saves (default is any token)`)
+	fs.StringVar(&o.saveDir, "save-dir", "", "Directory for numbered save slots (default is per-program under user config dir)")
+	fs.StringVar(&o.saveTo, "save-to", "", `Save VM state to file when the program stops ("-" for stdout, sending output to stderr)`)
+	fs.BoolVar(&o.skipIntro, "skip-intro", false, "Start from a cached snapshot taken before the program first reads input")
+	fs.BoolVar(&o.status, "status", false, "Show the room, command count, and codes found on the terminal's bottom line")
+	fs.BoolVar(&o.strs, "strings", false, "Print printable strings found in memory and exit")
+	fs.IntVar(&o.strsMin, "strings-min", 4, "Minimum length of strings printed by -strings")
+	fs.StringVar(&o.writeImg, "write-image", "", "Write memory image (after patching) to file and exit")
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+// pagerPrompt is written when the pager is waiting for a key.
+const pagerPrompt = "--More--"
+
+// pager tracks the program's output to decide when it would scroll text that
+// hasn't been read off the terminal. Bursts of output (i.e. output written
+// after an input line) are paged like more(1): Space shows the next page,
+// Enter shows the next line, and q shows the rest of the burst.
+//
+// pager is not safe for concurrent use; session guards it with outMu.
+type pager struct {
+	fd       int  // terminal's file descriptor
+	enabled  bool // true once input is being read from the terminal
+	waiting  bool // pagerPrompt was written and a key is needed
+	rows     int  // terminal height
+	reserved int  // rows at the bottom of the terminal not used for output
+	cols     int  // terminal width
+	lines    int  // lines written in the current page
+	col      int  // column of the next byte
+	skip     bool // don't page the rest of the burst
+}
+
+func newPager(fd int) *pager {
+	return &pager{fd: fd}
+}
+
+// reset starts a new burst of output, checking the terminal's size again in
+// case it changed.
+func (p *pager) reset() {
+	rows, cols, err := termSize(p.fd)
+	if err != nil {
+		rows, cols = 0, 0
+	}
+	p.rows, p.cols = rows-p.reserved, cols
+	p.lines, p.skip = 0, false
+}
+
+// output records a byte of output. True is returned if the page is full,
+// in which case the caller should write pagerPrompt and wait for a key.
+func (p *pager) output(b byte) bool {
+	if !p.enabled || p.skip || p.rows < 2 {
+		return false
+	}
+	if b == '\n' {
+		p.lines++
+		p.col = 0
+	} else if p.col++; p.cols > 0 && p.col > p.cols {
+		p.lines++ // the terminal wrapped the line
+		p.col = 1
+	}
+	if p.lines < p.rows-1 {
+		return false
+	}
+	p.waiting = true
+	return true
+}
+
+// key handles a key pressed while p is waiting.
+func (p *pager) key(r rune) {
+	p.waiting = false
+	switch r {
+	case '\r', '\n':
+		p.lines--
+	case 'q', 'Q':
+		p.skip = true
+	default:
+		p.lines = 0
+	}
+}
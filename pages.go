@@ -0,0 +1,114 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+// Memory is divided into pages so that search drivers (e.g. bruteForce) can
+// save and restore many VM states cheaply. A pagedSnapshot shares the pages
+// that haven't changed since the snapshot that the VM was last restored from
+// or saved to, so a tree of states that differ in a few variables costs
+// little more than one copy of memory. Restoring a snapshot only copies the
+// pages that differ from the VM's current memory.
+const (
+	pageSize = 256 // words per page
+	npages   = msize / pageSize
+)
+
+// memPage holds one page of memory. Pages referenced by pagedSnapshots are
+// shared and must not be modified.
+type memPage [pageSize]uint16
+
+// zeroPage is shared by all snapshots for pages containing only zeros.
+var zeroPage = &memPage{}
+
+// pagedSnapshot is an in-memory snapshot of a VM's state that shares
+// unmodified pages with related snapshots. Unlike snapshot, it can't be
+// written to disk. It is only read after being created, so it may be
+// restored by multiple VMs concurrently.
+type pagedSnapshot struct {
+	pages [npages]*memPage
+	size  int
+	reg   [nregs]uint16
+	stack []uint16
+	ip    uint16
+	steps uint64
+}
+
+// markDirty records that addr was written if vm.dirty is non-nil.
+func (vm *vm) markDirty(addr uint16) {
+	if vm.dirty != nil {
+		vm.dirty[addr/pageSize] = true
+	}
+}
+
+// trackPages starts recording the pages that vm writes, with ps as the
+// snapshot that vm's memory currently matches. Only pages written afterward
+// need to be copied by pagedSnapshot and restorePaged.
+func (vm *vm) trackPages(ps *pagedSnapshot) {
+	if vm.dirty == nil {
+		vm.dirty = make([]bool, npages)
+	} else {
+		for p := range vm.dirty {
+			vm.dirty[p] = false
+		}
+	}
+	vm.pages = ps
+}
+
+// pagedSnapshot returns a snapshot of vm's state. Pages that vm hasn't
+// written since it was last restored from or saved to a pagedSnapshot are
+// shared with that snapshot rather than copied. vm must not be executing
+// instructions.
+func (vm *vm) pagedSnapshot() *pagedSnapshot {
+	ps := &pagedSnapshot{
+		size:  vm.size,
+		reg:   vm.reg,
+		stack: append([]uint16(nil), vm.stack...),
+		ip:    vm.ip,
+		steps: vm.steps,
+	}
+	for p := range ps.pages {
+		if vm.pages != nil && !vm.dirty[p] {
+			ps.pages[p] = vm.pages.pages[p]
+			continue
+		}
+		src := vm.mem[p*pageSize : (p+1)*pageSize]
+		if isZero(src) {
+			ps.pages[p] = zeroPage
+			continue
+		}
+		pg := &memPage{}
+		copy(pg[:], src)
+		ps.pages[p] = pg
+	}
+	vm.trackPages(ps)
+	return ps
+}
+
+// restorePaged replaces vm's state with ps. Only pages that vm has written
+// or that differ between ps and the snapshot that vm was last restored from
+// or saved to are copied. vm must not be executing instructions.
+func (vm *vm) restorePaged(ps *pagedSnapshot) {
+	for p, pg := range ps.pages {
+		if vm.pages != nil && !vm.dirty[p] && vm.pages.pages[p] == pg {
+			continue
+		}
+		copy(vm.mem[p*pageSize:(p+1)*pageSize], pg[:])
+	}
+	vm.trackPages(ps)
+	vm.size = ps.size
+	vm.reg = ps.reg
+	vm.setStack(ps.stack)
+	vm.ip = ps.ip
+	vm.steps = ps.steps
+}
+
+// isZero returns true if all of the words in s are zero.
+func isZero(s []uint16) bool {
+	for _, v := range s {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// patchEntry describes the replacement of a single word of memory.
+type patchEntry struct {
+	addr, old, new uint16
+	line           int // 1-indexed line number in patch file
+}
+
+// readPatch parses a patch file consisting of lines of the form
+//
+//	address: old -> new
+//
+// Blank lines are ignored, as is text following '#' or ';'.
+// Values may be decimal, hexadecimal with a "0x" prefix, registers like "r7",
+// or opcode mnemonics like "trap" (e.g. to inject a debugger trap).
+func readPatch(r io.Reader) ([]patchEntry, error) {
+	var entries []patchEntry
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		s := sc.Text()
+		if i := strings.IndexAny(s, "#;"); i >= 0 {
+			s = s[:i]
+		}
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: missing ':'", ln)
+		}
+		vals := strings.SplitN(parts[1], "->", 2)
+		if len(vals) != 2 {
+			return nil, fmt.Errorf("line %d: missing '->'", ln)
+		}
+		e := patchEntry{line: ln}
+		var err error
+		if e.addr, err = parseWord(parts[0]); err != nil {
+			return nil, fmt.Errorf("line %d: bad address: %v", ln, err)
+		} else if e.addr >= msize {
+			return nil, fmt.Errorf("line %d: address %d out of range", ln, e.addr)
+		}
+		if e.old, err = parseWord(vals[0]); err != nil {
+			return nil, fmt.Errorf("line %d: bad old value: %v", ln, err)
+		}
+		if e.new, err = parseWord(vals[1]); err != nil {
+			return nil, fmt.Errorf("line %d: bad new value: %v", ln, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// readPatchFile is a wrapper around readPatch that reads the named file.
+func readPatchFile(p string) ([]patchEntry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPatch(f)
+}
+
+// parseWord parses a 16-bit value in decimal or "0x"-prefixed hexadecimal,
+// a register reference like "r7", or an opcode mnemonic like "trap".
+func parseWord(s string) (uint16, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 2 && s[0] == 'r' && s[1] >= '0' && s[1] < '0'+nregs {
+		return vreg + uint16(s[1]-'0'), nil
+	}
+	for op, info := range ops {
+		if s == info.name {
+			return uint16(op), nil
+		}
+	}
+	v, err := strconv.ParseUint(s, 0, 16)
+	return uint16(v), err
+}
+
+// applyPatch verifies that each word in mem matches the old value in entries
+// and then writes the new values. mem is unmodified if an error is returned.
+func applyPatch(mem []uint16, entries []patchEntry) error {
+	for _, e := range entries {
+		if mem[e.addr] != e.old {
+			return fmt.Errorf("line %d: word at %d is %d; expected %d", e.line, e.addr, mem[e.addr], e.old)
+		}
+	}
+	for _, e := range entries {
+		mem[e.addr] = e.new
+	}
+	return nil
+}
+
+// writeImage writes mem to w as little-endian words.
+// At least size words are written, along with any later nonzero words.
+func writeImage(w io.Writer, mem []uint16, size int) error {
+	end := len(mem)
+	for end > size && mem[end-1] == 0 {
+		end--
+	}
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.LittleEndian, mem[:end]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeImageFile is a wrapper around writeImage that writes to the named file.
+func writeImageFile(p string, mem []uint16, size int) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if err := writeImage(f, mem, size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readImageFile reads the named program or memory image.
+// The full memory and the number of words read are returned.
+func readImageFile(p string) ([]uint16, int, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	mem := make([]uint16, msize)
+	n, err := loadImage(f, mem)
+	return mem, n, err
+}
+
+// diffImages returns patch entries that convert a into b.
+func diffImages(a, b []uint16) []patchEntry {
+	var entries []patchEntry
+	for i := range a {
+		if a[i] != b[i] {
+			entries = append(entries, patchEntry{addr: uint16(i), old: a[i], new: b[i]})
+		}
+	}
+	return entries
+}
+
+// writePatch writes entries to w in the format parsed by readPatch.
+// If header is non-empty, it is written as an initial comment.
+func writePatch(w io.Writer, entries []patchEntry, header string) error {
+	var b strings.Builder
+	if header != "" {
+		fmt.Fprintf(&b, "# %s\n", header)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%d: %d -> %d\n", e.addr, e.old, e.new)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWord(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want uint16
+		ok   bool
+	}{
+		{"0", 0, true},
+		{" 1234 ", 1234, true},
+		{"0x7fff", vmax, true},
+		{"65535", 65535, true},
+		{"65536", 0, false},
+		{"r0", vreg, true},
+		{"r7", vreg + 7, true},
+		{"r8", 0, false},
+		{"R1", 0, false},
+		{"noop", opNoop, true},
+		{"trap", opTrap, true},
+		{"bogus", 0, false},
+		{"", 0, false},
+		{"-1", 0, false},
+	} {
+		got, err := parseWord(tc.s)
+		if err != nil && tc.ok {
+			t.Errorf("parseWord(%q) failed: %v", tc.s, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("parseWord(%q) = %d; want error", tc.s, got)
+		} else if tc.ok && got != tc.want {
+			t.Errorf("parseWord(%q) = %d; want %d", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestReadPatch(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want []patchEntry // nil if an error is expected
+	}{
+		{"", []patchEntry{}},
+		{"# comment\n\n  ; another\n", []patchEntry{}},
+		{"10: 1 -> 2", []patchEntry{{10, 1, 2, 1}}},
+		{"\n0x10: r7 -> noop  # skip the check\n20: trap->0 ; again",
+			[]patchEntry{{16, vreg + 7, opNoop, 2}, {20, opTrap, 0, 3}}},
+		{"10 1 -> 2", nil},        // missing ':'
+		{"10: 1 => 2", nil},       // missing '->'
+		{"x: 1 -> 2", nil},        // bad address
+		{"r7: 1 -> 2", nil},       // register as address
+		{"32768: 1 -> 2", nil},    // address out of range
+		{"10: foo -> 2", nil},     // bad old value
+		{"10: 1 -> 0x10000", nil}, // bad new value
+	} {
+		got, err := readPatch(strings.NewReader(tc.src))
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("readPatch(%q) = %v; want error", tc.src, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readPatch(%q) failed: %v", tc.src, err)
+		} else if len(got) != len(tc.want) || (len(got) > 0 && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("readPatch(%q) = %v; want %v", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	orig := []uint16{1, 2, 3, 4}
+	for _, tc := range []struct {
+		entries []patchEntry
+		want    []uint16 // nil if an error is expected
+	}{
+		{nil, []uint16{1, 2, 3, 4}},
+		{[]patchEntry{{0, 1, 5, 1}, {3, 4, 6, 2}}, []uint16{5, 2, 3, 6}},
+		// The first entry matches, but nothing should be written since the
+		// second one doesn't.
+		{[]patchEntry{{0, 1, 5, 1}, {2, 9, 6, 2}}, nil},
+	} {
+		mem := append([]uint16(nil), orig...)
+		err := applyPatch(mem, tc.entries)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("applyPatch(%v) unexpectedly succeeded", tc.entries)
+			} else if !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("applyPatch(%v) returned %q; want line 2", tc.entries, err)
+			}
+			if !reflect.DeepEqual(mem, orig) {
+				t.Errorf("Failed applyPatch(%v) changed memory to %v", tc.entries, mem)
+			}
+		} else if err != nil {
+			t.Errorf("applyPatch(%v) failed: %v", tc.entries, err)
+		} else if !reflect.DeepEqual(mem, tc.want) {
+			t.Errorf("applyPatch(%v) produced %v; want %v", tc.entries, mem, tc.want)
+		}
+	}
+}
+
+func TestPatchRoundTrip(t *testing.T) {
+	a := []uint16{0, 1, 2, 3}
+	b := []uint16{0, 5, 2, vreg}
+	var sb strings.Builder
+	if err := writePatch(&sb, diffImages(a, b), "a -> b"); err != nil {
+		t.Fatal("Writing failed: ", err)
+	}
+	entries, err := readPatch(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatalf("Reading %q failed: %v", sb.String(), err)
+	}
+	if err := applyPatch(a, entries); err != nil {
+		t.Fatal("Applying failed: ", err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("Patched memory is %v; want %v", a, b)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements plugins: external programs that extend the runner
+// without changes to this repository. Each -plugin command is started with
+// its stdin and stdout connected to the host, and JSON objects are exchanged
+// one per line. The plugin first writes a registration:
+//
+//	{"name": "mapper", "hooks": [5451], "commands": {"map": "show the map"}, "filter": true}
+//
+// "hooks" lists addresses of instructions to be notified about, "commands"
+// maps meta-command names to help text (built-in meta-commands take
+// precedence), and "filter" requests the program's output. The host then
+// sends events, each of which must be answered by a single reply:
+//
+//	{"event": "hook", "state": {...}}  before executing a hooked instruction
+//	{"event": "command", "command": "map", "args": ["a"], "state": {...}}
+//	{"event": "output", "text": "..."}  output about to be displayed
+//
+// "state" contains "ip", "regs", "stack", and "steps". Replies may contain:
+//
+//	"message"  text to show to the user
+//	"error"    error to show to the user
+//	"text"     replacement for the output (output events only)
+//	"set"      registers and memory to set, e.g. {"r7": 1, "2732": 0}
+//	"ip"       address of the next instruction to execute
+//	"input"    text to send to the program
+//
+// Replies to output events may only contain "message", "error", and "text".
+// Before replying to a hook or command event, a plugin may write
+// {"read": {"addr": N, "n": M}} to receive {"words": [...]} containing memory.
+// Output is filtered in chunks that end at newlines or when no more output
+// is pending.
+
+// pluginExitTimeout is how long plugins are given to exit after their stdin
+// is closed.
+const pluginExitTimeout = time.Second
+
+// pluginMaxLine is the maximum length of a line written by a plugin.
+const pluginMaxLine = 1 << 20
+
+// pluginReg is the registration written by a plugin at startup.
+type pluginReg struct {
+	Name     string            `json:"name"`
+	Hooks    []uint16          `json:"hooks"`
+	Commands map[string]string `json:"commands"`
+	Filter   bool              `json:"filter"`
+}
+
+// pluginState describes the VM's state in events.
+type pluginState struct {
+	IP    uint16        `json:"ip"`
+	Regs  [nregs]uint16 `json:"regs"`
+	Stack []uint16      `json:"stack"`
+	Steps uint64        `json:"steps"`
+}
+
+// pluginEvent is sent by the host to a plugin.
+type pluginEvent struct {
+	Event   string       `json:"event"`
+	Command string       `json:"command,omitempty"`
+	Args    []string     `json:"args,omitempty"`
+	Text    string       `json:"text,omitempty"`
+	State   *pluginState `json:"state,omitempty"`
+}
+
+// pluginReply is sent by a plugin in response to an event or to read memory.
+type pluginReply struct {
+	Read *struct {
+		Addr int `json:"addr"`
+		N    int `json:"n"`
+	} `json:"read"`
+	Message string            `json:"message"`
+	Error   string            `json:"error"`
+	Text    *string           `json:"text"`
+	Set     map[string]uint16 `json:"set"`
+	IP      *uint16           `json:"ip"`
+	Input   string            `json:"input"`
+}
+
+// plugin communicates with a plugin process.
+// It is safe for concurrent use.
+type plugin struct {
+	reg   pluginReg
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	enc   *json.Encoder
+	sc    *bufio.Scanner
+	msg   io.Writer // receives messages and errors
+
+	mu   sync.Mutex // serializes exchanges
+	dead bool       // plugin failed and shouldn't be used
+}
+
+// startPlugin starts the plugin described by cmdline and reads its
+// registration.
+func startPlugin(cmdline string, msg io.Writer) (*plugin, error) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	p := &plugin{cmd: exec.Command(args[0], args[1:]...), msg: msg}
+	p.cmd.Stderr = os.Stderr
+	var err error
+	if p.stdin, err = p.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.enc = json.NewEncoder(p.stdin)
+	p.sc = bufio.NewScanner(stdout)
+	p.sc.Buffer(nil, pluginMaxLine)
+	if err := p.read(&p.reg); err != nil {
+		p.close()
+		return nil, fmt.Errorf("bad registration: %v", err)
+	}
+	if p.reg.Name == "" {
+		p.reg.Name = args[0]
+	}
+	return p, nil
+}
+
+// read unmarshals the plugin's next line into v.
+func (p *plugin) read(v interface{}) error {
+	if !p.sc.Scan() {
+		if err := p.sc.Err(); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	return json.Unmarshal(p.sc.Bytes(), v)
+}
+
+// call sends ev to the plugin and returns its reply. If vm is non-nil, the
+// plugin's memory reads are answered from it, so it must not be executing
+// instructions. Errors are reported to p.msg, and nil is returned if the
+// plugin has failed.
+func (p *plugin) call(ev *pluginEvent, vm *vm) *pluginReply {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dead {
+		return nil
+	}
+	rep, err := p.exchange(ev, vm)
+	if err != nil {
+		fmt.Fprintf(p.msg, "Plugin %s failed: %v\n", p.reg.Name, err)
+		p.dead = true
+		return nil
+	}
+	if rep.Error != "" {
+		fmt.Fprintf(p.msg, "%s: %s\n", p.reg.Name, rep.Error)
+	}
+	if rep.Message != "" {
+		fmt.Fprint(p.msg, rep.Message)
+		if !strings.HasSuffix(rep.Message, "\n") {
+			fmt.Fprintln(p.msg)
+		}
+	}
+	return rep
+}
+
+// exchange sends ev and reads the reply. p.mu must be held.
+func (p *plugin) exchange(ev *pluginEvent, vm *vm) (*pluginReply, error) {
+	if err := p.enc.Encode(ev); err != nil {
+		return nil, err
+	}
+	for {
+		var rep pluginReply
+		if err := p.read(&rep); err != nil {
+			return nil, err
+		}
+		if rep.Read == nil {
+			return &rep, nil
+		}
+		if vm == nil {
+			return nil, fmt.Errorf("read during %s event", ev.Event)
+		}
+		addr, n := rep.Read.Addr, rep.Read.N
+		if addr < 0 || n < 0 || addr+n > msize {
+			return nil, fmt.Errorf("bad read of %d word(s) at %d", n, addr)
+		}
+		words := append([]uint16{}, vm.mem[addr:addr+n]...)
+		if err := p.enc.Encode(map[string][]uint16{"words": words}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// apply makes the state changes requested by rep to vm, which must not be
+// executing instructions.
+func (p *plugin) apply(rep *pluginReply, vm *vm) {
+	if rep == nil {
+		return
+	}
+	// Sort destinations so changes are applied consistently.
+	dsts := make([]string, 0, len(rep.Set))
+	for d := range rep.Set {
+		dsts = append(dsts, d)
+	}
+	sort.Strings(dsts)
+	for _, d := range dsts {
+		dst, err := parseWord(d)
+		if err == nil {
+			err = vm.setWord(dst, rep.Set[d])
+		}
+		if err != nil {
+			fmt.Fprintf(p.msg, "%s: bad set %q: %v\n", p.reg.Name, d, err)
+		}
+	}
+	if rep.IP != nil {
+		vm.ip = *rep.IP
+	}
+	if rep.Input != "" {
+		vm.in.write([]byte(rep.Input))
+	}
+}
+
+// hook notifies the plugin that vm is about to execute the instruction at
+// vm.ip. It is called on the VM's goroutine.
+func (p *plugin) hook(vm *vm) {
+	ev := &pluginEvent{Event: "hook", State: newPluginState(vm)}
+	p.apply(p.call(ev, vm), vm)
+}
+
+// filter passes text to the plugin and returns its replacement.
+func (p *plugin) filter(text string) string {
+	rep := p.call(&pluginEvent{Event: "output", Text: text}, nil)
+	if rep == nil || rep.Text == nil {
+		return text
+	}
+	return *rep.Text
+}
+
+// command runs the plugin's meta-command cmd. vm must not be executing
+// instructions.
+func (p *plugin) command(cmd string, args []string, vm *vm) {
+	ev := &pluginEvent{Event: "command", Command: cmd, Args: args, State: newPluginState(vm)}
+	p.apply(p.call(ev, vm), vm)
+}
+
+// close closes the plugin's stdin and waits for it to exit,
+// killing it if it takes too long.
+func (p *plugin) close() error {
+	p.stdin.Close()
+	t := time.AfterFunc(pluginExitTimeout, func() { p.cmd.Process.Kill() })
+	defer t.Stop()
+	return p.cmd.Wait()
+}
+
+// newPluginState returns vm's state, which must not be changing.
+func newPluginState(vm *vm) *pluginState {
+	return &pluginState{
+		IP:    vm.ip,
+		Regs:  vm.reg,
+		Stack: append([]uint16{}, vm.stack...),
+		Steps: vm.steps,
+	}
+}
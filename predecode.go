@@ -0,0 +1,94 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import "fmt"
+
+// predecoded is an instruction that has already been decoded and validated,
+// cached by the VM so that operands don't need to be checked each time the
+// instruction is executed.
+type predecoded struct {
+	gen  uint32    // vm.gen when decoded; the entry is stale if it differs
+	op   uint16    // opcode
+	size uint16    // words occupied by the instruction, or 0 if invalid
+	fn   uint16    // index of handler in opFuncs; op unless fused (see fuse.go)
+	args [3]uint16 // literal values or register references (vreg+N)
+}
+
+// predecode decodes the instruction at ip in mem. If it's invalid, size is 0
+// and a message describing the problem is returned.
+func predecode(mem []uint16, ip uint16) (predecoded, string) {
+	d := predecoded{op: mem[ip]}
+	if int(d.op) >= len(ops) {
+		return d, fmt.Sprintf("invalid op %v at %v", d.op, ip)
+	}
+	info := ops[d.op]
+	if int(ip)+1+info.nargs > len(mem) {
+		return d, fmt.Sprintf("%v instruction at %v extends past end of memory", info.name, ip)
+	}
+	// Report bad values before bad destinations, like the VM evaluates them.
+	for i := info.nargs - 1; i >= 0; i-- {
+		addr := ip + uint16(i) + 1
+		a := mem[addr]
+		if i == 0 && info.dst && (a < vreg || a >= vreg+nregs) {
+			return d, fmt.Sprintf("bad register ref %v at %v", a, addr)
+		} else if a >= vreg+nregs {
+			return d, fmt.Sprintf("bad value %v at %v", a, addr)
+		}
+		d.args[i] = a
+	}
+	d.size = uint16(1 + info.nargs)
+	d.fn = d.op
+	return d, ""
+}
+
+// decoded returns the cached decoding of the instruction at ip,
+// decoding it first if needed. The VM must not be executing instructions
+// on another goroutine.
+func (vm *vm) decoded(ip uint16) *predecoded {
+	d := &vm.code[ip]
+	if d.gen != vm.gen {
+		*d, _ = predecode(vm.mem[:], ip)
+		d.gen = vm.gen
+		if vm.fuse && d.size != 0 {
+			d.fn = vm.fusion(ip, d)
+		}
+		if vm.blocks != nil && vm.blocks[ip] != nil {
+			d.fn = fnBlock
+		}
+		if vm.natives[ip] != nil && d.size != 0 {
+			d.fn = fnNative
+		}
+	}
+	return d
+}
+
+// invalidate discards cached decodings of instructions (including fused
+// pairs) containing addr, which has been written, and marks its page dirty.
+func (vm *vm) invalidate(addr uint16) {
+	for a := int(addr) - maxFusedSize + 1; a <= int(addr); a++ {
+		if a >= 0 {
+			vm.code[a].gen = 0
+		}
+	}
+	if vm.cover != nil && vm.cover[addr] != 0 {
+		vm.dropBlocksAt(addr)
+	}
+	vm.markDirty(addr)
+}
+
+// changed should be called when the VM's state may have been modified by
+// code other than run, so that cached information is recomputed.
+func (vm *vm) changed() {
+	vm.slowAt = 0
+	vm.fuse = vm.canFuse()
+	vm.resetBlocks()
+	if vm.gen++; vm.gen == 0 {
+		// Clear stale entries from the last time the generation was 1.
+		for i := range vm.code {
+			vm.code[i].gen = 0
+		}
+		vm.gen = 1
+	}
+}
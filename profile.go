@@ -0,0 +1,93 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// profiler writes Go runtime profiles of this program.
+type profiler struct {
+	cpu   *os.File // CPU profile being written, or nil
+	mem   string   // path for heap profile, or empty
+	mutex string   // path for mutex contention profile, or empty
+	done  bool     // stop was called
+}
+
+// startProfiler starts writing a CPU profile to cpu if it's non-empty.
+// When stop is called, heap and mutex contention profiles are written to mem
+// and mutex if they're non-empty.
+func startProfiler(cpu, mem, mutex string) (*profiler, error) {
+	p := &profiler{mem: mem, mutex: mutex}
+	if cpu != "" {
+		f, err := os.Create(cpu)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		p.cpu = f
+	}
+	if mutex != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+	return p, nil
+}
+
+// stop finishes the CPU profile and writes the other profiles.
+// Subsequent calls have no effect.
+func (p *profiler) stop() error {
+	if p.done {
+		return nil
+	}
+	p.done = true
+
+	var firstErr error
+	save := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		save(p.cpu.Close())
+	}
+	if p.mem != "" {
+		runtime.GC() // get up-to-date statistics
+		save(writeProfile(p.mem, "heap"))
+	}
+	if p.mutex != "" {
+		save(writeProfile(p.mutex, "mutex"))
+	}
+	return firstErr
+}
+
+// writeProfile writes the named runtime profile to path.
+func writeProfile(path, name string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		f.Close()
+		return fmt.Errorf("%v profile: %v", name, err)
+	}
+	return f.Close()
+}
+
+// handlePprof registers net/http/pprof's handlers under /debug/pprof/ in mux.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+}
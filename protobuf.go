@@ -0,0 +1,205 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The gRPC service in grpc.go only needs a few protocol buffer types (varints,
+// strings, bytes, embedded messages, and packed repeated varints), so they're
+// encoded and decoded by hand rather than with generated code.
+
+// Protocol buffer wire types.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// pbEncoder builds an encoded protocol buffer message.
+// Fields with default values are omitted, as in proto3.
+type pbEncoder struct {
+	b []byte
+}
+
+// tag appends the key for the supplied field number and wire type.
+func (e *pbEncoder) tag(field, wire int) {
+	e.b = appendVarint(e.b, uint64(field)<<3|uint64(wire))
+}
+
+// uint appends a varint field.
+func (e *pbEncoder) uint(field int, v uint64) {
+	if v != 0 {
+		e.tag(field, pbVarint)
+		e.b = appendVarint(e.b, v)
+	}
+}
+
+// int appends an int64 field.
+func (e *pbEncoder) int(field int, v int64) { e.uint(field, uint64(v)) }
+
+// bool appends a bool field.
+func (e *pbEncoder) bool(field int, v bool) {
+	if v {
+		e.uint(field, 1)
+	}
+}
+
+// bytes appends a bytes field.
+func (e *pbEncoder) bytes(field int, b []byte) {
+	if len(b) > 0 {
+		e.tag(field, pbBytes)
+		e.b = appendVarint(e.b, uint64(len(b)))
+		e.b = append(e.b, b...)
+	}
+}
+
+// str appends a string field.
+func (e *pbEncoder) str(field int, s string) { e.bytes(field, []byte(s)) }
+
+// msg appends an embedded message field. Unlike other fields, it's written
+// even if m is empty so that elements of repeated fields aren't lost.
+func (e *pbEncoder) msg(field int, m *pbEncoder) {
+	e.tag(field, pbBytes)
+	e.b = appendVarint(e.b, uint64(len(m.b)))
+	e.b = append(e.b, m.b...)
+}
+
+// packed appends a packed repeated varint field.
+func (e *pbEncoder) packed(field int, vs []uint64) {
+	var p pbEncoder
+	for _, v := range vs {
+		p.b = appendVarint(p.b, v)
+	}
+	e.bytes(field, p.b)
+}
+
+// appendVarint appends the varint encoding of v to b.
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// pbValue holds a decoded field value.
+type pbValue struct {
+	wire int
+	n    uint64 // for pbVarint, pbFixed64, and pbFixed32
+	b    []byte // for pbBytes
+}
+
+// pbMessage holds a decoded protocol buffer message's fields,
+// keyed by field number.
+type pbMessage map[int][]pbValue
+
+// errBadProto is returned when a message can't be decoded.
+var errBadProto = errors.New("malformed message")
+
+// decodeProto decodes the protocol buffer message in b.
+func decodeProto(b []byte) (pbMessage, error) {
+	m := make(pbMessage)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key>>3 == 0 || key>>3 > 1<<29 {
+			return nil, errBadProto
+		}
+		b = b[n:]
+		v := pbValue{wire: int(key & 7)}
+		switch v.wire {
+		case pbVarint:
+			if v.n, n = binary.Uvarint(b); n <= 0 {
+				return nil, errBadProto
+			}
+			b = b[n:]
+		case pbFixed64:
+			if len(b) < 8 {
+				return nil, errBadProto
+			}
+			v.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case pbFixed32:
+			if len(b) < 4 {
+				return nil, errBadProto
+			}
+			v.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case pbBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return nil, errBadProto
+			}
+			v.b, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", v.wire)
+		}
+		field := int(key >> 3)
+		m[field] = append(m[field], v)
+	}
+	return m, nil
+}
+
+// uint returns the last value of a varint field, or 0 if it's missing.
+func (m pbMessage) uint(field int) uint64 {
+	vs := m[field]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].wire == pbVarint {
+			return vs[i].n
+		}
+	}
+	return 0
+}
+
+// int returns the last value of an int64 field, or 0 if it's missing.
+func (m pbMessage) int(field int) int64 { return int64(m.uint(field)) }
+
+// bytes returns the last value of a bytes field, or nil if it's missing.
+func (m pbMessage) bytes(field int) []byte {
+	vs := m[field]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].wire == pbBytes {
+			return vs[i].b
+		}
+	}
+	return nil
+}
+
+// str returns the last value of a string field, or "" if it's missing.
+func (m pbMessage) str(field int) string { return string(m.bytes(field)) }
+
+// msgs decodes the values of an embedded message field.
+func (m pbMessage) msgs(field int) ([]pbMessage, error) {
+	var msgs []pbMessage
+	for _, v := range m[field] {
+		if v.wire != pbBytes {
+			continue
+		}
+		sub, err := decodeProto(v.b)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, sub)
+	}
+	return msgs, nil
+}
+
+// uints returns the values of a repeated varint field, which may be packed.
+func (m pbMessage) uints(field int) ([]uint64, error) {
+	var vals []uint64
+	for _, v := range m[field] {
+		switch v.wire {
+		case pbVarint:
+			vals = append(vals, v.n)
+		case pbBytes:
+			for b := v.b; len(b) > 0; {
+				n, l := binary.Uvarint(b)
+				if l <= 0 {
+					return nil, errBadProto
+				}
+				vals, b = append(vals, n), b[l:]
+			}
+		}
+	}
+	return vals, nil
+}
@@ -0,0 +1,355 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// servePage is the terminal page served at "/". It connects to "/ws",
+// appends received text to the page, and sends entered lines. The page's
+// query parameters (e.g. "?token=x") are passed along to "/ws".
+const servePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Synacor Challenge</title>
+<style>
+body { background: #111; color: #ccc; margin: 0; }
+#out { font: 14px/1.4 monospace; margin: 0; padding: 1em; white-space: pre-wrap; }
+#in { background: #111; border: none; color: #fff; font: bold 14px/1.4 monospace;
+  outline: none; padding: 0 1em 1em; width: calc(100% - 2em); }
+.in { color: #fff; font-weight: bold; }
+.host { color: #8cf; }
+</style>
+</head>
+<body>
+<pre id="out"></pre>
+<input id="in" autofocus autocomplete="off" spellcheck="false">
+<script>
+const out = document.getElementById('out');
+const input = document.getElementById('in');
+const hist = [];
+let histPos = 0;
+
+function append(text, cls) {
+  const node = cls ? document.createElement('span') : document.createTextNode(text);
+  if (cls) {
+    node.className = cls;
+    node.textContent = text;
+  }
+  out.appendChild(node);
+  window.scrollTo(0, document.body.scrollHeight);
+}
+
+const ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') +
+    location.host + '/ws' + location.search);
+ws.onmessage = (e) => append(e.data);
+ws.onclose = () => {
+  append('\n[Disconnected]\n', 'host');
+  input.disabled = true;
+};
+
+input.addEventListener('keydown', (e) => {
+  if (e.key === 'Enter') {
+    const ln = input.value;
+    input.value = '';
+    append(ln + '\n', 'in');
+    if (ln !== '' && hist[hist.length - 1] !== ln) hist.push(ln);
+    histPos = hist.length;
+    ws.send(ln + '\n');
+  } else if (e.key === 'ArrowUp' && histPos > 0) {
+    input.value = hist[--histPos];
+    e.preventDefault();
+  } else if (e.key === 'ArrowDown' && histPos < hist.length) {
+    input.value = ++histPos < hist.length ? hist[histPos] : '';
+    e.preventDefault();
+  }
+});
+document.addEventListener('click', () => {
+  if (!window.getSelection().toString()) input.focus();
+});
+</script>
+</body>
+</html>
+`
+
+// server serves VMs to web browsers and REST API clients.
+type server struct {
+	snap *snapshot // initial state for new sessions
+	msg  io.Writer // receives log messages
+
+	maxSessions int           // if positive, maximum number of concurrent sessions
+	maxIPS      int           // if positive, maximum instructions per second per session
+	saveMem     int           // maximum bytes of saved states per API session
+	idle        time.Duration // if positive, delete sessions after this long without activity
+	users       *userStore    // if non-nil, stores users' saves
+	pprof       bool          // serve Go profiles under /debug/pprof/
+
+	mu       sync.Mutex
+	sessions map[string]*serverSession // keyed by ID, guarded by mu
+}
+
+// serverSession describes a WebSocket connection or REST API session.
+type serverSession struct {
+	id      string
+	kind    string // "ws" or "api"
+	remote  string // client's address
+	created time.Time
+	vm      *vm
+	api     *apiSession // non-nil for API sessions
+	user    string      // authenticated user (see userStore), or empty
+	end     func()      // halts the program and disconnects the client
+	used    time.Time   // time of last activity, guarded by server.mu
+}
+
+func newServer(snap *snapshot, msg io.Writer) *server {
+	return &server{snap: snap, msg: msg, sessions: make(map[string]*serverSession)}
+}
+
+// serve listens at addr and serves a terminal page to web browsers and
+// the REST API described by apiHelp. Each WebSocket connection and API
+// session gets its own VM starting from srv.snap.
+func (srv *server) serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, servePage)
+	})
+	mux.HandleFunc("/api/", srv.serveAPI)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgradeWebSocket(w, r)
+		if err != nil {
+			fmt.Fprintf(srv.msg, "%v: %v\n", r.RemoteAddr, err)
+			return
+		}
+		srv.runWebSocket(c, r)
+	})
+	if srv.pprof {
+		handlePprof(mux)
+	}
+	fmt.Fprintf(srv.msg, "Serving at http://%v/\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// newVM returns an unstarted VM in the initial state.
+func (srv *server) newVM() *vm {
+	vm := &vm{maxIPS: srv.maxIPS}
+	vm.initChans()
+	vm.restore(srv.snap)
+	return vm
+}
+
+// user returns the user making r. Tokens are checked against srv.users if
+// it's non-nil; otherwise any token is accepted.
+// errNoUser is returned if r doesn't contain a valid token.
+func (srv *server) user(r *http.Request) (string, error) {
+	if srv.users != nil {
+		return srv.users.user(r)
+	}
+	return tokenUser(r, nil)
+}
+
+// errTooManySessions is returned by add when srv.maxSessions is reached.
+var errTooManySessions = errors.New("too many sessions")
+
+// newSessionID returns a random ID for a new session.
+func newSessionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// add registers ss, setting its creation and activity times.
+// errTooManySessions is returned if srv.maxSessions has been reached.
+func (srv *server) add(ss *serverSession) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.maxSessions > 0 && len(srv.sessions) >= srv.maxSessions {
+		fmt.Fprintf(srv.msg, "%v: %v\n", ss.remote, errTooManySessions)
+		return errTooManySessions
+	}
+	ss.created = time.Now()
+	ss.used = ss.created
+	srv.sessions[ss.id] = ss
+	fmt.Fprintf(srv.msg, "Session %v (%v) started by %v\n", ss.id, ss.kind, ss.remote)
+	return nil
+}
+
+// get returns the session with the supplied ID and records activity in it.
+// nil is returned if the session doesn't exist.
+func (srv *server) get(id string) *serverSession {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	ss := srv.sessions[id]
+	if ss != nil {
+		ss.used = time.Now()
+	}
+	return ss
+}
+
+// touch records activity in ss.
+func (srv *server) touch(ss *serverSession) {
+	srv.mu.Lock()
+	ss.used = time.Now()
+	srv.mu.Unlock()
+}
+
+// remove unregisters ss (if it's still registered) and ends it.
+// reason is logged.
+func (srv *server) remove(ss *serverSession, reason string) {
+	srv.mu.Lock()
+	found := srv.sessions[ss.id] == ss
+	if found {
+		delete(srv.sessions, ss.id)
+	}
+	srv.mu.Unlock()
+	if found {
+		fmt.Fprintf(srv.msg, "Session %v ended: %v\n", ss.id, reason)
+		ss.end()
+	}
+}
+
+// snapshot returns the session's state, waiting up to timeout for the
+// program to stop. errRunning is returned if it doesn't.
+func (ss *serverSession) snapshot(timeout time.Duration) (*snapshot, error) {
+	if ss.api != nil {
+		return ss.api.snapshot(timeout)
+	}
+	var snap *snapshot
+	if !ss.vm.doWithin(func() { snap = ss.vm.snapshot() }, timeout) {
+		return nil, errRunning
+	}
+	return snap, nil
+}
+
+// expireMinInterval is the minimum time between checks for idle sessions.
+const expireMinInterval = time.Second
+
+// expire periodically removes sessions that have been idle for srv.idle.
+// It returns when done is closed.
+func (srv *server) expire(done <-chan struct{}) {
+	interval := srv.idle / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	} else if interval < expireMinInterval {
+		interval = expireMinInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var idle []*serverSession
+		srv.mu.Lock()
+		for _, ss := range srv.sessions {
+			if time.Since(ss.used) >= srv.idle {
+				idle = append(idle, ss)
+			}
+		}
+		srv.mu.Unlock()
+		for _, ss := range idle {
+			srv.remove(ss, "idle")
+		}
+	}
+}
+
+// runWebSocket runs a new VM, connecting it to c, which was upgraded from r.
+// Messages from c are sent to the program as input. It returns when the
+// program halts or the connection is closed.
+//
+// If r has a token, the session belongs to its user. With srv.users, the
+// program is resumed from the user's save named by r's "save" parameter
+// (userAutosave by default), and the program's state is saved to
+// userAutosave when the connection is closed.
+func (srv *server) runWebSocket(c *wsConn, r *http.Request) {
+	vm := srv.newVM()
+	var user, saveName string
+	var snap *snapshot
+	var err error
+	if r.URL.Query().Get("token") != "" || r.Header.Get("Authorization") != "" {
+		if user, err = srv.user(r); err == nil && srv.users != nil {
+			if saveName = r.URL.Query().Get("save"); saveName == "" {
+				saveName = userAutosave
+			}
+			snap, err = srv.users.load(user, saveName)
+			if err == errNoSave && saveName == userAutosave {
+				err = nil // new users start at the beginning
+			}
+		}
+	}
+	var id string
+	if err == nil {
+		id, err = newSessionID()
+	}
+	ss := &serverSession{id: id, kind: "ws", remote: r.RemoteAddr, vm: vm, user: user, end: vm.halt}
+	if err == nil {
+		err = srv.add(ss)
+	}
+	if err != nil {
+		c.writeFrame(wsText, []byte(err.Error()+"\n"))
+		c.close()
+		return
+	}
+
+	w := newWSWriter(c)
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			_, data, err := c.readMessage()
+			if err != nil {
+				pw.Close()
+				vm.halt()
+				return
+			}
+			srv.touch(ss)
+			if _, err := pw.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Meta-commands are disabled since they could touch the server's files.
+	sess := &session{vm: vm, onEOF: eofHalt, msg: w}
+	if snap != nil {
+		sess.restore(snap)
+		fmt.Fprintf(w, "Resumed from save %q\n", saveName)
+	}
+	runErr := sess.run(pr, w)
+	if runErr != nil {
+		fmt.Fprintf(w, "\n%v\n", runErr)
+	}
+	pw.Close() // end input if the program halted on its own
+	if srv.users != nil && user != "" && (vm.reason == haltQuit || vm.reason == haltInput) {
+		if err := srv.users.save(user, userAutosave, sess.snapshot()); err != nil {
+			fmt.Fprintf(srv.msg, "Session %v: failed saving state: %v\n", ss.id, err)
+		}
+	}
+	err = w.flush()
+	c.close()
+
+	reason := "disconnected"
+	if runErr != nil {
+		reason = runErr.Error()
+	} else if err != nil {
+		reason = err.Error()
+	}
+	srv.remove(ss, reason)
+}
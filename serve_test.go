@@ -0,0 +1,178 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server running a program that echoes its input.
+func newTestServer(t *testing.T) *server {
+	words, err := assemble(strings.NewReader("loop: in r0\nout r0\njmp loop"), nil)
+	if err != nil {
+		t.Fatal("Assembling failed: ", err)
+	}
+	vm, err := newVM(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.size = copy(vm.mem[:], words)
+	srv := newServer(vm.snapshot(), ioutil.Discard)
+	t.Cleanup(func() {
+		for _, ss := range srv.sessions {
+			srv.remove(ss, "test finished")
+		}
+	})
+	return srv
+}
+
+// apiRequest sends a request to srv's API with the supplied token (if
+// non-empty) and returns the response's status code and body.
+func apiRequest(srv *server, method, path, token string) (int, string) {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	srv.serveAPI(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAPISessionOwnership(t *testing.T) {
+	srv := newTestServer(t)
+
+	if code, _ := apiRequest(srv, http.MethodPost, "/api/sessions", ""); code != http.StatusUnauthorized {
+		t.Errorf("Creating session without token returned %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, body := apiRequest(srv, http.MethodPost, "/api/sessions", "alice")
+	if code != http.StatusCreated {
+		t.Fatalf("Creating session returned %d: %s", code, body)
+	}
+	var created struct{ ID string }
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("Bad response %q: %v", body, err)
+	}
+
+	for _, tc := range []struct {
+		token string
+		n     int // sessions listed
+	}{
+		{"alice", 1},
+		{"bob", 0},
+	} {
+		code, body := apiRequest(srv, http.MethodGet, "/api/sessions", tc.token)
+		var infos []apiSessionInfo
+		if code != http.StatusOK {
+			t.Errorf("Listing sessions as %v returned %d: %s", tc.token, code, body)
+		} else if err := json.Unmarshal([]byte(body), &infos); err != nil {
+			t.Errorf("Bad list for %v %q: %v", tc.token, body, err)
+		} else if len(infos) != tc.n {
+			t.Errorf("Listing sessions as %v returned %d session(s); want %d", tc.token, len(infos), tc.n)
+		}
+	}
+	if code, _ := apiRequest(srv, http.MethodGet, "/api/sessions", ""); code != http.StatusUnauthorized {
+		t.Errorf("Listing sessions without token returned %d; want %d", code, http.StatusUnauthorized)
+	}
+
+	path := "/api/sessions/" + created.ID
+	for _, tc := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{http.MethodGet, path, "", http.StatusUnauthorized},
+		{http.MethodGet, path, "bob", http.StatusNotFound},
+		{http.MethodGet, path + "/regs", "bob", http.StatusNotFound},
+		{http.MethodPost, path + "/input", "bob", http.StatusNotFound},
+		{http.MethodDelete, path, "bob", http.StatusNotFound},
+		{http.MethodGet, path, "alice", http.StatusOK},
+		{http.MethodDelete, path, "alice", http.StatusNoContent},
+	} {
+		if code, body := apiRequest(srv, tc.method, tc.path, tc.token); code != tc.code {
+			t.Errorf("%v %v as %q returned %d (%q); want %d",
+				tc.method, tc.path, tc.token, code, strings.TrimSpace(body), tc.code)
+		}
+	}
+}
+
+func TestAPIUploadTooLarge(t *testing.T) {
+	srv := newTestServer(t)
+	for _, tc := range []struct {
+		desc string
+		body []byte
+	}{
+		{"compressed", gzipBomb(t, snapshotMaxBytes+1)},
+		{"uncompressed", make([]byte, apiMaxBody+1)},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/sessions", bytes.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer alice")
+		rec := httptest.NewRecorder()
+		srv.serveAPI(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Uploading %d-byte %v snapshot returned %d (%q); want %d", len(tc.body), tc.desc,
+				rec.Code, strings.TrimSpace(rec.Body.String()), http.StatusRequestEntityTooLarge)
+		}
+	}
+	if len(srv.sessions) != 0 {
+		t.Errorf("%d session(s) created", len(srv.sessions))
+	}
+}
+
+func TestExpire(t *testing.T) {
+	srv := newTestServer(t)
+	srv.idle = time.Nanosecond // checked every expireMinInterval
+	if code, body := apiRequest(srv, http.MethodPost, "/api/sessions", "alice"); code != http.StatusCreated {
+		t.Fatalf("Creating session returned %d: %s", code, body)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		srv.expire(done)
+		close(stopped)
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		srv.mu.Lock()
+		n := len(srv.sessions)
+		srv.mu.Unlock()
+		if n == 0 {
+			break
+		} else if time.Since(start) > 5*expireMinInterval {
+			t.Fatal("Idle session wasn't removed")
+		}
+	}
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("expire didn't return after done was closed")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"http://example.com:8080", true},
+		{"https://EXAMPLE.com:8080", true},
+		{"http://example.com", false},
+		{"http://evil.example.org:8080", false},
+		{"null", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/ws", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if err := checkOrigin(req); (err == nil) != tc.ok {
+			t.Errorf("checkOrigin with %q returned %v", tc.origin, err)
+		}
+	}
+}
@@ -0,0 +1,1094 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metaHelp = `Meta-commands:
+  save <slot|file>     save VM state to numbered slot or file
+  load <slot|file>     load VM state from slot (e.g. "3" or "auto1") or file
+  saves                list save slots
+  state export <file>  write VM state to file in an editable text format
+  state import <file>  load edited VM state from file and show changes
+  fork <name>          save VM state as a new branch of the current branch
+  checkout <name>      load VM state from branch
+  tree                 show tree of branches
+  undo                 undo the last command
+  redo                 redo the last undone command
+  alias [name = cmds]  list aliases or define one (e.g. "n = go north")
+  regs                 print registers, ip, and stack
+  poke <rN|addr> <val> set register or memory word
+  teleporter [set]     find r7 value for the teleporter (and set it)
+  trace on [file]      write executed instructions to stderr or file
+  trace off            stop tracing
+  help                 print this message
+`
+
+// undoEntry describes a command that can be undone or redone.
+type undoEntry struct {
+	cmd  string    // command sent to the program
+	snap *snapshot // state before (for undo) or after (for redo) cmd
+}
+
+// session runs a VM interactively, connecting it to the user's terminal.
+type session struct {
+	vm     *vm
+	dbg    *debugger // may be nil
+	prefix string    // prefix for meta-commands, or empty to disable them
+	slots  string    // directory containing save slots
+	msg    io.Writer // receives messages from the host rather than the program
+	info   gameInfo  // parsed from the program's output
+	branch string    // current branch (see fork.go); accessed within vm.do
+
+	outMu   sync.Mutex
+	outw    *bufio.Writer // buffers the program's output for out; used by writeOutput
+	outCond *sync.Cond    // signaled when nout changes or output ends
+	nout    uint64        // number of output bytes written to out, guarded by outMu
+	outDone bool          // true when the program has stopped, guarded by outMu
+	paused  bool          // output is paused by pauseOutput or pager, guarded by outMu
+	pager   *pager        // if non-nil, pages output to the terminal, guarded by outMu
+
+	busyOut   io.Writer     // if non-nil, terminal receiving busy indicator
+	busyDelay time.Duration // time without output or input before busy indicator is shown
+	busyShown bool          // busy indicator is visible, guarded by outMu
+	inputWait bool          // program is waiting for input, guarded by outMu
+
+	autosave  int           // if positive, autosave after this many commands
+	autoEvery time.Duration // if positive, also autosave at this interval
+	autoKeep  int           // number of autosave slots to rotate through
+	autoMu    sync.Mutex    // serializes autosaves and guards vm replacement
+	nauto     int           // number of autosaves written, guarded by autoMu
+	autoHash  string        // stateHash at last autosave, guarded by autoMu
+	ncmds     int           // number of lines sent to the program
+
+	undoDepth int         // maximum number of commands that can be undone
+	undo      []undoEntry // states before commands, oldest first; accessed within vm.do
+	redo      []undoEntry // states after undone commands, most recently undone last
+
+	swapMu   sync.Mutex
+	swapping bool     // hotRestore is replacing vm, guarded by swapMu
+	ended    bool     // run has returned or is about to, guarded by swapMu
+	swapped  chan *vm // receives replacement VMs from hotRestore
+
+	script   io.Reader     // if non-nil, lines are read from here and echoed before stdin
+	prompt   string        // if non-empty, written when the program waits for input
+	onEOF    string        // eofHalt, eofWait, or eofNewline
+	eofGrace time.Duration // if positive, time to wait after EOF before halting
+	expect   *expecter     // non-nil if expectCmds is non-empty
+	expCmds  []*expectCmd
+	expErr   error    // set if the expect script failed
+	aliases  aliasMap // if non-nil, expanded in input lines
+	loadCmd  string   // if non-empty, sent to the program after loading a state
+	cmdSep   string   // if non-empty, separates commands in input lines
+
+	lineMu    sync.Mutex  // serializes handling of input lines from different sources
+	inputDone bool        // stdin has been closed, guarded by lineMu
+	injected  chan string // if non-nil, receives lines from other programs; see inject.go
+
+	traceFile *os.File      // file receiving trace, or nil; accessed within vm.do
+	traceBuf  *bufio.Writer // buffers writes to traceFile
+
+	rec   *inputRecorder // if non-nil, records input lines
+	vcr   *vcr           // if non-nil, records or plays back the session
+	trans *transcript    // if non-nil, records input and output
+	out   io.Writer      // receives the program's output
+
+	outDelay time.Duration // if positive, time to pause after writing each byte of output
+
+	idleDelay time.Duration // if positive, report when the program waits this long for input
+	idleCmd   []string      // if non-empty, command and args run when idleDelay elapses
+	idleMu    sync.Mutex
+	idleTimer *time.Timer // guarded by idleMu
+
+	timer  *speedTimer   // if non-nil, records splits when codes are found
+	notify *codeNotifier // if non-nil, reports codes when they're found
+	status *statusLine   // if non-nil, updated when the program waits for input
+
+	plugins   []*plugin // see plugin.go
+	filtering bool      // a plugin filters output
+	filterBuf []rune    // output waiting to be filtered, accessed by writeOutput
+}
+
+// run runs s.vm until it stops, sending lines read from stdin to it and
+// copying its output to stdout.
+func (s *session) run(stdin io.Reader, stdout io.Writer) error {
+	s.out = stdout
+	s.outw = bufio.NewWriter(stdout)
+	s.outCond = sync.NewCond(&s.outMu)
+	s.swapped = make(chan *vm)
+	vm := s.vm // s.vm is only written by hotRestore while we wait for it
+	if s.prompt != "" || s.idleDelay > 0 || s.busyOut != nil || s.status != nil {
+		vm.onBlock = s.waiting
+	}
+	if s.pager != nil && s.expect == nil && s.script == nil {
+		// Keys are read as soon as readInput starts, so page output that the
+		// program writes before then.
+		s.pager.enabled = true
+		s.pager.reset()
+	}
+	go s.readInput(stdin)
+	if s.injected != nil {
+		go func() {
+			for ln := range s.injected {
+				s.processLine(ln, true)
+			}
+		}()
+	}
+
+	if s.busyOut != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.showBusy(stop)
+	}
+
+	if s.autoEvery > 0 {
+		t := time.NewTicker(s.autoEvery)
+		stop := make(chan struct{})
+		defer func() {
+			t.Stop()
+			close(stop)
+		}()
+		go func() {
+			for {
+				select {
+				case <-t.C:
+					s.autosaveState()
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		v := vm // vm is reassigned while v's goroutine may still be running
+		vm.output = func(p []byte) { s.writeOutput(v, p) }
+		vm.start()
+		err := vm.wait()
+		s.outMu.Lock()
+		s.outDone = true
+		s.outCond.Broadcast()
+		s.outMu.Unlock()
+
+		s.swapMu.Lock()
+		swapping := s.swapping
+		s.ended = !swapping
+		s.swapMu.Unlock()
+		if !swapping {
+			if s.expect != nil {
+				s.expect.end()
+			}
+			if terr := s.stopTrace(); terr != nil {
+				fmt.Fprintf(s.msg, "Failed writing trace: %v\n", terr)
+			}
+			return err
+		}
+		vm = <-s.swapped
+		s.swapMu.Lock()
+		s.swapping = false
+		s.swapMu.Unlock()
+		s.outMu.Lock()
+		s.nout, s.outDone = 0, false
+		s.outMu.Unlock()
+	}
+}
+
+// writeOutput passes the program's output p to the session's consumers and
+// writes it to s.out. It's called by vm on its goroutine after newlines and
+// before the program waits for input or stops, so the program is blocked
+// while output is paused.
+func (s *session) writeOutput(vm *vm, p []byte) {
+	if s.busyOut != nil {
+		s.clearBusy()
+	}
+	var unflushed uint64 // bytes handled but not written to s.out
+	flush := func() {
+		s.outMu.Lock()
+		for s.paused {
+			s.outCond.Wait()
+		}
+		s.outMu.Unlock()
+		s.outw.Flush()
+		s.outMu.Lock()
+		s.nout += unflushed
+		s.outCond.Broadcast()
+		s.outMu.Unlock()
+		unflushed = 0
+	}
+
+	for i, v := range p {
+		s.handleOutput(vm, s.outw, v, i == len(p)-1)
+		unflushed++
+
+		s.outMu.Lock()
+		page := s.pager != nil && s.pager.output(v)
+		paused := s.paused
+		s.outMu.Unlock()
+		if page || paused {
+			flush()
+		}
+		if page {
+			s.outMu.Lock()
+			fmt.Fprint(s.out, pagerPrompt)
+			s.paused = true
+			for s.paused {
+				s.outCond.Wait()
+			}
+			s.outMu.Unlock()
+		}
+	}
+	flush()
+}
+
+// handleOutput passes the program's output byte v to the session's
+// consumers and writes it to w. last is true if v ends a batch of output.
+func (s *session) handleOutput(vm *vm, w *bufio.Writer, v byte, last bool) {
+	for _, c := range s.info.write(v) {
+		if s.timer != nil {
+			s.timer.split(c, vm)
+		}
+		if vm.ctrace != nil {
+			vm.ctrace.instant("code "+c, "code")
+		}
+		if s.notify != nil {
+			s.notify.notify(c, vm)
+		}
+	}
+	if s.trans != nil {
+		s.trans.output(v)
+	}
+	if s.expect != nil {
+		s.expect.output(v)
+	}
+	if s.vcr == nil || s.vcr.output(v) {
+		switch {
+		case s.filtering:
+			if s.filterBuf = append(s.filterBuf, rune(v)); v == '\n' || last {
+				s.display(w, s.filterOutput(string(s.filterBuf)))
+				s.filterBuf = s.filterBuf[:0]
+			}
+		case s.outDelay > 0:
+			s.display(w, string(rune(v)))
+		default:
+			w.WriteRune(rune(v))
+		}
+	}
+}
+
+// display writes the program's output str to w.
+func (s *session) display(w *bufio.Writer, str string) {
+	if s.outDelay <= 0 {
+		w.WriteString(str)
+		return
+	}
+	for _, r := range str {
+		w.WriteRune(r)
+		w.Flush()
+		time.Sleep(s.outDelay)
+	}
+}
+
+// filterOutput passes the program's output str through plugins' filters.
+func (s *session) filterOutput(str string) string {
+	for _, p := range s.plugins {
+		if p.reg.Filter {
+			str = p.filter(str)
+		}
+	}
+	return str
+}
+
+// addPlugin registers p's hooks and filter.
+func (s *session) addPlugin(p *plugin) {
+	s.plugins = append(s.plugins, p)
+	s.filtering = s.filtering || p.reg.Filter
+	if len(p.reg.Hooks) > 0 && s.vm.hooks == nil {
+		s.vm.hooks = make(map[uint16][]func(*vm))
+	}
+	for _, addr := range p.reg.Hooks {
+		s.vm.hooks[addr] = append(s.vm.hooks[addr], p.hook)
+	}
+}
+
+// readInput runs the expect script (if any) and reads lines from s.script and
+// then r, passing them to the debugger (if paused), the meta-command handler,
+// or the program until EOF is reached.
+func (s *session) readInput(r io.Reader) {
+	if s.expect != nil {
+		s.expErr = s.runExpect(s.expCmds)
+		s.expect.end()
+	}
+	if s.expErr != nil {
+		fmt.Fprintf(s.msg, "Expect script failed: %v\n", s.expErr)
+		s.vm.halt()
+	} else {
+		if s.script != nil {
+			s.readLines(s.script, true)
+		}
+		s.outMu.Lock()
+		if s.pager != nil && !s.pager.enabled {
+			s.pager.enabled = true // keys can be read now
+			s.pager.reset()
+		}
+		s.outMu.Unlock()
+		s.readLines(r, false)
+		s.handleEOF()
+	}
+
+	// Don't leave output stuck if input ended while it was paused.
+	s.outMu.Lock()
+	s.paused, s.pager = false, nil
+	s.outCond.Broadcast()
+	s.outMu.Unlock()
+
+	// Let the program consume buffered input before stopping.
+	s.lineMu.Lock()
+	s.inputDone = true
+	s.vm.in.close()
+	if s.dbg != nil {
+		close(s.dbg.lines)
+	}
+	s.lineMu.Unlock()
+}
+
+// Values for session.onEOF.
+const (
+	eofHalt    = "halt"    // halt when the program next reads input
+	eofWait    = "wait"    // wait for the program to halt
+	eofNewline = "newline" // send empty lines until the program halts
+)
+
+// handleEOF is called when the end of input is reached. If s.onEOF is eofWait
+// or eofNewline, it waits for the program to stop, halting it if s.eofGrace
+// is positive and elapses first.
+func (s *session) handleEOF() {
+	if s.onEOF != eofWait && s.onEOF != eofNewline {
+		return
+	}
+	var expired <-chan time.Time
+	if s.eofGrace > 0 {
+		t := time.NewTimer(s.eofGrace)
+		defer t.Stop()
+		expired = t.C
+	}
+	if s.onEOF == eofWait {
+		select {
+		case <-s.vm.stopped:
+		case <-expired:
+			s.vm.halt()
+		}
+		return
+	}
+	for {
+		// Wait for the program to read input before sending each line.
+		waiting := make(chan bool, 1)
+		go func() { waiting <- s.vm.do(func() {}) }()
+		select {
+		case ok := <-waiting:
+			if !ok {
+				return
+			}
+			s.lineMu.Lock()
+			s.handleLine("\n")
+			s.lineMu.Unlock()
+		case <-expired:
+			s.vm.halt()
+			return
+		}
+	}
+}
+
+// readLines handles lines read from r until EOF is reached. If script is
+// true, each line is echoed after the program handles the preceding input,
+// and a final line without a trailing newline is also handled.
+func (s *session) readLines(r io.Reader, script bool) {
+	br := bufio.NewReader(r)
+	for {
+		ln, err := br.ReadString('\n')
+		if err == io.EOF {
+			if !script || ln == "" {
+				break
+			}
+			ln += "\n"
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Input failed: %v\n", err)
+			os.Exit(1)
+		}
+		s.processLine(ln, script)
+	}
+}
+
+// processLine passes ln to the debugger (if paused), the meta-command handler,
+// or the program, splitting it into multiple commands and expanding aliases.
+// If echo is true, ln is first echoed after the program handles the preceding
+// input. Lines from different sources are handled one at a time.
+func (s *session) processLine(ln string, echo bool) {
+	s.lineMu.Lock()
+	defer s.lineMu.Unlock()
+
+	if s.inputDone {
+		return
+	}
+	if echo {
+		s.echoInput(ln)
+	}
+	if s.dbg != nil && s.dbg.feed(ln) {
+		return
+	}
+	for i, cmd := range s.splitLine(ln) {
+		if i > 0 {
+			s.vm.do(func() {}) // wait for the program to read the previous command
+		}
+		if s.aliases == nil || strings.HasPrefix(cmd, literalPrefix) {
+			s.handleLine(cmd)
+			continue
+		}
+		for _, ln := range s.aliases.expand(cmd) {
+			s.handleLine(ln)
+		}
+	}
+}
+
+// splitLine splits ln (ending in a newline) into commands separated by
+// s.cmdSep, each ending in a newline. Meta-commands and literal lines aren't
+// split.
+func (s *session) splitLine(ln string) []string {
+	if s.cmdSep == "" || !strings.Contains(ln, s.cmdSep) ||
+		strings.HasPrefix(ln, literalPrefix) || (s.prefix != "" && strings.HasPrefix(ln, s.prefix)) {
+		return []string{ln}
+	}
+	var cmds []string
+	for _, c := range strings.Split(ln, s.cmdSep) {
+		if c = strings.TrimSpace(c); c != "" {
+			cmds = append(cmds, c+"\n")
+		}
+	}
+	return cmds
+}
+
+// pauseOutput pauses or resumes copying the program's output. The program
+// stops running if it writes more output while paused.
+func (s *session) pauseOutput(paused bool) {
+	s.outMu.Lock()
+	s.paused = paused
+	s.outCond.Broadcast()
+	s.outMu.Unlock()
+}
+
+// interrupt halts the program right away, even if it's computing rather than
+// waiting for input. It's called when Ctrl-C is pressed.
+func (s *session) interrupt() {
+	s.autoMu.Lock() // s.vm may be replaced by hotRestore
+	vm := s.vm
+	s.autoMu.Unlock()
+	vm.halt()
+
+	// Don't leave the program blocked writing output.
+	s.outMu.Lock()
+	s.paused, s.pager = false, nil
+	s.outCond.Broadcast()
+	s.outMu.Unlock()
+}
+
+// pagerKey passes r to s.pager if it's waiting for a key, resuming output.
+// False is returned if r wasn't consumed.
+func (s *session) pagerKey(r rune) bool {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if s.pager == nil || !s.pager.waiting {
+		return false
+	}
+	fmt.Fprint(s.out, "\r\x1b[K") // erase pagerPrompt
+	s.pager.key(r)
+	s.paused = false
+	s.outCond.Broadcast()
+	return r != ctrl('c')
+}
+
+// literalPrefix starts input lines that are sent to the program without
+// alias expansion or meta-command handling, e.g. `\n` sends "n" even if "n"
+// is an alias.
+const literalPrefix = "\\"
+
+// inputWarnSize is the number of bytes of unread input above which the
+// user is told that the program isn't keeping up.
+const inputWarnSize = 4096
+
+// handleLine passes ln to the meta-command handler or the program.
+func (s *session) handleLine(ln string) {
+	literal := strings.HasPrefix(ln, literalPrefix)
+	meta := !literal && s.prefix != "" && strings.HasPrefix(ln, s.prefix)
+	if s.trans != nil {
+		if meta {
+			// Don't wait long, since the command may be needed to load
+			// a new state into a busy program.
+			s.vm.doWithin(s.waitOutput, hotRestoreDelay)
+		} else {
+			s.vm.do(s.waitOutput)
+		}
+		if err := s.trans.input(ln); err != nil {
+			fmt.Fprintf(s.msg, "Failed writing transcript: %v\n", err)
+		}
+	}
+	if meta {
+		s.meta(strings.TrimPrefix(ln, s.prefix))
+		return
+	}
+	if s.vcr != nil {
+		s.vcrInput(ln)
+	}
+	send := ln
+	if literal {
+		send = strings.TrimPrefix(ln, literalPrefix)
+	}
+	if s.undoDepth > 0 {
+		s.vm.do(func() {
+			if len(s.undo) == s.undoDepth {
+				s.undo = s.undo[1:]
+			}
+			s.undo = append(s.undo, undoEntry{strings.TrimSpace(send), s.snapshot()})
+			s.redo = nil
+		})
+	}
+	s.outMu.Lock()
+	if s.pager != nil {
+		s.pager.reset()
+	}
+	s.outMu.Unlock()
+	s.stopIdleTimer()
+	if s.status != nil {
+		s.status.command()
+	}
+	if s.busyOut != nil {
+		s.outMu.Lock()
+		s.inputWait = false
+		s.outMu.Unlock()
+	}
+	if n := s.vm.in.write([]byte(send)); n > inputWarnSize && n-len(send) <= inputWarnSize {
+		fmt.Fprintf(s.msg, "%d bytes of input are waiting for the program\n", n)
+	}
+	if s.rec != nil {
+		if err := s.rec.input(ln); err != nil {
+			fmt.Fprintf(s.msg, "Failed recording input: %v\n", err)
+		}
+	}
+	s.ncmds++
+	if s.autosave > 0 && s.ncmds%s.autosave == 0 {
+		s.autosaveState()
+	}
+}
+
+// waiting is called on the VM's goroutine when the program waits for input.
+// It writes s.prompt after the program's output and starts the idle timer.
+func (s *session) waiting() {
+	if s.busyOut != nil {
+		s.outMu.Lock()
+		s.inputWait = true
+		s.outMu.Unlock()
+	}
+	if s.status != nil {
+		s.waitOutput()
+		s.status.draw(&s.info)
+	}
+	if s.prompt != "" {
+		s.waitOutput()
+		fmt.Fprint(s.out, s.prompt)
+	}
+	if s.idleDelay > 0 {
+		s.startIdleTimer()
+	}
+}
+
+// echoInput writes ln to s.out once the program has handled earlier input,
+// so that scripted input appears as if it had been typed.
+func (s *session) echoInput(ln string) {
+	if s.dbg == nil || !s.dbg.paused() {
+		s.vm.do(s.waitOutput)
+	}
+	fmt.Fprint(s.out, ln)
+}
+
+// meta handles the meta-command line ln (without its prefix).
+func (s *session) meta(ln string) {
+	fields := strings.Fields(ln)
+	if len(fields) == 0 {
+		s.writeHelp()
+		return
+	}
+	cmd, args := fields[0], fields[1:]
+	if err := s.execMeta(cmd, args); err != nil {
+		fmt.Fprintf(s.msg, "%s: %v\n", cmd, err)
+	}
+}
+
+// execMeta executes the meta-command cmd with arguments args.
+func (s *session) execMeta(cmd string, args []string) error {
+	switch cmd {
+	case "save", "load":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s%s <slot|file>", s.prefix, cmd)
+		}
+		p, desc := args[0], args[0]
+		if p == stdioPath {
+			return fmt.Errorf("can't use stdin or stdout while running")
+		}
+		if sp, ok := slotPath(s.slots, p); ok {
+			if cmd == "save" && strings.HasPrefix(p, autoSlotPrefix) {
+				return fmt.Errorf("autosave slots are read-only")
+			}
+			p, desc = sp, "slot "+p
+			if cmd == "save" {
+				if err := os.MkdirAll(s.slots, 0755); err != nil {
+					return err
+				}
+			}
+		}
+		if cmd == "save" {
+			var err error
+			if derr := s.doMeta(func() { err = saveSnapshotFile(p, s.snapshot()) }); derr != nil {
+				return derr
+			}
+			if err == nil {
+				fmt.Fprintln(s.msg, "Saved state to", desc)
+			}
+			return err
+		}
+		snap, err := loadSnapshotFile(p)
+		if err != nil {
+			return err
+		}
+		hot, err := s.load(snap)
+		if err != nil {
+			return err
+		}
+		s.note("state loaded from " + desc + "; replay will diverge")
+		if hot {
+			desc += " (program was busy and has been restarted)"
+		}
+		fmt.Fprintln(s.msg, "Loaded state from", desc)
+		s.sendLoadCmd()
+		return nil
+	case "saves":
+		slots, err := listSlots(s.slots)
+		if err != nil {
+			return err
+		}
+		if len(slots) == 0 {
+			fmt.Fprintln(s.msg, "No saved slots in", s.slots)
+		}
+		for _, sl := range slots {
+			m := sl.meta
+			fmt.Fprintf(s.msg, "%6s  %s  %11d steps  %d code(s)  %s\n", sl.name,
+				m.Time.Format("2006-01-02 15:04:05"), m.Steps, len(m.Codes), describeState(m))
+		}
+		return nil
+	case "state":
+		if len(args) != 2 || (args[0] != "export" && args[0] != "import") {
+			return fmt.Errorf("usage: %sstate <export|import> <file>", s.prefix)
+		}
+		p := args[1]
+		var err error
+		if derr := s.doMeta(func() {
+			if args[0] == "export" {
+				if err = writeSnapshotFile(p, s.snapshot(), textSnapshot); err == nil {
+					fmt.Fprintln(s.msg, "Exported state to", p)
+				}
+				return
+			}
+			var snap *snapshot
+			if snap, err = loadSnapshotFile(p); err != nil {
+				return
+			}
+			old := s.snapshot()
+			s.restore(snap)
+			s.note("state imported from " + p + "; replay will diverge")
+			fmt.Fprintln(s.msg, "Imported state from", p)
+			err = writeStateDiff(s.msg, old, snap, false)
+		}); derr != nil {
+			return derr
+		}
+		return err
+	case "fork", "checkout":
+		if len(args) != 1 || !validBranch(args[0]) {
+			return fmt.Errorf("usage: %s%s <name>", s.prefix, cmd)
+		}
+		name := args[0]
+		p := branchPath(s.slots, name)
+		if cmd == "fork" {
+			if _, err := os.Stat(p); err == nil {
+				return fmt.Errorf("branch %q already exists", name)
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+		}
+		var err error
+		if derr := s.doMeta(func() {
+			if cmd == "fork" {
+				snap := s.snapshot()
+				snap.Meta.Branch = name
+				if err = saveSnapshotFile(p, snap); err == nil {
+					s.branch = name
+				}
+			} else {
+				var snap *snapshot
+				if snap, err = loadSnapshotFile(p); err == nil {
+					s.restore(snap)
+				}
+			}
+		}); derr != nil {
+			return derr
+		}
+		if err == nil {
+			if cmd == "checkout" {
+				s.note("checked out branch " + name + "; replay will diverge")
+			} else {
+				s.note("forked branch " + name)
+			}
+			fmt.Fprintf(s.msg, "On branch %s\n", name)
+			if cmd == "checkout" {
+				s.sendLoadCmd()
+			}
+		}
+		return err
+	case "tree":
+		branches, err := listBranches(s.slots)
+		if err != nil {
+			return err
+		}
+		if len(branches) == 0 {
+			fmt.Fprintln(s.msg, "No branches in", s.slots)
+			return nil
+		}
+		var cur string
+		if err := s.doMeta(func() { cur = s.branch }); err != nil {
+			return err
+		}
+		return writeBranchTree(s.msg, branches, cur)
+	case "undo", "redo":
+		var err error
+		var ucmd, done string
+		if derr := s.doMeta(func() {
+			from, to := &s.undo, &s.redo
+			if cmd == "redo" {
+				from, to = to, from
+			}
+			if len(*from) == 0 {
+				err = fmt.Errorf("nothing to %s", cmd)
+				return
+			}
+			e := (*from)[len(*from)-1]
+			*from = (*from)[:len(*from)-1]
+			*to = append(*to, undoEntry{e.cmd, s.snapshot()})
+			s.restore(e.snap)
+			ucmd = e.cmd
+			if cmd == "undo" {
+				done = fmt.Sprintf("Undid %q", e.cmd)
+			} else {
+				done = fmt.Sprintf("Redid %q", e.cmd)
+			}
+		}); derr != nil {
+			return derr
+		}
+		if err == nil {
+			s.note(fmt.Sprintf("%s of %q; replay will diverge", cmd, ucmd))
+			fmt.Fprintln(s.msg, done)
+		}
+		return err
+	case "alias":
+		if len(args) == 0 {
+			s.aliases.write(s.msg)
+			return nil
+		}
+		if s.aliases == nil {
+			s.aliases = make(aliasMap)
+		}
+		return s.aliases.define(strings.Join(args, " "))
+	case "regs":
+		return s.doMeta(func() { writeRegs(s.msg, s.vm) })
+	case "poke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %spoke <rN|addr> <val>", s.prefix)
+		}
+		dst, err := parseWord(args[0])
+		if err != nil {
+			return fmt.Errorf("bad destination %q", args[0])
+		}
+		v, err := parseWord(args[1])
+		if err != nil {
+			return fmt.Errorf("bad value %q", args[1])
+		}
+		if derr := s.doMeta(func() { err = s.vm.setWord(dst, v) }); derr != nil {
+			return derr
+		}
+		if err == nil {
+			s.note(fmt.Sprintf("poked %s = %d; replay will diverge", args[0], v))
+		}
+		return err
+	case "teleporter":
+		if len(args) > 1 || (len(args) == 1 && args[0] != "set") {
+			return fmt.Errorf("usage: %steleporter [set]", s.prefix)
+		}
+		fmt.Fprintln(s.msg, "Searching for r7 value...")
+		ks := searchTeleporter(teleporterM, teleporterN, teleporterWant, runtime.NumCPU())
+		if len(ks) == 0 {
+			return fmt.Errorf("no value found")
+		}
+		fmt.Fprintln(s.msg, "Confirmation passes with r7 =", ks[0])
+		if len(args) == 0 {
+			return nil
+		}
+		// Also compute the check natively, since the program would never finish.
+		var err error
+		if derr := s.doMeta(func() {
+			s.vm.reg[7] = ks[0]
+			if s.vm.natives == nil {
+				_, err = s.vm.addTeleporter("auto")
+			}
+		}); derr != nil {
+			return derr
+		}
+		s.note(fmt.Sprintf("set r7 = %d for the teleporter; replay will diverge", ks[0]))
+		return err
+	case "trace":
+		if len(args) < 1 || (args[0] == "on" && len(args) > 2) ||
+			(args[0] == "off" && len(args) != 1) || (args[0] != "on" && args[0] != "off") {
+			return fmt.Errorf("usage: %strace <on [file]|off>", s.prefix)
+		}
+		var err error
+		if derr := s.doMeta(func() {
+			if err = s.stopTrace(); err != nil || args[0] == "off" {
+				return
+			}
+			if len(args) == 1 {
+				s.vm.trace = s.msg
+				return
+			}
+			if s.traceFile, err = os.Create(args[1]); err == nil {
+				s.traceBuf = bufio.NewWriter(s.traceFile)
+				s.vm.trace = s.traceBuf
+			}
+		}); derr != nil {
+			return derr
+		}
+		return err
+	case "help":
+		s.writeHelp()
+		return nil
+	default:
+		for _, p := range s.plugins {
+			if _, ok := p.reg.Commands[cmd]; ok {
+				if err := s.doMeta(func() { p.command(cmd, args, s.vm) }); err != nil {
+					return err
+				}
+				// The plugin may have changed the program's state.
+				s.note(fmt.Sprintf("ran plugin command %q; replay may diverge", cmd))
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown command (try %shelp)", s.prefix)
+	}
+}
+
+// metaTimeout is how long meta-commands wait for the program to read input
+// before giving up.
+const metaTimeout = time.Second
+
+// doMeta runs f via s.vm.doWithin for a meta-command, returning an error if
+// the program doesn't wait for input within metaTimeout. This keeps a busy
+// program from blocking input (e.g. a later /load) indefinitely.
+func (s *session) doMeta(f func()) error {
+	if s.vm.doWithin(f, metaTimeout) {
+		return nil
+	}
+	select {
+	case <-s.vm.stopped:
+		return fmt.Errorf("program stopped")
+	default:
+		return fmt.Errorf("program is busy")
+	}
+}
+
+// writeHelp lists meta-commands, including those registered by plugins.
+func (s *session) writeHelp() {
+	fmt.Fprint(s.msg, metaHelp)
+	for _, p := range s.plugins {
+		names := make([]string, 0, len(p.reg.Commands))
+		for name := range p.reg.Commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(s.msg, "  %-20s %s (%s)\n", name, p.reg.Commands[name], p.reg.Name)
+		}
+	}
+}
+
+// stopTrace stops tracing instructions and closes the trace file, if any.
+// The VM must not be executing instructions.
+func (s *session) stopTrace() error {
+	s.vm.trace = nil
+	if s.traceFile == nil {
+		return nil
+	}
+	err := s.traceBuf.Flush()
+	if cerr := s.traceFile.Close(); err == nil {
+		err = cerr
+	}
+	s.traceFile, s.traceBuf = nil, nil
+	return err
+}
+
+// sendLoadCmd sends s.loadCmd (if any) to the program without echoing it
+// so that the user can see where they are after loading a state. It isn't
+// recorded as input since it's a side effect of the meta-command.
+func (s *session) sendLoadCmd() {
+	if s.loadCmd != "" {
+		s.vm.in.write([]byte(s.loadCmd + "\n"))
+	}
+}
+
+// hotRestoreDelay is how long load waits for the program to read input
+// before replacing the VM.
+const hotRestoreDelay = 100 * time.Millisecond
+
+// load restores snap into the VM once the program waits for input. If the
+// program is busy or has stopped, the VM is replaced via hotRestore and true
+// is returned.
+func (s *session) load(snap *snapshot) (hot bool, err error) {
+	if s.vm.doWithin(func() { s.restore(snap) }, hotRestoreDelay) {
+		return false, nil
+	}
+	return true, s.hotRestore(snap)
+}
+
+// hotRestore stops s.vm and replaces it with a new VM restored from snap,
+// which run then starts in place of the old one. It must be called while
+// handling a line of input.
+func (s *session) hotRestore(snap *snapshot) error {
+	s.swapMu.Lock()
+	if s.ended {
+		s.swapMu.Unlock()
+		return fmt.Errorf("program stopped")
+	}
+	s.swapping = true
+	s.swapMu.Unlock()
+
+	old := s.vm
+	old.halt()
+	<-old.stopped
+	s.autoMu.Lock() // autosaveState may be called from another goroutine
+	s.vm = respawnVM(old)
+	s.autoMu.Unlock()
+	s.restore(snap)
+	s.swapped <- s.vm
+	return nil
+}
+
+// autosaveState saves the program's state to the next autosave slot after
+// it finishes handling the most-recently-sent command. Nothing is saved if
+// the program's state hasn't changed since the last autosave.
+func (s *session) autosaveState() {
+	s.autoMu.Lock()
+	defer s.autoMu.Unlock()
+
+	name := fmt.Sprintf("%s%d", autoSlotPrefix, s.nauto%s.autoKeep)
+	p, _ := slotPath(s.slots, name)
+	var err error
+	if err = os.MkdirAll(s.slots, 0755); err == nil {
+		s.vm.do(func() {
+			h := stateHash(s.vm)
+			if h == s.autoHash {
+				return
+			}
+			if err = saveSnapshotFile(p, s.snapshot()); err == nil {
+				s.nauto++
+				s.autoHash = h
+			}
+		})
+	}
+	if err != nil {
+		fmt.Fprintf(s.msg, "Autosave failed: %v\n", err)
+	}
+}
+
+// note records str in the input log and VCR recording, if any. It's used to
+// explain changes to the program's state that weren't caused by its input.
+func (s *session) note(str string) {
+	if s.rec != nil {
+		s.rec.note(str)
+	}
+	if s.vcr != nil {
+		if err := s.vcr.note(str); err != nil {
+			fmt.Fprintf(s.msg, "Failed recording session: %v\n", err)
+		}
+	}
+}
+
+// vcrInput passes ln to s.vcr once the program has handled all earlier input.
+func (s *session) vcrInput(ln string) {
+	var steps uint64
+	s.vm.do(func() {
+		s.waitOutput()
+		steps = s.vm.steps
+	})
+	echo, err := s.vcr.input(ln, steps)
+	if err != nil {
+		fmt.Fprintf(s.msg, "Failed recording session: %v\n", err)
+	} else if echo {
+		fmt.Fprint(s.out, ln)
+	}
+}
+
+// waitOutput waits until all output written by the VM has been handled.
+// The VM must not be executing instructions.
+func (s *session) waitOutput() {
+	s.outMu.Lock()
+	for s.nout < s.vm.nout && !s.outDone {
+		s.outCond.Wait()
+	}
+	s.outMu.Unlock()
+}
+
+// snapshot returns a snapshot of the VM's state including metadata from
+// the program's output. The VM must not be executing instructions.
+func (s *session) snapshot() *snapshot {
+	if s.outCond != nil {
+		s.waitOutput()
+	}
+	snap := s.vm.snapshot()
+	snap.Meta.Room, snap.Meta.Last, snap.Meta.Codes = s.info.get()
+	snap.Meta.Parent = s.branch
+	return snap
+}
+
+// restore restores the VM's state and output metadata from snap.
+// The VM must not be executing instructions.
+func (s *session) restore(snap *snapshot) {
+	s.vm.restore(snap)
+	s.info.set(snap.Meta.Room, snap.Meta.Last, snap.Meta.Codes)
+	s.branch = snap.Meta.Branch
+	if s.branch == "" {
+		s.branch = snap.Meta.Parent
+	}
+}
+
+// describeState returns a short description of the game state in m.
+func describeState(m snapshotMeta) string {
+	if m.Room != "" {
+		return m.Room
+	}
+	return fmt.Sprintf("%q", m.Last)
+}
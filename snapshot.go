@@ -0,0 +1,466 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshots are stored in one of three encodings:
+//
+// The binary encoding consists of snapshotMagic followed by a gob-encoded
+// snapshotHeader and a gob-encoded snapshot, which is gzip-compressed if
+// indicated by the header. Files written before the header was introduced
+// contain only the gob-encoded snapshot and are read as version 0.
+//
+// The JSON encoding is an object with "format" set to snapshotFormatName,
+// "version", and "state" containing the snapshot. It's intended to be
+// inspected by hand.
+//
+// The text encoding is described in statetext.go. It's intended to be edited
+// by hand.
+//
+// Snapshots in any encoding may additionally be wrapped in gzip
+// compression, e.g. by compressing them with an external tool.
+
+const (
+	snapshotMagic      = "SYNSNAP\x00"      // prefix of binary snapshots
+	snapshotFormatName = "synacor-snapshot" // "format" value in JSON snapshots
+	snapshotVersion    = 1                  // current version
+
+	// snapshotMaxStack is the maximum number of words in a snapshot's stack.
+	snapshotMaxStack = 1 << 22
+	// snapshotMaxBytes is the maximum decompressed size of a snapshot.
+	// The largest valid snapshot is an indented JSON object with full
+	// memory and stack, which takes about 12 bytes per word.
+	snapshotMaxBytes = 64 << 20
+)
+
+// snapshotHeader precedes the snapshot in the binary encoding.
+type snapshotHeader struct {
+	Version int
+	Gzip    bool // snapshot is gzip-compressed
+}
+
+// snapshotJSON is the top-level object in the JSON encoding.
+type snapshotJSON struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	State   *snapshot `json:"state"`
+}
+
+// snapshot holds the complete state of a stopped VM.
+// New fields must be added such that their zero values are safe when reading
+// older snapshots, or else snapshotVersion must be incremented and readSnapshot
+// updated to convert older versions.
+type snapshot struct {
+	Mem   []uint16      `json:"mem"`  // trailing zeros are omitted
+	Size  int           `json:"size"` // number of words loaded from the program
+	Reg   [nregs]uint16 `json:"reg"`
+	Stack []uint16      `json:"stack"`
+	IP    uint16        `json:"ip"`
+	Meta  snapshotMeta  `json:"meta"`
+}
+
+// snapshotMeta contains descriptive information about a snapshot.
+type snapshotMeta struct {
+	Time  time.Time `json:"time"`  // when the snapshot was created
+	Steps uint64    `json:"steps"` // instructions executed
+	Room  string    `json:"room"`  // most recent room title
+	Last  string    `json:"last"`  // last non-empty line of output
+	Codes []string  `json:"codes"` // codes seen in output
+
+	Image  string `json:"image,omitempty"`  // imageID of the program the state came from
+	Branch string `json:"branch,omitempty"` // branch name; see fork.go
+	Parent string `json:"parent,omitempty"` // parent branch name
+
+	Fault string   `json:"fault,omitempty"` // run-time error in core dumps
+	Trace []uint16 `json:"trace,omitempty"` // recently-executed addresses in core dumps
+}
+
+// snapshot returns a copy of vm's state.
+// The VM must not be executing instructions.
+func (vm *vm) snapshot() *snapshot {
+	end := len(vm.mem)
+	for end > 0 && vm.mem[end-1] == 0 {
+		end--
+	}
+	return &snapshot{
+		Mem:   append([]uint16(nil), vm.mem[:end]...),
+		Size:  vm.size,
+		Reg:   vm.reg,
+		Stack: append([]uint16(nil), vm.stack...),
+		IP:    vm.ip,
+		Meta:  snapshotMeta{Time: time.Now(), Steps: vm.steps, Image: vm.image},
+	}
+}
+
+// restore replaces vm's state with s.
+// The VM must not be executing instructions.
+func (vm *vm) restore(s *snapshot) {
+	n := copy(vm.mem[:], s.Mem)
+	for i := n; i < len(vm.mem); i++ {
+		vm.mem[i] = 0
+	}
+	vm.size = s.Size
+	vm.reg = s.Reg
+	vm.setStack(s.Stack)
+	vm.ip = s.IP
+	vm.steps = s.Meta.Steps
+	if s.Meta.Image != "" {
+		vm.image = s.Meta.Image
+	}
+	vm.pages = nil // memory no longer matches a pagedSnapshot
+}
+
+// check returns an error if s is malformed.
+func (s *snapshot) check() error {
+	if len(s.Mem) > msize {
+		return fmt.Errorf("memory has %d words", len(s.Mem))
+	}
+	if s.Size < 0 || s.Size > msize {
+		return fmt.Errorf("bad size %d", s.Size)
+	}
+	if s.IP > vmax {
+		return fmt.Errorf("bad ip %d", s.IP)
+	}
+	for i, v := range s.Reg {
+		if v > vmax {
+			return fmt.Errorf("bad r%d value %d", i, v)
+		}
+	}
+	if len(s.Stack) > snapshotMaxStack {
+		return fmt.Errorf("stack has %d words", len(s.Stack))
+	}
+	for i, v := range s.Stack {
+		if v > vmax {
+			return fmt.Errorf("bad stack value %d at depth %d", v, i)
+		}
+	}
+	return nil
+}
+
+// snapshotEncoding identifies a snapshot encoding.
+type snapshotEncoding int
+
+const (
+	gobSnapshot snapshotEncoding = iota
+	jsonSnapshot
+	textSnapshot
+)
+
+// snapshotEncodingFor returns the encoding used for the snapshot file at p:
+// JSON if it has a ".json" extension, text if it has a ".state" or ".yaml"
+// extension, and the binary encoding otherwise.
+func snapshotEncodingFor(p string) snapshotEncoding {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".json":
+		return jsonSnapshot
+	case ".state", ".yaml", ".yml":
+		return textSnapshot
+	}
+	return gobSnapshot
+}
+
+// writeSnapshot writes s to w using enc.
+func writeSnapshot(w io.Writer, s *snapshot, enc snapshotEncoding) error {
+	switch enc {
+	case jsonSnapshot:
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(snapshotJSON{snapshotFormatName, snapshotVersion, s})
+	case textSnapshot:
+		return writeStateText(w, s)
+	default:
+		bw := bufio.NewWriter(w)
+		if _, err := io.WriteString(bw, snapshotMagic); err != nil {
+			return err
+		}
+		if err := gob.NewEncoder(bw).Encode(snapshotHeader{snapshotVersion, true}); err != nil {
+			return err
+		}
+		// Memory is mostly zeros and repeated text, so it compresses well.
+		zw := gzip.NewWriter(bw)
+		if err := gob.NewEncoder(zw).Encode(s); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+}
+
+// readSnapshot reads a snapshot in any encoding from r.
+// If r is a *bufio.Reader, data following a binary snapshot remains unread.
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(2); err == nil && b[0] == 0x1f && b[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false) // leave following data unread
+		br = bufio.NewReader(&snapshotLimitReader{zr, snapshotMaxBytes})
+	}
+
+	var s snapshot
+	var version int
+	if b, err := br.Peek(len(snapshotMagic)); err == nil && string(b) == snapshotMagic {
+		br.Discard(len(b))
+		var hdr snapshotHeader
+		if err := gob.NewDecoder(br).Decode(&hdr); err != nil {
+			return nil, err
+		}
+		if version = hdr.Version; version > snapshotVersion {
+			return nil, fmt.Errorf("unsupported version %d", version)
+		}
+		var body io.Reader = br
+		if hdr.Gzip {
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			zr.Multistream(false) // leave following data unread
+			body = &snapshotLimitReader{zr, snapshotMaxBytes}
+		}
+		if err := gob.NewDecoder(body).Decode(&s); err != nil {
+			return nil, err
+		}
+	} else if b, err := br.Peek(len(stateTextHeader)); err == nil && string(b) == stateTextHeader {
+		st, err := readStateText(br)
+		if err != nil {
+			return nil, err
+		}
+		s = *st
+	} else if isJSON(br) {
+		sj := snapshotJSON{State: &s}
+		if err := json.NewDecoder(br).Decode(&sj); err != nil {
+			return nil, err
+		}
+		if sj.Format != snapshotFormatName {
+			return nil, fmt.Errorf("bad format %q", sj.Format)
+		}
+		if version = sj.Version; version < 1 || version > snapshotVersion {
+			return nil, fmt.Errorf("unsupported version %d", version)
+		}
+	} else if err := gob.NewDecoder(br).Decode(&s); err != nil { // version 0
+		return nil, fmt.Errorf("not a snapshot: %v", err)
+	}
+
+	// Versions 0 and 1 have the same fields, so no conversion is needed yet.
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// errSnapshotTooLarge is returned by readSnapshot if a compressed snapshot
+// expands to more than snapshotMaxBytes.
+var errSnapshotTooLarge = errors.New("snapshot too large")
+
+// snapshotLimitReader reads from r until n bytes have been read and then
+// returns errSnapshotTooLarge. Unlike io.LimitReader, it distinguishes
+// hitting the limit from reaching the end of the data.
+type snapshotLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *snapshotLimitReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		return 0, errSnapshotTooLarge
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	return n, err
+}
+
+// isSnapshot returns true if br appears to contain a snapshot (in any
+// encoding other than version 0) rather than a program. No data is consumed.
+// Programs can't be mistaken for snapshots since the leading words of
+// snapshots aren't valid opcodes.
+func isSnapshot(br *bufio.Reader) bool {
+	b, _ := br.Peek(len(snapshotMagic))
+	switch {
+	case string(b) == snapshotMagic:
+		return true
+	case len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b: // gzip
+		return true
+	case len(b) >= 1 && b[0] == '{':
+		return true
+	}
+	b, _ = br.Peek(len(stateTextHeader))
+	return string(b) == stateTextHeader
+}
+
+// isJSON returns true if the next non-whitespace byte in br is '{'.
+// Whitespace is consumed.
+func isJSON(br *bufio.Reader) bool {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			br.UnreadByte()
+			return true
+		default:
+			br.UnreadByte()
+			return false
+		}
+	}
+}
+
+// stdioPath is used in place of a file path to read from stdin or write to stdout.
+const stdioPath = "-"
+
+// stdin is shared by everything that reads from standard input so that
+// buffered data isn't lost, e.g. input following a snapshot.
+var stdin = bufio.NewReader(os.Stdin)
+
+// saveSnapshotFile is a wrapper around writeSnapshot that writes to the named
+// file (or stdout if p is stdioPath) using the encoding returned by
+// snapshotEncodingFor.
+func saveSnapshotFile(p string, s *snapshot) error {
+	if p == stdioPath {
+		return writeSnapshot(os.Stdout, s, gobSnapshot)
+	}
+	return writeSnapshotFile(p, s, snapshotEncodingFor(p))
+}
+
+// writeSnapshotFile is a wrapper around writeSnapshot that writes to the
+// named file using enc.
+func writeSnapshotFile(p string, s *snapshot, enc snapshotEncoding) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(f, s, enc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadSnapshotFile is a wrapper around readSnapshot that reads the named file
+// (or stdin if p is stdioPath).
+func loadSnapshotFile(p string) (*snapshot, error) {
+	if p == stdioPath {
+		return readSnapshot(stdin)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readSnapshot(f)
+}
+
+// imageID returns a short identifier for the program in mem.
+func imageID(mem []uint16) string {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, mem)
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// defaultSlotDir returns the default directory for save slots for the
+// program identified by id.
+func defaultSlotDir(id string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "synacor-challenge", id), nil
+}
+
+// autoSlotPrefix prefixes the names of autosave slots.
+const autoSlotPrefix = "auto"
+
+// slotPath returns the path within dir of the save slot with the supplied
+// name: either a number like "3" or an autosave slot like "auto1".
+// False is returned if name isn't a slot name.
+func slotPath(dir, name string) (string, bool) {
+	if _, ok := parseSlotNum(strings.TrimPrefix(name, autoSlotPrefix)); !ok {
+		return "", false
+	}
+	return filepath.Join(dir, name+".sav"), true
+}
+
+// parseSlotNum returns the number in s, or false if s isn't a
+// non-negative integer.
+func parseSlotNum(s string) (int, bool) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+// saveSlot describes an existing save slot.
+type saveSlot struct {
+	name string // e.g. "3" or "auto1"
+	auto bool
+	num  int
+	meta snapshotMeta // Time is the file's mtime if unset
+}
+
+// listSlots returns the save slots in dir, with numbered slots sorted by
+// number followed by autosave slots. A missing directory is not an error,
+// and unreadable slots are skipped.
+func listSlots(dir string) ([]saveSlot, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var slots []saveSlot
+	for _, fi := range fis {
+		name := strings.TrimSuffix(fi.Name(), ".sav")
+		if name == fi.Name() {
+			continue
+		}
+		auto := strings.HasPrefix(name, autoSlotPrefix)
+		n, ok := parseSlotNum(strings.TrimPrefix(name, autoSlotPrefix))
+		if !ok {
+			continue
+		}
+		snap, err := loadSnapshotFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		if snap.Meta.Time.IsZero() {
+			snap.Meta.Time = fi.ModTime()
+		}
+		slots = append(slots, saveSlot{name, auto, n, snap.Meta})
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		a, b := slots[i], slots[j]
+		return (!a.auto && b.auto) || (a.auto == b.auto && a.num < b.num)
+	})
+	return slots, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotImage(t *testing.T) {
+	words, err := assemble(strings.NewReader("set r0 5\nout r0\nhalt"), nil)
+	if err != nil {
+		t.Fatal("Assembling failed: ", err)
+	}
+	vm, err := newVM(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.size = copy(vm.mem[:], words)
+	vm.image = imageID(vm.mem[:vm.size])
+
+	// Change memory so the ID can't be recomputed from the snapshot.
+	vm.mem[1] = 6
+	s := vm.snapshot()
+
+	for _, tc := range []struct {
+		name string
+		enc  snapshotEncoding
+	}{
+		{"gob", gobSnapshot},
+		{"json", jsonSnapshot},
+		{"text", textSnapshot},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeSnapshot(&b, s, tc.enc); err != nil {
+				t.Fatal("Writing failed: ", err)
+			}
+			rs, err := readSnapshot(&b)
+			if err != nil {
+				t.Fatal("Reading failed: ", err)
+			}
+			nvm, err := newVM(strings.NewReader(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nvm.restore(rs)
+			if nvm.image != vm.image {
+				t.Errorf("Restored image ID %q; want %q", nvm.image, vm.image)
+			}
+		})
+	}
+}
+
+// gzipBomb returns a gzip-compressed binary snapshot containing a single
+// n-byte gob message.
+func gzipBomb(t *testing.T, n int) []byte {
+	var b bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(zw, snapshotMagic)
+	if err := gob.NewEncoder(zw).Encode(snapshotHeader{snapshotVersion, false}); err != nil {
+		t.Fatal(err)
+	}
+	// gob prefixes messages with their length: a negated byte count
+	// followed by the big-endian value.
+	zw.Write([]byte{0xfc, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	zero := make([]byte, 1<<16)
+	for i := 0; i < n; i += len(zero) {
+		zw.Write(zero)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestReadSnapshotTooLarge(t *testing.T) {
+	b := gzipBomb(t, snapshotMaxBytes+1)
+	if len(b) > 1<<20 {
+		t.Fatalf("Compressed snapshot is %d bytes", len(b))
+	}
+	if _, err := readSnapshot(bytes.NewReader(b)); err != errSnapshotTooLarge {
+		t.Errorf("Reading %d-byte compressed snapshot returned %v; want %v", len(b), err, errSnapshotTooLarge)
+	}
+}
+
+func TestSnapshotCheck(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		mod  func(s *snapshot)
+		ok   bool
+	}{
+		{"valid", func(s *snapshot) { s.Reg[7] = vmax; s.Stack = []uint16{vmax} }, true},
+		{"long mem", func(s *snapshot) { s.Mem = make([]uint16, msize+1) }, false},
+		{"bad size", func(s *snapshot) { s.Size = -1 }, false},
+		{"bad ip", func(s *snapshot) { s.IP = vmax + 1 }, false},
+		{"bad reg", func(s *snapshot) { s.Reg[0] = 40000 }, false},
+		{"bad stack", func(s *snapshot) { s.Stack = []uint16{1, vreg} }, false},
+		{"deep stack", func(s *snapshot) { s.Stack = make([]uint16, snapshotMaxStack+1) }, false},
+	} {
+		s := &snapshot{Mem: []uint16{opHalt}, Size: 1}
+		tc.mod(s)
+		if err := s.check(); err != nil && tc.ok {
+			t.Errorf("%v: check failed: %v", tc.desc, err)
+		} else if err == nil && !tc.ok {
+			t.Errorf("%v: check unexpectedly succeeded", tc.desc)
+		}
+	}
+
+	// readSnapshot should reject malformed snapshots rather than letting
+	// them crash the VM later.
+	src := `{"format": "synacor-snapshot", "version": 1,
+		"state": {"mem": [6, 32768], "size": 2, "reg": [40000, 0, 0, 0, 0, 0, 0, 0]}}`
+	if _, err := readSnapshot(strings.NewReader(src)); err == nil {
+		t.Error("Reading snapshot with out-of-range register unexpectedly succeeded")
+	}
+}
+
+func TestStateTextRoundTrip(t *testing.T) {
+	mem := make([]uint16, 100)
+	copy(mem, []uint16{21, 19, 'H', 19, 'i', 0, 0, 0, 1})
+	mem[99] = vreg + 7 // after a run of zero rows
+	s := &snapshot{
+		Mem:   mem,
+		Size:  9,
+		Reg:   [nregs]uint16{1, 2, 3, 4, 5, 6, 7, vmax},
+		Stack: []uint16{6080, 16},
+		IP:    2317,
+		Meta: snapshotMeta{
+			Time:   time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC),
+			Steps:  123456,
+			Room:   `Foothills "north"`,
+			Last:   "What do you do?",
+			Codes:  []string{"abcDEF123", "ghiJKL456"},
+			Image:  "0123456789ab",
+			Branch: "alt",
+			Parent: "main",
+			Fault:  "invalid opcode 99",
+			Trace:  []uint16{10, 12},
+		},
+	}
+	var b bytes.Buffer
+	if err := writeStateText(&b, s); err != nil {
+		t.Fatal("Writing failed: ", err)
+	}
+	got, err := readStateText(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("Reading failed: %v\n%s", err, b.String())
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("Read %+v; want %+v", got, s)
+	}
+}
+
+func TestReadStateTextInvalid(t *testing.T) {
+	if _, err := readStateText(strings.NewReader("# synacor-state 2\nip: 0")); err == nil {
+		t.Error("Reading state with bad header unexpectedly succeeded")
+	}
+	for _, tc := range []struct {
+		desc, src string
+	}{
+		{"missing colon", "ip 0"},
+		{"unknown field", "foo: 1"},
+		{"bad ip", "ip: abc"},
+		{"ip too large", "ip: 70000"},
+		{"reg count", "reg: [1, 2]"},
+		{"reg too large", "reg: [40000, 0, 0, 0, 0, 0, 0, 0]"},
+		{"bad list", "stack: 1, 2"},
+		{"bad time", "time: yesterday"},
+		{"unquoted room", "room: Foothills"},
+		{"inline mem", "mem: [1, 2]"},
+		{"indented before mem", "ip: 0\n  0: [1]"},
+		{"bad row address", "mem:\n  abc: [1]"},
+		{"row address too large", "mem:\n  32768: [1]"},
+		{"row past end", "mem:\n  32767: [1, 2]"},
+		{"row value too large", "mem:\n  0: [65536]"},
+		{"row without list", "mem:\n  0: 1 2 3"},
+	} {
+		src := stateTextHeader + "\n" + tc.src
+		if _, err := readStateText(strings.NewReader(src)); err == nil {
+			t.Errorf("%v: reading %q unexpectedly succeeded", tc.desc, src)
+		}
+	}
+
+	// Values that the text parser accepts but that aren't valid in registers
+	// should be rejected by readSnapshot.
+	src := stateTextHeader + "\nreg: [32770, 0, 0, 0, 0, 0, 0, 0]\n"
+	if _, err := readSnapshot(strings.NewReader(src)); err == nil {
+		t.Errorf("Reading %q unexpectedly succeeded", src)
+	}
+}
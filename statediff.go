@@ -0,0 +1,68 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeStateDiff writes the differences between snapshots a and b to w:
+// registers, ip, stack, and memory words. If code is true, an
+// instruction-level diff of code reachable from address 0 and each
+// snapshot's ip is also written.
+func writeStateDiff(w io.Writer, a, b *snapshot, code bool) error {
+	var sb strings.Builder
+	for i := range a.Reg {
+		if a.Reg[i] != b.Reg[i] {
+			fmt.Fprintf(&sb, "r%d: %d -> %d\n", i, a.Reg[i], b.Reg[i])
+		}
+	}
+	if a.IP != b.IP {
+		fmt.Fprintf(&sb, "ip: %d -> %d\n", a.IP, b.IP)
+	}
+
+	stackVal := func(s []uint16, i int) string {
+		if i < len(s) {
+			return fmt.Sprint(s[i])
+		}
+		return "-"
+	}
+	if len(a.Stack) != len(b.Stack) {
+		fmt.Fprintf(&sb, "stack depth: %d -> %d\n", len(a.Stack), len(b.Stack))
+	}
+	for i := 0; i < len(a.Stack) || i < len(b.Stack); i++ {
+		if av, bv := stackVal(a.Stack, i), stackVal(b.Stack, i); av != bv {
+			fmt.Fprintf(&sb, "stack[%d]: %s -> %s\n", i, av, bv)
+		}
+	}
+
+	amem, bmem := a.memory(), b.memory()
+	var n int
+	for i := range amem {
+		if amem[i] != bmem[i] {
+			fmt.Fprintf(&sb, "mem[%d]: %d -> %d\n", i, amem[i], bmem[i])
+			n++
+		}
+	}
+	if n > 0 {
+		fmt.Fprintf(&sb, "%d memory word(s) changed\n", n)
+	}
+	if _, err := io.WriteString(w, sb.String()); err != nil {
+		return err
+	}
+
+	if code {
+		return writeDisasmDiff(w, analyze(amem, 0, a.IP), analyze(bmem, 0, b.IP))
+	}
+	return nil
+}
+
+// memory returns s's full memory.
+func (s *snapshot) memory() []uint16 {
+	mem := make([]uint16, msize)
+	copy(mem, s.Mem)
+	return mem
+}
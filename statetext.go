@@ -0,0 +1,257 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The text encoding of snapshots is intended to be edited by hand, e.g. to
+// change a register or flip a flag in memory. It starts with stateTextHeader
+// and is a subset of YAML:
+//
+//	ip: 2317
+//	reg: [0, 0, 0, 0, 0, 0, 0, 0]
+//	stack: [6080, 16]
+//	...
+//	mem:
+//	  0: [21, 21, 19, 87, 19, 101, 19, 108]  # ...W.e.l
+//
+// Each memory row lists up to stateTextRow words starting at the address
+// before the colon. Words not appearing in any row are zero.
+
+const (
+	stateTextHeader = "# synacor-state 1"
+	stateTextRow    = 8 // words per memory row
+)
+
+// writeStateText writes s to w in the text encoding.
+func writeStateText(w io.Writer, s *snapshot) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, stateTextHeader)
+	fmt.Fprintln(bw, `# Edit values and load with "/state import <file>" or -load-from.`)
+	fmt.Fprintln(bw, "# Memory words missing from the rows below are zero.")
+	fmt.Fprintf(bw, "ip: %d\n", s.IP)
+	fmt.Fprintf(bw, "reg: %s\n", fmtWordList(s.Reg[:]))
+	fmt.Fprintf(bw, "stack: %s\n", fmtWordList(s.Stack))
+	fmt.Fprintf(bw, "size: %d\n", s.Size)
+
+	m := &s.Meta
+	fmt.Fprintf(bw, "steps: %d\n", m.Steps)
+	if !m.Time.IsZero() {
+		fmt.Fprintf(bw, "time: %s\n", m.Time.Format(time.RFC3339Nano))
+	}
+	fmt.Fprintf(bw, "room: %s\n", strconv.Quote(m.Room))
+	fmt.Fprintf(bw, "last: %s\n", strconv.Quote(m.Last))
+	fmt.Fprintf(bw, "codes: [%s]\n", strings.Join(m.Codes, ", "))
+	if m.Image != "" {
+		fmt.Fprintf(bw, "image: %s\n", m.Image)
+	}
+	if m.Branch != "" {
+		fmt.Fprintf(bw, "branch: %s\n", m.Branch)
+	}
+	if m.Parent != "" {
+		fmt.Fprintf(bw, "parent: %s\n", m.Parent)
+	}
+	if m.Fault != "" {
+		fmt.Fprintf(bw, "fault: %s\n", strconv.Quote(m.Fault))
+	}
+	if len(m.Trace) > 0 {
+		fmt.Fprintf(bw, "trace: %s\n", fmtWordList(m.Trace))
+	}
+
+	fmt.Fprintln(bw, "mem:")
+	for addr := 0; addr < len(s.Mem); addr += stateTextRow {
+		end := addr + stateTextRow
+		if end > len(s.Mem) {
+			end = len(s.Mem)
+		}
+		row := s.Mem[addr:end]
+		zero := true
+		for _, v := range row {
+			zero = zero && v == 0
+		}
+		if zero {
+			continue
+		}
+		var text strings.Builder
+		for _, v := range row {
+			if v >= ' ' && v <= '~' {
+				text.WriteByte(byte(v))
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(bw, "  %d: %s  # %s\n", addr, fmtWordList(row), text.String())
+	}
+	return bw.Flush()
+}
+
+// fmtWordList formats vals as a YAML flow sequence, e.g. "[1, 2, 3]".
+func fmtWordList(vals []uint16) string {
+	strs := make([]string, len(vals))
+	for i, v := range vals {
+		strs[i] = strconv.Itoa(int(v))
+	}
+	return "[" + strings.Join(strs, ", ") + "]"
+}
+
+// readStateText reads a snapshot in the text encoding from r.
+func readStateText(r io.Reader) (*snapshot, error) {
+	var s snapshot
+	var inMem bool
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := sc.Text()
+		if ln == 1 {
+			if line != stateTextHeader {
+				return nil, fmt.Errorf("bad header %q", line)
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: bad line %q", ln, line)
+		}
+		key, val := parts[0], strings.TrimSpace(parts[1])
+		indented := line[0] == ' ' || line[0] == '\t'
+
+		var err error
+		if indented {
+			if !inMem {
+				err = fmt.Errorf("unexpected indented line")
+			} else {
+				err = s.readMemRow(key, val)
+			}
+		} else {
+			inMem = key == "mem"
+			err = s.readStateField(key, val)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", ln, err)
+		}
+	}
+	return &s, sc.Err()
+}
+
+// readStateField sets the field named key in s from val.
+func (s *snapshot) readStateField(key, val string) error {
+	var err error
+	m := &s.Meta
+	switch key {
+	case "ip":
+		s.IP, err = parseWordVal(val)
+	case "reg":
+		var reg []uint16
+		if reg, err = parseWordList(val); err == nil && len(reg) != nregs {
+			err = fmt.Errorf("need %d registers", nregs)
+		}
+		copy(s.Reg[:], reg)
+	case "stack":
+		s.Stack, err = parseWordList(val)
+	case "size":
+		s.Size, err = strconv.Atoi(val)
+	case "steps":
+		m.Steps, err = strconv.ParseUint(val, 10, 64)
+	case "time":
+		m.Time, err = time.Parse(time.RFC3339Nano, val)
+	case "room":
+		m.Room, err = strconv.Unquote(val)
+	case "last":
+		m.Last, err = strconv.Unquote(val)
+	case "codes":
+		if !strings.HasPrefix(val, "[") || !strings.HasSuffix(val, "]") {
+			return fmt.Errorf("bad list %q", val)
+		}
+		m.Codes = nil
+		for _, c := range strings.Split(val[1:len(val)-1], ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				m.Codes = append(m.Codes, c)
+			}
+		}
+	case "image":
+		m.Image = val
+	case "branch":
+		m.Branch = val
+	case "parent":
+		m.Parent = val
+	case "fault":
+		m.Fault, err = strconv.Unquote(val)
+	case "trace":
+		m.Trace, err = parseWordList(val)
+	case "mem":
+		if val != "" {
+			err = fmt.Errorf("memory must be listed in rows")
+		}
+	default:
+		err = fmt.Errorf("unknown field %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
+
+// readMemRow copies the words in val to s.Mem starting at the address in
+// addr, extending s.Mem if needed. A trailing comment is ignored.
+func (s *snapshot) readMemRow(addr, val string) error {
+	start, err := strconv.Atoi(addr)
+	if err != nil || start < 0 || start >= msize {
+		return fmt.Errorf("bad address %q", addr)
+	}
+	if i := strings.IndexByte(val, ']'); i >= 0 {
+		val = val[:i+1]
+	}
+	words, err := parseWordList(val)
+	if err != nil {
+		return fmt.Errorf("mem %d: %v", start, err)
+	}
+	end := start + len(words)
+	if end > msize {
+		return fmt.Errorf("mem %d: row extends past end of memory", start)
+	}
+	if end > len(s.Mem) {
+		s.Mem = append(s.Mem, make([]uint16, end-len(s.Mem))...)
+	}
+	copy(s.Mem[start:], words)
+	return nil
+}
+
+// parseWordList parses a YAML flow sequence of words, e.g. "[1, 2, 3]".
+func parseWordList(val string) ([]uint16, error) {
+	if !strings.HasPrefix(val, "[") || !strings.HasSuffix(val, "]") {
+		return nil, fmt.Errorf("bad list %q", val)
+	}
+	val = strings.TrimSpace(val[1 : len(val)-1])
+	if val == "" {
+		return []uint16{}, nil
+	}
+	var words []uint16
+	for _, f := range strings.Split(val, ",") {
+		v, err := parseWordVal(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, v)
+	}
+	return words, nil
+}
+
+// parseWordVal parses a single word, which may not exceed vreg+nregs-1.
+func parseWordVal(s string) (uint16, error) {
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil || v >= vreg+nregs {
+		return 0, fmt.Errorf("bad word %q", s)
+	}
+	return uint16(v), nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// statusLine reserves the bottom row of a terminal for a line showing the
+// current room, the number of commands issued, and the number of codes found.
+// The rest of the terminal is used as a scrolling region for output.
+// It is safe for concurrent use.
+type statusLine struct {
+	mu    sync.Mutex
+	w     io.Writer
+	fd    int // terminal's file descriptor
+	rows  int // terminal height when the scrolling region was set
+	ncmds int // commands sent to the program
+}
+
+func newStatusLine(w io.Writer, fd int) *statusLine {
+	return &statusLine{w: w, fd: fd}
+}
+
+// command records that a command was sent to the program.
+func (l *statusLine) command() {
+	l.mu.Lock()
+	l.ncmds++
+	l.mu.Unlock()
+}
+
+// draw writes the status line with information from info. The cursor is
+// left where it was. The program's output must not be written concurrently.
+func (l *statusLine) draw(info *gameInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rows, cols, err := termSize(l.fd)
+	if err != nil || rows < 2 || cols < 1 {
+		return
+	}
+	if rows != l.rows {
+		// Scroll the text up a line if the cursor is at the bottom, and
+		// limit scrolling to the rows above the status line. Setting the
+		// region moves the cursor, so save and restore it.
+		fmt.Fprintf(l.w, "\x1bD\x1b[A\x1b7\x1b[1;%dr\x1b8", rows-1)
+		l.rows = rows
+	}
+	room, _, codes := info.get()
+	if room == "" {
+		room = "?"
+	}
+	text := fmt.Sprintf(" %s | %d commands | %d codes", room, l.ncmds, len(codes))
+	if len(text) > cols {
+		text = text[:cols]
+	}
+	text += strings.Repeat(" ", cols-len(text))
+	fmt.Fprintf(l.w, "\x1b7\x1b[%d;1H\x1b[7m%s\x1b[0m\x1b8", rows, text)
+}
+
+// close clears the status line and restores the full scrolling region.
+func (l *statusLine) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rows == 0 {
+		return
+	}
+	fmt.Fprintf(l.w, "\x1b7\x1b[r\x1b[%d;1H\x1b[K\x1b8", l.rows)
+	l.rows = 0
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// foundString is a printable string found in memory.
+type foundString struct {
+	addr uint16
+	kind string // "word", "byte", or "out"
+	s    string
+}
+
+// printable returns true if v is a printable 7-bit character or newline.
+func printable(v uint16) bool { return (v >= ' ' && v < 0x7f) || v == '\n' }
+
+// findStrings returns runs of at least min printable characters in mem, sorted by address.
+// Three encodings are recognized: one character per word, two characters packed
+// into each word's low and high bytes, and sequences of "out" instructions with
+// literal operands (as used by the self-test).
+func findStrings(mem []uint16, min int) []foundString {
+	var found []foundString
+	var sb strings.Builder
+	var start int
+	flush := func(kind string) {
+		if sb.Len() >= min {
+			found = append(found, foundString{uint16(start), kind, sb.String()})
+		}
+		sb.Reset()
+	}
+
+	// One character per word.
+	for i, v := range mem {
+		if !printable(v) {
+			flush("word")
+			continue
+		}
+		if sb.Len() == 0 {
+			start = i
+		}
+		sb.WriteByte(byte(v))
+	}
+	flush("word")
+
+	// Two characters per word, little-endian.
+	for i, v := range mem {
+		for _, c := range []uint16{v & 0xff, v >> 8} {
+			if !printable(c) {
+				flush("byte")
+				continue
+			}
+			if sb.Len() == 0 {
+				start = i // strings starting in a high byte are attributed to its word
+			}
+			sb.WriteByte(byte(c))
+		}
+	}
+	flush("byte")
+
+	// Consecutive "out" instructions with literal operands.
+	for i := 0; i+1 < len(mem); {
+		if mem[i] != opOut || !printable(mem[i+1]) {
+			flush("out")
+			i++
+			continue
+		}
+		if sb.Len() == 0 {
+			start = i
+		}
+		sb.WriteByte(byte(mem[i+1]))
+		i += 2
+	}
+	flush("out")
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].addr < found[j].addr })
+	return found
+}
+
+// writeStrings writes strings of at least min characters found in mem to w.
+func writeStrings(w io.Writer, mem []uint16, min int) error {
+	var b strings.Builder
+	for _, f := range findStrings(mem, min) {
+		fmt.Fprintf(&b, "%5d %-4s %q\n", f.addr, f.kind, f.s)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
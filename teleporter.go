@@ -0,0 +1,289 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The teleporter's confirmation routine computes a variant of the Ackermann
+// function in which the base case for n == 0 uses an extra parameter k
+// (the eighth register) instead of 1:
+//
+//	f(0, n) = n + 1
+//	f(m, 0) = f(m-1, k)
+//	f(m, n) = f(m-1, f(m, n-1))
+//
+// with all arithmetic performed modulo 32768. It's called with m = 4 and
+// n = 1, which would take the VM far longer to evaluate than anyone is willing
+// to wait. This file implements a memoized version that's installed in
+// vm.natives to service calls to the routine.
+
+// maxTeleporterM is the largest m handled natively. Each row of the table
+// uses 128 KB, and calls with larger values are left to the program.
+const maxTeleporterM = 8
+
+// Placeholder operands in teleporterCode.
+const (
+	tpFunc = 0xfff0 + iota // address of the routine
+	tpOne                  // address of the n == 0 case
+	tpTwo                  // address of the general case
+	tpK                    // k
+)
+
+// teleporterCode is the routine as it appears in the challenge.
+// Operands matching placeholders are checked or captured by findTeleporter.
+var teleporterCode = []struct {
+	op   uint16
+	args [3]uint16
+}{
+	{opJt, [3]uint16{vreg + 0, tpOne}},
+	{opAdd, [3]uint16{vreg + 0, vreg + 1, 1}},
+	{opRet, [3]uint16{}},
+	{opJt, [3]uint16{vreg + 1, tpTwo}}, // tpOne
+	{opAdd, [3]uint16{vreg + 0, vreg + 0, vmax}},
+	{opSet, [3]uint16{vreg + 1, tpK}},
+	{opCall, [3]uint16{tpFunc}},
+	{opRet, [3]uint16{}},
+	{opPush, [3]uint16{vreg + 0}}, // tpTwo
+	{opAdd, [3]uint16{vreg + 1, vreg + 1, vmax}},
+	{opCall, [3]uint16{tpFunc}},
+	{opSet, [3]uint16{vreg + 1, vreg + 0}},
+	{opPop, [3]uint16{vreg + 0}},
+	{opAdd, [3]uint16{vreg + 0, vreg + 0, vmax}},
+	{opCall, [3]uint16{tpFunc}},
+	{opRet, [3]uint16{}},
+}
+
+// matchTeleporter checks whether teleporterCode is at addr in mem.
+// If so, k's operand (a literal value or register reference) is returned.
+func matchTeleporter(mem []uint16, addr uint16) (k uint16, ok bool) {
+	var one, two uint16
+	ip := int(addr)
+	for i, want := range teleporterCode {
+		if ip >= len(mem) {
+			return 0, false
+		}
+		d, _ := predecode(mem, uint16(ip))
+		if d.size == 0 || d.op != want.op {
+			return 0, false
+		}
+		switch i {
+		case 3:
+			one = uint16(ip)
+		case 8:
+			two = uint16(ip)
+		}
+		for j, a := range want.args[:d.size-1] {
+			switch a {
+			case tpFunc:
+				ok = d.args[j] == addr
+			case tpOne, tpTwo:
+				ok = true // checked below
+			case tpK:
+				k, ok = d.args[j], true
+			default:
+				ok = d.args[j] == a
+			}
+			if !ok {
+				return 0, false
+			}
+		}
+		ip += int(d.size)
+	}
+	// The branch targets must be the corresponding instructions.
+	return k, mem[addr+2] == one && mem[one+2] == two
+}
+
+// findTeleporter searches mem for the teleporter's confirmation routine and
+// returns its address and k's operand.
+func findTeleporter(mem []uint16) (addr, k uint16, ok bool) {
+	for a := 0; a+1 < len(mem); a++ {
+		if mem[a] != opJt || mem[a+1] != vreg+0 {
+			continue
+		}
+		if k, ok := matchTeleporter(mem, uint16(a)); ok {
+			return uint16(a), k, true
+		}
+	}
+	return 0, 0, false
+}
+
+// teleporterTable holds the routine's results for a single k.
+type teleporterTable struct {
+	k  uint16
+	r0 [][vmod]uint16 // r0[m][n] is f(m, n)
+	r1 [][vmod]uint16 // r1[m][n] is the value left in r1 by the routine
+}
+
+// newTeleporterTable returns a table for k containing only row 0.
+func newTeleporterTable(k uint16) *teleporterTable {
+	t := &teleporterTable{k: k, r0: make([][vmod]uint16, 1), r1: make([][vmod]uint16, 1)}
+	for n := 0; n < vmod; n++ {
+		t.r0[0][n] = uint16((n + 1) % vmod)
+		t.r1[0][n] = uint16(n)
+	}
+	return t
+}
+
+// extend computes rows through m. Each row is computed from the previous one:
+// f(m, 0) is f(m-1, k), and f(m, n) is f(m-1, f(m, n-1)). The routine's final
+// "ret" always follows a call with m-1, so r1 is computed the same way.
+func (t *teleporterTable) extend(m int) {
+	for len(t.r0) <= m {
+		i := len(t.r0)
+		t.r0 = append(t.r0, [vmod]uint16{})
+		t.r1 = append(t.r1, [vmod]uint16{})
+		nextTeleporterRow(&t.r0[i], &t.r0[i-1], t.k)
+		p1, c0, c1 := &t.r1[i-1], &t.r0[i], &t.r1[i]
+		c1[0] = p1[t.k]
+		for n := 1; n < vmod; n++ {
+			c1[n] = p1[c0[n-1]]
+		}
+	}
+}
+
+// nextTeleporterRow fills cur with f(m, n) for each n, given prev containing
+// f(m-1, n).
+func nextTeleporterRow(cur, prev *[vmod]uint16, k uint16) {
+	cur[0] = prev[k]
+	for n := 1; n < vmod; n++ {
+		cur[n] = prev[cur[n-1]]
+	}
+}
+
+// teleporterRow2 returns f(2, n). Rows 1 and 2 have closed forms:
+// f(1, n) is n+k+1, and f(2, n) is f(1, f(2, n-1)) = (n+2)k + n+1.
+func teleporterRow2(n, k uint16) uint16 {
+	return uint16((uint32(n)+2)*uint32(k)+uint32(n)+1) & vmax
+}
+
+// teleporterResult returns f(m, n) for k. a and b are used as scratch space.
+// Rows 3 through m-1 are computed in full.
+func teleporterResult(m, n, k uint16, a, b *[vmod]uint16) uint16 {
+	switch m {
+	case 0:
+		return (n + 1) & vmax
+	case 1:
+		return (n + k + 1) & vmax
+	case 2:
+		return teleporterRow2(n, k)
+	case 3:
+		v := teleporterRow2(k, k)
+		for i := 0; i < int(n); i++ {
+			v = teleporterRow2(v, k)
+		}
+		return v
+	}
+	v := teleporterRow2(k, k)
+	for i := 0; i < vmod; i++ {
+		a[i] = v // f(3, i)
+		v = teleporterRow2(v, k)
+	}
+	for i := 4; i < int(m); i++ {
+		nextTeleporterRow(b, a, k)
+		a, b = b, a
+	}
+	v = a[k]
+	for i := 0; i < int(n); i++ {
+		v = a[v]
+	}
+	return v
+}
+
+// Arguments passed to the routine by the challenge and the result that it
+// requires.
+const (
+	teleporterM    = 4
+	teleporterN    = 1
+	teleporterWant = 6
+)
+
+// searchTeleporter returns the nonzero values of k for which f(m, n) is want
+// in increasing order. The candidates are divided among workers goroutines.
+func searchTeleporter(m, n, want uint16, workers int) []uint16 {
+	if workers < 1 {
+		workers = 1
+	}
+	found := make([][]uint16, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var a, b [vmod]uint16
+			for k := 1 + w; k < vmod; k += workers {
+				if teleporterResult(m, n, uint16(k), &a, &b) == want {
+					found[w] = append(found[w], uint16(k))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var ks []uint16
+	for _, f := range found {
+		ks = append(ks, f...)
+	}
+	sort.Slice(ks, func(i, j int) bool { return ks[i] < ks[j] })
+	return ks
+}
+
+// teleporter services calls to the teleporter's confirmation routine.
+// It is safe for concurrent use by multiple VMs.
+type teleporter struct {
+	k     uint16 // literal value or register reference for k
+	mu    sync.Mutex
+	table *teleporterTable // most recently used table
+}
+
+// exec is installed in vm.natives at the routine's address. It sets r0 and
+// r1 to the values that the routine would leave in them and returns to the
+// caller. Calls that can't be handled natively are executed by the program.
+func (t *teleporter) exec(vm *vm, d *predecoded, ip uint16) uint16 {
+	m, n, k := vm.reg[0], vm.reg[1], vm.val(t.k)
+	if m > maxTeleporterM || len(vm.stack) == 0 {
+		return opFuncs[d.op](vm, d, ip)
+	}
+	t.mu.Lock()
+	if t.table == nil || t.table.k != k {
+		t.table = newTeleporterTable(k)
+	}
+	t.table.extend(int(m))
+	vm.reg[0], vm.reg[1] = t.table.r0[m][n], t.table.r1[m][n]
+	t.mu.Unlock()
+
+	if vm.ctrace != nil {
+		vm.ctrace.end()
+	}
+	return vm.pop()
+}
+
+// addTeleporter installs a native implementation of the teleporter's
+// confirmation routine in vm. spec is either "auto" to search memory for the
+// routine, or the routine's address. In the latter case, the routine isn't
+// checked and is assumed to take k from r7.
+func (vm *vm) addTeleporter(spec string) (uint16, error) {
+	var addr, k uint16
+	if spec == "auto" {
+		var ok bool
+		if addr, k, ok = findTeleporter(vm.mem[:]); !ok {
+			return 0, fmt.Errorf("routine not found")
+		}
+	} else {
+		v, err := strconv.ParseUint(spec, 0, 16)
+		if err != nil || v > vmax {
+			return 0, fmt.Errorf("bad address %q", spec)
+		}
+		addr, k = uint16(v), vreg+7
+	}
+	if vm.natives == nil {
+		vm.natives = make(map[uint16]opFunc)
+	}
+	vm.natives[addr] = (&teleporter{k: k}).exec
+	return addr, nil
+}
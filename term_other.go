@@ -0,0 +1,26 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func isTerminal(fd int) bool { return false }
+
+func makeRaw(fd int) (restore func() error, err error) {
+	return nil, errors.New("terminal control unsupported")
+}
+
+func termSize(fd int) (rows, cols int, err error) {
+	return 0, 0, errors.New("terminal control unsupported")
+}
+
+var stopSignals []os.Signal
+
+func raiseDefault(ch chan<- os.Signal, sig os.Signal) {}
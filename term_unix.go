@@ -0,0 +1,87 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// getTermios returns the terminal attributes of fd.
+func getTermios(fd int) (*syscall.Termios, error) {
+	var t syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		ioctlGetTermios, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		return nil, errno
+	}
+	return &t, nil
+}
+
+// setTermios sets the terminal attributes of fd.
+func setTermios(fd int, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		ioctlSetTermios, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal returns true if fd is a terminal.
+func isTerminal(fd int) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// makeRaw puts the terminal fd into a mode where input is passed through
+// byte-by-byte without echoing. Signal generation (e.g. Ctrl-C and Ctrl-Z)
+// and output processing are left enabled. The returned function restores the
+// original mode.
+func makeRaw(fd int) (restore func() error, err error) {
+	orig, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+	raw := *orig
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.IEXTEN
+	raw.Iflag &^= syscall.IXON
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return func() error { return setTermios(fd, orig) }, nil
+}
+
+// stopSignals lists the signals generated by Ctrl-Z and Ctrl-\, which stop
+// and kill the process.
+var stopSignals = []os.Signal{syscall.SIGTSTP, syscall.SIGQUIT}
+
+// raiseDefault sends sig to the process with its default action and then
+// resumes delivering it to ch. It returns after the process is continued.
+func raiseDefault(ch chan<- os.Signal, sig os.Signal) {
+	if sig == syscall.SIGTSTP {
+		// The Go runtime ignores SIGTSTP after signal.Reset, so stop with
+		// SIGSTOP (which can't be caught) instead.
+		syscall.Kill(syscall.Getpid(), syscall.SIGSTOP)
+		return
+	}
+	signal.Reset(sig)
+	syscall.Kill(syscall.Getpid(), sig.(syscall.Signal))
+	signal.Notify(ch, sig)
+}
+
+// termSize returns the number of rows and columns in the terminal fd.
+func termSize(fd int) (rows, cols int, err error) {
+	var ws struct{ row, col, xpixel, ypixel uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.row), int(ws.col), nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+// Console mode flags from wincon.h.
+const (
+	enableProcessedInput            = 0x1
+	enableLineInput                 = 0x2
+	enableEchoInput                 = 0x4
+	enableVirtualTerminalInput      = 0x200
+	enableProcessedOutput           = 0x1
+	enableVirtualTerminalProcessing = 0x4
+)
+
+// getConsoleMode returns the mode of the console handle fd.
+func getConsoleMode(fd int) (uint32, error) {
+	var mode uint32
+	err := syscall.GetConsoleMode(syscall.Handle(fd), &mode)
+	return mode, err
+}
+
+// setConsoleMode sets the mode of the console handle fd.
+func setConsoleMode(fd int, mode uint32) error {
+	if r, _, err := procSetConsoleMode.Call(uintptr(fd), uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// isTerminal returns true if fd is a console.
+func isTerminal(fd int) bool {
+	_, err := getConsoleMode(fd)
+	return err == nil
+}
+
+// makeRaw puts the console input handle fd into a mode where keys are passed
+// through without line buffering, echoing, or Ctrl-C handling, with special
+// keys reported as VT escape sequences. Consoles attached to stdout and stderr
+// are switched to virtual terminal processing so that the escape sequences
+// written by the line editor, pager, and colorWriter are interpreted; an error
+// is returned if that isn't supported (i.e. before Windows 10). The returned
+// function restores the original modes.
+func makeRaw(fd int) (restore func() error, err error) {
+	var restores []func() error
+	restoreAll := func() error {
+		var err error
+		for i := len(restores) - 1; i >= 0; i-- {
+			if rerr := restores[i](); err == nil {
+				err = rerr
+			}
+		}
+		return err
+	}
+	setMode := func(fd int, f func(mode uint32) uint32) error {
+		orig, err := getConsoleMode(fd)
+		if err != nil {
+			return err
+		}
+		if err := setConsoleMode(fd, f(orig)); err != nil {
+			return err
+		}
+		restores = append(restores, func() error { return setConsoleMode(fd, orig) })
+		return nil
+	}
+
+	if err := setMode(fd, func(mode uint32) uint32 {
+		return mode&^(enableLineInput|enableEchoInput|enableProcessedInput) | enableVirtualTerminalInput
+	}); err != nil {
+		return nil, err
+	}
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		ofd := int(f.Fd())
+		if !isTerminal(ofd) {
+			continue
+		}
+		if err := setMode(ofd, func(mode uint32) uint32 {
+			return mode | enableProcessedOutput | enableVirtualTerminalProcessing
+		}); err != nil {
+			restoreAll()
+			return nil, err
+		}
+	}
+	return restoreAll, nil
+}
+
+// stopSignals is empty since the console has no job control.
+var stopSignals []os.Signal
+
+func raiseDefault(ch chan<- os.Signal, sig os.Signal) {}
+
+// termSize returns the number of rows and columns in the console window
+// for the output handle fd.
+func termSize(fd int) (rows, cols int, err error) {
+	type coord struct{ x, y int16 }
+	var info struct {
+		size       coord
+		cursor     coord
+		attrs      uint16
+		window     struct{ left, top, right, bottom int16 }
+		maxWinSize coord
+	}
+	if r, _, err := procGetConsoleScreenBufferInfo.Call(uintptr(fd),
+		uintptr(unsafe.Pointer(&info))); r == 0 {
+		return 0, 0, err
+	}
+	w := info.window
+	return int(w.bottom-w.top) + 1, int(w.right-w.left) + 1, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// timerSplit describes the discovery of a code.
+type timerSplit struct {
+	code    string
+	elapsed time.Duration // wall time since the timer was started
+	steps   uint64        // instructions executed when the program next read input
+}
+
+// speedTimer records splits when codes are found during a speedrun.
+// It is safe for concurrent use.
+type speedTimer struct {
+	start  time.Time
+	msg    io.Writer // receives a line for each split
+	mu     sync.Mutex
+	splits []timerSplit
+	wg     sync.WaitGroup // tracks split goroutines
+}
+
+func newSpeedTimer(msg io.Writer) *speedTimer {
+	return &speedTimer{start: time.Now(), msg: msg}
+}
+
+// split records the discovery of code, which was just written by vm.
+// The instruction count is read once the program waits for input (or stops),
+// since the VM can't be inspected while it's running.
+func (t *speedTimer) split(code string, vm *vm) {
+	elapsed := time.Since(t.start)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		var steps uint64
+		if !vm.do(func() { steps = vm.steps }) {
+			steps = vm.steps // stopped
+		}
+		t.mu.Lock()
+		t.splits = append(t.splits, timerSplit{code, elapsed, steps})
+		n := len(t.splits)
+		t.mu.Unlock()
+		fmt.Fprintf(t.msg, "Split %d: %s at %v (%d instructions)\n",
+			n, code, fmtTimer(elapsed), steps)
+	}()
+}
+
+// summary waits for pending splits and writes all splits and the final time
+// and instruction count to w.
+func (t *speedTimer) summary(w io.Writer, steps uint64) {
+	t.wg.Wait()
+	elapsed := time.Since(t.start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintln(w, "Split  Code          Time          Delta  Instructions")
+	var last time.Duration
+	for i, s := range t.splits {
+		fmt.Fprintf(w, "%5d  %-12s  %10s  %10s  %12d\n", i+1, s.code,
+			fmtTimer(s.elapsed), fmtTimer(s.elapsed-last), s.steps)
+		last = s.elapsed
+	}
+	fmt.Fprintf(w, "%5s  %-12s  %10s  %10s  %12d\n", "Total", "",
+		fmtTimer(elapsed), fmtTimer(elapsed-last), steps)
+}
+
+// fmtTimer formats d as "h:mm:ss.cc" or "m:ss.cc".
+func fmtTimer(d time.Duration) string {
+	cs := d.Milliseconds() / 10
+	h, m, sec, cs := cs/360000, cs/6000%60, cs/100%60, cs%100
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d.%02d", h, m, sec, cs)
+	}
+	return fmt.Sprintf("%d:%02d.%02d", m, sec, cs)
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transcripts are text files that start with transcriptHeader and contain the
+// program's output interleaved with input lines, which are prefixed by
+// transcriptInputPrefix. Input lines always start on a new line and may be
+// preceded by a line containing transcriptTimePrefix and the time at which
+// the input was entered.
+
+const (
+	transcriptHeader      = "# synacor-transcript 1"
+	transcriptInputPrefix = "> "
+	transcriptTimePrefix  = "#@ "
+)
+
+// transcript writes a transcript of a session.
+type transcript struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	bol   bool  // at beginning of line
+	times bool  // write times before input lines
+	err   error // first write error
+}
+
+// newTranscript creates a transcript at p. If times is true, the time at
+// which each line is entered is also recorded.
+func newTranscript(p string, times bool) (*transcript, error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	t := &transcript{f: f, w: bufio.NewWriter(f), bol: true, times: times}
+	t.write(transcriptHeader + "\n")
+	return t, t.err
+}
+
+// output records a byte of output from the program.
+func (t *transcript) output(b byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.w.WriteByte(b)
+	}
+	t.bol = b == '\n'
+}
+
+// input records a line of input, which should end with a newline.
+func (t *transcript) input(ln string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.bol {
+		t.write("\n")
+	}
+	if t.times {
+		t.write(transcriptTimePrefix + time.Now().Format(time.RFC3339) + "\n")
+	}
+	t.write(transcriptInputPrefix + ln)
+	t.bol = strings.HasSuffix(ln, "\n")
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	return t.err
+}
+
+// write writes s. t.mu must be held.
+func (t *transcript) write(s string) {
+	if t.err == nil {
+		_, t.err = t.w.WriteString(s)
+	}
+}
+
+// close flushes and closes the file.
+func (t *transcript) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	if err := t.f.Close(); t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+// isTranscript returns true if br starts with transcriptHeader.
+// No data is consumed.
+func isTranscript(br *bufio.Reader) bool {
+	b, _ := br.Peek(len(transcriptHeader))
+	return string(b) == transcriptHeader
+}
+
+// transcriptInput returns the input lines from the transcript in r.
+func transcriptInput(r io.Reader) (io.Reader, error) {
+	var b strings.Builder
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for ln := 1; sc.Scan(); ln++ {
+		s := sc.Text()
+		if ln == 1 {
+			if s != transcriptHeader {
+				return nil, fmt.Errorf("bad header %q", s)
+			}
+			continue
+		}
+		if strings.HasPrefix(s, transcriptInputPrefix) {
+			b.WriteString(strings.TrimPrefix(s, transcriptInputPrefix) + "\n")
+		}
+	}
+	return strings.NewReader(b.String()), sc.Err()
+}
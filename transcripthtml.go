@@ -0,0 +1,141 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// transcriptCSS styles pages written by writeTranscriptHTML.
+const transcriptCSS = `body { background: #111; color: #ccc; margin: 2em; }
+pre { font: 14px/1.4 monospace; white-space: pre-wrap; }
+.in { color: #fff; font-weight: bold; }
+.room { color: #8cf; font-weight: bold; }
+.code { background: #552; color: #ff8; padding: 0 2px; }
+.time { color: #777; font-weight: normal; margin-right: 1em; }
+.codes { border-top: 1px solid #444; margin-top: 2em; padding-top: 1em; }`
+
+// writeTranscriptHTML reads a transcript from r and writes it to w as an
+// HTML page. Input lines are highlighted, room titles and codes are called
+// out, and recorded times are shown next to input lines. All codes are
+// listed at the end of the page.
+func writeTranscriptHTML(w io.Writer, r io.Reader, title string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"+
+		"<title>%s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n<pre>",
+		html.EscapeString(title), transcriptCSS)
+
+	var codes []string
+	var when string // time for the next input line
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for ln := 1; sc.Scan(); ln++ {
+		s := sc.Text()
+		switch {
+		case ln == 1:
+			if s != transcriptHeader {
+				return fmt.Errorf("bad header %q", s)
+			}
+		case strings.HasPrefix(s, transcriptTimePrefix):
+			t, err := time.Parse(time.RFC3339, strings.TrimPrefix(s, transcriptTimePrefix))
+			if err != nil {
+				return fmt.Errorf("line %d: %v", ln, err)
+			}
+			when = t.Format("15:04:05")
+		case strings.HasPrefix(s, transcriptInputPrefix):
+			bw.WriteString(`<span class="in">`)
+			if when != "" {
+				fmt.Fprintf(bw, `<span class="time">%s</span>`, when)
+				when = ""
+			}
+			fmt.Fprintf(bw, "%s</span>\n", html.EscapeString(s))
+		case strings.HasPrefix(s, "== ") && strings.HasSuffix(s, " =="):
+			fmt.Fprintf(bw, "<span class=\"room\">%s</span>\n", html.EscapeString(s))
+		default:
+			found := findCodes(s)
+			bw.WriteString(highlightCodes(s, found) + "\n")
+			for _, c := range found {
+				if !containsString(codes, c) {
+					codes = append(codes, c)
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	bw.WriteString("</pre>\n")
+	if len(codes) > 0 {
+		bw.WriteString("<div class=\"codes\">Codes:<ol>\n")
+		for _, c := range codes {
+			fmt.Fprintf(bw, "<li><span class=\"code\">%s</span></li>\n", html.EscapeString(c))
+		}
+		bw.WriteString("</ol></div>\n")
+	}
+	bw.WriteString("</body>\n</html>\n")
+	return bw.Flush()
+}
+
+// highlightCodes escapes s and wraps occurrences of codes in spans.
+func highlightCodes(s string, codes []string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		start, code := -1, ""
+		for _, c := range codes {
+			if i := strings.Index(s, c); i >= 0 && (start < 0 || i < start) {
+				start, code = i, c
+			}
+		}
+		if start < 0 {
+			b.WriteString(html.EscapeString(s))
+			break
+		}
+		b.WriteString(html.EscapeString(s[:start]))
+		fmt.Fprintf(&b, `<span class="code">%s</span>`, html.EscapeString(code))
+		s = s[start+len(code):]
+	}
+	return b.String()
+}
+
+// containsString returns true if strs contains s.
+func containsString(strs []string, s string) bool {
+	for _, o := range strs {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTranscriptHTMLFile is a wrapper around writeTranscriptHTML that reads
+// the transcript at src and writes the page to dst ("-" for stdout).
+func writeTranscriptHTMLFile(dst, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	title := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	if dst == stdioPath {
+		return writeTranscriptHTML(os.Stdout, f, title)
+	}
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := writeTranscriptHTML(w, f, title); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
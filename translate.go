@@ -0,0 +1,250 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Translated programs are structured as one function per detected routine.
+// Each function takes the address at which to start executing and returns
+// the address at which execution should continue, with calls and returns
+// going through a dispatch loop that maps addresses to functions (or falls
+// back to interpreting single instructions for addresses that weren't
+// translated). Blocks whose code is later overwritten are marked as dirty and
+// are interpreted from then on.
+//
+// Function bodies are emitted using a subset of syntax that's valid in both
+// Go and C: assignments to r[] and calls to runtime helpers that each backend
+// defines (push, pop, popRet, eq, gt, add, mul, mod, and, or, inv, rd, wr,
+// out, in, bad), plus if, goto, and return statements.
+
+// haltPC is returned by translated functions to stop execution.
+const haltPC = 0xffff
+
+// backend emits source code for a target language.
+type backend interface {
+	// prologue writes everything preceding the translated functions,
+	// including the runtime helpers and the initial state in t.
+	prologue(b *strings.Builder, t *translation)
+	// funcHeader writes the start of a function with the supplied name that
+	// takes a uint16 "pc" argument and returns a uint16.
+	funcHeader(b *strings.Builder, name string)
+	// funcFooter writes the end of a function.
+	funcFooter(b *strings.Builder)
+	// epilogue writes the dispatch loop and anything following the functions.
+	epilogue(b *strings.Builder, t *translation)
+	// format returns a formatted version of the complete source.
+	format(src []byte) ([]byte, error)
+}
+
+// translation holds a program prepared for ahead-of-time compilation.
+type translation struct {
+	p       *program
+	fns     []*tfunc
+	regs    [nregs]uint16 // initial register values
+	stack   []uint16      // initial stack
+	pc      uint16        // initial address
+	memEnd  int           // number of leading words of p.mem to emit
+	blocks  [][2]uint16   // translated blocks as [start, end) ranges
+	entries []tentry      // dispatched addresses, sorted by address
+}
+
+// tfunc is a function within a translation.
+type tfunc struct {
+	fn      *function
+	blocks  []*block
+	entries []uint16            // block starts dispatched to this function
+	starts  map[uint16]struct{} // start addresses of blocks in the function
+}
+
+// tentry maps an address to the function that handles it.
+type tentry struct {
+	addr uint16
+	fn   *tfunc
+}
+
+// newTranslation prepares p for translation, with execution starting in
+// the supplied state.
+func newTranslation(p *program, regs [nregs]uint16, stack []uint16, pc uint16) *translation {
+	t := &translation{p: p, regs: regs, stack: stack, pc: pc}
+	t.memEnd = len(p.mem)
+	for t.memEnd > 0 && p.mem[t.memEnd-1] == 0 {
+		t.memEnd--
+	}
+
+	owned := make(map[uint16]struct{})
+	for _, fn := range p.sortedFuncs() {
+		tf := &tfunc{fn: fn, blocks: p.blocks(fn), starts: make(map[uint16]struct{})}
+		for _, b := range tf.blocks {
+			tf.starts[b.start] = struct{}{}
+			if _, ok := owned[b.start]; !ok {
+				owned[b.start] = struct{}{}
+				tf.entries = append(tf.entries, b.start)
+				t.entries = append(t.entries, tentry{b.start, tf})
+				t.blocks = append(t.blocks, [2]uint16{b.start, b.end()})
+			}
+		}
+		t.fns = append(t.fns, tf)
+	}
+	sort.Slice(t.entries, func(i, j int) bool { return t.entries[i].addr < t.entries[j].addr })
+	sort.Slice(t.blocks, func(i, j int) bool { return t.blocks[i][0] < t.blocks[j][0] })
+	return t
+}
+
+// write writes the translated program to w using be.
+func (t *translation) write(w io.Writer, be backend) error {
+	var b strings.Builder
+	be.prologue(&b, t)
+	for _, tf := range t.fns {
+		if len(tf.entries) > 0 {
+			t.writeFunc(&b, be, tf)
+		}
+	}
+	be.epilogue(&b, t)
+	src, err := be.format([]byte(b.String()))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// writeFunc writes tf to b.
+func (t *translation) writeFunc(b *strings.Builder, be backend, tf *tfunc) {
+	// Gather each block's statements first so that only referenced labels are emitted
+	// (Go rejects unused labels).
+	refs := make(map[uint16]struct{})
+	for _, e := range tf.entries {
+		refs[e] = struct{}{}
+	}
+	body := make([][]string, len(tf.blocks))
+	for i, blk := range tf.blocks {
+		for _, in := range blk.instrs {
+			body[i] = append(body[i], t.lower(tf, in, refs)...)
+		}
+		// Leave the function if control falls off the end of the block to
+		// code that isn't in the function.
+		next := blk.end()
+		if !endsBlock(blk.last()) && (i+1 == len(tf.blocks) || tf.blocks[i+1].start != next) {
+			body[i] = append(body[i], fmt.Sprintf("return %d;", next))
+		}
+	}
+
+	be.funcHeader(b, funcName(tf.fn.entry))
+	b.WriteString("\tswitch (pc) {\n")
+	for _, e := range tf.entries {
+		fmt.Fprintf(b, "\tcase %d:\n\t\tgoto %s;\n", e, labelName(e))
+	}
+	b.WriteString("\t}\n")
+	fmt.Fprintf(b, "\treturn bad(pc, pc);\n")
+	for i, blk := range tf.blocks {
+		if _, ok := refs[blk.start]; ok {
+			fmt.Fprintf(b, "%s:\n", labelName(blk.start))
+		}
+		fmt.Fprintf(b, "\tif (dirty[%d]) {\n\t\treturn %d;\n\t}\n", blk.start, blk.start)
+		for _, s := range body[i] {
+			fmt.Fprintf(b, "\t%s\n", s)
+		}
+	}
+	be.funcFooter(b)
+}
+
+// lower returns statements implementing in within tf.
+// Labels referenced by the statements are added to refs.
+func (t *translation) lower(tf *tfunc, in instr, refs map[uint16]struct{}) []string {
+	v := func(i int) string {
+		a := in.args[i]
+		switch {
+		case a <= vmax:
+			return fmt.Sprint(a)
+		case a < vreg+nregs:
+			return fmt.Sprintf("r[%d]", a-vreg)
+		default:
+			return fmt.Sprintf("bad(%d, %d)", a, int(in.addr)+1+i)
+		}
+	}
+	// dst returns an assignment of expr to the register named by the first argument.
+	dst := func(expr string) string {
+		if a := in.args[0]; a >= vreg && a < vreg+nregs {
+			return fmt.Sprintf("r[%d] = %s;", a-vreg, expr)
+		}
+		return fmt.Sprintf("bad(%d, %d);", in.args[0], in.addr+1)
+	}
+	// jump returns a statement transferring control to the address described by arg.
+	jump := func(arg int) string {
+		if t, ok := in.target(); ok {
+			if _, ok := tf.starts[t]; ok {
+				refs[t] = struct{}{}
+				return fmt.Sprintf("goto %s;", labelName(t))
+			}
+		}
+		return fmt.Sprintf("return %s;", v(arg))
+	}
+
+	switch in.op {
+	case opHalt:
+		return []string{fmt.Sprintf("return %d;", haltPC)}
+	case opSet:
+		return []string{dst(v(1))}
+	case opPush:
+		return []string{fmt.Sprintf("push(%s);", v(0))}
+	case opPop:
+		return []string{dst("pop()")}
+	case opEq:
+		return []string{dst(fmt.Sprintf("eq(%s, %s)", v(1), v(2)))}
+	case opGt:
+		return []string{dst(fmt.Sprintf("gt(%s, %s)", v(1), v(2)))}
+	case opJmp:
+		return []string{jump(0)}
+	case opJt:
+		return []string{fmt.Sprintf("if (%s != 0) {", v(0)), "\t" + jump(1), "}"}
+	case opJf:
+		return []string{fmt.Sprintf("if (%s == 0) {", v(0)), "\t" + jump(1), "}"}
+	case opAdd:
+		return []string{dst(fmt.Sprintf("add(%s, %s)", v(1), v(2)))}
+	case opMult:
+		return []string{dst(fmt.Sprintf("mul(%s, %s)", v(1), v(2)))}
+	case opMod:
+		return []string{dst(fmt.Sprintf("mod(%s, %s)", v(1), v(2)))}
+	case opAnd:
+		return []string{dst(fmt.Sprintf("and(%s, %s)", v(1), v(2)))}
+	case opOr:
+		return []string{dst(fmt.Sprintf("or(%s, %s)", v(1), v(2)))}
+	case opNot:
+		return []string{dst(fmt.Sprintf("inv(%s)", v(1)))}
+	case opRmem:
+		return []string{dst(fmt.Sprintf("rd(%s)", v(1)))}
+	case opWmem:
+		return []string{fmt.Sprintf("wr(%s, %s);", v(0), v(1))}
+	case opCall:
+		return []string{fmt.Sprintf("push(%d);", in.next()), fmt.Sprintf("return %s;", v(0))}
+	case opRet:
+		return []string{"return popRet();"}
+	case opOut:
+		return []string{fmt.Sprintf("out(%s);", v(0))}
+	case opIn:
+		return []string{dst("in()")}
+	}
+	return nil // noop, trap
+}
+
+// writeWords writes vals to b as comma-separated decimal numbers, 16 per line,
+// with each line prefixed by indent.
+func writeWords(b *strings.Builder, vals []uint16, indent string) {
+	for i, v := range vals {
+		if i%16 == 0 {
+			b.WriteString(indent)
+		}
+		fmt.Fprintf(b, "%d,", v)
+		if i%16 == 15 || i == len(vals)-1 {
+			b.WriteString("\n")
+		} else {
+			b.WriteString(" ")
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userAutosave is the save that WebSocket sessions resume from and update.
+const userAutosave = "autosave"
+
+// userSaveExt is the extension of files containing user saves.
+const userSaveExt = ".sav"
+
+// userNameRegexp matches valid user and save names.
+var userNameRegexp = regexp.MustCompile(`^[-_a-zA-Z0-9][-_.a-zA-Z0-9]{0,63}$`)
+
+var (
+	errNoUser      = errors.New("missing or unknown token")
+	errNoSave      = errors.New("no such save")
+	errBadSaveName = errors.New("bad save name")
+	errUserQuota   = errors.New("save quota exceeded")
+)
+
+// userStore stores snapshots on disk for -http users so they can disconnect
+// and resume later. Users are identified by tokens passed in
+// "Authorization: Bearer" headers or "token" query parameters.
+type userStore struct {
+	dir   string            // contains a subdirectory per user
+	quota int64             // maximum bytes of saves per user
+	users map[string]string // tokens to user names; if nil, any token is accepted
+
+	mu sync.Mutex // serializes changes to files
+}
+
+// newUserStore returns a userStore that saves files in dir.
+// If tokensPath is non-empty, it names a file containing "user token" lines
+// listing the only accepted tokens.
+func newUserStore(dir string, quota int64, tokensPath string) (*userStore, error) {
+	us := &userStore{dir: dir, quota: quota}
+	if tokensPath != "" {
+		b, err := ioutil.ReadFile(tokensPath)
+		if err != nil {
+			return nil, err
+		}
+		us.users = make(map[string]string)
+		for i, ln := range strings.Split(string(b), "\n") {
+			ln = strings.TrimSpace(ln)
+			if ln == "" || ln[0] == '#' {
+				continue
+			}
+			f := strings.Fields(ln)
+			if len(f) != 2 || !userNameRegexp.MatchString(f[0]) {
+				return nil, fmt.Errorf("%v:%d: want \"user token\"", tokensPath, i+1)
+			}
+			us.users[f[1]] = f[0]
+		}
+	}
+	return us, os.MkdirAll(dir, 0755)
+}
+
+// user returns the name of the user making r.
+// errNoUser is returned if r doesn't contain a valid token.
+func (us *userStore) user(r *http.Request) (string, error) {
+	return tokenUser(r, us.users)
+}
+
+// tokenUser returns the name of the user identified by r's token in users.
+// If users is nil, any token is accepted and identifies its own user.
+// errNoUser is returned if r doesn't contain a valid token.
+func tokenUser(r *http.Request, users map[string]string) (string, error) {
+	tok := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok = strings.TrimSpace(h[len("Bearer "):])
+	}
+	if tok == "" {
+		return "", errNoUser
+	}
+	if users == nil {
+		// Name the user after a hash so tokens aren't written to disk.
+		sum := sha256.Sum256([]byte(tok))
+		return "t" + hex.EncodeToString(sum[:16]), nil
+	}
+	u, ok := users[tok]
+	if !ok {
+		return "", errNoUser
+	}
+	return u, nil
+}
+
+// path returns the path of user's save with the supplied name.
+func (us *userStore) path(user, name string) (string, error) {
+	if !userNameRegexp.MatchString(name) {
+		return "", errBadSaveName
+	}
+	return filepath.Join(us.dir, user, name+userSaveExt), nil
+}
+
+// userSaveInfo describes a save in the list returned by the API.
+type userSaveInfo struct {
+	Name     string    `json:"name"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+}
+
+// list returns user's saves sorted by name.
+func (us *userStore) list(user string) ([]userSaveInfo, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(us.dir, user))
+	if os.IsNotExist(err) {
+		return []userSaveInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	infos := make([]userSaveInfo, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), userSaveExt) {
+			name := strings.TrimSuffix(fi.Name(), userSaveExt)
+			infos = append(infos, userSaveInfo{name, fi.Size(), fi.ModTime()})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// save writes snap to user's save with the supplied name, replacing any
+// existing save. errUserQuota is returned if us.quota would be exceeded.
+func (us *userStore) save(user, name string, snap *snapshot) error {
+	p, err := us.path(user, name)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := writeSnapshot(&b, snap, gobSnapshot); err != nil {
+		return err
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	infos, err := us.list(user)
+	if err != nil {
+		return err
+	}
+	used := int64(b.Len())
+	for _, info := range infos {
+		if info.Name != name {
+			used += info.Bytes
+		}
+	}
+	if used > us.quota {
+		return errUserQuota
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Rename a temporary file so the old save isn't lost if writing fails.
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// read returns the encoded contents of user's save with the supplied name.
+func (us *userStore) read(user, name string) ([]byte, error) {
+	p, err := us.path(user, name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, errNoSave
+	}
+	return b, err
+}
+
+// load reads user's save with the supplied name.
+func (us *userStore) load(user, name string) (*snapshot, error) {
+	b, err := us.read(user, name)
+	if err != nil {
+		return nil, err
+	}
+	return readSnapshot(bytes.NewReader(b))
+}
+
+// remove deletes user's save with the supplied name.
+func (us *userStore) remove(user, name string) error {
+	p, err := us.path(user, name)
+	if err != nil {
+		return err
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return errNoSave
+	}
+	return err
+}
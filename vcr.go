@@ -0,0 +1,234 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VCR recordings capture a whole session so that it can be replayed later.
+// They are text files that start with vcrHeader. Each following line
+// consists of a keyword and arguments:
+//
+//	start <hash>              VM state hash before execution
+//	out <quoted-string>       output written by the program
+//	in <steps> <quoted-string> input line and instruction count when it was sent
+//	end <steps> <hash>        instruction count and state hash after execution
+//
+// Lines starting with '#' are ignored.
+
+const vcrHeader = "synacor-vcr 1"
+
+// vcrEvent is an input line in a VCR recording.
+type vcrEvent struct {
+	out   string // output preceding the input
+	in    string
+	steps uint64 // instruction count when the input was sent
+}
+
+// vcrRecording is a parsed VCR recording.
+type vcrRecording struct {
+	start  string // initial state hash
+	events []vcrEvent
+	out    string // output following the last input
+	steps  uint64 // final instruction count
+	end    string // final state hash, or empty if the recording is incomplete
+}
+
+// readVCR reads a VCR recording from r.
+func readVCR(r io.Reader) (*vcrRecording, error) {
+	var rec vcrRecording
+	var out strings.Builder // output since last input
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for ln := 1; sc.Scan(); ln++ {
+		s := sc.Text()
+		if ln == 1 {
+			if s != vcrHeader {
+				return nil, fmt.Errorf("bad header %q", s)
+			}
+			continue
+		}
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(s, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: bad line %q", ln, s)
+		}
+		var err error
+		switch parts[0] {
+		case "start":
+			rec.start = parts[1]
+		case "out":
+			var o string
+			if o, err = strconv.Unquote(parts[1]); err == nil {
+				out.WriteString(o)
+			}
+		case "in":
+			ev := vcrEvent{out: out.String()}
+			args := strings.SplitN(parts[1], " ", 2)
+			if len(args) != 2 {
+				err = fmt.Errorf("bad input %q", parts[1])
+			} else if ev.steps, err = strconv.ParseUint(args[0], 10, 64); err == nil {
+				if ev.in, err = strconv.Unquote(args[1]); err == nil {
+					rec.events = append(rec.events, ev)
+					out.Reset()
+				}
+			}
+		case "end":
+			var steps string
+			if _, err = fmt.Sscan(parts[1], &steps, &rec.end); err == nil {
+				rec.steps, err = strconv.ParseUint(steps, 10, 64)
+			}
+		default:
+			err = fmt.Errorf("bad line %q", s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", ln, err)
+		}
+	}
+	rec.out = out.String()
+	return &rec, sc.Err()
+}
+
+// readVCRFile is a wrapper around readVCR that reads the named file.
+func readVCRFile(p string) (*vcrRecording, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readVCR(f)
+}
+
+// reader returns a reader that supplies the recording's input.
+func (rec *vcrRecording) reader() io.Reader {
+	var b strings.Builder
+	for _, ev := range rec.events {
+		b.WriteString(ev.in)
+	}
+	return strings.NewReader(b.String())
+}
+
+// vcr records a session or plays back a recording within a session.
+type vcr struct {
+	mu  sync.Mutex
+	out strings.Builder // output since last input, guarded by mu
+
+	w   *os.File  // recording destination, or nil if playing
+	msg io.Writer // receives divergence warnings during playback
+
+	rec      *vcrRecording // recording being played, or nil if recording
+	n        int           // number of inputs handled
+	seek     int           // number of inputs to handle without showing output
+	diverged bool          // playback has diverged from rec
+}
+
+// newVCRRecorder creates a recording at p for a session starting from vm's
+// current state.
+func newVCRRecorder(p string, vm *vm) (*vcr, error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%s\nstart %s\n", vcrHeader, stateHash(vm)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &vcr{w: f}, nil
+}
+
+// newVCRPlayer returns a vcr that plays rec, hiding output until seek inputs
+// have been sent. Warnings are written to msg.
+func newVCRPlayer(rec *vcrRecording, seek int, msg io.Writer) *vcr {
+	return &vcr{rec: rec, seek: seek, msg: msg}
+}
+
+// output handles a byte of output from the program and returns true if it
+// should be shown.
+func (v *vcr) output(b byte) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.out.WriteByte(b)
+	return v.n >= v.seek
+}
+
+// input handles a line of input sent by the session when the VM has executed
+// steps instructions. All preceding output must have been passed to output.
+// True is returned if the line should be echoed.
+func (v *vcr) input(ln string, steps uint64) (echo bool, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := v.out.String()
+	v.out.Reset()
+	defer func() { v.n++ }()
+
+	if v.w != nil {
+		return false, v.writeOutput(out, fmt.Sprintf("in %d %q\n", steps, ln))
+	}
+	if v.n >= len(v.rec.events) {
+		return false, nil // past end of recording; input is from the user
+	}
+	ev := v.rec.events[v.n]
+	if !v.diverged && (out != ev.out || steps != ev.steps) {
+		v.diverged = true
+		fmt.Fprintf(v.msg, "Playback diverged before input %d (%q)\n", v.n+1, strings.TrimSpace(ev.in))
+	}
+	return v.n >= v.seek, nil
+}
+
+// note records a comment when recording, after any preceding output.
+func (v *vcr) note(s string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.w == nil {
+		return nil
+	}
+	out := v.out.String()
+	v.out.Reset()
+	return v.writeOutput(out, fmt.Sprintf("# %s\n", s))
+}
+
+// writeOutput writes out (if non-empty) and then s to the recording.
+func (v *vcr) writeOutput(out, s string) error {
+	if out != "" {
+		if _, err := fmt.Fprintf(v.w, "out %q\n", out); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(v.w, s)
+	return err
+}
+
+// finish is called after the session ends. When recording, the remaining
+// output and vm's final state are written and the file is closed. When
+// playing, divergence from the recording is reported.
+func (v *vcr) finish(vm *vm) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := v.out.String()
+	if v.w != nil {
+		if err := v.writeOutput(out, fmt.Sprintf("end %d %s\n", vm.steps, stateHash(vm))); err != nil {
+			v.w.Close()
+			return err
+		}
+		return v.w.Close()
+	}
+	if v.n == len(v.rec.events) && !v.diverged && v.rec.end != "" &&
+		(out != v.rec.out || vm.steps != v.rec.steps || stateHash(vm) != v.rec.end) {
+		v.diverged = true
+		fmt.Fprintln(v.msg, "Playback diverged after last input")
+	}
+	if v.diverged {
+		return fmt.Errorf("playback diverged")
+	}
+	return nil
+}
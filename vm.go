@@ -8,6 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -18,39 +23,157 @@ const (
 	vreg  = vmax + 1      // value referring to register 0
 )
 
+const (
+	outBatchSize  = 1024    // maximum bytes of output buffered by the VM
+	outFlushSteps = 1 << 17 // maximum instructions executed before flushing output
+	initStackCap  = 1 << 12 // initial capacity of the stack in words
+)
+
+// haltReason describes why the VM stopped running.
+type haltReason int
+
+const (
+	haltNone  haltReason = iota // not stopped yet
+	haltOp                      // executed "halt" instruction
+	haltQuit                    // halt method was called
+	haltInput                   // "in" executed after input was closed
+	haltBreak                   // stopped before "in" due to breakIn
+	haltError                   // run-time error
+)
+
+func (r haltReason) String() string {
+	switch r {
+	case haltNone:
+		return "none"
+	case haltOp:
+		return "halt"
+	case haltQuit:
+		return "quit"
+	case haltInput:
+		return "end of input"
+	case haltBreak:
+		return "break"
+	case haltError:
+		return "error"
+	}
+	return fmt.Sprintf("haltReason(%d)", int(r))
+}
+
 type vm struct {
 	mem     [msize]uint16
+	size    int    // number of words loaded from the program
+	image   string // imageID of the originally-loaded program, if known
 	reg     [nregs]uint16
+	ip      uint16 // address of next instruction
 	stack   []uint16
-	in, out chan byte
+	in      *inputQueue  // input waiting to be read by "in" instructions
+	output  func([]byte) // if non-nil, receives output on the VM's goroutine; must not retain slice
+	obuf    []byte       // output not yet passed to output
 	done    chan error
-	quit    chan struct{} // halt on next instruction
+	stopped chan struct{} // closed when run returns
+	ctl     chan func()   // functions to run while waiting for input; see do
+	quit    chan struct{} // closed by halt; for goroutines blocked waiting for something else
+	qonce   sync.Once     // used to close quit
+	quitReq int32         // set atomically by halt; checked by run before each instruction
+	breakIn bool          // stop before executing "in" instructions
+	reason  haltReason    // why run most recently returned
+	steps   uint64        // number of instructions executed
+	nout    uint64        // number of bytes of output written
+
+	opCounts []uint64               // if non-nil, incremented for each executed opcode
+	hist     []uint16               // if non-nil, ring buffer of recently-executed addresses
+	dbg      *debugger              // if non-nil, consulted before each instruction
+	trace    io.Writer              // if non-nil, receives each executed instruction
+	ctrace   *chromeTrace           // if non-nil, receives calls, returns, and input waits
+	hooks    map[uint16][]func(*vm) // called before executing instructions; may change state
+	natives  map[uint16]opFunc      // if non-nil, Go implementations of routines; see teleporter.go
+	onBlock  func()                 // if non-nil, called before blocking on input
+	blocked  bool                   // onBlock was called and no input has been read since
+
+	slowAt uint64         // steps at which slowPath should next be called
+	code   []predecoded   // cached instructions indexed by address; see predecode.go
+	gen    uint32         // current generation of code entries
+	fuse   bool           // fuse instruction pairs when decoding; see fuse.go
+	jit    bool           // compile hot blocks; see blocks.go
+	blocks []*hotBlock    // compiled blocks indexed by starting address
+	heat   []uint16       // number of entries to each address
+	cover  []uint16       // number of blocks containing each address
+	dirty  []bool         // if non-nil, pages of mem written since it matched pages
+	pages  *pagedSnapshot // snapshot last saved or restored; see pages.go
+
+	maxIPS   int       // if positive, maximum instructions executed per second
+	ipsStart time.Time // start of current throttling period; see throttle
+	ipsSteps uint64    // steps at ipsStart
+	ipsNext  uint64    // steps at which throttle should next be called
 }
 
 func newVM(r io.Reader) (*vm, error) {
-	vm := &vm{
-		in:   make(chan byte, 2048),
-		out:  make(chan byte, 2048),
-		quit: make(chan struct{}),
-	}
-	var nr int
-	for {
-		if err := binary.Read(r, binary.LittleEndian, &vm.mem[nr]); err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		nr++
+	vm := &vm{}
+	vm.initChans()
+	vm.setStack(nil)
+	var err error
+	if vm.size, err = loadImage(r, vm.mem[:]); err != nil {
+		return nil, err
 	}
 	return vm, nil
 }
 
+// initChans creates vm's channels.
+func (vm *vm) initChans() {
+	vm.in = newInputQueue()
+	vm.quit = make(chan struct{})
+	vm.stopped = make(chan struct{})
+	vm.ctl = make(chan func())
+}
+
+// respawnVM returns a new, unstarted VM with the same instrumentation and
+// debugger as old but with empty state. old's debugger is transferred to the
+// new VM, so old must be stopped.
+func respawnVM(old *vm) *vm {
+	nv := &vm{opCounts: old.opCounts, dbg: old.dbg, trace: old.trace, ctrace: old.ctrace,
+		hooks: old.hooks, onBlock: old.onBlock, output: old.output, jit: old.jit,
+		maxIPS: old.maxIPS, natives: old.natives, image: old.image}
+	nv.initChans()
+	nv.setStack(nil)
+	if old.hist != nil {
+		nv.hist = make([]uint16, len(old.hist))
+	}
+	if nv.dbg != nil {
+		nv.dbg.vm = nv
+	}
+	return nv
+}
+
+// loadImage reads little-endian words from r into mem.
+// The number of words read is returned.
+func loadImage(r io.Reader, mem []uint16) (int, error) {
+	// Read one extra byte to detect programs that are too large.
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(2*len(mem)+1)))
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > 2*len(mem) {
+		return 0, errors.New("program too large")
+	}
+	if len(b)%2 != 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := len(b) / 2
+	for i := 0; i < n; i++ {
+		mem[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return n, nil
+}
+
 func (vm *vm) start() {
 	assertf(vm.done == nil, "already running")
-	vm.done = make(chan error, 1)
+	done, stopped := make(chan error, 1), vm.stopped
+	vm.done = done
 	go func() {
-		vm.done <- vm.run()
-		close(vm.done)
+		err := vm.run()
+		close(stopped)
+		done <- err // vm may be reset by resetFrom after this
+		close(done)
 	}()
 }
 
@@ -60,137 +183,333 @@ func (vm *vm) wait() error {
 }
 
 func (vm *vm) halt() {
-	close(vm.quit)
+	atomic.StoreInt32(&vm.quitReq, 1)
+	vm.qonce.Do(func() { close(vm.quit) })
+}
+
+// do runs f on the VM's goroutine the next time that the program waits for
+// input, at which point vm.ip addresses the "in" instruction and f may inspect
+// or replace the VM's state. False is returned if the VM stops first.
+func (vm *vm) do(f func()) bool {
+	fin := make(chan struct{})
+	select {
+	case vm.ctl <- func() { f(); close(fin) }:
+		<-fin
+		return true
+	case <-vm.stopped:
+		return false
+	}
+}
+
+// doWithin is like do but gives up and returns false if the program doesn't
+// wait for input within timeout.
+func (vm *vm) doWithin(f func(), timeout time.Duration) bool {
+	fin := make(chan struct{})
+	select {
+	case vm.ctl <- func() { f(); close(fin) }:
+		<-fin
+		return true
+	case <-vm.stopped:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// history returns the addresses of recently-executed instructions from vm.hist,
+// oldest first.
+func (vm *vm) history() []uint16 {
+	n := uint64(len(vm.hist))
+	if vm.steps < n {
+		n = vm.steps
+	}
+	addrs := make([]uint16, 0, n)
+	for s := vm.steps - n + 1; s <= vm.steps && n > 0; s++ {
+		addrs = append(addrs, vm.hist[s%uint64(len(vm.hist))])
+	}
+	return addrs
+}
+
+// traceInstr writes the instruction at ip to vm.trace.
+func (vm *vm) traceInstr(ip uint16) {
+	if in, ok := decode(vm.mem[:], ip); ok {
+		fmt.Fprintf(vm.trace, "%5d: %s\n", ip, in)
+	} else {
+		fmt.Fprintf(vm.trace, "%5d: %d\n", ip, vm.mem[ip])
+	}
+}
+
+// throttle sleeps as needed to keep the program from executing more than
+// vm.maxIPS instructions per second, averaged since it last waited for input.
+func (vm *vm) throttle() {
+	vm.ipsNext = vm.steps + uint64(vm.maxIPS/100) + 1 // check every 10 ms or so
+	now := time.Now()
+	if vm.ipsStart.IsZero() {
+		vm.ipsStart, vm.ipsSteps = now, vm.steps
+		return
+	}
+	want := time.Duration(float64(vm.steps-vm.ipsSteps) / float64(vm.maxIPS) * float64(time.Second))
+	if d := want - now.Sub(vm.ipsStart); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-vm.quit:
+			t.Stop()
+		}
+	}
+}
+
+// val returns the value of the predecoded operand a, which is either a
+// literal value or a register reference.
+func (vm *vm) val(a uint16) uint16 {
+	// - numbers 0..32767 mean a literal value
+	// - numbers 32768..32775 instead mean registers 0..7
+	if a >= vreg {
+		return vm.reg[(a-vreg)&(nregs-1)] // masked to skip the bounds check
+	}
+	return a
+}
+
+// setReg sets the register referenced by the predecoded operand a to v.
+func (vm *vm) setReg(a, v uint16) { vm.reg[(a-vreg)&(nregs-1)] = v }
+
+// setStack replaces the stack's contents with a copy of s. The stack's
+// backing array is reused if it's large enough.
+func (vm *vm) setStack(s []uint16) {
+	if vm.stack == nil {
+		vm.stack = make([]uint16, 0, initStackCap)
+	}
+	vm.stack = append(vm.stack[:0], s...)
+}
+
+func (vm *vm) push(v uint16) {
+	if len(vm.stack) == cap(vm.stack) {
+		vm.growStack()
+	}
+	vm.stack = append(vm.stack, v)
+}
+
+// growStack doubles the stack's capacity. append only grows large slices by
+// 25% at a time, which results in many copies during deep recursion.
+func (vm *vm) growStack() {
+	n := 2 * cap(vm.stack)
+	if n < initStackCap {
+		n = initStackCap
+	}
+	vm.stack = append(make([]uint16, 0, n), vm.stack...)
+}
+
+func (vm *vm) pop() uint16 {
+	n := len(vm.stack)
+	if n == 0 {
+		panic("pop with empty stack") // not assertf, so pop can be inlined
+	}
+	v := vm.stack[n-1]
+	vm.stack = vm.stack[:n-1]
+	return v
+}
+
+// slowPath performs periodic work that doesn't need to be checked for on
+// every instruction: throttling and flushing buffered output.
+func (vm *vm) slowPath() {
+	vm.slowAt = math.MaxUint64
+	if vm.maxIPS > 0 {
+		if vm.steps >= vm.ipsNext {
+			vm.flushOutput() // before sleeping
+			vm.throttle()
+		}
+		vm.slowAt = vm.ipsNext
+	}
+	if len(vm.obuf) > 0 {
+		vm.flushOutput()
+	}
+}
+
+// flushOutput passes buffered output to vm.output, or discards it if
+// vm.output is nil.
+func (vm *vm) flushOutput() {
+	if len(vm.obuf) == 0 {
+		return
+	}
+	if vm.output != nil {
+		vm.output(vm.obuf)
+	}
+	vm.obuf = vm.obuf[:0]
+}
+
+// setWord sets the register or memory address identified by dst to v.
+// Registers may only hold values up to vmax, while memory may also hold
+// register references. The VM must not be executing instructions.
+func (vm *vm) setWord(dst, v uint16) error {
+	switch {
+	case dst <= vmax && v < vreg+nregs:
+		vm.mem[dst] = v
+		vm.markDirty(dst)
+	case dst >= vreg && dst < vreg+nregs && v <= vmax:
+		vm.reg[dst-vreg] = v
+	case dst >= vreg+nregs:
+		return fmt.Errorf("bad destination %d", dst)
+	default:
+		return fmt.Errorf("bad value %d", v)
+	}
+	return nil
+}
+
+// quitting returns true if halt has been called.
+// If so, vm.reason is updated if it hasn't already been set.
+func (vm *vm) quitting() bool {
+	// This is cheaper than receiving from vm.quit in a select statement.
+	if atomic.LoadInt32(&vm.quitReq) == 0 {
+		return false
+	}
+	if vm.reason == haltNone {
+		vm.reason = haltQuit
+	}
+	return true
+}
+
+// runUntilInput runs the program until it's about to execute its first "in"
+// instruction (or halts), discarding any output. vm.ip and vm.mem can be
+// inspected afterward, e.g. to analyze self-modified code.
+func (vm *vm) runUntilInput() error {
+	vm.breakIn, vm.output = true, func([]byte) {}
+	vm.start()
+	err := vm.wait()
+	vm.breakIn, vm.output = false, nil
+	return err
 }
 
 func (vm *vm) run() (err error) {
+	vm.reason = haltNone
+	vm.blocked = false
+	if vm.code == nil {
+		vm.code = make([]predecoded, msize)
+	}
+	vm.changed() // memory may have been modified since the last run
+	funcs := &opFuncs
+	if vm.ctrace != nil {
+		funcs = &ctraceOpFuncs
+	} else if vm.jit {
+		funcs = &jitOpFuncs
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
-			err = errors.New(r.(string))
+			err = fmt.Errorf("%v", r)
+			vm.reason = haltError
 		}
-		close(vm.out)
+		vm.flushOutput()
 	}()
 
-	var ip uint16 // instruction start index
-	var sz uint16 // instruction size (including opcode)
+	// Each loop returns when instrumentation is enabled or disabled so that
+	// uninstrumented programs don't pay for checking it on every instruction.
+	for vm.reason == haltNone && !vm.quitting() {
+		if vm.instrumented() {
+			vm.runInstrumented(funcs)
+		} else {
+			vm.runPlain(funcs)
+		}
+	}
+	return nil
+}
+
+// instrumented returns true if instrumentation that needs to observe each
+// instruction is enabled, requiring runInstrumented to be used.
+func (vm *vm) instrumented() bool {
+	return vm.dbg != nil || vm.hooks != nil || vm.hist != nil || vm.trace != nil ||
+		vm.opCounts != nil
+}
 
-	// Returns the value corresponding to the 1-indexed argument.
-	// The argument may be either a literal value or a register.
-	get := func(arg uint16) uint16 {
-		assertf(arg > 0, "invalid arg %v", arg)
-		sz = cond(arg+1 > sz, arg+1, sz)
-		addr := ip + arg
-		av := vm.mem[addr]
+// runPlain executes instructions starting at vm.ip until the program stops,
+// quit is requested, or instrumentation is enabled. Instrumentation can only
+// be enabled by code that calls changed, which causes slowPath to be called.
+func (vm *vm) runPlain(funcs *[numOpFuncs]opFunc) {
+	ip := vm.ip // instruction start index
+	defer func() { vm.ip = ip }()
 
-		// - numbers 0..32767 mean a literal value
-		// - numbers 32768..32775 instead mean registers 0..7
-		// - numbers 32776..65535 are invalid
-		if av <= vmax { // "numbers 0..32767 mean a literal value"
-			return av
+	for {
+		if vm.quitting() {
+			return
+		}
+		if vm.steps+1 >= vm.slowAt {
+			if vm.slowPath(); vm.instrumented() {
+				return
+			}
 		}
-		assertf(av < vreg+nregs, "bad value %v at %v", av, addr)
-		return vm.reg[av-vreg]
-	}
 
-	// Sets the 1-indexed argument to the supplied value.
-	// The argument must reference a register.
-	set := func(arg uint16, val uint16) {
-		assertf(arg > 0, "invalid arg %v", arg)
-		sz = cond(arg+1 > sz, arg+1, sz)
-		addr := ip + arg
-		av := vm.mem[addr]
-		assertf(av >= vreg && av < vreg+nregs, "bad register ref %v at %v", av, addr)
-		vm.reg[av-vreg] = val
+		d := &vm.code[ip]
+		if d.gen != vm.gen {
+			d = vm.decoded(ip)
+		}
+		vm.steps++
+		if d.size == 0 {
+			_, msg := predecode(vm.mem[:], ip)
+			panic(msg)
+		}
+		if ip = funcs[d.fn](vm, d, ip); vm.reason != haltNone {
+			return
+		}
 	}
+}
 
-	push := func(v uint16) { vm.stack = append(vm.stack, v) }
-	pop := func() uint16 {
-		assertf(len(vm.stack) > 0, "pop with empty stack")
-		v := vm.stack[len(vm.stack)-1]
-		vm.stack = vm.stack[:len(vm.stack)-1]
-		return v
-	}
+// runInstrumented is like runPlain but also services vm's debugger, hooks,
+// history, trace, and opcode counts. It returns when they're all disabled.
+func (vm *vm) runInstrumented(funcs *[numOpFuncs]opFunc) {
+	ip := vm.ip // instruction start index
+	defer func() { vm.ip = ip }()
 
 	for {
-		// Quit if requested.
-		select {
-		case <-vm.quit:
+		if vm.quitting() {
 			return
-		default:
-		}
-
-		op := vm.mem[ip]
-		sz = 1
-
-		switch op {
-		case 0: // halt: stop execution and terminate the program
-			close(vm.quit)
-		case 1: // set a b: set register <a> to the value of <b>
-			set(1, get(2))
-		case 2: // push a: push <a> onto the stack
-			push(get(1))
-		case 3: // pop a: remove the top element from the stack and write it into <a>; empty stack = error
-			set(1, pop())
-		case 4: // eq a b c: set <a> to 1 if <b> is equal to <c>; set it to 0 otherwise
-			b, c := get(2), get(3)
-			set(1, cond(b == c, 1, 0))
-		case 5: // gt a b c: set <a> to 1 if <b> is greater than <c>; set it to 0 otherwise
-			b, c := get(2), get(3)
-			set(1, cond(b > c, 1, 0))
-		case 6: // jmp a: jump to <a>
-			ip = get(1)
-			sz = 0 // don't advance ip
-		case 7: // jt a b: if <a> is nonzero, jump to <b>
-			if addr := get(2); get(1) != 0 {
-				ip = addr
-				sz = 0 // don't advance ip
+		}
+		if vm.steps+1 >= vm.slowAt {
+			if vm.slowPath(); !vm.instrumented() {
+				return
 			}
-		case 8: // jf a b: if <a> is zero, jump to <b>
-			if addr := get(2); get(1) == 0 {
-				ip = addr
-				sz = 0 // don't advance ip
+		}
+
+		if vm.dbg != nil && vm.dbg.shouldPause(ip) {
+			vm.ip = ip
+			vm.flushOutput()
+			vm.dbg.pause("")
+			vm.changed()
+			if ip = vm.ip; vm.quitting() {
+				return
 			}
-		case 9: // add a b c: assign into <a> the sum of <b> and <c> (modulo 32768)
-			set(1, (get(2)+get(3))%vmod)
-		case 10: // mult a b c: store into <a> the product of <b> and <c> (modulo 32768)
-			set(1, uint16((int(get(2))*int(get(3)))%vmod))
-		case 11: // mod a b c: store into <a> the remainder of <b> divided by <c>
-			set(1, get(2)%get(3))
-		case 12: // and a b c: stores into <a> the bitwise and of <b> and <c>
-			set(1, get(2)&get(3))
-		case 13: // or a b c: stores into <a> the bitwise or of <b> and <c>
-			set(1, get(2)|get(3))
-		case 14: // not a b: stores 15-bit bitwise inverse of <b> in <a>
-			set(1, (^get(2))&vmax)
-		case 15: // rmem a b: read memory at address <b> and write it to <a>
-			set(1, vm.mem[get(2)])
-		case 16: // wmem a b: write the value from <b> into memory at address <a>
-			vm.mem[get(1)] = get(2)
-		case 17: // call a: write the address of the next instruction to the stack and jump to <a>
-			addr := get(1)
-			push(ip + sz)
-			ip = addr
-			sz = 0 // don't advance ip
-		case 18: // ret: remove the top element from the stack and jump to it; empty stack = halt
-			ip = pop()
-			sz = 0 // don't advance ip
-		case 19: // out a: write the character represented by ascii code <a> to the terminal
-			vm.out <- byte(get(1))
-		case 20: // in a: read a character from the terminal and write its ascii code to <a>
-			select {
-			case v := <-vm.in:
-				set(1, uint16(v))
-			case <-vm.quit:
-				return // interrupt read if requested to quit
+		}
+		if vm.hooks != nil {
+			if fs, ok := vm.hooks[ip]; ok {
+				vm.ip = ip
+				for _, f := range fs {
+					f(vm)
+				}
+				ip = vm.ip
+				vm.changed()
 			}
-		case 21: // nop: no operation
-		default:
-			panic(fmt.Sprintf("invalid op %v at %v", op, ip))
 		}
 
-		ip += sz
+		d := &vm.code[ip]
+		if d.gen != vm.gen {
+			d = vm.decoded(ip)
+		}
+		vm.steps++
+		if vm.hist != nil {
+			vm.hist[vm.steps%uint64(len(vm.hist))] = ip
+		}
+		if vm.trace != nil {
+			vm.traceInstr(ip)
+		}
+		if vm.opCounts != nil && int(d.op) < len(vm.opCounts) {
+			vm.opCounts[d.op]++
+		}
+		if d.size == 0 {
+			_, msg := predecode(vm.mem[:], ip)
+			panic(msg)
+		}
+		if ip = funcs[d.fn](vm, d, ip); vm.reason != haltNone {
+			return
+		}
 	}
-	return
 }
 
 // cond returns a if c is true and b otherwise.
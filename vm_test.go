@@ -0,0 +1,329 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestVM is a regression suite for the interpreter.
+func TestVM(t *testing.T) {
+	for _, tc := range vmTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			for _, f := range tc.run() {
+				t.Error(f)
+			}
+		})
+	}
+}
+
+// TestRunLoops checks that run switches between runPlain and runInstrumented
+// as instrumentation is enabled and disabled while the program is running.
+func TestRunLoops(t *testing.T) {
+	words, err := assemble(strings.NewReader("loop: in r0\nout r0\njmp loop"), nil)
+	if err != nil {
+		t.Fatal("Assembling failed: ", err)
+	}
+	vm, err := newVM(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.size = copy(vm.mem[:], words)
+	if vm.instrumented() {
+		t.Fatal("New VM is instrumented")
+	}
+	vm.output = func([]byte) {}
+
+	// Functions passed to do run while the program waits for input, so
+	// each batch of input is consumed before the next function runs.
+	var trace bytes.Buffer
+	vm.start()
+	vm.do(func() {
+		vm.trace = &trace
+		vm.in.write([]byte("ab\n"))
+	})
+	vm.do(func() {
+		vm.trace = nil
+		vm.in.write([]byte("cd\n"))
+		vm.in.close()
+	})
+	if err := vm.wait(); err != nil {
+		t.Fatal("Program failed: ", err)
+	}
+	if got, want := strings.Count(trace.String(), "out r0"), 3; got != want {
+		t.Errorf("Traced %d out instructions; want %d:\n%s", got, want, trace.String())
+	}
+	if got, want := vm.nout, uint64(6); got != want {
+		t.Errorf("Program wrote %d bytes; want %d", got, want)
+	}
+}
+
+// TestDoSteps checks that running functions via do while the program waits
+// for input doesn't change its instruction count.
+func TestDoSteps(t *testing.T) {
+	words, err := assemble(strings.NewReader("in r0\nhalt"), nil)
+	if err != nil {
+		t.Fatal("Assembling failed: ", err)
+	}
+	vm, err := newVM(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.size = copy(vm.mem[:], words)
+	vm.start()
+	vm.do(func() {})
+	vm.do(func() { vm.in.write([]byte("a")) })
+	if err := vm.wait(); err != nil {
+		t.Fatal("Program failed: ", err)
+	}
+	if got, want := vm.steps, uint64(2); got != want {
+		t.Errorf("Program executed %d instruction(s); want %d", got, want)
+	}
+}
+
+// vmTests are run by TestVM.
+var vmTests = []vmTest{
+	{
+		name:   "halt",
+		src:    "halt",
+		reason: haltOp,
+	},
+	{
+		name:   "out",
+		src:    "out 'h'\nout 'i'\nout '\\n'\nhalt",
+		output: "hi\n",
+		reason: haltOp,
+	},
+	{
+		name:   "set",
+		src:    "set r0 5\nset r1 r0\nset r7 32767\nhalt",
+		reg:    map[int]uint16{0: 5, 1: 5, 7: 32767},
+		reason: haltOp,
+	},
+	{
+		name:   "push_pop",
+		src:    "push 1\npush 2\npop r0\npop r1\nhalt",
+		reg:    map[int]uint16{0: 2, 1: 1},
+		reason: haltOp,
+	},
+	{
+		name:   "pop_empty",
+		src:    "pop r0\nhalt",
+		reason: haltError,
+		err:    "empty stack",
+	},
+	{
+		name:   "eq_gt",
+		src:    "eq r0 3 3\neq r1 3 4\ngt r2 4 3\ngt r3 3 3\nhalt",
+		reg:    map[int]uint16{0: 1, 1: 0, 2: 1, 3: 0},
+		reason: haltOp,
+	},
+	{
+		name: "jumps",
+		src: `
+			jmp a
+			halt
+		a:	jt 0 bad
+			jt 1 b
+			halt
+		b:	jf 1 bad
+			jf 0 c
+			halt
+		c:	out 'k'
+			halt
+		bad:	out 'x'
+			halt`,
+		output: "k",
+		reason: haltOp,
+	},
+	{
+		name:   "arith",
+		src:    "add r0 32760 10\nmult r1 32767 2\nmod r2 17 5\nhalt",
+		reg:    map[int]uint16{0: 2, 1: 32766, 2: 2},
+		reason: haltOp,
+	},
+	{
+		name:   "mod_zero",
+		src:    "mod r0 1 0\nhalt",
+		reason: haltError,
+		err:    "divide by zero",
+	},
+	{
+		name:   "bitwise",
+		src:    "and r0 12 10\nor r1 12 10\nnot r2 0\nnot r3 32767\nhalt",
+		reg:    map[int]uint16{0: 8, 1: 14, 2: 32767, 3: 0},
+		reason: haltOp,
+	},
+	{
+		name:   "memory",
+		src:    "wmem val 42\nrmem r0 val\nhalt\nval: data 0",
+		reg:    map[int]uint16{0: 42},
+		reason: haltOp,
+	},
+	{
+		name:   "self_modify",
+		src:    "wmem 4 'y'\nout 'n'\nhalt",
+		output: "y",
+		reason: haltOp,
+	},
+	{
+		name: "self_modify_fused",
+		src: `
+		loop:	add r0 r0 1
+			eq r1 r0 2
+			jt r1 first
+			wmem 10 second
+			jmp loop
+		first:	out 'n'
+			halt
+		second:	out 'y'
+			halt`,
+		output: "y",
+		reason: haltOp,
+	},
+	{
+		name: "call_ret",
+		src: `
+			call fn
+			out '2'
+			halt
+		fn:	out '1'
+			ret`,
+		output: "12",
+		reason: haltOp,
+	},
+	{
+		name: "echo",
+		src: `
+		loop:	in r0
+			out r0
+			jmp loop`,
+		input:  "abc\n",
+		output: "abc\n",
+		reason: haltInput,
+	},
+	{
+		name:   "noop_trap",
+		src:    "noop\ntrap\nset r0 1\nhalt",
+		reg:    map[int]uint16{0: 1},
+		reason: haltOp,
+	},
+	{
+		name: "jit_self_modify",
+		src: `
+		loop:	add r1 r1 2
+			add r0 r0 1
+			gt r2 r0 199
+			jt r2 done
+			eq r2 r0 100
+			jf r2 loop
+			wmem 3 3
+			jmp loop
+		done:	halt`,
+		reg:    map[int]uint16{0: 200, 1: 500},
+		reason: haltOp,
+		jit:    true,
+	},
+	{
+		name: "jit_call_ret",
+		src: `
+		loop:	call fn
+			add r0 r0 1
+			eq r2 r0 1000
+			jf r2 loop
+			halt
+		fn:	push r0
+			mult r0 r0 3
+			add r1 r1 r0
+			pop r0
+			ret`,
+		reg:    map[int]uint16{0: 1000, 1: 3 * 999 * 1000 / 2 % 32768},
+		reason: haltOp,
+		jit:    true,
+	},
+	{
+		name: "jit_mod_zero",
+		src: `
+			set r0 100
+		loop:	add r0 r0 32767
+			mod r1 5 r0
+			jt r0 loop
+			halt`,
+		reason: haltError,
+		err:    "divide by zero",
+		jit:    true,
+	},
+	{
+		name: "jit_pop_empty",
+		src: `
+			set r0 100
+		push:	push r0
+			add r0 r0 32767
+			jt r0 push
+		pop:	pop r1
+			jmp pop`,
+		reg:    map[int]uint16{1: 100},
+		reason: haltError,
+		err:    "empty stack",
+		jit:    true,
+	},
+	{
+		name: "teleporter",
+		src: `
+			set r7 25734
+			set r0 4
+			set r1 1
+			call tp
+			halt
+		` + teleporterSource,
+		reg:        map[int]uint16{0: 6, 1: 5},
+		reason:     haltOp,
+		teleporter: true,
+	},
+	{
+		name: "teleporter_fallback",
+		src: `
+			set r1 3
+			jmp tp
+		` + teleporterSource,
+		reg:        map[int]uint16{0: 4},
+		reason:     haltError,
+		err:        "empty stack",
+		teleporter: true,
+	},
+	{
+		name:   "invalid_op",
+		src:    "data 23",
+		reason: haltError,
+		err:    "invalid op 23",
+	},
+	{
+		name:   "bad_register",
+		src:    "set 5 1\nhalt",
+		reason: haltError,
+		err:    "bad register ref",
+	},
+}
+
+// teleporterSource is the teleporter's confirmation routine from the challenge.
+const teleporterSource = `
+	tp:	jt r0 one
+		add r0 r1 1
+		ret
+	one:	jt r1 two
+		add r0 r0 32767
+		set r1 r7
+		call tp
+		ret
+	two:	push r0
+		add r1 r1 32767
+		call tp
+		set r1 r0
+		pop r0
+		add r0 r0 32767
+		call tp
+		ret`
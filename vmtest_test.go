@@ -0,0 +1,120 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// This file contains an assembler-driven helper for the VM's regression
+// suite in vm_test.go: each vmTest assembles a snippet, runs it with the
+// supplied input, and checks the output, final registers, and halt reason.
+// It lives in package main's tests rather than a separate vmtest package
+// since the VM and assembler are part of package main, which can't be
+// imported.
+
+// vmTestTimeout is the maximum time that a vmTest program may run.
+const vmTestTimeout = 5 * time.Second
+
+// vmResult describes the state of a VM after running a program.
+type vmResult struct {
+	output string
+	reg    [nregs]uint16
+	stack  []uint16
+	ip     uint16
+	reason haltReason
+	err    error // run-time error, if any
+}
+
+// runSource assembles src and runs it with the supplied input, which is
+// followed by end-of-input (halting the program if it's read). The program
+// is halted if it runs for longer than timeout. If setup is non-nil, it's
+// called before the program is started.
+func runSource(src, input string, setup func(*vm) error, timeout time.Duration) (*vmResult, error) {
+	words, err := assemble(strings.NewReader(src), nil)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := newVM(strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	vm.size = copy(vm.mem[:], words)
+	if setup != nil {
+		if err := setup(vm); err != nil {
+			return nil, err
+		}
+	}
+	vm.in.write([]byte(input))
+	vm.in.close()
+
+	var out strings.Builder
+	vm.output = func(p []byte) { out.Write(p) }
+	timer := time.AfterFunc(timeout, vm.halt)
+	vm.start()
+	err = vm.wait()
+	timer.Stop()
+
+	return &vmResult{
+		output: out.String(),
+		reg:    vm.reg,
+		stack:  vm.stack,
+		ip:     vm.ip,
+		reason: vm.reason,
+		err:    err,
+	}, nil
+}
+
+// vmTest describes a program to assemble and run and its expected results.
+type vmTest struct {
+	name       string
+	src        string         // assembly source; see assemble
+	input      string         // sent to "in" instructions
+	output     string         // expected output
+	reg        map[int]uint16 // expected final values of registers
+	reason     haltReason     // expected halt reason
+	err        string         // expected substring of run-time error
+	jit        bool           // compile hot blocks
+	teleporter bool           // compute the teleporter routine natively
+}
+
+// run runs t and returns descriptions of unmet expectations.
+func (t *vmTest) run() []string {
+	res, err := runSource(t.src, t.input, t.setup, vmTestTimeout)
+	if err != nil {
+		return []string{fmt.Sprint("setup failed: ", err)}
+	}
+	var fails []string
+	if res.output != t.output {
+		fails = append(fails, fmt.Sprintf("output %q; want %q", res.output, t.output))
+	}
+	for r, want := range t.reg {
+		if got := res.reg[r]; got != want {
+			fails = append(fails, fmt.Sprintf("r%d is %d; want %d", r, got, want))
+		}
+	}
+	if res.reason != t.reason {
+		fails = append(fails, fmt.Sprintf("halt reason %q; want %q", res.reason, t.reason))
+	}
+	switch {
+	case res.err == nil && t.err != "":
+		fails = append(fails, fmt.Sprintf("no error; want %q", t.err))
+	case res.err != nil && (t.err == "" || !strings.Contains(res.err.Error(), t.err)):
+		fails = append(fails, fmt.Sprintf("error %q; want %q", res.err, t.err))
+	}
+	return fails
+}
+
+// setup configures vm as requested by t.
+func (t *vmTest) setup(vm *vm) error {
+	vm.jit = t.jit
+	if t.teleporter {
+		if _, err := vm.addTeleporter("auto"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
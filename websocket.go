@@ -0,0 +1,231 @@
+// Copyright 2021 Daniel Erat <dan@erat.org>.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains a minimal server-side implementation of the WebSocket
+// protocol (RFC 6455), sufficient for exchanging text messages with browsers.
+// Extensions and subprotocols aren't supported.
+
+// wsGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsMaxMessage is the maximum size of a message read from a client.
+const wsMaxMessage = 1 << 20
+
+// wsConn is a server-side WebSocket connection.
+// Messages may be written concurrently but must be read from one goroutine.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex // guards writes to conn
+}
+
+// upgradeWebSocket performs the opening handshake for r and returns the
+// resulting connection. If an error is returned, a response has already
+// been written to w.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if err := checkOrigin(r); err != nil {
+		http.Error(w, "Cross-origin WebSocket connections not allowed", http.StatusForbidden)
+		return nil, err
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket request")
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported version %q", v)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't upgrade connection", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if _, err := fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:])); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+// checkOrigin returns an error if r was sent by a page served from a
+// different origin than the server, since browsers allow any page to open
+// WebSocket connections. Requests without an Origin header are from
+// non-browser clients and are allowed.
+func checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("bad origin %q", origin)
+	}
+	if !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("cross-origin request from %q", origin)
+	}
+	return nil
+}
+
+// readMessage reads the next text or binary message, answering pings along
+// the way. io.EOF is returned if the client closes the connection.
+func (c *wsConn) readMessage() (op byte, data []byte, err error) {
+	for {
+		fin, fop, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch fop {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return 0, nil, io.EOF
+		case wsText, wsBinary:
+			if op != 0 {
+				return 0, nil, errors.New("new message before end of previous one")
+			}
+			op = fop
+		case wsContinuation:
+			if op == 0 {
+				return 0, nil, errors.New("continuation without message")
+			}
+		default:
+			return 0, nil, fmt.Errorf("bad opcode %#x", fop)
+		}
+		if len(data)+len(payload) > wsMaxMessage {
+			return 0, nil, errors.New("message too large")
+		}
+		data = append(data, payload...)
+		if fin {
+			return op, data, nil
+		}
+	}
+}
+
+// readFrame reads a single frame and unmasks its payload.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0f
+	if hdr[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked frame from client")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxMessage {
+		return false, 0, nil, errors.New("frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame writes an unfragmented frame containing data.
+func (c *wsConn) writeFrame(op byte, data []byte) error {
+	hdr := []byte{0x80 | op, 0}
+	switch n := len(data); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		hdr = append(hdr, b[:]...)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.conn.Write(hdr); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// close sends a close frame and closes the underlying connection.
+func (c *wsConn) close() error {
+	c.writeFrame(wsClose, nil)
+	return c.conn.Close()
+}
+
+// wsFlushDelay is how long WebSocket output waits for more data before it's sent.
+const wsFlushDelay = 20 * time.Millisecond
+
+// newWSWriter returns a writer that sends data to c as text messages.
+// Small writes are coalesced into a single message.
+func newWSWriter(c *wsConn) *batchWriter {
+	return newBatchWriter(wsFlushDelay, func(b []byte) error { return c.writeFrame(wsText, b) })
+}